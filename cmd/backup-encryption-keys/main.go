@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"os"
+
+	"github.com/Shopify/goose/logger"
+
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+)
+
+var log = logger.New("main")
+
+// Dumps encryption_keys to stdout, sealed under BACKUP_ENCRYPTION_KEY (64 hex
+// characters). With -restore, reads a dump from stdin and inserts it instead.
+func main() {
+	restore := flag.Bool("restore", false, "restore a backup read from stdin")
+	flag.Parse()
+
+	backupKeyHex := os.Getenv("BACKUP_ENCRYPTION_KEY")
+	decoded, err := hex.DecodeString(backupKeyHex)
+	if err != nil || len(decoded) != 32 {
+		log(nil, err).Fatal("BACKUP_ENCRYPTION_KEY missing or not 32 hex-encoded bytes")
+	}
+	var backupKey [32]byte
+	copy(backupKey[:], decoded)
+
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		log(nil, nil).Fatal("DATABASE_URL must be set")
+	}
+
+	db, err := persistence.Dial(url)
+	if err != nil {
+		log(nil, err).Fatal("could not create db object")
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if *restore {
+		n, err := db.RestoreEncryptionKeys(ctx, os.Stdin, &backupKey)
+		if err != nil {
+			log(nil, err).Fatal("failed to restore encryption keys")
+		}
+		log(nil, nil).WithField("count", n).Info("restored encryption keys")
+		return
+	}
+
+	n, err := db.BackupEncryptionKeys(ctx, os.Stdout, &backupKey)
+	if err != nil {
+		log(nil, err).Fatal("failed to back up encryption keys")
+	}
+	log(nil, nil).WithField("count", n).Info("backed up encryption keys")
+}
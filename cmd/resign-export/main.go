@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/Shopify/goose/logger"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/retrieval"
+)
+
+var log = logger.New("main")
+
+// Reads an export for -region from stdin and writes it to stdout signed with
+// ECDSA_KEY, for carrying exports over a signing key rotation without
+// rebuilding them. The signature info comes from the region's configured
+// verification key id and version.
+func main() {
+	region := flag.String("region", "302", "region the export was built for")
+	config.InitConfig() // parses the command line flags
+
+	export, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log(nil, err).Fatal("failed to read export")
+	}
+
+	resigned, err := retrieval.ResignExport(export, *region, retrieval.NewSigner())
+	if err != nil {
+		log(nil, err).Fatal("failed to re-sign export")
+	}
+
+	if _, err := os.Stdout.Write(resigned); err != nil {
+		log(nil, err).Fatal("failed to write export")
+	}
+}
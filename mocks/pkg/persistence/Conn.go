@@ -5,6 +5,10 @@ package mocks
 import (
 	context "context"
 
+	io "io"
+
+	sql "database/sql"
+
 	covidshield "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	mock "github.com/stretchr/testify/mock"
 
@@ -18,27 +22,94 @@ type Conn struct {
 	mock.Mock
 }
 
-// CheckClaimKeyBan provides a mock function with given fields: _a0
-func (_m *Conn) CheckClaimKeyBan(_a0 string) (int, time.Duration, error) {
+// ActiveEncryptionKeysByRegion provides a mock function with given fields: _a0
+func (_m *Conn) ActiveEncryptionKeysByRegion(_a0 context.Context) (map[string]int, error) {
 	ret := _m.Called(_a0)
 
-	var r0 int
-	if rf, ok := ret.Get(0).(func(string) int); ok {
+	var r0 map[string]int
+	if rf, ok := ret.Get(0).(func(context.Context) map[string]int); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]int)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ActiveServerPublicKeys provides a mock function with given fields: _a0
+func (_m *Conn) ActiveServerPublicKeys(_a0 context.Context) ([][]byte, error) {
+	ret := _m.Called(_a0)
+
+	var r0 [][]byte
+	if rf, ok := ret.Get(0).(func(context.Context) [][]byte); ok {
 		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([][]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// BackupEncryptionKeys provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) BackupEncryptionKeys(_a0 context.Context, _a1 io.Writer, _a2 *[32]byte) (int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, io.Writer, *[32]byte) int); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, io.Writer, *[32]byte) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CheckClaimKeyBan provides a mock function with given fields: _a0, _a1
+func (_m *Conn) CheckClaimKeyBan(_a0 context.Context, _a1 string) (int, time.Duration, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(int)
 	}
 
 	var r1 time.Duration
-	if rf, ok := ret.Get(1).(func(string) time.Duration); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, string) time.Duration); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Get(1).(time.Duration)
 	}
 
 	var r2 error
-	if rf, ok := ret.Get(2).(func(string) error); ok {
-		r2 = rf(_a0)
+	if rf, ok := ret.Get(2).(func(context.Context, string) error); ok {
+		r2 = rf(_a0, _a1)
 	} else {
 		r2 = ret.Error(2)
 	}
@@ -47,11 +118,11 @@ func (_m *Conn) CheckClaimKeyBan(_a0 string) (int, time.Duration, error) {
 }
 
 // ClaimKey provides a mock function with given fields: _a0, _a1, _a2
-func (_m *Conn) ClaimKey(_a0 string, _a1 []byte, _a2 context.Context) ([]byte, error) {
+func (_m *Conn) ClaimKey(_a0 context.Context, _a1 string, _a2 []byte) ([]byte, error) {
 	ret := _m.Called(_a0, _a1, _a2)
 
 	var r0 []byte
-	if rf, ok := ret.Get(0).(func(string, []byte, context.Context) []byte); ok {
+	if rf, ok := ret.Get(0).(func(context.Context, string, []byte) []byte); ok {
 		r0 = rf(_a0, _a1, _a2)
 	} else {
 		if ret.Get(0) != nil {
@@ -60,7 +131,7 @@ func (_m *Conn) ClaimKey(_a0 string, _a1 []byte, _a2 context.Context) ([]byte, e
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, []byte, context.Context) error); ok {
+	if rf, ok := ret.Get(1).(func(context.Context, string, []byte) error); ok {
 		r1 = rf(_a0, _a1, _a2)
 	} else {
 		r1 = ret.Error(1)
@@ -69,27 +140,27 @@ func (_m *Conn) ClaimKey(_a0 string, _a1 []byte, _a2 context.Context) ([]byte, e
 	return r0, r1
 }
 
-// ClaimKeyFailure provides a mock function with given fields: _a0
-func (_m *Conn) ClaimKeyFailure(_a0 string) (int, time.Duration, error) {
-	ret := _m.Called(_a0)
+// ClaimKeyFailure provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ClaimKeyFailure(_a0 context.Context, _a1 string) (int, time.Duration, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 int
-	if rf, ok := ret.Get(0).(func(string) int); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(int)
 	}
 
 	var r1 time.Duration
-	if rf, ok := ret.Get(1).(func(string) time.Duration); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, string) time.Duration); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Get(1).(time.Duration)
 	}
 
 	var r2 error
-	if rf, ok := ret.Get(2).(func(string) error); ok {
-		r2 = rf(_a0)
+	if rf, ok := ret.Get(2).(func(context.Context, string) error); ok {
+		r2 = rf(_a0, _a1)
 	} else {
 		r2 = ret.Error(2)
 	}
@@ -97,13 +168,13 @@ func (_m *Conn) ClaimKeyFailure(_a0 string) (int, time.Duration, error) {
 	return r0, r1, r2
 }
 
-// ClaimKeySuccess provides a mock function with given fields: _a0
-func (_m *Conn) ClaimKeySuccess(_a0 string) error {
-	ret := _m.Called(_a0)
+// ClaimKeySuccess provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ClaimKeySuccess(_a0 context.Context, _a1 string) error {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -111,6 +182,50 @@ func (_m *Conn) ClaimKeySuccess(_a0 string) error {
 	return r0
 }
 
+// ClaimKeys provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ClaimKeys(_a0 context.Context, _a1 []persistence.ClaimRequest) ([]persistence.ClaimResult, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 []persistence.ClaimResult
+	if rf, ok := ret.Get(0).(func(context.Context, []persistence.ClaimRequest) []persistence.ClaimResult); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.ClaimResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []persistence.ClaimRequest) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ClampRemainingKeysToOriginatorLimit provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ClampRemainingKeysToOriginatorLimit(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Close provides a mock function with given fields:
 func (_m *Conn) Close() error {
 	ret := _m.Called()
@@ -125,20 +240,43 @@ func (_m *Conn) Close() error {
 	return r0
 }
 
-// CountClaimedOneTimeCodes provides a mock function with given fields:
-func (_m *Conn) CountClaimedOneTimeCodes() (int64, error) {
-	ret := _m.Called()
+// ClusteredClaims provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) ClusteredClaims(_a0 context.Context, _a1 time.Duration, _a2 int) ([]persistence.ClusteredClaims, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 []persistence.ClusteredClaims
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration, int) []persistence.ClusteredClaims); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.ClusteredClaims)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration, int) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CountClaimedOneTimeCodes provides a mock function with given fields: _a0
+func (_m *Conn) CountClaimedOneTimeCodes(_a0 context.Context) (int64, error) {
+	ret := _m.Called(_a0)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) int64); ok {
+		r0 = rf(_a0)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -146,20 +284,20 @@ func (_m *Conn) CountClaimedOneTimeCodes() (int64, error) {
 	return r0, r1
 }
 
-// CountDiagnosisKeys provides a mock function with given fields:
-func (_m *Conn) CountDiagnosisKeys() (int64, error) {
-	ret := _m.Called()
+// CountDiagnosisKeys provides a mock function with given fields: _a0
+func (_m *Conn) CountDiagnosisKeys(_a0 context.Context) (int64, error) {
+	ret := _m.Called(_a0)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) int64); ok {
+		r0 = rf(_a0)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -167,13 +305,34 @@ func (_m *Conn) CountDiagnosisKeys() (int64, error) {
 	return r0, r1
 }
 
-// CountOldEncryptionKeysByOriginator provides a mock function with given fields:
-func (_m *Conn) CountOldEncryptionKeysByOriginator() ([]persistence.CountByOriginator, error) {
-	ret := _m.Called()
+// CountDiagnosisKeysForDate provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) CountDiagnosisKeysForDate(_a0 context.Context, _a1 string, _a2 uint32) (int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32) int); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CountOldEncryptionKeysByOriginator provides a mock function with given fields: _a0
+func (_m *Conn) CountOldEncryptionKeysByOriginator(_a0 context.Context) ([]persistence.CountByOriginator, error) {
+	ret := _m.Called(_a0)
 
 	var r0 []persistence.CountByOriginator
-	if rf, ok := ret.Get(0).(func() []persistence.CountByOriginator); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) []persistence.CountByOriginator); ok {
+		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]persistence.CountByOriginator)
@@ -181,8 +340,8 @@ func (_m *Conn) CountOldEncryptionKeysByOriginator() ([]persistence.CountByOrigi
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -190,20 +349,62 @@ func (_m *Conn) CountOldEncryptionKeysByOriginator() ([]persistence.CountByOrigi
 	return r0, r1
 }
 
-// CountUnclaimedOneTimeCodes provides a mock function with given fields:
-func (_m *Conn) CountUnclaimedOneTimeCodes() (int64, error) {
-	ret := _m.Called()
+// CountRecentClaimFailures provides a mock function with given fields: _a0, _a1
+func (_m *Conn) CountRecentClaimFailures(_a0 context.Context, _a1 time.Time) (int, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) int); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CountUnclaimedCodes provides a mock function with given fields: _a0, _a1
+func (_m *Conn) CountUnclaimedCodes(_a0 context.Context, _a1 string) (int, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CountUnclaimedOneTimeCodes provides a mock function with given fields: _a0
+func (_m *Conn) CountUnclaimedOneTimeCodes(_a0 context.Context) (int64, error) {
+	ret := _m.Called(_a0)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) int64); ok {
+		r0 = rf(_a0)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -211,20 +412,20 @@ func (_m *Conn) CountUnclaimedOneTimeCodes() (int64, error) {
 	return r0, r1
 }
 
-// DeleteOldDiagnosisKeys provides a mock function with given fields:
-func (_m *Conn) DeleteOldDiagnosisKeys() (int64, error) {
-	ret := _m.Called()
+// DeleteDiagnosisKeysForRegion provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteDiagnosisKeysForRegion(_a0 context.Context, _a1 string) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context, string) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -232,20 +433,20 @@ func (_m *Conn) DeleteOldDiagnosisKeys() (int64, error) {
 	return r0, r1
 }
 
-// DeleteOldEncryptionKeys provides a mock function with given fields:
-func (_m *Conn) DeleteOldEncryptionKeys() (int64, error) {
-	ret := _m.Called()
+// DeleteOldClaimEvents provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldClaimEvents(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -253,20 +454,20 @@ func (_m *Conn) DeleteOldEncryptionKeys() (int64, error) {
 	return r0, r1
 }
 
-// DeleteOldFailedClaimKeyAttempts provides a mock function with given fields:
-func (_m *Conn) DeleteOldFailedClaimKeyAttempts() (int64, error) {
-	ret := _m.Called()
+// DeleteOldDiagnosisKeys provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldDiagnosisKeys(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -274,22 +475,20 @@ func (_m *Conn) DeleteOldFailedClaimKeyAttempts() (int64, error) {
 	return r0, r1
 }
 
-// FetchKeysForHours provides a mock function with given fields: _a0, _a1, _a2, _a3
-func (_m *Conn) FetchKeysForHours(_a0 string, _a1 uint32, _a2 uint32, _a3 int32) ([]*covidshield.TemporaryExposureKey, error) {
-	ret := _m.Called(_a0, _a1, _a2, _a3)
+// DeleteOldEncryptionKeys provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldEncryptionKeys(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
-	var r0 []*covidshield.TemporaryExposureKey
-	if rf, ok := ret.Get(0).(func(string, uint32, uint32, int32) []*covidshield.TemporaryExposureKey); ok {
-		r0 = rf(_a0, _a1, _a2, _a3)
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
-		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]*covidshield.TemporaryExposureKey)
-		}
+		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, uint32, uint32, int32) error); ok {
-		r1 = rf(_a0, _a1, _a2, _a3)
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -297,20 +496,20 @@ func (_m *Conn) FetchKeysForHours(_a0 string, _a1 uint32, _a2 uint32, _a3 int32)
 	return r0, r1
 }
 
-// NewKeyClaim provides a mock function with given fields: _a0, _a1, _a2
-func (_m *Conn) NewKeyClaim(_a0 string, _a1 string, _a2 string) (string, error) {
-	ret := _m.Called(_a0, _a1, _a2)
+// DeleteOldFailedClaimKeyAttempts provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldFailedClaimKeyAttempts(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(string, string, string) string); ok {
-		r0 = rf(_a0, _a1, _a2)
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
-		r0 = ret.Get(0).(string)
+		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
-		r1 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -318,22 +517,20 @@ func (_m *Conn) NewKeyClaim(_a0 string, _a1 string, _a2 string) (string, error)
 	return r0, r1
 }
 
-// PrivForPub provides a mock function with given fields: _a0
-func (_m *Conn) PrivForPub(_a0 []byte) ([]byte, error) {
-	ret := _m.Called(_a0)
+// DeleteOldHashIDKeyClaims provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldHashIDKeyClaims(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
-	var r0 []byte
-	if rf, ok := ret.Get(0).(func([]byte) []byte); ok {
-		r0 = rf(_a0)
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
-		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]byte)
-		}
+		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func([]byte) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -341,30 +538,707 @@ func (_m *Conn) PrivForPub(_a0 []byte) ([]byte, error) {
 	return r0, r1
 }
 
-// SaveEvent provides a mock function with given fields: event
-func (_m *Conn) SaveEvent(event persistence.Event) error {
-	ret := _m.Called(event)
+// DeleteOldUploadNonces provides a mock function with given fields: _a0, _a1
+func (_m *Conn) DeleteOldUploadNonces(_a0 context.Context, _a1 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(persistence.Event) error); ok {
-		r0 = rf(event)
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(int64)
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// StoreKeys provides a mock function with given fields: _a0, _a1, _a2
-func (_m *Conn) StoreKeys(_a0 *[32]byte, _a1 []*covidshield.TemporaryExposureKey, _a2 context.Context) error {
-	ret := _m.Called(_a0, _a1, _a2)
+// ExpireOneTimeCode provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ExpireOneTimeCode(_a0 context.Context, _a1 string) error {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*[32]byte, []*covidshield.TemporaryExposureKey, context.Context) error); ok {
-		r0 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Error(0)
 	}
 
 	return r0
 }
+
+// ExportBacklog provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ExportBacklog(_a0 context.Context, _a1 string) (int, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchKeyPagesForHours provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4, _a5
+func (_m *Conn) FetchKeyPagesForHours(_a0 context.Context, _a1 string, _a2 uint32, _a3 uint32, _a4 int32, _a5 int) (persistence.KeyPages, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4, _a5)
+
+	var r0 persistence.KeyPages
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, uint32, int32, int) persistence.KeyPages); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(persistence.KeyPages)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, uint32, int32, int) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchKeysForExport provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4, _a5
+func (_m *Conn) FetchKeysForExport(_a0 context.Context, _a1 string, _a2 uint32, _a3 uint32, _a4 int32, _a5 string) ([]*covidshield.TemporaryExposureKey, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4, _a5)
+
+	var r0 []*covidshield.TemporaryExposureKey
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, uint32, int32, string) []*covidshield.TemporaryExposureKey); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*covidshield.TemporaryExposureKey)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, uint32, int32, string) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4, _a5)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchKeysForHours provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *Conn) FetchKeysForHours(_a0 context.Context, _a1 string, _a2 uint32, _a3 uint32, _a4 int32) ([]*covidshield.TemporaryExposureKey, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 []*covidshield.TemporaryExposureKey
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, uint32, int32) []*covidshield.TemporaryExposureKey); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*covidshield.TemporaryExposureKey)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, uint32, int32) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchKeysSince provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *Conn) FetchKeysSince(_a0 context.Context, _a1 string, _a2 uint32, _a3 int32) ([]*covidshield.TemporaryExposureKey, uint32, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 []*covidshield.TemporaryExposureKey
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, int32) []*covidshield.TemporaryExposureKey); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*covidshield.TemporaryExposureKey)
+		}
+	}
+
+	var r1 uint32
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, int32) uint32); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r1 = ret.Get(1).(uint32)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, uint32, int32) error); ok {
+		r2 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// FindDuplicateAppKeys provides a mock function with given fields: _a0
+func (_m *Conn) FindDuplicateAppKeys(_a0 context.Context) ([][]byte, error) {
+	ret := _m.Called(_a0)
+
+	var r0 [][]byte
+	if rf, ok := ret.Get(0).(func(context.Context) [][]byte); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([][]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FindMalformedClaimedRows provides a mock function with given fields: _a0
+func (_m *Conn) FindMalformedClaimedRows(_a0 context.Context) ([]string, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GenerationClaimRatio provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) GenerationClaimRatio(_a0 context.Context, _a1 time.Time, _a2 time.Time) ([]persistence.DayRatio, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 []persistence.DayRatio
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, time.Time) []persistence.DayRatio); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.DayRatio)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, time.Time) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KeySubmissionBounds provides a mock function with given fields: _a0, _a1
+func (_m *Conn) KeySubmissionBounds(_a0 context.Context, _a1 string) (uint32, uint32, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 uint32
+	if rf, ok := ret.Get(0).(func(context.Context, string) uint32); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(uint32)
+	}
+
+	var r1 uint32
+	if rf, ok := ret.Get(1).(func(context.Context, string) uint32); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Get(1).(uint32)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string) error); ok {
+		r2 = rf(_a0, _a1)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// MarkKeysExported provides a mock function with given fields: _a0, _a1
+func (_m *Conn) MarkKeysExported(_a0 context.Context, _a1 string) (int64, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string) int64); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MonthlyOriginatorSummary provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) MonthlyOriginatorSummary(_a0 context.Context, _a1 int, _a2 int) ([]persistence.OriginatorMonthly, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 []persistence.OriginatorMonthly
+	if rf, ok := ret.Get(0).(func(context.Context, int, int) []persistence.OriginatorMonthly); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.OriginatorMonthly)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int, int) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// NewKeyClaim provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *Conn) NewKeyClaim(_a0 context.Context, _a1 string, _a2 string, _a3 string) (string, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) string); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OneTimeCodeRegion provides a mock function with given fields: _a0, _a1
+func (_m *Conn) OneTimeCodeRegion(_a0 context.Context, _a1 string) (string, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string) string); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OneTimeCodeStatus provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) OneTimeCodeStatus(_a0 context.Context, _a1 string, _a2 string) (persistence.ClaimStatus, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 persistence.ClaimStatus
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) persistence.ClaimStatus); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(persistence.ClaimStatus)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OriginatorUploadTotals provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) OriginatorUploadTotals(_a0 context.Context, _a1 time.Time, _a2 time.Time) ([]persistence.OriginatorUploadDay, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 []persistence.OriginatorUploadDay
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, time.Time) []persistence.OriginatorUploadDay); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.OriginatorUploadDay)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, time.Time) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PeakUploadHour provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) PeakUploadHour(_a0 context.Context, _a1 string, _a2 int) (uint32, int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 uint32
+	if rf, ok := ret.Get(0).(func(context.Context, string, int) uint32); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(uint32)
+	}
+
+	var r1 int
+	if rf, ok := ret.Get(1).(func(context.Context, string, int) int); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Get(1).(int)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, int) error); ok {
+		r2 = rf(_a0, _a1, _a2)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// Ping provides a mock function with given fields: _a0
+func (_m *Conn) Ping(_a0 context.Context) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PrivForPub provides a mock function with given fields: _a0, _a1
+func (_m *Conn) PrivForPub(_a0 context.Context, _a1 []byte) ([]byte, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) []byte); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []byte) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PurgeSoftDeletedDiagnosisKeys provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) PurgeSoftDeletedDiagnosisKeys(_a0 context.Context, _a1 time.Duration, _a2 persistence.CleanupOptions) (int64, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration, persistence.CleanupOptions) int64); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration, persistence.CleanupOptions) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RecordClaimEvent provides a mock function with given fields: _a0, _a1
+func (_m *Conn) RecordClaimEvent(_a0 context.Context, _a1 string) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RegionAndOriginatorForPub provides a mock function with given fields: _a0, _a1
+func (_m *Conn) RegionAndOriginatorForPub(_a0 context.Context, _a1 []byte) (string, string, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) string); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, []byte) string); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, []byte) error); ok {
+		r2 = rf(_a0, _a1)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// RestoreEncryptionKeys provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) RestoreEncryptionKeys(_a0 context.Context, _a1 io.Reader, _a2 *[32]byte) (int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, io.Reader, *[32]byte) int); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, io.Reader, *[32]byte) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RotateExpiringServerKeys provides a mock function with given fields: _a0, _a1
+func (_m *Conn) RotateExpiringServerKeys(_a0 context.Context, _a1 int) (int, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, int) int); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveEvent provides a mock function with given fields: event
+func (_m *Conn) SaveEvent(event persistence.Event) error {
+	ret := _m.Called(event)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(persistence.Event) error); ok {
+		r0 = rf(event)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ServerPublicKeyForCode provides a mock function with given fields: _a0, _a1
+func (_m *Conn) ServerPublicKeyForCode(_a0 context.Context, _a1 string) ([]byte, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func(context.Context, string) []byte); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Stats provides a mock function with given fields:
+func (_m *Conn) Stats() sql.DBStats {
+	ret := _m.Called()
+
+	var r0 sql.DBStats
+	if rf, ok := ret.Get(0).(func() sql.DBStats); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(sql.DBStats)
+	}
+
+	return r0
+}
+
+// StoreKeys provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *Conn) StoreKeys(_a0 context.Context, _a1 *[32]byte, _a2 []byte, _a3 []*covidshield.TemporaryExposureKey) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *[32]byte, []byte, []*covidshield.TemporaryExposureKey) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// StreamDiagnosisKeysJSON provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *Conn) StreamDiagnosisKeysJSON(_a0 context.Context, _a1 string, _a2 uint32, _a3 uint32, _a4 io.Writer) (int, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, uint32, io.Writer) int); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, uint32, io.Writer) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SubmissionHistogram provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Conn) SubmissionHistogram(_a0 context.Context, _a1 string, _a2 uint32) ([24]int, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 [24]int
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32) [24]int); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).([24]int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UploadCountsByHour provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *Conn) UploadCountsByHour(_a0 context.Context, _a1 string, _a2 uint32, _a3 uint32) (map[uint32]int, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 map[uint32]int
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32, uint32) map[uint32]int); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[uint32]int)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32, uint32) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// VerifyServerKeypairIntegrity provides a mock function with given fields: _a0
+func (_m *Conn) VerifyServerKeypairIntegrity(_a0 context.Context) ([]persistence.CorruptRow, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []persistence.CorruptRow
+	if rf, ok := ret.Get(0).(func(context.Context) []persistence.CorruptRow); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.CorruptRow)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -31,3 +31,26 @@ func (_m *Signer) Sign(_a0 []byte) ([]byte, error) {
 
 	return r0, r1
 }
+
+// SignDigest provides a mock function with given fields: _a0
+func (_m *Signer) SignDigest(_a0 []byte) ([]byte, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func([]byte) []byte); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]byte) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -44,6 +44,7 @@ func NewBuilder() *AppBuilder {
 		database:          newDatabase(DatabaseURL()),
 	}
 	builder.servlets = append(builder.servlets, server.NewServicesServlet())
+	builder.servlets = append(builder.servlets, server.NewReadinessServlet(builder.database))
 	return builder
 }
 
@@ -51,7 +52,7 @@ func (a *AppBuilder) WithSubmission() *AppBuilder {
 	a.defaultServerPort = config.AppConstants.DefaultSubmissionServerPort
 
 	a.servlets = append(a.servlets, server.NewUploadServlet(a.database))
-	a.servlets = append(a.servlets, server.NewKeyClaimServlet(a.database, lookup))
+	a.servlets = append(a.servlets, server.NewKeyClaimServlet(a.database, lookup, keyclaim.NewDeliveryHook(), keyclaim.NewAttestor()))
 	return a
 }
 
@@ -84,6 +85,13 @@ func DatabaseURL() string {
 }
 
 func newDatabase(dbURL string) persistence.Conn {
+	if replicaURL := os.Getenv("DATABASE_REPLICA_URL"); replicaURL != "" {
+		db, err := persistence.NewReplicaConnection(dbURL, replicaURL)
+		fatalIfErr(err, "could not create db object")
+
+		return db
+	}
+
 	db, err := persistence.Dial(dbURL)
 	fatalIfErr(err, "could not create db object")
 
@@ -101,7 +109,8 @@ func bindAddr(defaultPort uint32) string {
 }
 
 func newExpirationWorker(db persistence.Conn) workers.Worker {
-	worker, err := workers.StartExpirationWorker(db)
+	opts := persistence.CleanupOptions{DryRun: config.AppConstants.CleanupDryRun}
+	worker, err := workers.StartExpirationWorker(db, opts)
 	fatalIfErr(err, "failed to do initial run of expiration worker")
 	return worker
 }
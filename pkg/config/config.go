@@ -2,6 +2,8 @@ package config
 
 import (
 	"flag"
+	"regexp"
+	"time"
 
 	"github.com/Shopify/goose/logger"
 	"github.com/spf13/viper"
@@ -14,22 +16,91 @@ type Constants struct {
 	DefaultRetrievalServerPort         uint32
 	DefaultServerPort                  uint32
 	WorkerExpirationInterval           uint32
+	CleanupDryRun                      bool
 	MaxConsecutiveClaimKeyFailures     int
 	ClaimKeyBanDuration                uint32
+	ClaimFailureWindowMinutes          uint32
 	MaxDiagnosisKeyRetentionDays       uint32
+	RegionRetentionDays                map[string]uint32
+	SoftDeleteDiagnosisKeys            bool
+	SoftDeletedKeyRetentionDays        uint32
+	DiagnosisKeyDeleteChunkSize        int
 	InitialRemainingKeys               uint32
+	OriginatorRemainingKeys            map[string]uint32
+	ClampRemainingKeysToLimit          bool
 	EncryptionKeyValidityDays          uint32
 	OneTimeCodeExpiryInMinutes         uint32
+	OneTimeCodeGraceMinutes            uint32
+	EnforceKeyValidityOnClaim          bool
+	RotateServerKeysWithinDays         int
+	OneTimeCodeLength                  int
+	KeyDateTimezone                    string
 	AssignmentParts                    int
 	HmacKeyLength                      int
 	CORSAccessControlAllowOrigin       string
 	DisableCurrentDateCheckFeatureFlag bool
 	EnableEntirePeriodBundle           bool
+	RetrievalPageSize                  int
+	RetrievalHourLag                   uint32
+	MaxRetrievalRangeHours             uint32
+	RetrievalZipCompressionLevel       int
+	MinTransmissionRiskLevel           int32
+	DiagnosisKeysForceIndex            string
+	EnablePrometheusExemplars          bool
 	RegionCode                         string
+	RegionCodePattern                  string
+	EnabledRegions                     []string
+	RetrieveRateLimitPerMinute         int
+	RetrieveRateLimitExemptIPs         []string
+	MaxActiveCodesPerRegion            map[string]int
+	HashIDRateLimit                    int
+	HashIDRateLimitWindowMinutes       uint32
+	ExportDirectory                    string
+	ExportFileRetentionHours           uint32
+	OTCDeliveryAttempts                int
+	AttestationRequiredRegions         []string
+	ExportKeyOrder                     string
+	VerificationKeyIDs                 map[string]string
+	VerificationKeyVersions            map[string]string
+	SlowQueryThresholdMs               uint32
+	MaxClaimToUploadMinutes            uint32
+	ReadinessPoolInUseRatio            float64
+	ReadinessWaitCountGrowth           int64
+	DBMaxOpenConns                     int
+	DBMaxIdleConns                     int
+	DBConnMaxLifetimeSeconds           uint32
+	MaxKeysPerUpload                   int
+	AdminToken                         string
+	IPHashKey                          string
+
+	// Set by InitConfig from the fields above rather than read from config.yaml
+	RegionCodeRegexp *regexp.Regexp `mapstructure:"-"`
+	KeyDateLocation  *time.Location `mapstructure:"-"`
 }
 
 var AppConstants Constants
 
+// ExportKeyOrderKeyData, ExportKeyOrderRandom and ExportKeyOrderSubmission
+// are the values for AppConstants.ExportKeyOrder.
+const (
+	ExportKeyOrderKeyData    = "keydata"
+	ExportKeyOrderRandom     = "random"
+	ExportKeyOrderSubmission = "submission"
+)
+
+// DiagnosisKeysIndexes are the indexes on diagnosis_keys that
+// AppConstants.DiagnosisKeysForceIndex may name. It's written into SQL, so
+// nothing else is accepted.
+var DiagnosisKeysIndexes = map[string]bool{
+	"key_data":           true,
+	"key_data_2":         true,
+	"region":             true,
+	"region_2":           true,
+	"hour_of_submission": true,
+	"originator":         true,
+	"deleted_at":         true,
+}
+
 func InitConfig() {
 	viper.SetConfigName("config")
 	// Reading config file path from command line flag
@@ -41,10 +112,35 @@ func InitConfig() {
 	if err := viper.ReadInConfig(); err != nil {
 		log(nil, err).Fatal("Error reading application configuration file")
 	}
+	// Secrets come from the environment, never config.yaml
+	if err := viper.BindEnv("adminToken", "ADMIN_TOKEN"); err != nil {
+		log(nil, err).Fatal("Unable to bind ADMIN_TOKEN")
+	}
+	if err := viper.BindEnv("ipHashKey", "IP_HASH_KEY"); err != nil {
+		log(nil, err).Fatal("Unable to bind IP_HASH_KEY")
+	}
 	err := viper.Unmarshal(&AppConstants)
 	if err != nil {
 		log(nil, err).Fatal("Unable to unmarshal the application configuration file")
 	}
+	if AppConstants.OneTimeCodeLength < 8 || AppConstants.OneTimeCodeLength > 32 {
+		log(nil, nil).WithField("length", AppConstants.OneTimeCodeLength).Fatal("oneTimeCodeLength must be between 8 and 32")
+	}
+	AppConstants.RegionCodeRegexp, err = regexp.Compile(AppConstants.RegionCodePattern)
+	if err != nil {
+		log(nil, err).Fatal("Invalid regionCodePattern")
+	}
+	AppConstants.KeyDateLocation, err = time.LoadLocation(AppConstants.KeyDateTimezone)
+	if err != nil {
+		log(nil, err).Fatal("Invalid keyDateTimezone")
+	}
+	if index := AppConstants.DiagnosisKeysForceIndex; index != "" && !DiagnosisKeysIndexes[index] {
+		log(nil, nil).WithField("index", index).Fatal("Invalid diagnosisKeysForceIndex")
+	}
+	// Paged retrieval reads keys in key_data order
+	if AppConstants.RetrievalPageSize > 0 && AppConstants.ExportKeyOrder == ExportKeyOrderSubmission {
+		log(nil, nil).Fatal("retrievalPageSize can't be used with exportKeyOrder submission")
+	}
 }
 
 func setDefaults() {
@@ -52,17 +148,59 @@ func setDefaults() {
 	viper.SetDefault("defaultRetrievalServerPort", 8001)
 	viper.SetDefault("defaultServerPort", 8010)
 	viper.SetDefault("workerExpirationInterval", 30)
+	viper.SetDefault("cleanupDryRun", false)
 	viper.SetDefault("maxConsecutiveClaimKeyFailures", 50)
 	viper.SetDefault("claimKeyBanDuration", 1)
+	viper.SetDefault("claimFailureWindowMinutes", 15)
 	viper.SetDefault("maxDiagnosisKeyRetentionDays", 15)
+	viper.SetDefault("regionRetentionDays", map[string]uint32{})
+	viper.SetDefault("softDeleteDiagnosisKeys", false)
+	viper.SetDefault("softDeletedKeyRetentionDays", 7)
+	viper.SetDefault("diagnosisKeyDeleteChunkSize", 10000)
 	viper.SetDefault("initialRemainingKeys", 28)
+	viper.SetDefault("originatorRemainingKeys", map[string]uint32{})
+	viper.SetDefault("clampRemainingKeysToLimit", false)
 	viper.SetDefault("encryptionKeyValidityDays", 15)
 	viper.SetDefault("oneTimeCodeExpiryInMinutes", 1440)
+	viper.SetDefault("oneTimeCodeGraceMinutes", 0)
+	viper.SetDefault("enforceKeyValidityOnClaim", true)
+	viper.SetDefault("rotateServerKeysWithinDays", 0)
+	viper.SetDefault("oneTimeCodeLength", 10)
+	viper.SetDefault("keyDateTimezone", "UTC")
 	viper.SetDefault("assignmentParts", 2)
 	viper.SetDefault("hmacKeyLength", 32)
 	viper.SetDefault("corsAccessControlAllowOrigin", "*")
 	viper.SetDefault("disableCurrentDateCheckFeatureFlag", true)
 	viper.SetDefault("enableEntirePeriodBundle", false)
+	viper.SetDefault("retrievalPageSize", 0)
+	viper.SetDefault("retrievalHourLag", 0)
+	viper.SetDefault("maxRetrievalRangeHours", 360)
+	viper.SetDefault("retrievalZipCompressionLevel", -1)
+	viper.SetDefault("minTransmissionRiskLevel", 0)
+	viper.SetDefault("diagnosisKeysForceIndex", "")
+	viper.SetDefault("enablePrometheusExemplars", false)
 	/// The MCC Region Code for Canada
 	viper.SetDefault("regionCode", "302")
+	viper.SetDefault("regionCodePattern", "^[0-9]{3}$")
+	viper.SetDefault("enabledRegions", []string{})
+	viper.SetDefault("retrieveRateLimitPerMinute", 0)
+	viper.SetDefault("retrieveRateLimitExemptIPs", []string{})
+	viper.SetDefault("maxActiveCodesPerRegion", map[string]int{})
+	viper.SetDefault("hashIDRateLimit", 0)
+	viper.SetDefault("hashIDRateLimitWindowMinutes", 60)
+	viper.SetDefault("exportDirectory", "")
+	viper.SetDefault("exportFileRetentionHours", 336)
+	viper.SetDefault("otcDeliveryAttempts", 3)
+	viper.SetDefault("attestationRequiredRegions", []string{})
+	viper.SetDefault("exportKeyOrder", "keydata")
+	viper.SetDefault("verificationKeyIDs", map[string]string{})
+	viper.SetDefault("verificationKeyVersions", map[string]string{})
+	viper.SetDefault("slowQueryThresholdMs", 0)
+	viper.SetDefault("maxClaimToUploadMinutes", 0)
+	viper.SetDefault("readinessPoolInUseRatio", 1.0)
+	viper.SetDefault("readinessWaitCountGrowth", 0)
+	viper.SetDefault("dbMaxOpenConns", 100)
+	viper.SetDefault("dbMaxIdleConns", 10)
+	viper.SetDefault("dbConnMaxLifetimeSeconds", 300)
+	viper.SetDefault("maxKeysPerUpload", 28)
 }
@@ -0,0 +1,87 @@
+package keyclaim
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"os"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+)
+
+// ErrInvalidAttestation is returned when a device attestation token is missing
+// or wasn't signed by the configured attestation key.
+var ErrInvalidAttestation = errors.New("invalid device attestation")
+
+// Attestor checks the device attestation token sent alongside a key claim.
+type Attestor interface {
+	// Required reports whether claims for region must carry an attestation.
+	Required(region string) bool
+	Verify(appPublicKey []byte, token string) error
+}
+
+type attestor struct {
+	publicKey *ecdsa.PublicKey
+	regions   map[string]bool
+}
+
+// NewAttestor verifies tokens against DEVICE_ATTESTATION_PUBLIC_KEY, a hex
+// encoded PKIX ECDSA public key belonging to the attestation service (which
+// has already checked Play Integrity / DeviceCheck). Tokens are a base64 ASN.1
+// signature over the SHA-256 of the app public key being claimed.
+func NewAttestor() Attestor {
+	regions := make(map[string]bool)
+	for _, region := range config.AppConstants.AttestationRequiredRegions {
+		regions[region] = true
+	}
+	if len(regions) == 0 {
+		return &attestor{regions: regions}
+	}
+
+	keyHex := os.Getenv("DEVICE_ATTESTATION_PUBLIC_KEY")
+	if keyHex == "" {
+		panic("no DEVICE_ATTESTATION_PUBLIC_KEY")
+	}
+	der, err := hex.DecodeString(keyHex)
+	if err != nil {
+		panic(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		panic(err)
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		panic("DEVICE_ATTESTATION_PUBLIC_KEY is not an ECDSA key")
+	}
+
+	return &attestor{publicKey: ecdsaPub, regions: regions}
+}
+
+func (a *attestor) Required(region string) bool {
+	return a.regions[region]
+}
+
+func (a *attestor) Verify(appPublicKey []byte, token string) error {
+	if a.publicKey == nil || token == "" {
+		return ErrInvalidAttestation
+	}
+	der, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalidAttestation
+	}
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) != 0 {
+		return ErrInvalidAttestation
+	}
+	digest := sha256.Sum256(appPublicKey)
+	if !ecdsa.Verify(a.publicKey, digest[:], sig.R, sig.S) {
+		return ErrInvalidAttestation
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package keyclaim
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func attestationToken(priv *ecdsa.PrivateKey, appPublicKey []byte) string {
+	digest := sha256.Sum256(appPublicKey)
+	r, s, _ := ecdsa.Sign(rand.Reader, priv, digest[:])
+	sig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestNewAttestor(t *testing.T) {
+	oldRegions := config.AppConstants.AttestationRequiredRegions
+	defer func() { config.AppConstants.AttestationRequiredRegions = oldRegions }()
+
+	// Skipped when disabled
+	config.AppConstants.AttestationRequiredRegions = []string{}
+	os.Setenv("DEVICE_ATTESTATION_PUBLIC_KEY", "")
+
+	assert.False(t, NewAttestor().Required("302"), "Attestation should not be required when no regions are configured")
+
+	// Needs a key when enabled
+	config.AppConstants.AttestationRequiredRegions = []string{"302"}
+	assert.PanicsWithValue(t, "no DEVICE_ATTESTATION_PUBLIC_KEY", func() { NewAttestor() }, "DEVICE_ATTESTATION_PUBLIC_KEY needs to be defined")
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	os.Setenv("DEVICE_ATTESTATION_PUBLIC_KEY", hex.EncodeToString(der))
+	defer os.Setenv("DEVICE_ATTESTATION_PUBLIC_KEY", "")
+
+	attestor := NewAttestor()
+	assert.True(t, attestor.Required("302"), "Attestation should be required for a configured region")
+	assert.False(t, attestor.Required("999"), "Attestation should not be required for other regions")
+}
+
+func TestAttestorVerify(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	attestor := &attestor{publicKey: &priv.PublicKey, regions: map[string]bool{"302": true}}
+
+	appPublicKey := make([]byte, 32)
+	rand.Read(appPublicKey)
+
+	// Valid attestation is accepted
+	assert.Nil(t, attestor.Verify(appPublicKey, attestationToken(priv, appPublicKey)))
+
+	// Attestation for another app key is rejected
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	assert.Equal(t, ErrInvalidAttestation, attestor.Verify(appPublicKey, attestationToken(priv, otherKey)))
+
+	// Attestation signed by another key is rejected
+	otherPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, ErrInvalidAttestation, attestor.Verify(appPublicKey, attestationToken(otherPriv, appPublicKey)))
+
+	// Missing or malformed attestation is rejected
+	assert.Equal(t, ErrInvalidAttestation, attestor.Verify(appPublicKey, ""))
+	assert.Equal(t, ErrInvalidAttestation, attestor.Verify(appPublicKey, "not base64!"))
+}
@@ -0,0 +1,68 @@
+package keyclaim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DeliveryHook is called after a one time code has been generated so it can be
+// pushed to an external gateway (SMS, email, ...) as well as being returned to
+// the caller.
+type DeliveryHook interface {
+	Deliver(ctx context.Context, oneTimeCode, hashID string) error
+}
+
+type noopDeliveryHook struct{}
+
+func (noopDeliveryHook) Deliver(_ context.Context, _, _ string) error {
+	return nil
+}
+
+type webhookDeliveryHook struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	OneTimeCode string `json:"oneTimeCode"`
+	HashID      string `json:"hashID,omitempty"`
+}
+
+// NewDeliveryHook returns a hook that POSTs each new one time code to
+// OTC_DELIVERY_WEBHOOK_URL, or one that does nothing if it isn't set.
+func NewDeliveryHook() DeliveryHook {
+	url := os.Getenv("OTC_DELIVERY_WEBHOOK_URL")
+	if url == "" {
+		return noopDeliveryHook{}
+	}
+	return &webhookDeliveryHook{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (h *webhookDeliveryHook) Deliver(ctx context.Context, oneTimeCode, hashID string) error {
+	body, err := json.Marshal(webhookPayload{OneTimeCode: oneTimeCode, HashID: hashID})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("delivery webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
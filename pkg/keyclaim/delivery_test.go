@@ -0,0 +1,50 @@
+package keyclaim
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeliveryHook(t *testing.T) {
+	os.Setenv("OTC_DELIVERY_WEBHOOK_URL", "")
+	assert.Equal(t, noopDeliveryHook{}, NewDeliveryHook(), "Expected a no-op hook if no webhook is configured")
+	assert.Nil(t, NewDeliveryHook().Deliver(context.Background(), "AAABBBCCCC", ""))
+
+	os.Setenv("OTC_DELIVERY_WEBHOOK_URL", "http://localhost/deliver")
+	defer os.Setenv("OTC_DELIVERY_WEBHOOK_URL", "")
+	hook, ok := NewDeliveryHook().(*webhookDeliveryHook)
+	assert.True(t, ok, "Expected a webhook hook if a webhook is configured")
+	assert.Equal(t, "http://localhost/deliver", hook.url)
+}
+
+func TestWebhookDeliveryHook(t *testing.T) {
+	var received webhookPayload
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	hook := &webhookDeliveryHook{url: srv.URL, client: srv.Client()}
+
+	// Posts the code and hashID
+	err := hook.Deliver(context.Background(), "AAABBBCCCC", "abcd")
+
+	assert.Nil(t, err, "Expected nil if the webhook accepted the code")
+	assert.Equal(t, webhookPayload{OneTimeCode: "AAABBBCCCC", HashID: "abcd"}, received)
+
+	// Returns error if the webhook rejects the code
+	status = http.StatusBadGateway
+
+	err = hook.Deliver(context.Background(), "AAABBBCCCC", "")
+
+	assert.EqualError(t, err, "delivery webhook returned 502")
+}
@@ -0,0 +1,285 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ErrBackupCorrupt is returned when a backup can't be decrypted with the given
+// key, is truncated or out of order, mixes entries from several backups, or
+// contains a keypair whose halves don't match.
+var ErrBackupCorrupt = errors.New("encryption key backup is corrupt")
+
+// Number of encryption_keys rows read per query while dumping.
+var backupBatchSize = 1000
+
+// BackupEncryptionKeys writes every encryption_keys row to w, sealed under
+// backupKey, and returns the number of rows written.
+func (c *conn) BackupEncryptionKeys(ctx context.Context, w io.Writer, backupKey *[32]byte) (int, error) {
+	return dumpEncryptionKeys(ctx, c.db, w, backupKey)
+}
+
+// RestoreEncryptionKeys reads a backup written by BackupEncryptionKeys and
+// inserts its rows, skipping any that already exist, and returns the number of
+// rows inserted. Nothing is written unless the whole backup verifies.
+func (c *conn) RestoreEncryptionKeys(ctx context.Context, r io.Reader, backupKey *[32]byte) (int, error) {
+	return restoreEncryptionKeys(ctx, c.db, r, backupKey)
+}
+
+type encryptionKeyRecord struct {
+	Region           string     `json:"region"`
+	Originator       *string    `json:"originator"`
+	HashID           *string    `json:"hash_id"`
+	ServerPrivateKey []byte     `json:"server_private_key"`
+	ServerPublicKey  []byte     `json:"server_public_key"`
+	AppPublicKey     []byte     `json:"app_public_key"`
+	OneTimeCode      *string    `json:"one_time_code"`
+	RemainingKeys    int        `json:"remaining_keys"`
+	Created          time.Time  `json:"created"`
+	ClaimedAt        *time.Time `json:"claimed_at"`
+	ClaimedCodeHash  *string    `json:"claimed_code_hash"`
+}
+
+// Each line of a backup is one sealed entry. Entries are numbered from zero and
+// carry an id picked for the backup, so lines can't be dropped, reordered or
+// spliced in from another backup unnoticed. The last entry carries only the
+// number of records so that a truncated backup can be detected.
+type backupEntry struct {
+	FileID string               `json:"file_id"`
+	Seq    int                  `json:"seq"`
+	Record *encryptionKeyRecord `json:"record,omitempty"`
+	Count  *int                 `json:"count,omitempty"`
+}
+
+// backupWriter seals entries to w, numbering them and tagging them with the
+// backup's id.
+type backupWriter struct {
+	w         io.Writer
+	backupKey *[32]byte
+	fileID    string
+	seq       int
+}
+
+func newBackupWriter(w io.Writer, backupKey *[32]byte) (*backupWriter, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return &backupWriter{w: w, backupKey: backupKey, fileID: hex.EncodeToString(id[:])}, nil
+}
+
+func (b *backupWriter) write(entry backupEntry) error {
+	entry.FileID = b.fileID
+	entry.Seq = b.seq
+	if err := writeBackupEntry(b.w, entry, b.backupKey); err != nil {
+		return err
+	}
+	b.seq++
+	return nil
+}
+
+func dumpEncryptionKeys(ctx context.Context, db *sql.DB, w io.Writer, backupKey *[32]byte) (int, error) {
+	bw, err := newBackupWriter(w, backupKey)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	after := []byte{}
+
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT region, originator, hash_id, server_private_key, server_public_key, app_public_key, one_time_code, remaining_keys, created, claimed_at, claimed_code_hash
+			FROM encryption_keys
+			WHERE server_public_key > ?
+			ORDER BY server_public_key
+			LIMIT ?`,
+			after, backupBatchSize,
+		)
+		if err != nil {
+			return count, err
+		}
+
+		n := 0
+		for rows.Next() {
+			var record encryptionKeyRecord
+			if err := rows.Scan(
+				&record.Region, &record.Originator, &record.HashID,
+				&record.ServerPrivateKey, &record.ServerPublicKey, &record.AppPublicKey,
+				&record.OneTimeCode, &record.RemainingKeys, &record.Created, &record.ClaimedAt, &record.ClaimedCodeHash,
+			); err != nil {
+				rows.Close()
+				return count, err
+			}
+			if err := bw.write(backupEntry{Record: &record}); err != nil {
+				rows.Close()
+				return count, err
+			}
+			after = record.ServerPublicKey
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return count, err
+		}
+
+		count += n
+		if n < backupBatchSize {
+			break
+		}
+	}
+
+	return count, bw.write(backupEntry{Count: &count})
+}
+
+func restoreEncryptionKeys(ctx context.Context, db *sql.DB, r io.Reader, backupKey *[32]byte) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var fileID string
+	seq := 0
+	records := 0
+	restored := 0
+	complete := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry, err := readBackupEntry(scanner.Bytes(), backupKey)
+		if err != nil || complete || entry.Seq != seq || entry.FileID == "" || (seq > 0 && entry.FileID != fileID) {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, ErrBackupCorrupt
+		}
+		fileID = entry.FileID
+		seq++
+
+		if entry.Count != nil {
+			if *entry.Count != records {
+				if err := tx.Rollback(); err != nil {
+					return 0, err
+				}
+				return 0, ErrBackupCorrupt
+			}
+			complete = true
+			continue
+		}
+
+		record := entry.Record
+		if record == nil || !validKeypair(record.ServerPublicKey, record.ServerPrivateKey) {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, ErrBackupCorrupt
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT IGNORE INTO encryption_keys
+			(region, originator, hash_id, server_private_key, server_public_key, app_public_key, one_time_code, remaining_keys, created, claimed_at, claimed_code_hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			record.Region, record.Originator, record.HashID,
+			record.ServerPrivateKey, record.ServerPublicKey, record.AppPublicKey,
+			record.OneTimeCode, record.RemainingKeys, record.Created, record.ClaimedAt, record.ClaimedCodeHash,
+		)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, err
+		}
+
+		// INSERT IGNORE reports a row that already exists as no rows affected
+		n, err := res.RowsAffected()
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, err
+		}
+		records++
+		restored += int(n)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return 0, err
+		}
+		return 0, err
+	}
+
+	if !complete {
+		if err := tx.Rollback(); err != nil {
+			return 0, err
+		}
+		return 0, ErrBackupCorrupt
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
+
+func writeBackupEntry(w io.Writer, entry backupEntry, backupKey *[32]byte) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	sealed := secretbox.Seal(nonce[:], data, &nonce, backupKey)
+
+	line := base64.StdEncoding.EncodeToString(sealed) + "\n"
+	_, err = io.WriteString(w, line)
+	return err
+}
+
+func readBackupEntry(line []byte, backupKey *[32]byte) (*backupEntry, error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 24 {
+		return nil, ErrBackupCorrupt
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, backupKey)
+	if !ok {
+		return nil, ErrBackupCorrupt
+	}
+
+	var entry backupEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// validKeypair reports whether pub is the curve25519 public key for priv.
+func validKeypair(pub, priv []byte) bool {
+	if len(pub) != 32 || len(priv) != 32 {
+		return false
+	}
+	var derived, scalar [32]byte
+	copy(scalar[:], priv)
+	curve25519.ScalarBaseMult(&derived, &scalar)
+	return bytes.Equal(derived[:], pub)
+}
@@ -0,0 +1,251 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	dumpQuery = `
+	SELECT region, originator, hash_id, server_private_key, server_public_key, app_public_key, one_time_code, remaining_keys, created, claimed_at, claimed_code_hash
+		FROM encryption_keys
+		WHERE server_public_key > ?
+		ORDER BY server_public_key
+		LIMIT ?`
+	restoreQuery = `
+	INSERT IGNORE INTO encryption_keys
+		(region, originator, hash_id, server_private_key, server_public_key, app_public_key, one_time_code, remaining_keys, created, claimed_at, claimed_code_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+)
+
+func setupBackupRecords() []encryptionKeyRecord {
+	originator := "randomOrigin"
+	oneTimeCode := "AAABBBCCCC"
+	created := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	var records []encryptionKeyRecord
+	for i := 0; i < 2; i++ {
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		records = append(records, encryptionKeyRecord{
+			Region:           "302",
+			Originator:       &originator,
+			ServerPrivateKey: priv[:],
+			ServerPublicKey:  pub[:],
+			RemainingKeys:    28,
+			Created:          created,
+		})
+	}
+	records[0].OneTimeCode = &oneTimeCode
+	app, _, _ := box.GenerateKey(rand.Reader)
+	records[1].AppPublicKey = app[:]
+	records[1].ClaimedAt = &created
+	claimedCodeHash := hashOneTimeCode("DDDEEEFFFF")
+	records[1].ClaimedCodeHash = &claimedCodeHash
+	return records
+}
+
+func backupRows(records []encryptionKeyRecord) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"region", "originator", "hash_id", "server_private_key", "server_public_key", "app_public_key", "one_time_code", "remaining_keys", "created", "claimed_at", "claimed_code_hash"})
+	for _, r := range records {
+		var oneTimeCode interface{}
+		if r.OneTimeCode != nil {
+			oneTimeCode = *r.OneTimeCode
+		}
+		var appPublicKey interface{}
+		if r.AppPublicKey != nil {
+			appPublicKey = r.AppPublicKey
+		}
+		var claimedAt interface{}
+		if r.ClaimedAt != nil {
+			claimedAt = *r.ClaimedAt
+		}
+		var claimedCodeHash interface{}
+		if r.ClaimedCodeHash != nil {
+			claimedCodeHash = *r.ClaimedCodeHash
+		}
+		rows.AddRow(r.Region, *r.Originator, nil, r.ServerPrivateKey, r.ServerPublicKey, appPublicKey, oneTimeCode, r.RemainingKeys, r.Created, claimedAt, claimedCodeHash)
+	}
+	return rows
+}
+
+func TestBackupAndRestoreEncryptionKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	var backupKey [32]byte
+	rand.Read(backupKey[:])
+
+	records := setupBackupRecords()
+
+	// Dumps in batches until a short batch is read
+	oldBatchSize := backupBatchSize
+	defer func() { backupBatchSize = oldBatchSize }()
+	backupBatchSize = 1
+
+	mock.ExpectQuery(dumpQuery).WithArgs([]byte{}, 1).WillReturnRows(backupRows(records[:1]))
+	mock.ExpectQuery(dumpQuery).WithArgs(records[0].ServerPublicKey, 1).WillReturnRows(backupRows(records[1:]))
+	mock.ExpectQuery(dumpQuery).WithArgs(records[1].ServerPublicKey, 1).WillReturnRows(backupRows(nil))
+
+	var dump bytes.Buffer
+	dumped, err := dumpEncryptionKeys(context.Background(), db, &dump, &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, err, "Expected nil if dump succeeded")
+	assert.Equal(t, 2, dumped, "Expected two rows to be dumped")
+	assert.NotContains(t, dump.String(), "randomOrigin", "Expected dump to be encrypted")
+
+	// Restores every dumped row
+	mock.ExpectBegin()
+	for _, r := range records {
+		mock.ExpectExec(restoreQuery).WithArgs(
+			r.Region, r.Originator, r.HashID,
+			r.ServerPrivateKey, r.ServerPublicKey, r.AppPublicKey,
+			r.OneTimeCode, r.RemainingKeys, r.Created, r.ClaimedAt, r.ClaimedCodeHash,
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	restored, err := restoreEncryptionKeys(context.Background(), db, bytes.NewReader(dump.Bytes()), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, err, "Expected nil if restore succeeded")
+	assert.Equal(t, 2, restored, "Expected two rows to be restored")
+
+	// Rows that already exist aren't counted as restored
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(restoreQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	restored, err = restoreEncryptionKeys(context.Background(), db, bytes.NewReader(dump.Bytes()), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, err, "Expected nil if restore succeeded")
+	assert.Equal(t, 1, restored, "Expected only the inserted row to be counted")
+}
+
+// Write records and a trailer as one backup, returning its lines.
+func writeTestBackup(records []encryptionKeyRecord, backupKey *[32]byte) []string {
+	var dump bytes.Buffer
+	bw, _ := newBackupWriter(&dump, backupKey)
+	for i := range records {
+		bw.write(backupEntry{Record: &records[i]})
+	}
+	count := len(records)
+	bw.write(backupEntry{Count: &count})
+	return strings.SplitAfter(strings.TrimSuffix(dump.String(), "\n"), "\n")
+}
+
+func TestRestoreEncryptionKeysCorrupt(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	var backupKey [32]byte
+	rand.Read(backupKey[:])
+
+	records := setupBackupRecords()
+	lines := writeTestBackup(records, &backupKey)
+	dump := strings.Join(lines, "")
+
+	// Wrong backup key
+	var wrongKey [32]byte
+	rand.Read(wrongKey[:])
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, err := restoreEncryptionKeys(context.Background(), db, strings.NewReader(dump), &wrongKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if the key is wrong")
+
+	// Missing trailer
+	mock.ExpectBegin()
+	for range records {
+		mock.ExpectExec(restoreQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectRollback()
+
+	_, err = restoreEncryptionKeys(context.Background(), db, strings.NewReader(strings.Join(lines[:2], "")), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if the backup is truncated")
+
+	// Dropped record
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	_, err = restoreEncryptionKeys(context.Background(), db, strings.NewReader(lines[0]+lines[2]), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if a record is missing")
+
+	// Reordered records
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, err = restoreEncryptionKeys(context.Background(), db, strings.NewReader(lines[1]+lines[0]+lines[2]), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if records are out of order")
+
+	// Record spliced in from another backup under the same key
+	other := writeTestBackup(setupBackupRecords(), &backupKey)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	_, err = restoreEncryptionKeys(context.Background(), db, strings.NewReader(lines[0]+other[1]+lines[2]), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if a record comes from another backup")
+
+	// Mismatched keypair
+	records[0].ServerPublicKey = records[1].ServerPublicKey
+	lines = writeTestBackup(records, &backupKey)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, err = restoreEncryptionKeys(context.Background(), db, strings.NewReader(strings.Join(lines, "")), &backupKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrBackupCorrupt, err, "Expected ErrBackupCorrupt if a keypair doesn't match")
+}
@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ClaimRequest is one one time code / app public key pair in a batch claim.
+type ClaimRequest struct {
+	OneTimeCode  string
+	AppPublicKey []byte
+}
+
+// ClaimResult is the outcome of a single ClaimRequest. Err is set instead of
+// ServerPublicKey if that pair couldn't be claimed, using the same errors as
+// ClaimKey.
+type ClaimResult struct {
+	ServerPublicKey []byte
+	Err             error
+	// InGrace is set when the code had expired and was only accepted because
+	// of OneTimeCodeGraceMinutes.
+	InGrace bool
+}
+
+// Claim every pair in a single transaction. A bad code or key only fails its
+// own item; the batch is only rolled back (and an error returned) if the
+// database itself fails, in which case it is retried like ClaimKey.
+func claimKeys(ctx context.Context, db txBeginner, pairs []ClaimRequest) ([]ClaimResult, error) {
+	var claims []claimedKey
+	var itemErrs []error
+
+	err := retryOnDeadlock(ctx, func() error {
+		return withTimedTransaction(ctx, db, claimKeyDuration, func(tx *sql.Tx) error {
+			claims = make([]claimedKey, len(pairs))
+			itemErrs = make([]error, len(pairs))
+			for i, pair := range pairs {
+				var err error
+				claims[i], itemErrs[i], err = claimKeyInTx(ctx, tx, pair.OneTimeCode, pair.AppPublicKey)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ClaimResult, len(pairs))
+	for i, claimed := range claims {
+		countClaimKeyOutcome(ctx, itemErrs[i], claimed.region)
+		if itemErrs[i] != nil {
+			results[i] = ClaimResult{Err: itemErrs[i]}
+			continue
+		}
+
+		recordClaim(ctx, db, claimed)
+		results[i] = ClaimResult{ServerPublicKey: claimed.serverPub, InGrace: claimed.inGrace}
+	}
+
+	return results, nil
+}
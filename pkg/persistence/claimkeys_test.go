@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestClaimKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	goodPub, _, _ := box.GenerateKey(rand.Reader)
+	dupPub, _, _ := box.GenerateKey(rand.Reader)
+	badCodePub, _, _ := box.GenerateKey(rand.Reader)
+	expiredPub, _, _ := box.GenerateKey(rand.Reader)
+	badServerPub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+
+	update := fmt.Sprintf(`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
+
+	// Rolls back the whole batch if the database fails
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(goodPub[:]).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+
+	receivedResults, receivedErr := claimKeys(context.Background(), db, []ClaimRequest{{OneTimeCode: "AAABBBCCCC", AppPublicKey: goodPub[:]}})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResults, "Expected no results if the batch was rolled back")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the database fails")
+
+	// Claims good pairs and reports per item errors for the rest
+	mock.ExpectBegin()
+
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(goodPub[:]).WillReturnRows(rows)
+	created := time.Now()
+	setupSelectOneTimeCode(mock, "AAABBBCCCC", created, serverPub[:])
+	mock.ExpectExec(update).WithArgs(goodPub[:], timemath.MostRecentUTCMidnight(created), sqlmock.AnyArg(), hashOneTimeCode("AAABBBCCCC"), "AAABBBCCCC").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(1)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(dupPub[:]).WillReturnRows(rows)
+
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(badCodePub[:]).WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"created", "originator", "region", "server_public_key"})
+	mock.ExpectQuery(`SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?`).WithArgs("DDDEEEFFFF").WillReturnRows(rows)
+
+	// Refused before the update, like ClaimKey, so the rest of the batch carries on
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(expiredPub[:]).WillReturnRows(rows)
+	overAged := time.Now().Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays)*24*time.Hour - time.Minute)
+	setupSelectOneTimeCode(mock, "MMMNNNPPPP", overAged, serverPub[:])
+
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(badServerPub[:]).WillReturnRows(rows)
+	setupSelectOneTimeCode(mock, "SSSTTTVVVV", created, serverPub[:31])
+
+	mock.ExpectCommit()
+
+	receivedResults, receivedErr = claimKeys(context.Background(), db, []ClaimRequest{
+		{OneTimeCode: "AAABBBCCCC", AppPublicKey: goodPub[:]},
+		{OneTimeCode: "HHHJJJKKKK", AppPublicKey: dupPub[:]},
+		{OneTimeCode: "DDDEEEFFFF", AppPublicKey: badCodePub[:]},
+		{OneTimeCode: "LLLQQQRRRR", AppPublicKey: []byte{1, 2, 3}},
+		{OneTimeCode: "MMMNNNPPPP", AppPublicKey: expiredPub[:]},
+		{OneTimeCode: "SSSTTTVVVV", AppPublicKey: badServerPub[:]},
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResults := []ClaimResult{
+		{ServerPublicKey: serverPub[:]},
+		{Err: ErrDuplicateKey},
+		{Err: ErrInvalidOneTimeCode},
+		{Err: ErrInvalidKeyFormat},
+		{Err: ErrExpiredKey},
+		{Err: ErrInvalidKeyFormat},
+	}
+	assert.Equal(t, expectedResults, receivedResults, "Expected a result for each pair")
+	assert.Nil(t, receivedErr, "Expected nil if the batch was committed")
+}
+
+func TestClaimKeysGraceWindow(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	defer func(grace uint32) { config.AppConstants.OneTimeCodeGraceMinutes = grace }(config.AppConstants.OneTimeCodeGraceMinutes)
+	config.AppConstants.OneTimeCodeGraceMinutes = 10
+
+	freshPub, _, _ := box.GenerateKey(rand.Reader)
+	expiredPub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+
+	update := fmt.Sprintf(`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes+10,
+	)
+
+	fresh := now.Add(-time.Hour)
+	justExpired := now.Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes+5) * time.Minute)
+
+	mock.ExpectBegin()
+	for _, claim := range []struct {
+		code    string
+		pub     []byte
+		created time.Time
+	}{{"AAABBBCCCC", freshPub[:], fresh}, {"DDDEEEFFFF", expiredPub[:], justExpired}} {
+		rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+		mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(claim.pub).WillReturnRows(rows)
+		setupSelectOneTimeCode(mock, claim.code, claim.created, serverPub[:])
+		mock.ExpectExec(update).WithArgs(claim.pub, timemath.MostRecentUTCMidnight(claim.created), now, hashOneTimeCode(claim.code), claim.code).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	receivedResults, receivedErr := claimKeys(context.Background(), db, []ClaimRequest{
+		{OneTimeCode: "AAABBBCCCC", AppPublicKey: freshPub[:]},
+		{OneTimeCode: "DDDEEEFFFF", AppPublicKey: expiredPub[:]},
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if the batch ran")
+	assert.False(t, receivedResults[0].InGrace, "Expected an unexpired code not to be flagged")
+	assert.True(t, receivedResults[1].InGrace, "Expected a recently expired code to be flagged")
+}
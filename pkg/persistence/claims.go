@@ -0,0 +1,83 @@
+package persistence
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+)
+
+// ClusteredClaims is the number of successful claims made from a single
+// (hashed) IP within a clustering window.
+type ClusteredClaims struct {
+	IPHash string
+	Count  int
+}
+
+// RecordClaimEvent stores a successful claim against a hash of the client IP.
+// The raw IP is never written.
+func (c *conn) RecordClaimEvent(ctx context.Context, ip string) error {
+	return recordClaimEvent(ctx, c.db, ip)
+}
+
+// ClusteredClaims returns every hashed IP that made more than threshold
+// successful claims within the trailing window.
+func (c *conn) ClusteredClaims(ctx context.Context, window time.Duration, threshold int) ([]ClusteredClaims, error) {
+	return clusteredClaims(ctx, c.db, window, threshold)
+}
+
+func (c *conn) DeleteOldClaimEvents(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldClaimEvents(ctx, c.db, opts)
+}
+
+// The IPv4 space is small enough to hash every address, so a plain hash would
+// give the IPs back. Keying it with IPHashKey means only we can link them.
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConstants.IPHashKey))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func recordClaimEvent(ctx context.Context, db *sql.DB, ip string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO claim_events (ip_hash) VALUES (?)`, hashIP(ip))
+	return err
+}
+
+func clusteredClaims(ctx context.Context, db *sql.DB, window time.Duration, threshold int) ([]ClusteredClaims, error) {
+	since := clock.Now().Add(-window)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT ip_hash, COUNT(*) FROM claim_events
+		WHERE claimed >= ?
+		GROUP BY ip_hash
+		HAVING COUNT(*) > ?`,
+		since, threshold,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clusters []ClusteredClaims
+	for rows.Next() {
+		var cluster ClusteredClaims
+		if err := rows.Scan(&cluster.IPHash, &cluster.Count); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, rows.Err()
+}
+
+// Claim events are only useful for as long as we'd ban an IP for, so they
+// share the failed claim-key attempts retention.
+func deleteOldClaimEvents(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	threshold := clock.Now().Add(-(time.Duration(config.AppConstants.ClaimKeyBanDuration) * time.Hour))
+
+	return purge(ctx, db, "claim_events", "claimed < ?", opts, threshold)
+}
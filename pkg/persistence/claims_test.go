@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordClaimEvent(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	ip := "1.1.1.1"
+
+	mock.ExpectExec(`INSERT INTO claim_events (ip_hash) VALUES (?)`).WithArgs(hashIP(ip)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	receivedErr := recordClaimEvent(context.Background(), db, ip)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if insert ran")
+	assert.NotContains(t, hashIP(ip), ip, "Expected raw IP not to be stored")
+}
+
+func TestHashIP(t *testing.T) {
+	oldKey := config.AppConstants.IPHashKey
+	defer func() { config.AppConstants.IPHashKey = oldKey }()
+
+	ip := "1.1.1.1"
+
+	// The same IP and key always give the same hash
+	config.AppConstants.IPHashKey = "first key"
+	first := hashIP(ip)
+	assert.Equal(t, first, hashIP(ip), "Expected the hash to be deterministic")
+	assert.NotEqual(t, first, hashIP("1.1.1.2"), "Expected different IPs to hash differently")
+
+	unkeyed := sha256.Sum256([]byte(ip))
+	assert.NotEqual(t, hex.EncodeToString(unkeyed[:]), first, "Expected the hash to be keyed")
+
+	// Another key gives another hash for the same IP
+	config.AppConstants.IPHashKey = "second key"
+	assert.NotEqual(t, first, hashIP(ip), "Expected the key to change the hash")
+}
+
+func TestClusteredClaims(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+		SELECT ip_hash, COUNT(*) FROM claim_events
+		WHERE claimed >= ?
+		GROUP BY ip_hash
+		HAVING COUNT(*) > ?`
+
+	threshold := 5
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), threshold).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := clusteredClaims(context.Background(), db, 10*time.Minute, threshold)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns only the abusive IP, counting claims back from the clock
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	abusive := hashIP("6.6.6.6")
+	rows := sqlmock.NewRows([]string{"ip_hash", "count"}).AddRow(abusive, 12)
+	mock.ExpectQuery(query).WithArgs(now.Add(-10*time.Minute), threshold).WillReturnRows(rows)
+
+	receivedResult, receivedErr = clusteredClaims(context.Background(), db, 10*time.Minute, threshold)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := []ClusteredClaims{{IPHash: abusive, Count: 12}}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected the abusive IP to be returned")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
@@ -7,16 +7,20 @@ import (
 	"crypto/x509"
 	"database/sql"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 
 	"github.com/Shopify/goose/logger"
 	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -24,6 +28,26 @@ import (
 // past their limit, assigned on keypair creation. The entire batch is rejected.
 var ErrTooManyKeys = errors.New("key limit for keypair exceeded")
 
+// ErrInvalidKeyData is reported for a diagnosis key whose key_data isn't
+// exactly 16 bytes. Such keys are skipped rather than failing the upload.
+var ErrInvalidKeyData = errors.New("key data must be 16 bytes")
+
+// ErrInvalidRollingPeriod is reported for a diagnosis key whose rolling_period
+// is outside 1..144. Such keys are skipped rather than failing the upload.
+var ErrInvalidRollingPeriod = errors.New("rolling period must be between 1 and 144")
+
+// ErrInvalidRollingStartIntervalNumber is reported for a diagnosis key without
+// a positive rolling_start_interval_number. Such keys are skipped too.
+var ErrInvalidRollingStartIntervalNumber = errors.New("rolling start interval number must be positive")
+
+// ErrFutureRollingStartIntervalNumber is reported for a diagnosis key that
+// starts after the current UTC date. Such keys are skipped too.
+var ErrFutureRollingStartIntervalNumber = errors.New("rolling start interval number is in the future")
+
+// ErrInvalidDaysSinceOnsetOfSymptoms is reported for a diagnosis key whose
+// days_since_onset_of_symptoms is outside -14..14. Such keys are skipped too.
+var ErrInvalidDaysSinceOnsetOfSymptoms = errors.New("days since onset of symptoms must be between -14 and 14")
+
 // Conn mediates all access to a MySQL/CloudSQL connection. It exposes a
 // method for each query we support. The one exception is database
 // creation/migrations, which are handled separately.
@@ -33,45 +57,112 @@ type Conn interface {
 	//
 	// Only returns keys that correspond to a Key for a date
 	// less than 14 days ago.
-	FetchKeysForHours(string, uint32, uint32, int32) ([]*pb.TemporaryExposureKey, error)
-	StoreKeys(*[32]byte, []*pb.TemporaryExposureKey, context.Context) error
-	NewKeyClaim(string, string, string) (string, error)
-	ClaimKey(string, []byte, context.Context) ([]byte, error)
-	PrivForPub([]byte) ([]byte, error)
-
-	CheckClaimKeyBan(string) (triesRemaining int, banDuration time.Duration, err error)
-	ClaimKeySuccess(string) error
-	ClaimKeyFailure(string) (triesRemaining int, banDuration time.Duration, err error)
-
-	DeleteOldDiagnosisKeys() (int64, error)
-	DeleteOldEncryptionKeys() (int64, error)
-	DeleteOldFailedClaimKeyAttempts() (int64, error)
-
-	CountClaimedOneTimeCodes() (int64, error)
-	CountDiagnosisKeys() (int64, error)
-	CountUnclaimedOneTimeCodes() (int64, error)
-	CountOldEncryptionKeysByOriginator() ([]CountByOriginator, error)
+	FetchKeysForHours(context.Context, string, uint32, uint32, int32) ([]*pb.TemporaryExposureKey, error)
+	// FetchKeyPagesForHours reads the keys FetchKeysForHours would return a
+	// page of the given size at a time, all from one snapshot of the table.
+	FetchKeyPagesForHours(context.Context, string, uint32, uint32, int32, int) (KeyPages, error)
+	// FetchKeysSince returns the keys submitted in or after an hour, and the
+	// latest hour among them for the caller to resume from.
+	FetchKeysSince(context.Context, string, uint32, int32) ([]*pb.TemporaryExposureKey, uint32, error)
+	StoreKeys(context.Context, *[32]byte, []byte, []*pb.TemporaryExposureKey) error
+	// FetchKeysForExport returns the keys FetchKeysForHours would as a full
+	// or delta export feed. It's for export jobs, not for serving clients.
+	FetchKeysForExport(context.Context, string, uint32, uint32, int32, string) ([]*pb.TemporaryExposureKey, error)
+	MarkKeysExported(context.Context, string) (int64, error)
+	NewKeyClaim(context.Context, string, string, string) (string, error)
+	ClaimKey(context.Context, string, []byte) ([]byte, error)
+	ClaimKeys(context.Context, []ClaimRequest) ([]ClaimResult, error)
+	ExpireOneTimeCode(context.Context, string) error
+	OneTimeCodeStatus(context.Context, string, string) (ClaimStatus, error)
+	ServerPublicKeyForCode(context.Context, string) ([]byte, error)
+	OneTimeCodeRegion(context.Context, string) (string, error)
+	PrivForPub(context.Context, []byte) ([]byte, error)
+	RegionAndOriginatorForPub(context.Context, []byte) (string, string, error)
+
+	CheckClaimKeyBan(context.Context, string) (triesRemaining int, banDuration time.Duration, err error)
+	ClaimKeySuccess(context.Context, string) error
+	ClaimKeyFailure(context.Context, string) (triesRemaining int, banDuration time.Duration, err error)
+	RecordClaimEvent(context.Context, string) error
+
+	DeleteOldDiagnosisKeys(context.Context, CleanupOptions) (int64, error)
+	DeleteDiagnosisKeysForRegion(context.Context, string) (int64, error)
+	PurgeSoftDeletedDiagnosisKeys(context.Context, time.Duration, CleanupOptions) (int64, error)
+	DeleteOldEncryptionKeys(context.Context, CleanupOptions) (int64, error)
+	RotateExpiringServerKeys(context.Context, int) (int, error)
+	DeleteOldFailedClaimKeyAttempts(context.Context, CleanupOptions) (int64, error)
+	DeleteOldUploadNonces(context.Context, CleanupOptions) (int64, error)
+	DeleteOldHashIDKeyClaims(context.Context, CleanupOptions) (int64, error)
+	DeleteOldClaimEvents(context.Context, CleanupOptions) (int64, error)
+	ClampRemainingKeysToOriginatorLimit(context.Context, CleanupOptions) (int64, error)
+
+	CountClaimedOneTimeCodes(context.Context) (int64, error)
+	CountDiagnosisKeys(context.Context) (int64, error)
+	CountUnclaimedOneTimeCodes(context.Context) (int64, error)
+	CountUnclaimedCodes(context.Context, string) (int, error)
+	CountRecentClaimFailures(context.Context, time.Time) (int, error)
+	ActiveEncryptionKeysByRegion(context.Context) (map[string]int, error)
+	ActiveServerPublicKeys(context.Context) ([][]byte, error)
+	ExportBacklog(context.Context, string) (int, error)
+	CountOldEncryptionKeysByOriginator(context.Context) ([]CountByOriginator, error)
+	FindDuplicateAppKeys(context.Context) ([][]byte, error)
+	FindMalformedClaimedRows(context.Context) ([]string, error)
+	VerifyServerKeypairIntegrity(context.Context) ([]CorruptRow, error)
+
+	SubmissionHistogram(context.Context, string, uint32) ([timemath.HoursInDay]int, error)
+	UploadCountsByHour(context.Context, string, uint32, uint32) (map[uint32]int, error)
+	CountDiagnosisKeysForDate(context.Context, string, uint32) (int, error)
+	KeySubmissionBounds(context.Context, string) (uint32, uint32, error)
+	PeakUploadHour(context.Context, string, int) (uint32, int, error)
+	ClusteredClaims(context.Context, time.Duration, int) ([]ClusteredClaims, error)
+	GenerationClaimRatio(context.Context, time.Time, time.Time) ([]DayRatio, error)
+	MonthlyOriginatorSummary(context.Context, int, int) ([]OriginatorMonthly, error)
+	OriginatorUploadTotals(context.Context, time.Time, time.Time) ([]OriginatorUploadDay, error)
+	StreamDiagnosisKeysJSON(context.Context, string, uint32, uint32, io.Writer) (int, error)
+
+	BackupEncryptionKeys(context.Context, io.Writer, *[32]byte) (int, error)
+	RestoreEncryptionKeys(context.Context, io.Reader, *[32]byte) (int, error)
 
 	SaveEvent(event Event) error
 
+	Ping(context.Context) error
+	Stats() sql.DBStats
 	Close() error
 }
 
 type conn struct {
 	db *sql.DB
+	// replica, if set, serves the read-only retrieval queries
+	replica *sql.DB
+}
+
+// reader is the handle for read-only queries: the replica if there is one.
+func (c *conn) reader() *sql.DB {
+	if c.replica != nil {
+		return c.replica
+	}
+	return c.db
 }
 
 var log = logger.New("db")
 
-const (
-	maxConnLifetime = 5 * time.Minute
-	maxOpenConns    = 100
-	maxIdleConns    = 10
-)
+// clock is "now" for queries that compute their time bounds in Go rather than
+// with the database's NOW(). Tests replace it with a fixed clock.
+var clock timemath.Clock = timemath.RealClock{}
 
 // Dial establishes a MySQL/CloudSQL connection and returns a Conn object,
 // wrapping each available query.
 func Dial(url string) (Conn, error) {
+	return &conn{db: open(url)}, nil
+}
+
+// NewReplicaConnection is Dial with a second connection to a read replica.
+// Key retrieval and private key lookups read from the replica; everything
+// else, including all writes, stays on the primary.
+func NewReplicaConnection(url, replicaURL string) (Conn, error) {
+	return &conn{db: open(url), replica: open(replicaURL)}, nil
+}
+
+func open(url string) *sql.DB {
 	if strings.Contains(url, "?") {
 		url += "&parseTime=true"
 	} else {
@@ -108,22 +199,45 @@ func Dial(url string) (Conn, error) {
 	if err != nil {
 		log(nil, err).Fatal("Could not connect to database")
 	}
-	db.SetConnMaxLifetime(maxConnLifetime)
-	db.SetMaxOpenConns(maxOpenConns)
-	db.SetMaxIdleConns(maxIdleConns)
-	return &conn{db: db}, nil
+	configurePool(db)
+	return db
 }
 
-func (c *conn) DeleteOldDiagnosisKeys() (int64, error) {
-	return deleteOldDiagnosisKeys(c.db)
+// Size the connection pool from config. MySQL refuses connections past its
+// max_connections, so DBMaxOpenConns across every server instance should stay
+// under it.
+func configurePool(db *sql.DB) {
+	db.SetConnMaxLifetime(time.Duration(config.AppConstants.DBConnMaxLifetimeSeconds) * time.Second)
+	db.SetMaxOpenConns(config.AppConstants.DBMaxOpenConns)
+	db.SetMaxIdleConns(config.AppConstants.DBMaxIdleConns)
 }
 
-func (c *conn) CountOldEncryptionKeysByOriginator() ([]CountByOriginator, error) {
-	return countOldEncryptionKeysByOriginator(c.db)
+func (c *conn) DeleteOldDiagnosisKeys(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldDiagnosisKeys(ctx, c.db, opts)
 }
 
-func (c *conn) DeleteOldEncryptionKeys() (int64, error) {
-	return deleteOldEncryptionKeys(c.db)
+func (c *conn) DeleteDiagnosisKeysForRegion(ctx context.Context, region string) (int64, error) {
+	return deleteDiagnosisKeysForRegion(ctx, c.db, region)
+}
+
+func (c *conn) PurgeSoftDeletedDiagnosisKeys(ctx context.Context, olderThan time.Duration, opts CleanupOptions) (int64, error) {
+	return purgeSoftDeletedDiagnosisKeys(ctx, c.db, olderThan, opts)
+}
+
+func (c *conn) CountOldEncryptionKeysByOriginator(ctx context.Context) ([]CountByOriginator, error) {
+	return countOldEncryptionKeysByOriginator(ctx, c.db)
+}
+
+func (c *conn) DeleteOldEncryptionKeys(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldEncryptionKeys(ctx, c.db, opts)
+}
+
+func (c *conn) RotateExpiringServerKeys(ctx context.Context, withinDays int) (int, error) {
+	return rotateExpiringServerKeys(ctx, c.db, withinDays)
+}
+
+func (c *conn) ClampRemainingKeysToOriginatorLimit(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return clampRemainingKeysToOriginatorLimit(ctx, c.db, opts)
 }
 
 // ErrNoRecordWritten indicates that, though we should have been able to write
@@ -133,59 +247,184 @@ var ErrNoRecordWritten = errors.New("we tried to write a transaction but no reco
 
 var ErrKeyConsumed = errors.New("keypair has uploaded maximum number of diagnosis keys")
 
-var ErrInvalidKeyFormat = errors.New("argument had wrong size")
+// ErrReplay is returned when an upload reuses a nonce the keypair has already
+// uploaded with, i.e. a captured upload is being sent again.
+var ErrReplay = errors.New("upload nonce has already been used")
 
-var ErrDuplicateKey = errors.New("key is already registered")
+// ErrClaimExpiredForUpload is returned when a keypair was claimed longer ago
+// than MaxClaimToUploadMinutes allows an upload to follow.
+var ErrClaimExpiredForUpload = errors.New("keypair was claimed too long ago to upload")
 
-var ErrInvalidOneTimeCode = errors.New("argument had wrong size")
+var ErrInvalidKeyFormat = &PersistenceError{Code: CodeInvalidKeyFormat, Message: "argument had wrong size"}
 
-func (c *conn) ClaimKey(oneTimeCode string, appPublicKey []byte, ctx context.Context) ([]byte, error) {
-	if len(appPublicKey) != pb.KeyLength {
-		return nil, ErrInvalidKeyFormat
-	}
-	return claimKey(c.db, oneTimeCode, appPublicKey, ctx)
+// ErrKeyNotFound is returned when there is no unexpired keypair for a server
+// public key.
+var ErrKeyNotFound = errors.New("no keypair for server public key")
+
+var ErrDuplicateKey = &PersistenceError{Code: CodeDuplicateKey, Message: "key is already registered"}
+
+var ErrInvalidOneTimeCode = &PersistenceError{Code: CodeInvalidOneTimeCode, Message: "argument had wrong size"}
+
+// ErrExpiredKey is returned by ClaimKey when the one time code's row is older
+// than EncryptionKeyValidityDays. It carries CodeInvalidOneTimeCode, so callers
+// treat it like any other unusable code.
+var ErrExpiredKey = &PersistenceError{Code: CodeInvalidOneTimeCode, Message: "encryption key is past its validity period"}
+
+func (c *conn) ClaimKey(ctx context.Context, oneTimeCode string, appPublicKey []byte) (serverPub []byte, err error) {
+	defer traceQuery(ctx, "ClaimKey", nil, &err, oneTimeCode, appPublicKey)()
+	return claimKey(ctx, c.db, oneTimeCode, appPublicKey)
 }
 
+func (c *conn) ClaimKeys(ctx context.Context, pairs []ClaimRequest) (results []ClaimResult, err error) {
+	defer traceQuery(ctx, "ClaimKeys", nil, &err)()
+	return claimKeys(ctx, c.db, pairs)
+}
+
+// ErrCodeNotFound is returned when there is no unclaimed keypair for a one
+// time code, e.g. because it has already been claimed.
+var ErrCodeNotFound = errors.New("no unclaimed keypair for one time code")
+
+func (c *conn) ExpireOneTimeCode(ctx context.Context, oneTimeCode string) error {
+	return expireOneTimeCode(ctx, c.db, oneTimeCode)
+}
+
+// OneTimeCodeStatus reports whether a one time code issued to originator is
+// waiting to be claimed, has been claimed, has expired or doesn't exist.
+// Another originator's codes are reported as not existing.
+func (c *conn) OneTimeCodeStatus(ctx context.Context, originator, oneTimeCode string) (ClaimStatus, error) {
+	return oneTimeCodeStatus(ctx, c.db, originator, oneTimeCode)
+}
+
+// ServerPublicKeyForCode returns the server public key for a one time code
+// that hasn't been claimed yet, or ErrCodeNotFound.
+func (c *conn) ServerPublicKeyForCode(ctx context.Context, oneTimeCode string) ([]byte, error) {
+	return serverPublicKeyForCode(ctx, c.db, oneTimeCode)
+}
+
+// OneTimeCodeRegion returns the region a one time code was issued for, or
+// ErrCodeNotFound.
+func (c *conn) OneTimeCodeRegion(ctx context.Context, oneTimeCode string) (string, error) {
+	return oneTimeCodeRegion(ctx, c.db, oneTimeCode)
+}
+
+// ErrDuplicateOneTimeCode is returned when a newly generated one time code is
+// already outstanding, e.g. because two requests raced with the same code.
+// Generating another code and trying again is safe.
+var ErrDuplicateOneTimeCode = errors.New("one time code already in use")
+
 // ErrHashIDClaimed is returned when the client tries to get a new code for a
 // HashID that has already used the code
 var ErrHashIDClaimed = errors.New("HashID claimed")
 
-func (c *conn) NewKeyClaim(region, originator, hashID string) (string, error) {
+// ErrInvalidRegion is returned when a region doesn't match the configured
+// region code pattern.
+var ErrInvalidRegion = errors.New("region does not match expected format")
+
+// ErrInvalidOrderBy is returned when diagnosis keys are asked for in an order
+// that isn't allowed.
+var ErrInvalidOrderBy = errors.New("diagnosis keys can't be ordered by that column")
+
+// ErrInvalidExportFeed is returned when keys are asked for in an export feed
+// other than ExportFeedFull or ExportFeedDelta.
+var ErrInvalidExportFeed = errors.New("unknown export feed")
+
+// ValidateRegion checks region against config.AppConstants.RegionCodePattern.
+func ValidateRegion(region string) error {
+	if !config.AppConstants.RegionCodeRegexp.MatchString(region) {
+		return ErrInvalidRegion
+	}
+	return nil
+}
+
+// normalizeRegion trims the whitespace clients sometimes send around a region
+// before validating it, so " 302" and "302\n" are stored and queried as "302".
+func normalizeRegion(region string) (string, error) {
+	region = strings.TrimSpace(region)
+	if err := ValidateRegion(region); err != nil {
+		return "", err
+	}
+	return region, nil
+}
+
+// ErrHashIDRateLimited is returned when too many codes have recently been
+// generated for the same HashID.
+var ErrHashIDRateLimited = errors.New("HashID rate limited")
+
+// ErrRegionCodeCapReached is returned when a region already has its configured
+// maximum number of unclaimed one time codes outstanding.
+var ErrRegionCodeCapReached = errors.New("region active code cap reached")
+
+// ErrRegionNotEnabled is returned when keys are requested for a region that
+// isn't in config.AppConstants.EnabledRegions.
+var ErrRegionNotEnabled = errors.New("region is not enabled")
+
+// ErrRangeTooWide is returned when keys are requested for more hours than
+// config.AppConstants.MaxRetrievalRangeHours.
+var ErrRangeTooWide = errors.New("requested hour range is too wide")
+
+func (c *conn) NewKeyClaim(ctx context.Context, region, originator, hashID string) (oneTimeCode string, err error) {
+	defer traceQuery(ctx, "NewKeyClaim", logrus.Fields{"region": region, "originator": translateTokenForLogs(originator)}, &err)()
+	result, err := newKeyClaim(ctx, c.db, region, originator, hashID)
+	return result.OneTimeCode, err
+}
+
+// Generate a one time code and persist it with a fresh keypair, retrying with
+// a new code if it collides with one that's already outstanding.
+func newKeyClaim(ctx context.Context, db *sql.DB, region, originator, hashID string) (PersistResult, error) {
 	var err error
 
+	if region, err = normalizeRegion(region); err != nil {
+		return PersistResult{}, err
+	}
+
+	if len(hashID) == 128 {
+		if err = enforceHashIDRateLimit(ctx, db, hashID); err != nil {
+			return PersistResult{}, err
+		}
+	}
+
 	pub, priv, err := box.GenerateKey(rand.Reader)
 	if err != nil {
-		return "", err
+		return PersistResult{}, err
 	}
 
+	// An unclaimed code for the hashID is deleted on one attempt and its
+	// replacement inserted on the next, so remember it across retries.
+	replacedExisting := false
+
 	for tries := 5; tries > 0; tries-- {
 
-		oneTimeCode, err := generateOneTimeCode()
+		var oneTimeCode string
+		oneTimeCode, err = generateOneTimeCode()
 
 		if err != nil {
-			return "", err
+			return PersistResult{}, err
 		}
 
-		if len(hashID) == 128 {
-			err = persistEncryptionKeyWithHashID(c.db, region, originator, hashID, pub, priv, oneTimeCode)
-		} else {
-			err = persistEncryptionKey(c.db, region, originator, pub, priv, oneTimeCode)
-		}
+		var result PersistResult
+		err = retryOnDeadlock(ctx, func() (err error) {
+			if len(hashID) == 128 {
+				result, err = persistEncryptionKeyWithHashID(ctx, db, region, originator, hashID, pub, priv, oneTimeCode)
+			} else {
+				result, err = persistEncryptionKey(ctx, db, region, originator, pub, priv, oneTimeCode)
+			}
+			return err
+		})
+		replacedExisting = replacedExisting || result.ReplacedExisting
 		if err == nil {
-
-
-			return oneTimeCode, nil
+			result.ReplacedExisting = replacedExisting
+			return result, nil
 		} else if strings.Contains(err.Error(), "used hashID found") {
-			return "", ErrHashIDClaimed
+			return PersistResult{}, ErrHashIDClaimed
 		} else if strings.Contains(err.Error(), "regenerate OTC for hashID") {
 			log(nil, err).Warn("regenerating OTC for hashID")
-		} else if strings.Contains(err.Error(), "Duplicate entry") {
+		} else if errors.Is(err, ErrDuplicateOneTimeCode) || strings.Contains(err.Error(), "Duplicate entry") {
 			log(nil, err).Warn("duplicate one_time_code")
 		} else {
-			return "", err
+			return PersistResult{}, err
 		}
 	}
-	return "", err
+	return PersistResult{}, err
 }
 
 // Generate a random one time code in the format AAABBBCCCC where
@@ -201,15 +440,30 @@ func generateOneTimeCode() (string, error) {
 
 	characterSetLength := int64(len(characterSets))
 
-	seg1, err := rand.Int(rand.Reader, big.NewInt(characterSetLength))
-	seg2, err := rand.Int(rand.Reader, big.NewInt(characterSetLength))
-	seg3, err := rand.Int(rand.Reader, big.NewInt(characterSetLength))
+	var oneTimeCode strings.Builder
+	for _, length := range oneTimeCodeSegments(config.AppConstants.OneTimeCodeLength) {
+		seg, err := rand.Int(rand.Reader, big.NewInt(characterSetLength))
+		if err != nil {
+			return "", err
+		}
+		oneTimeCode.WriteString(genRandom(characterSets[seg.Int64()], length))
+	}
 
-	oneTimeCode := genRandom(characterSets[seg1.Int64()], 3) +
-		genRandom(characterSets[seg2.Int64()], 3) +
-		genRandom(characterSets[seg3.Int64()], 4)
+	return oneTimeCode.String(), nil
+}
 
-	return oneTimeCode, err
+// oneTimeCodeSegments splits a code length into groups of three, with the
+// last group taking the remaining one to four characters, so the default
+// length of 10 keeps the AAABBBCCCC shape.
+func oneTimeCodeSegments(length int) []int64 {
+	var segments []int64
+	for ; length > 4; length -= 3 {
+		segments = append(segments, 3)
+	}
+	if length > 0 {
+		segments = append(segments, int64(length))
+	}
+	return segments
 }
 
 // Generates a string of random characters based on a
@@ -225,11 +479,11 @@ func genRandom(chars []rune, length int64) string {
 	return b.String()
 }
 
-func (c *conn) PrivForPub(pub []byte) ([]byte, error) {
+func (c *conn) PrivForPub(ctx context.Context, pub []byte) ([]byte, error) {
 	if len(pub) != pb.KeyLength {
 		return nil, ErrInvalidKeyFormat
 	}
-	row := privForPub(c.db, pub)
+	row := privForPub(ctx, c.reader(), pub)
 	var priv []byte
 	switch err := row.Scan(&priv); err {
 	case sql.ErrNoRows:
@@ -241,18 +495,56 @@ func (c *conn) PrivForPub(pub []byte) ([]byte, error) {
 	}
 }
 
-func (c *conn) StoreKeys(appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) error {
-	return registerDiagnosisKeys(c.db, appPubKey, keys, ctx)
+func (c *conn) RegionAndOriginatorForPub(ctx context.Context, appPublicKey []byte) (string, string, error) {
+	return regionAndOriginatorForPub(ctx, c.db, appPublicKey)
+}
+
+func (c *conn) StoreKeys(ctx context.Context, appPubKey *[32]byte, nonce []byte, keys []*pb.TemporaryExposureKey) (err error) {
+	defer traceQuery(ctx, "StoreKeys", nil, &err, appPubKey[:])()
+	result, err := storeKeys(ctx, c.db, appPubKey[:], nonce, keys, timemath.HourNumber(clock.Now()))
+	if err != nil {
+		return err
+	}
+
+	if len(result.Skipped) > 0 {
+		log(ctx, nil).WithField("skipped", len(result.Skipped)).Warn("skipped invalid diagnosis keys")
+	}
+	if result.Duplicates > 0 {
+		log(ctx, nil).WithField("duplicates", result.Duplicates).Info("skipped already submitted diagnosis keys")
+	}
+	return nil
 }
 
-func (c *conn) FetchKeysForHours(region string, startHour uint32, endHour uint32, currentRSIN int32) ([]*pb.TemporaryExposureKey, error) {
-	rows, err := diagnosisKeysForHours(c.db, region, startHour, endHour, currentRSIN)
+func (c *conn) FetchKeysForHours(ctx context.Context, region string, startHour uint32, endHour uint32, currentRSIN int32) (keys []*pb.TemporaryExposureKey, err error) {
+	defer traceQuery(ctx, "FetchKeysForHours", logrus.Fields{"region": region}, &err, region, startHour, endHour, currentRSIN)()
+	rows, err := diagnosisKeysForHours(ctx, c.reader(), region, startHour, endHour, currentRSIN, config.AppConstants.MinTransmissionRiskLevel)
 	if err != nil {
 		return nil, err
 	}
 	return handleKeysRows(rows)
 }
 
+// KeyPages yields diagnosis keys a page at a time. Next returns no keys once
+// every page has been read. Close must be called when done with it.
+type KeyPages interface {
+	Next() ([]*pb.TemporaryExposureKey, error)
+	Close() error
+}
+
+func (c *conn) FetchKeyPagesForHours(ctx context.Context, region string, startHour uint32, endHour uint32, currentRSIN int32, pageSize int) (pages KeyPages, err error) {
+	defer traceQuery(ctx, "FetchKeyPagesForHours", logrus.Fields{"region": region}, &err, region, startHour, endHour, currentRSIN, pageSize)()
+	keyPages, err := diagnosisKeyPagesForHours(ctx, c.reader(), region, startHour, endHour, currentRSIN, config.AppConstants.MinTransmissionRiskLevel, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return keyPages, nil
+}
+
+func (c *conn) FetchKeysSince(ctx context.Context, region string, sinceHour uint32, currentRSIN int32) (keys []*pb.TemporaryExposureKey, cursor uint32, err error) {
+	defer traceQuery(ctx, "FetchKeysSince", logrus.Fields{"region": region}, &err, region, sinceHour, currentRSIN)()
+	return diagnosisKeysSince(ctx, c.reader(), region, sinceHour, currentRSIN, config.AppConstants.MinTransmissionRiskLevel)
+}
+
 func handleKeysRows(rows *sql.Rows) ([]*pb.TemporaryExposureKey, error) {
 	var keys []*pb.TemporaryExposureKey
 	for rows.Next() {
@@ -260,49 +552,113 @@ func handleKeysRows(rows *sql.Rows) ([]*pb.TemporaryExposureKey, error) {
 		var rollingStartIntervalNumber int32
 		var rollingPeriod int32
 		var transmissionRiskLevel int32
+		var reportType pb.TemporaryExposureKey_ReportType
+		var daysSinceOnsetOfSymptoms sql.NullInt32
 		var region string
-		err := rows.Scan(&region, &key, &rollingStartIntervalNumber, &rollingPeriod, &transmissionRiskLevel)
+		err := rows.Scan(&region, &key, &rollingStartIntervalNumber, &rollingPeriod, &transmissionRiskLevel, &reportType, &daysSinceOnsetOfSymptoms)
 		if err != nil {
 			return nil, err
 		}
-		keys = append(keys, &pb.TemporaryExposureKey{
+		tek := &pb.TemporaryExposureKey{
 			KeyData:                    key,
 			RollingStartIntervalNumber: &rollingStartIntervalNumber,
 			RollingPeriod:              &rollingPeriod,
 			TransmissionRiskLevel:      &transmissionRiskLevel,
-		})
+			ReportType:                 &reportType,
+		}
+		if daysSinceOnsetOfSymptoms.Valid {
+			tek.DaysSinceOnsetOfSymptoms = &daysSinceOnsetOfSymptoms.Int32
+		}
+		keys = append(keys, tek)
 	}
 	return keys, nil
 }
 
-func (c *conn) CheckClaimKeyBan(identifier string) (triesRemaining int, banDuration time.Duration, err error) {
-	return checkClaimKeyBan(c.db, identifier)
+// ErrBanned is reported when an identifier has used up its claim attempts and
+// must wait out ClaimKeyBanDuration before trying again.
+var ErrBanned = errors.New("too many failed claim-key attempts")
+
+func (c *conn) CheckClaimKeyBan(ctx context.Context, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
+	return checkClaimKeyBan(ctx, c.db, identifier)
+}
+
+func (c *conn) ClaimKeySuccess(ctx context.Context, identifier string) error {
+	return registerClaimKeySuccess(ctx, c.db, identifier)
+}
+
+func (c *conn) ClaimKeyFailure(ctx context.Context, identifier string) (int, time.Duration, error) {
+	return registerClaimKeyFailure(ctx, c.db, identifier)
+}
+
+func (c *conn) DeleteOldFailedClaimKeyAttempts(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldFailedClaimKeyAttempts(ctx, c.db, opts)
+}
+
+func (c *conn) DeleteOldUploadNonces(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldUploadNonces(ctx, c.db, opts)
 }
 
-func (c *conn) ClaimKeySuccess(identifier string) error {
-	return registerClaimKeySuccess(c.db, identifier)
+func (c *conn) DeleteOldHashIDKeyClaims(ctx context.Context, opts CleanupOptions) (int64, error) {
+	return deleteOldHashIDKeyClaims(ctx, c.db, opts)
 }
 
-func (c *conn) ClaimKeyFailure(identifier string) (int, time.Duration, error) {
-	return registerClaimKeyFailure(c.db, identifier)
+func (c *conn) CountClaimedOneTimeCodes(ctx context.Context) (int64, error) {
+	return countClaimedOneTimeCodes(ctx, c.db)
 }
 
-func (c *conn) DeleteOldFailedClaimKeyAttempts() (int64, error) {
-	return deleteOldFailedClaimKeyAttempts(c.db)
+func (c *conn) CountDiagnosisKeys(ctx context.Context) (int64, error) {
+	return countDiagnosisKeys(ctx, c.db)
 }
 
-func (c *conn) CountClaimedOneTimeCodes() (int64, error) {
-	return countClaimedOneTimeCodes(c.db)
+func (c *conn) CountUnclaimedOneTimeCodes(ctx context.Context) (int64, error) {
+	return countUnclaimedOneTimeCodes(ctx, c.db)
 }
 
-func (c *conn) CountDiagnosisKeys() (int64, error) {
-	return countDiagnosisKeys(c.db)
+func (c *conn) CountUnclaimedCodes(ctx context.Context, originator string) (int, error) {
+	return countUnclaimedCodes(ctx, c.db, originator)
 }
 
-func (c *conn) CountUnclaimedOneTimeCodes() (int64, error) {
-	return countUnclaimedOneTimeCodes(c.db)
+// CountRecentClaimFailures returns how many failed claim attempts were made by
+// identifiers that have failed since since, for brute-force alerting.
+func (c *conn) CountRecentClaimFailures(ctx context.Context, since time.Time) (int, error) {
+	return countRecentClaimFailures(ctx, c.db, since)
+}
+
+func (c *conn) ActiveEncryptionKeysByRegion(ctx context.Context) (map[string]int, error) {
+	return activeEncryptionKeysByRegion(ctx, c.db)
+}
+
+func (c *conn) ActiveServerPublicKeys(ctx context.Context) ([][]byte, error) {
+	return activeServerPublicKeys(ctx, c.db)
+}
+
+func (c *conn) FindDuplicateAppKeys(ctx context.Context) ([][]byte, error) {
+	return findDuplicateAppKeys(ctx, c.db)
+}
+
+func (c *conn) FindMalformedClaimedRows(ctx context.Context) ([]string, error) {
+	return findMalformedClaimedRows(ctx, c.db)
+}
+
+// VerifyServerKeypairIntegrity returns every encryption_keys row whose server
+// public key doesn't match its private key.
+func (c *conn) VerifyServerKeypairIntegrity(ctx context.Context) ([]CorruptRow, error) {
+	return verifyServerKeypairIntegrity(ctx, c.db)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	return ping(ctx, c.db)
+}
+
+func (c *conn) Stats() sql.DBStats {
+	return c.db.Stats()
 }
 
 func (c *conn) Close() error {
+	if c.replica != nil {
+		if err := c.replica.Close(); err != nil {
+			return err
+		}
+	}
 	return c.db.Close()
 }
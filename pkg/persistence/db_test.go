@@ -1,12 +1,14 @@
 package persistence
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"database/sql/driver"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"regexp"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/Shopify/goose/logger"
+	"github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
@@ -40,9 +43,10 @@ func TestDBDeleteOldDiagnosisKeys(t *testing.T) {
 	}
 
 	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(0, 0))
 
 	expectedResult := int64(1)
-	receivedResult, receivedError := conn.DeleteOldDiagnosisKeys()
+	receivedResult, receivedError := conn.DeleteOldDiagnosisKeys(context.Background(), CleanupOptions{})
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
@@ -56,10 +60,12 @@ func TestDBDeleteOldEncryptionKeys(t *testing.T) {
 		db: db,
 	}
 
+	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
 
-	expectedResult := int64(1)
-	receivedResult, receivedError := conn.DeleteOldEncryptionKeys()
+	expectedResult := int64(3)
+	receivedResult, receivedError := conn.DeleteOldEncryptionKeys(context.Background(), CleanupOptions{})
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
@@ -77,7 +83,7 @@ func TestDBClaimKey(t *testing.T) {
 	oneTimeCode := "80311300"
 
 	// App key to short
-	receivedResult, receivedError := conn.ClaimKey(oneTimeCode, make([]byte, 8), nil)
+	receivedResult, receivedError := conn.ClaimKey(context.Background(), oneTimeCode, make([]byte, 8))
 	assert.Equal(t, receivedError, ErrInvalidKeyFormat)
 	assert.Nil(t, receivedResult)
 
@@ -88,8 +94,8 @@ func TestDBClaimKey(t *testing.T) {
 
 	created := time.Now()
 	originator := "onAPI"
-	rows = sqlmock.NewRows([]string{"created", "originator"}).AddRow(created, originator)
-	mock.ExpectQuery(`SELECT created, originator FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"created", "originator", "region", "server_public_key"}).AddRow(created, originator, "302", pub[:])
+	mock.ExpectQuery(`SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnRows(rows)
 
 	created = timemath.MostRecentUTCMidnight(created)
 
@@ -97,26 +103,140 @@ func TestDBClaimKey(t *testing.T) {
 		`UPDATE encryption_keys
 		SET one_time_code = NULL,
 			app_public_key = ?,
-			created = ?
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
 		WHERE one_time_code = ?
 		AND created > (NOW() - INTERVAL %d MINUTE)`,
 		config.AppConstants.OneTimeCodeExpiryInMinutes,
 	)
 
-	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
-
-	rows = sqlmock.NewRows([]string{"server_public_key"}).AddRow(pub[:])
-	mock.ExpectPrepare(`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`).ExpectQuery().WithArgs(pub[:]).WillReturnRows(rows)
+	mock.ExpectExec(query).WithArgs(pub[:], created, sqlmock.AnyArg(), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectCommit()
 
 	expectedResult := pub[:]
-	receivedResult, receivedError = conn.ClaimKey(oneTimeCode, pub[:], nil)
+	receivedResult, receivedError = conn.ClaimKey(context.Background(), oneTimeCode, pub[:])
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
 }
 
+func TestDBClaimKeyRetriesDeadlock(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	oldDelay := deadlockRetryDelay
+	defer func() { deadlockRetryDelay = oldDelay }()
+	deadlockRetryDelay = 0
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+
+	// Deadlocks, then succeeds on the retry
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnError(deadlock)
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	created := time.Now()
+	rows = sqlmock.NewRows([]string{"created", "originator", "region", "server_public_key"}).AddRow(created, "onAPI", "302", pub[:])
+	mock.ExpectQuery(`SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnRows(rows)
+
+	query := fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
+	mock.ExpectExec(query).WithArgs(pub[:], timemath.MostRecentUTCMidnight(created), sqlmock.AnyArg(), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	// The claim event is only recorded once, after the retry commits
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO events
+		(source, identifier, device_type, date, count)
+		VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(
+		AnyType{}, OTKClaimed, Server, AnyType{}, 1, 1,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedError := conn.ClaimKey(context.Background(), oneTimeCode, pub[:])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, pub[:], receivedResult, "Expected the server key from the retry")
+	assert.Nil(t, receivedError, "Expected nil if the retry succeeds")
+
+	// Gives up if every attempt deadlocks
+	for i := 0; i < deadlockAttempts; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnError(deadlock)
+		mock.ExpectRollback()
+	}
+
+	receivedResult, receivedError = conn.ClaimKey(context.Background(), oneTimeCode, pub[:])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult)
+	assert.Equal(t, deadlock, receivedError, "Expected the deadlock if every attempt fails")
+}
+
+func TestDBNewKeyClaimRetriesDeadlock(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	oldDelay := deadlockRetryDelay
+	defer func() { deadlockRetryDelay = oldDelay }()
+	deadlockRetryDelay = 0
+
+	region := "302"
+	originator := "randomOrigin"
+	insert := `INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`
+
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).WithArgs(region, originator, AnyType{}, AnyType{}, AnyType{}, config.AppConstants.InitialRemainingKeys).WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).WithArgs(region, originator, AnyType{}, AnyType{}, AnyType{}, config.AppConstants.InitialRemainingKeys).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedError := conn.NewKeyClaim(context.Background(), region, originator, "")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Less(t, 0, len(receivedResult))
+	assert.Nil(t, receivedError, "Expected nil if the retry succeeds")
+}
+
 func TestDBNewKeyClaim(t *testing.T) {
 	// Capture logs
 	oldLog := log
@@ -140,6 +260,7 @@ func TestDBNewKeyClaim(t *testing.T) {
 	originator := "randomOrigin"
 
 	// Success with no HashID
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -151,8 +272,9 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	receivedResult, receivedError := conn.NewKeyClaim(region, originator, "")
+	receivedResult, receivedError := conn.NewKeyClaim(context.Background(), region, originator, "")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -162,6 +284,7 @@ func TestDBNewKeyClaim(t *testing.T) {
 	assert.Nil(t, receivedError, "Expected nil if it could execute insert")
 
 	// Error - Generic
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -173,8 +296,9 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
 
-	receivedResult, receivedError = conn.NewKeyClaim(region, originator, "")
+	receivedResult, receivedError = conn.NewKeyClaim(context.Background(), region, originator, "")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -185,6 +309,7 @@ func TestDBNewKeyClaim(t *testing.T) {
 	assert.Equal(t, expectedErr, receivedError, "Expected error if could not execute insert")
 
 	// Error - existing code
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -196,7 +321,9 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("Duplicate entry"))
+	mock.ExpectRollback()
 
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -208,8 +335,9 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	receivedResult, receivedError = conn.NewKeyClaim(region, originator, "")
+	receivedResult, receivedError = conn.NewKeyClaim(context.Background(), region, originator, "")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -223,6 +351,7 @@ func TestDBNewKeyClaim(t *testing.T) {
 	// Error - never succeeds with duplicate codes
 
 	for i := 0; i < 5; i++ {
+		mock.ExpectBegin()
 		mock.ExpectExec(
 			`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -233,23 +362,25 @@ func TestDBNewKeyClaim(t *testing.T) {
 			AnyType{},
 			AnyType{},
 			config.AppConstants.InitialRemainingKeys,
-		).WillReturnError(fmt.Errorf("Duplicate entry"))
+		).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'AAABBBCCCC' for key 'one_time_code'"})
+		mock.ExpectRollback()
 	}
 
-	receivedResult, receivedError = conn.NewKeyClaim(region, originator, "")
+	receivedResult, receivedError = conn.NewKeyClaim(context.Background(), region, originator, "")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
 	assert.Equal(t, "", receivedResult, "Expected result if could not execute insert")
-	assert.Nil(t, receivedError) // This is a bug and should be fixed, however, it is high unlikely to trigger
+	assert.Equal(t, ErrDuplicateOneTimeCode, receivedError, "Expected ErrDuplicateOneTimeCode if every code collided")
 
 	assertLog(t, hook, 5, logrus.WarnLevel, "duplicate one_time_code")
 
 	// Error - unclaimed HashID, eventual success
 	hashID := hex.EncodeToString(SHA512([]byte("abcd")))
 
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -262,12 +393,14 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("for key 'hash_id"))
+	mock.ExpectRollback()
 
 	rows := sqlmock.NewRows([]string{"one_time_code"}).AddRow("ABCD")
 	mock.ExpectQuery(
 		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
 	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
 
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -280,8 +413,9 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	receivedResult, receivedError = conn.NewKeyClaim(region, originator, hashID)
+	receivedResult, receivedError = conn.NewKeyClaim(context.Background(), region, originator, hashID)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -293,6 +427,7 @@ func TestDBNewKeyClaim(t *testing.T) {
 	assertLog(t, hook, 1, logrus.WarnLevel, "regenerating OTC for hashID")
 
 	// Error - claimed HashID
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		`INSERT INTO encryption_keys
 		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
@@ -305,17 +440,180 @@ func TestDBNewKeyClaim(t *testing.T) {
 		AnyType{},
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("for key 'hash_id"))
+	mock.ExpectRollback()
 
 	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow(nil)
 	mock.ExpectQuery(
 		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
 
-	receivedResult, receivedError = conn.NewKeyClaim(region, originator, hashID)
+	receivedResult, receivedError = conn.NewKeyClaim(context.Background(), region, originator, hashID)
 
 	assert.Equal(t, "", receivedResult, "Expected result if could not execute insert")
 	assert.Equal(t, ErrHashIDClaimed, receivedError) // This is a bug and should be fixed, however, it is high unlikely to trigger
 }
 
+func TestNewKeyClaimReplacedExisting(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	region := "302"
+	originator := "randomOrigin"
+	hashID := hex.EncodeToString(SHA512([]byte("abcd")))
+
+	insert := `INSERT INTO encryption_keys
+		(region, originator, hash_id, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	// Clean insert
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).WithArgs(
+		region,
+		originator,
+		hashID,
+		AnyType{},
+		AnyType{},
+		AnyType{},
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedError := newKeyClaim(context.Background(), db, region, originator, hashID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Less(t, 0, len(receivedResult.OneTimeCode))
+	assert.False(t, receivedResult.ReplacedExisting, "Expected ReplacedExisting to be false on a clean insert")
+	assert.Nil(t, receivedError, "Expected nil if it could execute insert")
+
+	// Unclaimed code for the hashID is deleted, then replaced
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).WithArgs(
+		region,
+		originator,
+		hashID,
+		AnyType{},
+		AnyType{},
+		AnyType{},
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(fmt.Errorf("for key 'hash_id"))
+	mock.ExpectRollback()
+
+	rows := sqlmock.NewRows([]string{"one_time_code"}).AddRow("ABCD")
+	mock.ExpectQuery(`SELECT one_time_code FROM encryption_keys WHERE hash_id = ?`).WithArgs(hashID).WillReturnRows(rows)
+	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).WithArgs(
+		region,
+		originator,
+		hashID,
+		AnyType{},
+		AnyType{},
+		AnyType{},
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedError = newKeyClaim(context.Background(), db, region, originator, hashID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Less(t, 0, len(receivedResult.OneTimeCode))
+	assert.True(t, receivedResult.ReplacedExisting, "Expected ReplacedExisting after the unused code was replaced")
+	assert.Nil(t, receivedError, "Expected nil if it could execute insert")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "regenerating OTC for hashID")
+}
+
+func TestOneTimeCodeSegments(t *testing.T) {
+	assert.Equal(t, []int64{3, 3, 4}, oneTimeCodeSegments(10), "Expected the default length to keep the AAABBBCCCC shape")
+	assert.Equal(t, []int64{3, 3, 2}, oneTimeCodeSegments(8), "Expected the last group to take the remainder")
+	assert.Equal(t, []int64{3, 3, 3, 3}, oneTimeCodeSegments(12), "Expected groups of three")
+	assert.Equal(t, []int64{4}, oneTimeCodeSegments(4), "Expected a single group for short codes")
+	assert.Nil(t, oneTimeCodeSegments(0), "Expected no groups for a zero length")
+}
+
+func TestGenerateOneTimeCode(t *testing.T) {
+	oldLength := config.AppConstants.OneTimeCodeLength
+	defer func() { config.AppConstants.OneTimeCodeLength = oldLength }()
+
+	formats := map[int]*regexp.Regexp{
+		8:  regexp.MustCompile(`^([AEFHJKLQRSUWXYZ]{3}|[2456789]{3}){2}([AEFHJKLQRSUWXYZ]{2}|[2456789]{2})$`),
+		10: regexp.MustCompile(`^([AEFHJKLQRSUWXYZ]{3}|[2456789]{3}){2}([AEFHJKLQRSUWXYZ]{4}|[2456789]{4})$`),
+	}
+
+	for length, format := range formats {
+		config.AppConstants.OneTimeCodeLength = length
+
+		for i := 0; i < 50; i++ {
+			code, err := generateOneTimeCode()
+
+			assert.Nil(t, err, "Expected nil if code was generated")
+			assert.Len(t, code, length, "Expected a code of the configured length")
+			assert.Regexp(t, format, code, "Expected each group to come from a single character set")
+		}
+	}
+}
+
+func TestValidateRegion(t *testing.T) {
+	oldRegexp := config.AppConstants.RegionCodeRegexp
+	defer func() { config.AppConstants.RegionCodeRegexp = oldRegexp }()
+	config.AppConstants.RegionCodeRegexp = regexp.MustCompile("^[0-9]{3}$")
+
+	assert.Nil(t, ValidateRegion("302"), "Expected nil for a conforming region")
+	assert.Equal(t, ErrInvalidRegion, ValidateRegion("CA-ON"), "Expected ErrInvalidRegion for a non-conforming region")
+
+	// Rejects before touching the database
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	receivedResult, receivedError := conn.NewKeyClaim(context.Background(), "CA-ON", "randomOrigin", "")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, "", receivedResult, "Expected no code for a non-conforming region")
+	assert.Equal(t, ErrInvalidRegion, receivedError, "Expected ErrInvalidRegion for a non-conforming region")
+}
+
+func TestNormalizeRegion(t *testing.T) {
+	oldRegexp := config.AppConstants.RegionCodeRegexp
+	defer func() { config.AppConstants.RegionCodeRegexp = oldRegexp }()
+	config.AppConstants.RegionCodeRegexp = regexp.MustCompile("^[0-9]{3}$")
+
+	for _, region := range []string{"302", " 302", "302\n", "\t302 \r\n"} {
+		normalized, err := normalizeRegion(region)
+		assert.Nil(t, err, "Expected nil for %q", region)
+		assert.Equal(t, "302", normalized, "Expected whitespace to be trimmed from %q", region)
+	}
+
+	for _, region := range []string{"", "  ", "30 2", "3020", "CA-ON", "302x"} {
+		normalized, err := normalizeRegion(region)
+		assert.Equal(t, ErrInvalidRegion, err, "Expected ErrInvalidRegion for %q", region)
+		assert.Equal(t, "", normalized, "Expected no region for %q", region)
+	}
+}
+
 func TestDBPrivForPub(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
 	defer db.Close()
@@ -331,14 +629,14 @@ func TestDBPrivForPub(t *testing.T) {
 	mock.ExpectQuery("").WillReturnRows(rows)
 
 	expectedResult := pub[:]
-	receivedResult, receivedError := conn.PrivForPub(pub[:])
+	receivedResult, receivedError := conn.PrivForPub(context.Background(), pub[:])
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
 
 	// Bad cert
 	expectedResult = pub[:]
-	receivedResult, receivedError = conn.PrivForPub(make([]byte, 8))
+	receivedResult, receivedError = conn.PrivForPub(context.Background(), make([]byte, 8))
 
 	assert.NotEqual(t, expectedResult, receivedResult)
 	assert.Equal(t, ErrInvalidKeyFormat, receivedError)
@@ -347,7 +645,7 @@ func TestDBPrivForPub(t *testing.T) {
 	rows = sqlmock.NewRows([]string{"server_private_key"})
 	mock.ExpectQuery("").WillReturnRows(rows)
 
-	receivedResult, receivedError = conn.PrivForPub(pub[:])
+	receivedResult, receivedError = conn.PrivForPub(context.Background(), pub[:])
 
 	assert.Equal(t, errors.New("no record"), receivedError)
 	assert.Nil(t, receivedResult)
@@ -356,7 +654,7 @@ func TestDBPrivForPub(t *testing.T) {
 	rows = sqlmock.NewRows([]string{"server_private_key"})
 	mock.ExpectQuery("").WillReturnError(fmt.Errorf("generic error"))
 
-	receivedResult, receivedError = conn.PrivForPub(pub[:])
+	receivedResult, receivedError = conn.PrivForPub(context.Background(), pub[:])
 
 	assert.Equal(t, errors.New("no record"), receivedError)
 	assert.Nil(t, receivedResult)
@@ -371,6 +669,7 @@ func TestDBStoreKeys(t *testing.T) {
 	}
 
 	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
 	region := "302"
 	originator := "randomOrigin"
 
@@ -383,23 +682,26 @@ func TestDBStoreKeys(t *testing.T) {
 	mock.ExpectBegin()
 	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 3)
 	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectPrepare(
 		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 	)
 
 	for _, key := range keys {
 		mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`).WithArgs(
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`).WithArgs(
 			region,
 			originator,
 			key.GetKeyData(),
 			key.GetRollingStartIntervalNumber(),
 			key.GetRollingPeriod(),
 			key.GetTransmissionRiskLevel(),
+			key.GetReportType(),
+			key.DaysSinceOnsetOfSymptoms,
 			hourOfSubmission,
 		).WillReturnResult(sqlmock.NewResult(1, 1))
 	}
@@ -415,8 +717,12 @@ func TestDBStoreKeys(t *testing.T) {
 		pub[:],
 	).WillReturnResult(sqlmock.NewResult(1, 1))
 
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(len(keys)), int64(len(keys))).WillReturnResult(sqlmock.NewResult(1, 1))
+
 	mock.ExpectCommit()
-	receivedResult := conn.StoreKeys(pub, keys, nil)
+	receivedResult := conn.StoreKeys(context.Background(), pub, nonce[:], keys)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -425,6 +731,47 @@ func TestDBStoreKeys(t *testing.T) {
 	assert.Nil(t, receivedResult, "Expected nil when keys are commited")
 }
 
+func TestDBReplica(t *testing.T) {
+	primary, primaryMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer primary.Close()
+	replica, replicaMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer replica.Close()
+
+	conn := conn{
+		db:      primary,
+		replica: replica,
+	}
+
+	// Retrieval reads from the replica
+	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).AddRow("302", []byte{}, 2651450, 144, 4, 1, nil)
+	replicaMock.ExpectQuery("").WillReturnRows(row)
+
+	_, receivedError := conn.FetchKeysForHours(context.Background(), "302", 100, 200, 2651450)
+	assert.Nil(t, receivedError)
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	rows := sqlmock.NewRows([]string{"server_private_key"}).AddRow(pub[:])
+	replicaMock.ExpectQuery("").WillReturnRows(rows)
+
+	_, receivedError = conn.PrivForPub(context.Background(), pub[:])
+	assert.Nil(t, receivedError)
+
+	// Writes go to the primary
+	primaryMock.ExpectBegin()
+	primaryMock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
+	primaryMock.ExpectCommit()
+
+	_, receivedError = conn.NewKeyClaim(context.Background(), "302", "originator", "")
+	assert.Nil(t, receivedError)
+
+	if err := replicaMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled replica expectations: %s", err)
+	}
+	if err := primaryMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled primary expectations: %s", err)
+	}
+}
+
 func TestDBFetchKeysForHours(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
 	defer db.Close()
@@ -441,7 +788,7 @@ func TestDBFetchKeysForHours(t *testing.T) {
 	rollingPeriod := int32(144)
 	transmissionRiskLevel := int32(4)
 
-	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}).AddRow("302", []byte{}, 2651450, 144, 4)
+	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).AddRow("302", []byte{}, 2651450, 144, 4, 1, nil)
 	mock.ExpectQuery("").WillReturnRows(row)
 
 	expectedResult := []*pb.TemporaryExposureKey{
@@ -450,10 +797,11 @@ func TestDBFetchKeysForHours(t *testing.T) {
 			RollingStartIntervalNumber: &currentRollingStartIntervalNumber,
 			RollingPeriod:              &rollingPeriod,
 			TransmissionRiskLevel:      &transmissionRiskLevel,
+			ReportType:                 pb.TemporaryExposureKey_CONFIRMED_TEST.Enum(),
 		},
 	}
 
-	receivedResult, _ := conn.FetchKeysForHours(region, startHour, endHour, currentRollingStartIntervalNumber)
+	receivedResult, _ := conn.FetchKeysForHours(context.Background(), region, startHour, endHour, currentRollingStartIntervalNumber)
 
 	assert.Equal(t, expectedResult, receivedResult, "Expected rows for the query")
 
@@ -464,7 +812,7 @@ func TestDBFetchKeysForHours(t *testing.T) {
 	// Errors
 	mock.ExpectQuery("").WillReturnError(fmt.Errorf("Generic error"))
 
-	_, receivedError := conn.FetchKeysForHours(region, startHour, endHour, currentRollingStartIntervalNumber)
+	_, receivedError := conn.FetchKeysForHours(context.Background(), region, startHour, endHour, currentRollingStartIntervalNumber)
 
 	assert.Equal(t, fmt.Errorf("Generic error"), receivedError, "Expected rows for the query")
 }
@@ -486,7 +834,7 @@ func TestDBCheckClaimKeyBan(t *testing.T) {
 	expectedTriesRemaining := config.AppConstants.MaxConsecutiveClaimKeyFailures
 	expectedBanDuration := time.Duration(0)
 
-	receivedTriesRemaining, receivedBanDuration, _ := conn.CheckClaimKeyBan(identifier)
+	receivedTriesRemaining, receivedBanDuration, _ := conn.CheckClaimKeyBan(context.Background(), identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -506,7 +854,7 @@ func TestDBClaimKeySuccess(t *testing.T) {
 
 	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
 
-	receivedError := conn.ClaimKeySuccess("127.0.0.1")
+	receivedError := conn.ClaimKeySuccess(context.Background(), "127.0.0.1")
 
 	assert.Nil(t, receivedError)
 }
@@ -539,7 +887,7 @@ func TestDBClaimKeyFailure(t *testing.T) {
 	expectedTriesRemaining := config.AppConstants.MaxConsecutiveClaimKeyFailures - 1
 	expectedBanDuration := time.Duration(0)
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr := conn.ClaimKeyFailure(identifier)
+	receivedTriesRemaining, receivedBanDuration, receivedErr := conn.ClaimKeyFailure(context.Background(), identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -561,7 +909,7 @@ func TestDBDeleteOldFailedClaimKeyAttempts(t *testing.T) {
 	mock.ExpectExec("").WillReturnResult(sqlmock.NewResult(1, 1))
 
 	expectedResult := int64(1)
-	receivedResult, receivedError := conn.DeleteOldFailedClaimKeyAttempts()
+	receivedResult, receivedError := conn.DeleteOldFailedClaimKeyAttempts(context.Background(), CleanupOptions{})
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
@@ -579,12 +927,29 @@ func TestDBCountClaimedOneTimeCodes(t *testing.T) {
 	mock.ExpectQuery("").WillReturnRows(rows)
 
 	expectedResult := int64(100)
-	receivedResult, receivedError := conn.CountClaimedOneTimeCodes()
+	receivedResult, receivedError := conn.CountClaimedOneTimeCodes(context.Background())
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
 }
 
+func TestDBCountRecentClaimFailures(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(12)
+	mock.ExpectQuery("").WillReturnRows(rows)
+
+	receivedResult, receivedError := conn.CountRecentClaimFailures(context.Background(), time.Now().Add(-15 * time.Minute))
+
+	assert.Equal(t, 12, receivedResult)
+	assert.Nil(t, receivedError)
+}
+
 func TestDBCountDiagnosisKeys(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
 	defer db.Close()
@@ -597,7 +962,7 @@ func TestDBCountDiagnosisKeys(t *testing.T) {
 	mock.ExpectQuery("").WillReturnRows(rows)
 
 	expectedResult := int64(100)
-	receivedResult, receivedError := conn.CountDiagnosisKeys()
+	receivedResult, receivedError := conn.CountDiagnosisKeys(context.Background())
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
@@ -615,12 +980,29 @@ func TestDBCountUnclaimedOneTimeCodes(t *testing.T) {
 	mock.ExpectQuery("").WillReturnRows(rows)
 
 	expectedResult := int64(100)
-	receivedResult, receivedError := conn.CountUnclaimedOneTimeCodes()
+	receivedResult, receivedError := conn.CountUnclaimedOneTimeCodes(context.Background())
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
 }
 
+func TestOpenConfiguresPool(t *testing.T) {
+	oldMaxOpen := config.AppConstants.DBMaxOpenConns
+	oldMaxIdle := config.AppConstants.DBMaxIdleConns
+	defer func() {
+		config.AppConstants.DBMaxOpenConns = oldMaxOpen
+		config.AppConstants.DBMaxIdleConns = oldMaxIdle
+	}()
+	config.AppConstants.DBMaxOpenConns = 7
+	config.AppConstants.DBMaxIdleConns = 3
+
+	// Opening doesn't connect, so no database is needed
+	db := open("covid:secret@tcp(127.0.0.1:3306)/covid")
+	defer db.Close()
+
+	assert.Equal(t, 7, db.Stats().MaxOpenConnections, "Expected the configured max open connections")
+}
+
 func assertLog(t *testing.T, hook *test.Hook, length int, level logrus.Level, msg string) {
 	assert.Equal(t, length, len(hook.Entries))
 	assert.Equal(t, level, hook.LastEntry().Level)
@@ -0,0 +1,46 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect covers the SQL syntax that differs between the databases we can
+// build queries for. Only the queries that have been ported use it so far;
+// everything else is still written for MySQL.
+type Dialect interface {
+	// Placeholder is the bind parameter for the nth (1-based) argument.
+	Placeholder(n int) string
+	// Ago is an expression for the time amount units before now, where unit
+	// is one of MINUTE, HOUR or DAY.
+	Ago(amount uint32, unit string) string
+}
+
+// MySQLDialect is the dialect the server has always used.
+type MySQLDialect struct{}
+
+// Placeholder implements Dialect.
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// Ago implements Dialect.
+func (MySQLDialect) Ago(amount uint32, unit string) string {
+	return fmt.Sprintf("(NOW() - INTERVAL %d %s)", amount, unit)
+}
+
+// PostgresDialect numbers its placeholders and quotes intervals.
+type PostgresDialect struct{}
+
+// Placeholder implements Dialect.
+func (PostgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// Ago implements Dialect.
+func (PostgresDialect) Ago(amount uint32, unit string) string {
+	return fmt.Sprintf("(NOW() - INTERVAL '%d %s')", amount, strings.ToLower(unit))
+}
+
+// dialect is the Dialect queries are built with.
+var dialect Dialect = MySQLDialect{}
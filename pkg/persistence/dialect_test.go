@@ -0,0 +1,56 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Collapse whitespace so queries can be compared regardless of indentation.
+func normalizeSQL(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func TestDialects(t *testing.T) {
+	assert.Equal(t, "?", MySQLDialect{}.Placeholder(3))
+	assert.Equal(t, "(NOW() - INTERVAL 15 DAY)", MySQLDialect{}.Ago(15, "DAY"))
+
+	assert.Equal(t, "$3", PostgresDialect{}.Placeholder(3))
+	assert.Equal(t, "(NOW() - INTERVAL '15 day')", PostgresDialect{}.Ago(15, "DAY"))
+
+	assert.Equal(t, MySQLDialect{}, dialect, "Expected MySQL to be the default dialect")
+}
+
+func TestPrivForPubQueryDialects(t *testing.T) {
+	days := config.AppConstants.EncryptionKeyValidityDays
+
+	expected := fmt.Sprintf("SELECT server_private_key FROM encryption_keys WHERE server_public_key = ? AND created > (NOW() - INTERVAL %d DAY) LIMIT 1", days)
+	assert.Equal(t, expected, normalizeSQL(privForPubQuery(MySQLDialect{})))
+
+	expected = fmt.Sprintf("SELECT server_private_key FROM encryption_keys WHERE server_public_key = $1 AND created > (NOW() - INTERVAL '%d day') LIMIT 1", days)
+	assert.Equal(t, expected, normalizeSQL(privForPubQuery(PostgresDialect{})))
+}
+
+func TestClaimKeyUpdateQueryDialects(t *testing.T) {
+	minutes := config.AppConstants.OneTimeCodeExpiryInMinutes
+
+	expected := fmt.Sprintf("UPDATE encryption_keys SET one_time_code = NULL, app_public_key = ?, created = ?, claimed_at = ?, claimed_code_hash = ? WHERE one_time_code = ? AND created > (NOW() - INTERVAL %d MINUTE)", minutes)
+	assert.Equal(t, expected, normalizeSQL(claimKeyUpdateQuery(MySQLDialect{})))
+
+	expected = fmt.Sprintf("UPDATE encryption_keys SET one_time_code = NULL, app_public_key = $1, created = $2, claimed_at = $3, claimed_code_hash = $4 WHERE one_time_code = $5 AND created > (NOW() - INTERVAL '%d minute')", minutes)
+	assert.Equal(t, expected, normalizeSQL(claimKeyUpdateQuery(PostgresDialect{})))
+}
+
+func TestOldEncryptionKeysWhereDialects(t *testing.T) {
+	where, args := oldEncryptionKeysWhere(MySQLDialect{})
+	assert.Equal(t, "(created < ?) OR ((created < ?) AND app_public_key IS NULL) OR remaining_keys = 0", normalizeSQL(where))
+	assert.Len(t, args, 2, "Expected an argument for each placeholder")
+
+	where, args = oldEncryptionKeysWhere(PostgresDialect{})
+	assert.Equal(t, "(created < $1) OR ((created < $2) AND app_public_key IS NULL) OR remaining_keys = 0", normalizeSQL(where))
+	assert.Len(t, args, 2, "Expected an argument for each placeholder")
+}
@@ -0,0 +1,51 @@
+package persistence
+
+import "errors"
+
+// ErrorCode classifies a PersistenceError, so callers can decide how to
+// respond to it without comparing error messages.
+type ErrorCode int
+
+const (
+	// CodeDBFailure is anything that went wrong talking to the database.
+	CodeDBFailure ErrorCode = iota
+	CodeDuplicateKey
+	CodeInvalidOneTimeCode
+	CodeInvalidKeyFormat
+)
+
+// PersistenceError is an error with a stable Code, optionally wrapping the
+// error that caused it. The sentinel errors (ErrDuplicateKey etc.) are
+// PersistenceErrors without a cause; errors.Is matches any PersistenceError
+// with the same Code against them.
+type PersistenceError struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func (e *PersistenceError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *PersistenceError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PersistenceError) Is(target error) bool {
+	t, ok := target.(*PersistenceError)
+	return ok && t.Err == nil && t.Code == e.Code
+}
+
+// ErrorCodeOf returns the Code of the first PersistenceError in err's chain.
+// Any other (non-nil) error is a database failure.
+func ErrorCodeOf(err error) ErrorCode {
+	var perr *PersistenceError
+	if errors.As(err, &perr) {
+		return perr.Code
+	}
+	return CodeDBFailure
+}
@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistenceErrorIs(t *testing.T) {
+	assert.True(t, errors.Is(ErrDuplicateKey, ErrDuplicateKey), "Expected sentinel to match itself")
+	assert.False(t, errors.Is(ErrDuplicateKey, ErrInvalidOneTimeCode), "Expected sentinels with different codes not to match")
+
+	wrapped := fmt.Errorf("claiming key: %w", ErrInvalidOneTimeCode)
+	assert.True(t, errors.Is(wrapped, ErrInvalidOneTimeCode), "Expected wrapped sentinel to match")
+
+	cause := errors.New("Duplicate entry")
+	err := &PersistenceError{Code: CodeDuplicateKey, Message: "key is already registered", Err: cause}
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "Expected error with same code to match sentinel")
+	assert.True(t, errors.Is(err, cause), "Expected error to match its cause")
+	assert.False(t, errors.Is(ErrDuplicateKey, err), "Expected sentinel not to match an error with a cause")
+	assert.Equal(t, "key is already registered: Duplicate entry", err.Error())
+}
+
+func TestPersistenceErrorAs(t *testing.T) {
+	var perr *PersistenceError
+
+	wrapped := fmt.Errorf("claiming key: %w", ErrInvalidKeyFormat)
+	assert.True(t, errors.As(wrapped, &perr), "Expected wrapped error to be a PersistenceError")
+	assert.Equal(t, CodeInvalidKeyFormat, perr.Code)
+
+	assert.False(t, errors.As(errors.New("oops"), &perr), "Expected plain error not to be a PersistenceError")
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	assert.Equal(t, CodeDuplicateKey, ErrorCodeOf(ErrDuplicateKey))
+	assert.Equal(t, CodeInvalidOneTimeCode, ErrorCodeOf(fmt.Errorf("wrapped: %w", ErrInvalidOneTimeCode)))
+	assert.Equal(t, CodeDBFailure, ErrorCodeOf(errors.New("connection refused")))
+}
@@ -2,7 +2,6 @@ package persistence
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"time"
 
@@ -43,6 +42,20 @@ func translateToken(token string) string {
 	return region
 }
 
+// Name recorded for originators whose token doesn't map to a name.
+const unknownOriginator = "unknown"
+
+// Like translateToken, but a token that doesn't map to a name (or still maps
+// to "302") becomes unknownOriginator rather than being returned as is, so
+// the result is safe to store or use as a config key.
+func originatorName(token string) string {
+	region, ok := originatorLookup.Authenticate(token)
+	if region == "302" || ok == false {
+		return unknownOriginator
+	}
+	return region
+}
+
 func translateTokenForLogs(token string) string {
 	region, ok := originatorLookup.Authenticate(token)
 
@@ -118,7 +131,7 @@ func (et EventType) IsValid() error {
 	return fmt.Errorf("invalid EventType: (%s)", et)
 }
 
-func saveEvent(db *sql.DB, e Event) error {
+func saveEvent(db txBeginner, e Event) error {
 	if err := e.DeviceType.IsValid(); err != nil {
 		return err
 	}
@@ -129,7 +142,7 @@ func saveEvent(db *sql.DB, e Event) error {
 
 	originator := translateToken(e.Originator)
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(context.Background(), nil)
 	if err != nil {
 		return err
 	}
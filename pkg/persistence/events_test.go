@@ -68,6 +68,21 @@ func Test_translateTokenForLogs(t *testing.T) {
 
 }
 
+func Test_originatorName(t *testing.T) {
+
+	token3 := strings.Repeat("c",20)
+
+	originator := originatorName(token1)
+	assert.Equal(t, onApi, originator)
+
+	originator = originatorName(token2)
+	assert.Equal(t, unknownOriginator, originator)
+
+	originator = originatorName(token3)
+	assert.Equal(t, unknownOriginator, originator)
+
+}
+
 func setupSaveEventMock(mock sqlmock.Sqlmock, event Event){
 	mock.ExpectBegin()
 	mock.ExpectExec(
@@ -0,0 +1,100 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// ExportFeedFull and ExportFeedDelta are the feeds FetchKeysForExport can
+// build. A full feed has every key in the window; a delta feed skips keys
+// that have already been included in an export.
+const (
+	ExportFeedFull  = "full"
+	ExportFeedDelta = "delta"
+)
+
+// ExportBacklog returns the number of diagnosis keys for a region that haven't
+// yet been included in any served export.
+func (c *conn) ExportBacklog(ctx context.Context, region string) (int, error) {
+	return exportBacklog(ctx, c.db, region)
+}
+
+// MarkKeysExported records the keys for a region that retrieval now serves,
+// i.e. those submitted before today and outside RetrievalHourLag, as
+// exported. It's run in batches by the expiration worker rather than on each
+// retrieval.
+func (c *conn) MarkKeysExported(ctx context.Context, region string) (int64, error) {
+	endHour := clampEndHour(timemath.HourNumberAtStartOfDate(timemath.DateNumber(clock.Now())))
+	return markKeysExported(ctx, c.db, region, endHour)
+}
+
+// FetchKeysForExport returns the keys FetchKeysForHours would for the window,
+// as a full or delta feed, for export jobs publishing incremental exports. It
+// isn't used to serve clients: every client needs the full window, however
+// often it has been served. It reads from the primary so that keys marked by
+// MarkKeysExported are never left out of a delta by replica lag.
+func (c *conn) FetchKeysForExport(ctx context.Context, region string, startHour uint32, endHour uint32, currentRSIN int32, feed string) (keys []*pb.TemporaryExposureKey, err error) {
+	defer traceQuery(ctx, "FetchKeysForExport", logrus.Fields{"region": region, "feed": feed}, &err, region, startHour, endHour, currentRSIN, feed)()
+	rows, err := diagnosisKeysForExport(ctx, c.db, region, startHour, endHour, currentRSIN, config.AppConstants.MinTransmissionRiskLevel, feed)
+	if err != nil {
+		return nil, err
+	}
+	return handleKeysRows(rows)
+}
+
+func diagnosisKeysForExport(ctx context.Context, db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32, feed string) (*sql.Rows, error) {
+	region, err := normalizeRegion(region)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegionEnabled(region); err != nil {
+		return nil, err
+	}
+	if err := checkHourRange(startHour, endHour); err != nil {
+		return nil, err
+	}
+
+	regionClause := "region = ?"
+	switch feed {
+	case ExportFeedFull:
+	case ExportFeedDelta:
+		regionClause += " AND exported_at IS NULL"
+	default:
+		return nil, ErrInvalidExportFeed
+	}
+
+	query, args := diagnosisKeysQuery(regionClause, []interface{}{region}, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel)
+	return db.QueryContext(ctx, query, args...)
+}
+
+func exportBacklog(ctx context.Context, db *sql.DB, region string) (int, error) {
+	var count int
+
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM diagnosis_keys WHERE region = ? AND exported_at IS NULL", region)
+	if err := row.Scan(&count); err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+func markKeysExported(ctx context.Context, db *sql.DB, region string, endHour uint32) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE diagnosis_keys SET exported_at = NOW()
+		WHERE region = ?
+		AND hour_of_submission < ?
+		AND exported_at IS NULL`,
+		region, endHour,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
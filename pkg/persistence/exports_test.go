@@ -0,0 +1,120 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+func TestExportBacklog(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	endHour := uint32(444024)
+
+	countQuery := `SELECT COUNT(*) FROM diagnosis_keys WHERE region = ? AND exported_at IS NULL`
+	markQuery := `
+		UPDATE diagnosis_keys SET exported_at = NOW()
+		WHERE region = ?
+		AND hour_of_submission < ?
+		AND exported_at IS NULL`
+
+	// Returns error if query fails
+	mock.ExpectQuery(countQuery).WithArgs(region).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := exportBacklog(context.Background(), db, region)
+
+	assert.Equal(t, -1, receivedResult, "Expected -1 if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Backlog decreases after a publish
+	mock.ExpectQuery(countQuery).WithArgs(region).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectExec(markQuery).WithArgs(region, endHour).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery(countQuery).WithArgs(region).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	before, _ := exportBacklog(context.Background(), db, region)
+	marked, markErr := markKeysExported(context.Background(), db, region, endHour)
+	after, _ := exportBacklog(context.Background(), db, region)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(3), marked, "Expected three keys to be marked exported")
+	assert.Nil(t, markErr, "Expected nil if update ran")
+	assert.Equal(t, before-int(marked), after, "Expected the backlog to decrease by the keys exported")
+}
+
+func TestDiagnosisKeysForExport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	// One key in the window has already been exported, one hasn't
+	exported := []byte("exported")
+	fresh := []byte("fresh")
+
+	// Full feed includes already exported keys
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).
+		AddRow("302", exported, 2651450, 144, 4, 1, nil).
+		AddRow("302", fresh, 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region).WillReturnRows(rows)
+
+	full, _ := diagnosisKeysForExport(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, ExportFeedFull)
+	fullKeys, _ := handleKeysRows(full)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 2, len(fullKeys), "Expected every key in the window")
+
+	// Delta feed skips already exported keys
+	rows = sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).
+		AddRow("302", fresh, 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ? AND exported_at IS NULL
+		AND deleted_at IS NULL
+		ORDER BY key_data`).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region).WillReturnRows(rows)
+
+	delta, _ := diagnosisKeysForExport(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, ExportFeedDelta)
+	deltaKeys, _ := handleKeysRows(delta)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 1, len(deltaKeys), "Expected only keys not yet exported")
+	assert.Equal(t, fresh, deltaKeys[0].KeyData, "Expected only keys not yet exported")
+
+	// Refuses an unknown feed without querying
+	_, receivedErr := diagnosisKeysForExport(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, "partial")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrInvalidExportFeed, receivedErr, "Expected ErrInvalidExportFeed for an unknown feed")
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// redactArgs describes query bind values without revealing them. Most of what
+// we bind is key material or one time codes, so only the shape is logged.
+func redactArgs(args ...interface{}) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			redacted[i] = "NULL"
+		case []byte:
+			redacted[i] = fmt.Sprintf("[%d bytes]", len(v))
+		case string:
+			redacted[i] = fmt.Sprintf("[%d chars]", len(v))
+		default:
+			redacted[i] = fmt.Sprintf("[%T]", v)
+		}
+	}
+	return redacted
+}
+
+// traceQuery starts timing a query; call the returned func once it completes.
+// fields are logged alongside the timing (region, originator) and err, if not
+// nil, points at the caller's error result so the outcome can be logged too.
+//
+//	defer traceQuery(ctx, "FetchKeysForHours", logrus.Fields{"region": region}, &err, region)()
+func traceQuery(ctx context.Context, operation string, fields logrus.Fields, err *error, args ...interface{}) func() {
+	start := time.Now()
+	return func() {
+		duration := time.Since(start)
+		logSlowQuery(ctx, operation, duration, args...)
+
+		var queryErr error
+		if err != nil {
+			queryErr = *err
+		}
+		logQuery(ctx, operation, duration, fields, queryErr)
+	}
+}
+
+// logQuery emits a debug entry for every traced query, for per query latency
+// dashboards. Bind values are never included; see logSlowQuery for those.
+func logQuery(ctx context.Context, operation string, duration time.Duration, fields logrus.Fields, err error) {
+	entry := log(ctx, err).WithFields(fields).WithFields(logrus.Fields{
+		"operation":   operation,
+		"duration_ms": duration.Milliseconds(),
+	})
+	if err != nil {
+		entry.Debug("query failed")
+		return
+	}
+	entry.Debug("query completed")
+}
+
+// withTimedTransaction runs fn in a transaction, committing if it returns nil
+// and rolling back otherwise, and records how long it all took in the named
+// histogram, labelled with the outcome. Slow transactions are logged under
+// the histogram's name.
+func withTimedTransaction(ctx context.Context, db txBeginner, name string, fn func(tx *sql.Tx) error) (err error) {
+	start := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		elapsed := time.Since(start)
+		logSlowQuery(ctx, name, elapsed)
+		duration := float64(elapsed) / float64(time.Millisecond)
+		metrics.Observe(ctx, name, duration, kv.String("outcome", outcome))
+	}()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func logSlowQuery(ctx context.Context, name string, duration time.Duration, args ...interface{}) {
+	threshold := time.Duration(config.AppConstants.SlowQueryThresholdMs) * time.Millisecond
+	if threshold <= 0 || duration < threshold {
+		return
+	}
+
+	log(ctx, nil).WithFields(logrus.Fields{
+		"query":       name,
+		"duration_ms": duration.Milliseconds(),
+		"args":        redactArgs(args...),
+	}).Warn("slow query")
+}
@@ -0,0 +1,177 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Shopify/goose/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestRedactArgs(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+
+	expected := []string{"[32 bytes]", "[10 chars]", "[uint32]", "NULL"}
+	assert.Equal(t, expected, redactArgs(pub[:], "AAABBBCCCC", uint32(5), nil))
+}
+
+func TestLogSlowQuery(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldThreshold := config.AppConstants.SlowQueryThresholdMs
+	defer func() { config.AppConstants.SlowQueryThresholdMs = oldThreshold }()
+	config.AppConstants.SlowQueryThresholdMs = 100
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+
+	// Doesn't log queries under the threshold
+	logSlowQuery(context.Background(), "ClaimKey", 50*time.Millisecond, "AAABBBCCCC", pub[:])
+
+	assert.Equal(t, 0, len(hook.Entries), "Expected no log for a fast query")
+
+	// Logs slow queries without their bind values
+	logSlowQuery(context.Background(), "ClaimKey", 150*time.Millisecond, "AAABBBCCCC", pub[:])
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "ClaimKey", entry.Data["query"])
+	assert.Equal(t, int64(150), entry.Data["duration_ms"])
+
+	logged := fmt.Sprint(entry.Data)
+	assert.False(t, strings.Contains(logged, "AAABBBCCCC"), "Expected the one time code to be redacted")
+	assert.False(t, strings.Contains(logged, hex.EncodeToString(pub[:])), "Expected key bytes to be redacted")
+	assert.False(t, strings.Contains(logged, fmt.Sprint(pub[:])), "Expected key bytes to be redacted")
+	assertLog(t, hook, 1, logrus.WarnLevel, "slow query")
+
+	// Doesn't log anything if disabled
+	config.AppConstants.SlowQueryThresholdMs = 0
+
+	logSlowQuery(context.Background(), "ClaimKey", time.Hour, "AAABBBCCCC", pub[:])
+
+	assert.Equal(t, 0, len(hook.Entries), "Expected no log if slow query logging is disabled")
+}
+
+func TestTraceQuery(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+	nullLog.SetLevel(logrus.DebugLevel)
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		entry := logrus.NewEntry(nullLog)
+		if len(err) > 0 && err[0] != nil {
+			entry = entry.WithError(err[0])
+		}
+		return entry
+	}
+
+	oldThreshold := config.AppConstants.SlowQueryThresholdMs
+	defer func() { config.AppConstants.SlowQueryThresholdMs = oldThreshold }()
+	config.AppConstants.SlowQueryThresholdMs = 0
+
+	// Successful queries are logged at debug with their fields and duration
+	var err error
+	traceQuery(context.Background(), "FetchKeysForHours", logrus.Fields{"region": "302", "originator": "ON"}, &err, "302")()
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "FetchKeysForHours", entry.Data["operation"])
+	assert.Equal(t, "302", entry.Data["region"])
+	assert.Equal(t, "ON", entry.Data["originator"])
+	assert.Contains(t, entry.Data, "duration_ms", "Expected the query duration to be logged")
+	assert.IsType(t, int64(0), entry.Data["duration_ms"])
+	assertLog(t, hook, 1, logrus.DebugLevel, "query completed")
+
+	// Failures are logged with their error
+	err = fmt.Errorf("error")
+	traceQuery(context.Background(), "FetchKeysForHours", logrus.Fields{"region": "302"}, &err)()
+
+	entry = hook.LastEntry()
+	assert.Equal(t, err, entry.Data[logrus.ErrorKey])
+	assert.Contains(t, entry.Data, "duration_ms", "Expected the query duration to be logged")
+	assertLog(t, hook, 1, logrus.DebugLevel, "query failed")
+
+	// Without an error pointer the query is logged as completed
+	traceQuery(context.Background(), "ClaimKeys", nil, nil)()
+
+	assert.Contains(t, hook.LastEntry().Data, "duration_ms", "Expected the query duration to be logged")
+	assertLog(t, hook, 1, logrus.DebugLevel, "query completed")
+}
+
+func TestSlowQueryLogged(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldThreshold := config.AppConstants.SlowQueryThresholdMs
+	defer func() { config.AppConstants.SlowQueryThresholdMs = oldThreshold }()
+	config.AppConstants.SlowQueryThresholdMs = 10
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	// A traced query slower than the threshold
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery("").WillReturnRows(rows).WillDelayFor(20 * time.Millisecond)
+
+	conn.FetchKeysForHours(context.Background(), "302", 100, 200, 2651450)
+
+	assert.Equal(t, "FetchKeysForHours", hook.LastEntry().Data["query"])
+	assertLog(t, hook, 1, logrus.WarnLevel, "slow query")
+
+	// A timed transaction slower than the threshold
+	mock.ExpectBegin().WillDelayFor(20 * time.Millisecond)
+	mock.ExpectCommit()
+
+	withTimedTransaction(context.Background(), db, claimKeyDuration, func(tx *sql.Tx) error { return nil })
+
+	assert.Equal(t, claimKeyDuration, hook.LastEntry().Data["query"])
+	assertLog(t, hook, 1, logrus.WarnLevel, "slow query")
+
+	// Nothing is logged while disabled
+	config.AppConstants.SlowQueryThresholdMs = 0
+
+	mock.ExpectBegin().WillDelayFor(20 * time.Millisecond)
+	mock.ExpectCommit()
+
+	withTimedTransaction(context.Background(), db, claimKeyDuration, func(tx *sql.Tx) error { return nil })
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 0, len(hook.Entries), "Expected no log if slow query logging is disabled")
+}
@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/metric"
+	"go.opentelemetry.io/otel/api/unit"
+)
+
+// Counters for the outcome of claimKey.
+const (
+	claimKeySuccess   = "claim_key_success"
+	claimKeyDuplicate = "claim_key_duplicate"
+	claimKeyInvalid   = "claim_key_invalid"
+	claimKeyExpired   = "claim_key_expired"
+	claimKeyDBError   = "claim_key_db_error"
+)
+
+// Counts successful claims of one time codes that had expired but were still
+// within OneTimeCodeGraceMinutes.
+const claimKeyGrace = "claim_key_grace"
+
+// Histograms of how long transactional functions take, in milliseconds.
+const (
+	claimKeyDuration             = "claim_key_duration"
+	persistEncryptionKeyDuration = "persist_encryption_key_duration"
+)
+
+// metricsSink receives counter increments and histogram observations. It's a
+// variable so tests can record what was counted.
+type metricsSink interface {
+	Increment(ctx context.Context, name string, labels ...kv.KeyValue)
+	Observe(ctx context.Context, name string, value float64, labels ...kv.KeyValue)
+}
+
+var metrics metricsSink = &otelSink{
+	counters:  map[string]metric.Int64Counter{},
+	recorders: map[string]metric.Float64ValueRecorder{},
+}
+
+// otelSink reports each name as a covidshield.app.<name> counter or value
+// recorder.
+type otelSink struct {
+	mu        sync.Mutex
+	counters  map[string]metric.Int64Counter
+	recorders map[string]metric.Float64ValueRecorder
+}
+
+func (s *otelSink) Increment(ctx context.Context, name string, labels ...kv.KeyValue) {
+	s.mu.Lock()
+	counter, ok := s.counters[name]
+	if !ok {
+		counter = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.app." + name)
+		s.counters[name] = counter
+	}
+	s.mu.Unlock()
+
+	counter.Add(ctx, 1, labels...)
+}
+
+func (s *otelSink) Observe(ctx context.Context, name string, value float64, labels ...kv.KeyValue) {
+	s.mu.Lock()
+	recorder, ok := s.recorders[name]
+	if !ok {
+		recorder = metric.Must(global.Meter("covidshield")).NewFloat64ValueRecorder("covidshield.app."+name, metric.WithUnit(unit.Milliseconds))
+		s.recorders[name] = recorder
+	}
+	s.mu.Unlock()
+
+	recorder.Record(ctx, value, labels...)
+}
+
+func countClaimKeyOutcome(ctx context.Context, err error, region string) {
+	var name string
+	switch err {
+	case nil:
+		name = claimKeySuccess
+	case ErrDuplicateKey:
+		name = claimKeyDuplicate
+	case ErrInvalidOneTimeCode:
+		name = claimKeyInvalid
+	case ErrExpiredKey:
+		name = claimKeyExpired
+	default:
+		name = claimKeyDBError
+	}
+
+	var labels []kv.KeyValue
+	if region != "" {
+		labels = append(labels, kv.String("region", region))
+	}
+	metrics.Increment(ctx, name, labels...)
+}
@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/api/kv"
+	"golang.org/x/crypto/nacl/box"
+)
+
+type fakeSink struct {
+	names        []string
+	labels       [][]kv.KeyValue
+	observations []observation
+}
+
+func (f *fakeSink) Increment(ctx context.Context, name string, labels ...kv.KeyValue) {
+	f.names = append(f.names, name)
+	f.labels = append(f.labels, labels)
+}
+
+func (f *fakeSink) Observe(ctx context.Context, name string, value float64, labels ...kv.KeyValue) {
+	f.observations = append(f.observations, observation{name: name, value: value, labels: labels})
+}
+
+type observation struct {
+	name   string
+	value  float64
+	labels []kv.KeyValue
+}
+
+func TestClaimKeyOutcomeMetrics(t *testing.T) {
+	oldMetrics := metrics
+	defer func() { metrics = oldMetrics }()
+	sink := &fakeSink{}
+	metrics = sink
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	// Database error
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	assert.Equal(t, claimKeyDBError, sink.names[0], "Expected claim_key_db_error if the query failed")
+	assert.Empty(t, sink.labels[0], "Expected no region before the one time code is found")
+
+	// Duplicate key
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+	claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	assert.Equal(t, claimKeyDuplicate, sink.names[1], "Expected claim_key_duplicate if the key exists")
+
+	// Invalid one time code
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	setupSelectOneTimeCode(mock, oneTimeCode, time.Unix(3600, 0), pub[:])
+	mock.ExpectRollback()
+	claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	assert.Equal(t, claimKeyInvalid, sink.names[2], "Expected claim_key_invalid if the code is invalid")
+	assert.Equal(t, []kv.KeyValue{kv.String("region", "302")}, sink.labels[2], "Expected the region label once the code is found")
+
+	// Success
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	setupSelectOneTimeCode(mock, oneTimeCode, time.Now(), pub[:])
+	query := fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
+	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	assert.Equal(t, claimKeySuccess, sink.names[3], "Expected claim_key_success if the claim succeeded")
+	assert.Equal(t, []kv.KeyValue{kv.String("region", "302")}, sink.labels[3], "Expected the region label on success")
+}
+
+func TestWithTimedTransaction(t *testing.T) {
+	oldMetrics := metrics
+	defer func() { metrics = oldMetrics }()
+	sink := &fakeSink{}
+	metrics = sink
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	// Success commits and is observed as a success
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM events`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	receivedErr := withTimedTransaction(context.Background(), db, claimKeyDuration, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM events`)
+		return err
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if the transaction ran")
+	assert.Len(t, sink.observations, 1, "Expected one observation per transaction")
+	assert.Equal(t, claimKeyDuration, sink.observations[0].name)
+	assert.GreaterOrEqual(t, sink.observations[0].value, float64(0), "Expected a duration to be observed")
+	assert.Equal(t, []kv.KeyValue{kv.String("outcome", "success")}, sink.observations[0].labels)
+
+	// Failure rolls back and is observed as a failure
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	receivedErr = withTimedTransaction(context.Background(), db, persistEncryptionKeyDuration, func(tx *sql.Tx) error {
+		return fmt.Errorf("error")
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected the error from the transaction")
+	assert.Len(t, sink.observations, 2, "Expected one observation per transaction")
+	assert.Equal(t, persistEncryptionKeyDuration, sink.observations[1].name)
+	assert.Equal(t, []kv.KeyValue{kv.String("outcome", "failure")}, sink.observations[1].labels)
+
+	// Failing to begin is still observed
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("error"))
+
+	receivedErr = withTimedTransaction(context.Background(), db, claimKeyDuration, func(tx *sql.Tx) error {
+		return nil
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the transaction could not begin")
+	assert.Len(t, sink.observations, 3, "Expected one observation per transaction")
+	assert.Equal(t, []kv.KeyValue{kv.String("outcome", "failure")}, sink.observations[2].labels)
+}
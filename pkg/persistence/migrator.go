@@ -107,6 +107,87 @@ CREATE TABLE IF NOT EXISTS events (
 	UNIQUE KEY identifier_type_date (source, identifier,device_type,date)
 )`,
 		},
+	}, {
+		id: "8",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS claim_events (
+	ip_hash         CHAR(64)        NOT NULL,
+	claimed         TIMESTAMP       NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX (ip_hash),
+	INDEX (claimed)
+)`,
+		},
+	}, {
+		id: "9",
+		statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN exported_at TIMESTAMP NULL DEFAULT NULL`,
+			`ALTER TABLE diagnosis_keys ADD INDEX (region, exported_at)`,
+		},
+	}, {
+		id: "10",
+		statements: []string{
+			`ALTER TABLE encryption_keys ADD COLUMN claimed_at TIMESTAMP NULL DEFAULT NULL`,
+		},
+	}, {
+		id: "11",
+		statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL`,
+			`ALTER TABLE diagnosis_keys ADD INDEX (deleted_at)`,
+		},
+	}, {
+		id: "12",
+		statements: []string{
+			`ALTER TABLE encryption_keys MODIFY one_time_code VARCHAR(32)`,
+		},
+	}, {
+		id: "13",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS used_upload_nonces (
+	app_public_key  BINARY(32)      NOT NULL,
+	nonce           BINARY(24)      NOT NULL,
+	created         TIMESTAMP       NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE INDEX (app_public_key, nonce),
+	INDEX (created)
+)`,
+		},
+	}, {
+		id: "14",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS hash_id_key_claims (
+	hash_id         VARCHAR(128)    NOT NULL,
+	created         TIMESTAMP       NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX (hash_id, created),
+	INDEX (created)
+)`,
+		},
+	}, {
+		id: "15",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS originator_upload_stats (
+	originator      VARCHAR(64)     NOT NULL,
+	date            DATE            NOT NULL,
+	count           INT             UNSIGNED NOT NULL DEFAULT 0,
+	PRIMARY KEY (originator, date),
+	INDEX (date)
+)`,
+		},
+	}, {
+		id: "16",
+		statements: []string{
+			// Keys stored before clients sent a report type were all confirmed by a test
+			`ALTER TABLE diagnosis_keys ADD COLUMN report_type TINYINT UNSIGNED NOT NULL DEFAULT 1`,
+		},
+	}, {
+		id: "17",
+		statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN days_since_onset_of_symptoms TINYINT`,
+		},
+	}, {
+		id: "18",
+		statements: []string{
+			`ALTER TABLE encryption_keys ADD COLUMN claimed_code_hash CHAR(64) NULL DEFAULT NULL`,
+			`ALTER TABLE encryption_keys ADD INDEX (claimed_code_hash)`,
+		},
 	},
 }
 
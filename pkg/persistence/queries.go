@@ -2,41 +2,174 @@ package persistence
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/api/kv"
+	"golang.org/x/crypto/nacl/box"
 )
 
-func deleteOldDiagnosisKeys(db *sql.DB) (int64, error) {
-	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
-	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
+// CleanupOptions control how the old key cleanup routines run. With DryRun
+// set they only count the rows they would have deleted.
+type CleanupOptions struct {
+	DryRun bool
+}
+
+// Delete (or, in a dry run, count) the rows in table matching where.
+func purge(ctx context.Context, db *sql.DB, table, where string, opts CleanupOptions, args ...interface{}) (int64, error) {
+	if opts.DryRun {
+		var count int64
+		if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, table, where), args...).Scan(&count); err != nil {
+			return 0, err
+		}
+		return count, nil
+	}
+
+	res, err := db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s`, table, where), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Like purge, but deletes at most DiagnosisKeyDeleteChunkSize rows per
+// statement, repeating until nothing matches, so locks are released between
+// chunks and live queries can get in.
+func purgeInChunks(ctx context.Context, db *sql.DB, table, where string, opts CleanupOptions, args ...interface{}) (int64, error) {
+	chunkSize := config.AppConstants.DiagnosisKeyDeleteChunkSize
+	if opts.DryRun || chunkSize <= 0 {
+		return purge(ctx, db, table, where, opts, args...)
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s LIMIT ?`, table, where)
+	args = append(args, chunkSize)
+
+	var deleted int64
+	for {
+		res, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		if n == 0 {
+			return deleted, nil
+		}
+		deleted += n
+	}
+}
+
+func deleteOldDiagnosisKeys(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	oldestHour := oldestRetainedHour(config.AppConstants.MaxDiagnosisKeyRetentionDays)
+
+	remove := purgeInChunks
+	if config.AppConstants.SoftDeleteDiagnosisKeys {
+		remove = softDeleteDiagnosisKeys
+	}
+
+	if len(config.AppConstants.RegionRetentionDays) == 0 {
+		return remove(ctx, db, "diagnosis_keys", `hour_of_submission < ?`, opts, oldestHour)
+	}
+
+	// Regions with their own retention are purged individually, and everything
+	// else falls back to MaxDiagnosisKeyRetentionDays.
+	regions := make([]string, 0, len(config.AppConstants.RegionRetentionDays))
+	for region := range config.AppConstants.RegionRetentionDays {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	var deleted int64
+	for _, region := range regions {
+		regionOldestHour := oldestRetainedHour(config.AppConstants.RegionRetentionDays[region])
+
+		n, err := remove(ctx, db, "diagnosis_keys", `region = ? AND hour_of_submission < ?`, opts, region, regionOldestHour)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	args := make([]interface{}, 0, len(regions)+1)
+	for _, region := range regions {
+		args = append(args, region)
+	}
+	args = append(args, oldestHour)
+
+	n, err := remove(ctx, db, "diagnosis_keys",
+		fmt.Sprintf(
+			`region NOT IN (%s) AND hour_of_submission < ?`,
+			strings.TrimSuffix(strings.Repeat("?, ", len(regions)), ", "),
+		),
+		opts, args...,
+	)
+	if err != nil {
+		return deleted, err
+	}
+	return deleted + n, nil
+}
+
+// Remove every diagnosis key for a region straight away, regardless of
+// retention, e.g. when the region leaves the program.
+func deleteDiagnosisKeysForRegion(ctx context.Context, db *sql.DB, region string) (int64, error) {
+	res, err := db.ExecContext(ctx, `DELETE FROM diagnosis_keys WHERE region = ?`, region)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Mark rows as deleted rather than removing them, so they drop out of exports
+// but can still be audited or restored until purgeSoftDeletedDiagnosisKeys.
+func softDeleteDiagnosisKeys(ctx context.Context, db *sql.DB, table, where string, opts CleanupOptions, args ...interface{}) (int64, error) {
+	where += " AND deleted_at IS NULL"
+	if opts.DryRun {
+		return purge(ctx, db, table, where, opts, args...)
+	}
 
-	res, err := db.Exec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`, oldestHour)
+	res, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET deleted_at = NOW() WHERE %s`, table, where), args...)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
+// Hard delete diagnosis keys that were soft deleted more than olderThan ago.
+func purgeSoftDeletedDiagnosisKeys(ctx context.Context, db *sql.DB, olderThan time.Duration, opts CleanupOptions) (int64, error) {
+	return purge(ctx, db, "diagnosis_keys", "deleted_at IS NOT NULL AND deleted_at < (NOW() - INTERVAL ? SECOND)", opts, int64(olderThan.Seconds()))
+}
+
+func oldestRetainedHour(retentionDays uint32) uint32 {
+	oldestDateNumber := timemath.DateNumber(clock.Now()) - retentionDays
+	return timemath.HourNumberAtStartOfDate(oldestDateNumber)
+}
+
 type CountByOriginator struct {
 	Originator string
 	Count int
 }
 
-func countOldEncryptionKeysByOriginator(db *sql.DB) ([]CountByOriginator, error) {
+func countOldEncryptionKeysByOriginator(ctx context.Context, db *sql.DB) ([]CountByOriginator, error) {
+	where, args := oldEncryptionKeysWhere(dialect)
 
-	rows, err := db.Query(fmt.Sprintf(`
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
 			SELECT originator, count(*) FROM encryption_keys
-			WHERE  (created < (NOW() - INTERVAL %d DAY))
-			OR    ((created < (NOW() - INTERVAL %d MINUTE)) AND app_public_key IS NULL)
-			OR    remaining_keys = 0
-			GROUP BY encryption_keys.originator `, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes))
+			WHERE %s
+			GROUP BY encryption_keys.originator `, where), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -62,304 +195,1164 @@ func countOldEncryptionKeysByOriginator(db *sql.DB) ([]CountByOriginator, error)
 }
 
 // Delete anything past our data retention threshold, AND any timed-out KeyClaims.
-func deleteOldEncryptionKeys(db *sql.DB) (int64, error) {
-	res, err := db.Exec(
-		fmt.Sprintf(`
-			DELETE FROM encryption_keys
-			WHERE  (created < (NOW() - INTERVAL %d DAY))
-			OR    ((created < (NOW() - INTERVAL %d MINUTE)) AND app_public_key IS NULL)
+// A dry run counts with the same statements. No row matches more than one of
+// them, so the counts add up to what would be deleted.
+func deleteOldEncryptionKeys(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	var deleted int64
+	for _, part := range []func(context.Context, *sql.DB, CleanupOptions) (int64, error){
+		deleteExpiredUnclaimedCodes,
+		deleteExpiredEncryptionKeys,
+		deleteUsedUpEncryptionKeys,
+	} {
+		n, err := part(ctx, db, opts)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Codes that expired without being claimed.
+func deleteExpiredUnclaimedCodes(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	codesValidFrom := clock.Now().Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute)
+	where := fmt.Sprintf(`app_public_key IS NULL AND created < %s`, dialect.Placeholder(1))
+	return purge(ctx, db, "encryption_keys", where, opts, codesValidFrom)
+}
+
+// Keypairs past their validity, claimed or not, other than the expired codes
+// deleteExpiredUnclaimedCodes covers.
+func deleteExpiredEncryptionKeys(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	now := clock.Now()
+	validFrom := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+	codesValidFrom := now.Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute)
+	where := fmt.Sprintf(`created < %s AND (app_public_key IS NOT NULL OR created >= %s)`, dialect.Placeholder(1), dialect.Placeholder(2))
+	return purge(ctx, db, "encryption_keys", where, opts, validFrom, codesValidFrom)
+}
+
+// Keypairs that have used up their uploads, other than those the two above
+// cover.
+func deleteUsedUpEncryptionKeys(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	now := clock.Now()
+	validFrom := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+	codesValidFrom := now.Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute)
+	where := fmt.Sprintf(`remaining_keys = 0 AND created >= %s AND (app_public_key IS NOT NULL OR created >= %s)`, dialect.Placeholder(1), dialect.Placeholder(2))
+	return purge(ctx, db, "encryption_keys", where, opts, validFrom, codesValidFrom)
+}
+
+// Keypairs past their validity, codes that expired without being claimed, and
+// keypairs that have used up their uploads: everything deleteOldEncryptionKeys
+// removes, as a single condition. The placeholders are the first two of the
+// query it's used in.
+func oldEncryptionKeysWhere(d Dialect) (string, []interface{}) {
+	now := clock.Now()
+	validFrom := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+	codesValidFrom := now.Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute)
+
+	return fmt.Sprintf(`
+			      (created < %s)
+			OR    ((created < %s) AND app_public_key IS NULL)
 			OR    remaining_keys = 0
-		`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes),
-	)
+		`, d.Placeholder(1), d.Placeholder(2)), []interface{}{validFrom, codesValidFrom}
+}
+
+// Lower remaining_keys on any keypair issued before the upload allowance was
+// reduced so it can't upload more than a newly issued keypair could. Each
+// originator is held to its own allowance (see initialRemainingKeys).
+func clampRemainingKeysToOriginatorLimit(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT originator FROM encryption_keys WHERE remaining_keys > 0`)
 	if err != nil {
 		return 0, err
 	}
-	return res.RowsAffected()
+	var originators []string
+	for rows.Next() {
+		var originator string
+		if err := rows.Scan(&originator); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		originators = append(originators, originator)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var clamped int64
+	for _, originator := range originators {
+		limit := initialRemainingKeys(originator)
+		if opts.DryRun {
+			var n int64
+			if err := db.QueryRowContext(ctx,
+				`SELECT COUNT(*) FROM encryption_keys WHERE originator = ? AND remaining_keys > ?`,
+				originator, limit,
+			).Scan(&n); err != nil {
+				return clamped, err
+			}
+			clamped += n
+			continue
+		}
+
+		res, err := db.ExecContext(ctx,
+			`UPDATE encryption_keys SET remaining_keys = ? WHERE originator = ? AND remaining_keys > ?`,
+			limit, originator, limit,
+		)
+		if err != nil {
+			return clamped, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return clamped, err
+		}
+		clamped += n
+	}
+	return clamped, nil
 }
 
-func claimKey(db *sql.DB, oneTimeCode string, appPublicKey []byte, ctx context.Context) ([]byte, error) {
-	tx, err := db.Begin()
+func claimKey(ctx context.Context, db txBeginner, oneTimeCode string, appPublicKey []byte) (serverPub []byte, err error) {
+	// claimKeyInTx would refuse it too, but don't open a transaction for it
+	if len(appPublicKey) != pb.KeyLength {
+		return nil, ErrInvalidKeyFormat
+	}
+
+	// region is only known once the one time code has been looked up
+	var claimed claimedKey
+	defer func() { countClaimKeyOutcome(ctx, err, claimed.region) }()
+
+	err = retryOnDeadlock(ctx, func() error {
+		return withTimedTransaction(ctx, db, claimKeyDuration, func(tx *sql.Tx) error {
+			var itemErr, err error
+			claimed, itemErr, err = claimKeyInTx(ctx, tx, oneTimeCode, appPublicKey)
+			if err != nil {
+				return err
+			}
+			return itemErr
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	recordClaim(ctx, db, claimed)
+	return claimed.serverPub, nil
+}
+
+// claimedKey is what claimKeyInTx learns about a one time code's row.
+// region is set as soon as the code is found, even if the claim is refused.
+type claimedKey struct {
+	serverPub  []byte
+	originator string
+	region     string
+	// whether the code had expired and was only accepted thanks to the grace window
+	inGrace bool
+}
+
+// claimKeyInTx claims a single one time code for appPublicKey inside tx, for
+// both ClaimKey and ClaimKeys. itemErr reports why the pair was refused and is
+// always decided before anything is written, so a batch can carry on past it;
+// err is only set if the transaction can't continue.
+func claimKeyInTx(ctx context.Context, tx *sql.Tx, oneTimeCode string, appPublicKey []byte) (claimed claimedKey, itemErr error, err error) {
+	// nacl/box keys are always 32 bytes; don't store anything else
+	if len(appPublicKey) != pb.KeyLength {
+		return claimed, ErrInvalidKeyFormat, nil
+	}
+
 	var exists int
-	if err := tx.QueryRow("SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?", appPublicKey).Scan(&exists); err != nil {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
-		}
-		return nil, err
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?", appPublicKey).Scan(&exists); err != nil {
+		return claimed, nil, err
 	}
 	if exists == 1 {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
-		}
-		return nil, ErrDuplicateKey
+		return claimed, ErrDuplicateKey, nil
 	}
 
 	var created time.Time
+	row := tx.QueryRowContext(ctx, "SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?", oneTimeCode)
+	if err := row.Scan(&created, &claimed.originator, &claimed.region, &claimed.serverPub); err == sql.ErrNoRows {
+		return claimed, ErrInvalidOneTimeCode, nil
+	} else if err != nil {
+		return claimed, nil, err
+	}
 
-	// we need to capture originator so that we can log it later when capturing this event
-	var originator string
+	issued := created
+	created = timemath.MostRecentMidnightIn(created, config.AppConstants.KeyDateLocation)
+	if created.Unix() == int64(0) {
+		return claimed, ErrInvalidOneTimeCode, nil
+	}
+
+	if config.AppConstants.EnforceKeyValidityOnClaim && serverKeyIsStale(issued) {
+		return claimed, ErrExpiredKey, nil
+	}
+	claimed.inGrace = claimedInGrace(issued)
+
+	// A server key issued before the current rotation window may already be
+	// gone from the active set, so hand out a fresh keypair instead and start
+	// the row's validity over from today. With validity enforced this only
+	// happens when rounding created down to midnight crosses the window edge.
+	rotate := serverKeyIsStale(created)
+	if rotate {
+		created = timemath.MostRecentMidnightIn(clock.Now(), config.AppConstants.KeyDateLocation)
+	} else if len(claimed.serverPub) != pb.KeyLength {
+		return claimed, ErrInvalidKeyFormat, nil
+	}
 
-	row := tx.QueryRow("SELECT created, originator FROM encryption_keys WHERE one_time_code = ?", oneTimeCode)
-	if err := row.Scan(&created, &originator); err != nil {
+	res, err := tx.ExecContext(ctx, claimKeyUpdateQuery(dialect), appPublicKey, created, clock.Now(), hashOneTimeCode(oneTimeCode), oneTimeCode)
+	if err != nil {
+		return claimed, nil, err
+	}
 
-		fmt.Println(err)
+	n, err := res.RowsAffected()
+	if err != nil {
+		return claimed, nil, err
+	}
+	if n != 1 {
+		return claimed, ErrInvalidOneTimeCode, nil
+	}
+
+	if rotate {
+		if claimed.serverPub, err = rotateServerKey(ctx, tx, appPublicKey); err != nil {
+			return claimed, nil, err
+		}
+	}
+
+	return claimed, nil, nil
+}
+
+// Record a committed claim. Only called once the transaction has committed,
+// so a retried or rolled back transaction can't log a claim that never happened.
+func recordClaim(ctx context.Context, db txBeginner, claimed claimedKey) {
+	event := Event{Originator: claimed.originator, DeviceType: Server, Identifier: OTKClaimed, Count: 1, Date: clock.Now()}
+	if err := saveEvent(db, event); err != nil {
+		LogEvent(ctx, err, event)
+	}
+
+	if claimed.inGrace {
+		metrics.Increment(ctx, claimKeyGrace, kv.String("region", claimed.region))
+		log(ctx, nil).WithField("region", claimed.region).Warn("claimed one time code within grace window")
+	}
+}
+
+// Attach the app's key to the row for an unexpired one time code. Binds the
+// app public key, the new created date, the claim time, the hash of the one
+// time code and the one time code itself. Codes are accepted for OneTimeCodeGraceMinutes past their expiry.
+func claimKeyUpdateQuery(d Dialect) string {
+	return fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = %s,
+			created = %s,
+			claimed_at = %s,
+			claimed_code_hash = %s
+		WHERE one_time_code = %s
+		AND created > %s`,
+		d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4), d.Placeholder(5),
+		d.Ago(config.AppConstants.OneTimeCodeExpiryInMinutes+config.AppConstants.OneTimeCodeGraceMinutes, "MINUTE"),
+	)
+}
+
+// Whether a one time code issued at issued had already expired, so could
+// only be claimed because of OneTimeCodeGraceMinutes.
+func claimedInGrace(issued time.Time) bool {
+	if config.AppConstants.OneTimeCodeGraceMinutes == 0 {
+		return false
+	}
+	expiredAt := issued.Add(time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute)
+	return !clock.Now().Before(expiredAt)
+}
+
+// Whether a server keypair created at created falls outside the window
+// activeServerPublicKeys considers current.
+func serverKeyIsStale(created time.Time) bool {
+	validFrom := clock.Now().Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+	return !created.After(validFrom)
+}
+
+// Replace the server keypair of the row claimed by appPublicKey, returning
+// the new server public key.
+func rotateServerKey(ctx context.Context, tx *sql.Tx, appPublicKey []byte) ([]byte, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE encryption_keys
+		SET server_private_key = ?,
+			server_public_key = ?
+		WHERE app_public_key = ?`,
+		priv[:], pub[:], appPublicKey,
+	); err != nil {
+		return nil, err
+	}
+	return pub[:], nil
+}
+
+// Give unclaimed rows whose server key expires within withinDays a new
+// keypair, restarting their validity from today, so a code claimed near the
+// end of its key's life doesn't hand back a key that's about to expire.
+func rotateExpiringServerKeys(ctx context.Context, db *sql.DB, withinDays int) (rotated int, err error) {
+	now := clock.Now()
+	validity := time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour
+	validFrom := now.Add(-validity)
+	expiringFrom := validFrom.Add(time.Duration(withinDays) * 24 * time.Hour)
+	created := timemath.MostRecentMidnightIn(now, config.AppConstants.KeyDateLocation)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT one_time_code FROM encryption_keys
+		WHERE app_public_key IS NULL
+		AND one_time_code IS NOT NULL
+		AND created > ?
+		AND created <= ?
+		FOR UPDATE`,
+		validFrom, expiringFrom,
+	)
+	if err != nil {
 		if err := tx.Rollback(); err != nil {
-			return nil, err
+			return 0, err
 		}
-		return nil, ErrInvalidOneTimeCode
+		return 0, err
 	}
-	created = timemath.MostRecentUTCMidnight(created)
 
-	if created.Unix() == int64(0) {
+	var oneTimeCodes []string
+	for rows.Next() {
+		var oneTimeCode string
+		if err := rows.Scan(&oneTimeCode); err != nil {
+			rows.Close()
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, err
+		}
+		oneTimeCodes = append(oneTimeCodes, oneTimeCode)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		if err := tx.Rollback(); err != nil {
-			return nil, err
+			return 0, err
 		}
-		return nil, ErrInvalidOneTimeCode
+		return 0, err
 	}
 
-	s, err := tx.Prepare(
-		fmt.Sprintf(
+	for _, oneTimeCode := range oneTimeCodes {
+		pub, priv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, err
+		}
+
+		if _, err := tx.ExecContext(ctx,
 			`UPDATE encryption_keys
-			SET one_time_code = NULL,
-				app_public_key = ?,
+			SET server_private_key = ?,
+				server_public_key = ?,
 				created = ?
-			WHERE one_time_code = ?
-			AND created > (NOW() - INTERVAL %d MINUTE)`,
-			config.AppConstants.OneTimeCodeExpiryInMinutes,
-		),
-	)
-	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
+			WHERE one_time_code = ?`,
+			priv[:], pub[:], created, oneTimeCode,
+		); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, err
 		}
-		return nil, err
 	}
 
-	res, err := s.Exec(appPublicKey, created, oneTimeCode)
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(oneTimeCodes), nil
+}
+
+// The upload allowance for a new keypair. Overrides are keyed by the
+// lowercased name the originator's token maps to (viper lowercases map keys),
+// never by the token itself.
+func initialRemainingKeys(originator string) uint32 {
+	if len(config.AppConstants.OriginatorRemainingKeys) == 0 {
+		return config.AppConstants.InitialRemainingKeys
+	}
+	if remainingKeys, ok := config.AppConstants.OriginatorRemainingKeys[strings.ToLower(originatorName(originator))]; ok {
+		return remainingKeys
+	}
+	return config.AppConstants.InitialRemainingKeys
+}
+
+// PersistResult describes a newly persisted keypair. ReplacedExisting is set
+// when an unclaimed code already issued for the same hashID was deleted to
+// make way for this one, i.e. the code is being re-issued.
+type PersistResult struct {
+	OneTimeCode      string
+	ReplacedExisting bool
+}
+
+func persistEncryptionKey(ctx context.Context, db txBeginner, region, originator string, pub *[32]byte, priv *[32]byte, oneTimeCode string) (PersistResult, error) {
+	region, err := normalizeRegion(region)
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
+		return PersistResult{}, err
+	}
+
+	err = withTimedTransaction(ctx, db, persistEncryptionKeyDuration, func(tx *sql.Tx) error {
+		if err := enforceRegionCodeCap(ctx, tx, region); err != nil {
+			return err
 		}
-		return nil, err
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO encryption_keys
+				(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+			region, originator, priv[:], pub[:], oneTimeCode, initialRemainingKeys(originator),
+		)
+		return err
+	})
+	if isDuplicateOneTimeCode(err) {
+		return PersistResult{}, ErrDuplicateOneTimeCode
+	} else if err != nil {
+		return PersistResult{}, err
 	}
+	return PersistResult{OneTimeCode: oneTimeCode}, nil
+}
 
-	n, err := res.RowsAffected()
+func persistEncryptionKeyWithHashID(ctx context.Context, db *sql.DB, region, originator, hashID string, pub *[32]byte, priv *[32]byte, oneTimeCode string) (PersistResult, error) {
+	region, err := normalizeRegion(region)
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
+		return PersistResult{}, err
+	}
+
+	err = withTimedTransaction(ctx, db, persistEncryptionKeyDuration, func(tx *sql.Tx) error {
+		if err := enforceRegionCodeCap(ctx, tx, region); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO encryption_keys
+				(region, originator, hash_id, server_private_key, server_public_key, one_time_code, remaining_keys)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			region, originator, hashID, priv[:], pub[:], oneTimeCode, initialRemainingKeys(originator),
+		)
+		return err
+	})
+	if err == nil {
+		return PersistResult{OneTimeCode: oneTimeCode}, nil
+	} else if isDuplicateOneTimeCode(err) { // OTC duplicate, re-run
+		return PersistResult{}, ErrDuplicateOneTimeCode
+	} else if strings.Contains(err.Error(), "for key 'hash_id") { // HashID duplicate
+		var oneTimeCode sql.NullString
+		row := db.QueryRowContext(ctx, "SELECT one_time_code FROM encryption_keys WHERE hash_id = ?", hashID)
+		row.Scan(&oneTimeCode)
+
+		if oneTimeCode.Valid { // unused hashID found
+			_, err = db.ExecContext(ctx, `DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`, hashID)
+			if err != nil {
+				return PersistResult{}, err
+			}
+			return PersistResult{ReplacedExisting: true}, errors.New("regenerate OTC for hashID")
 		}
+		return PersistResult{}, errors.New("used hashID found")
+	}
+	return PersistResult{}, err
+}
+
+func privForPub(ctx context.Context, db *sql.DB, pub []byte) *sql.Row {
+	return db.QueryRowContext(ctx, privForPubQuery(dialect), pub)
+}
+
+func privForPubQuery(d Dialect) string {
+	return fmt.Sprintf(`
+		SELECT server_private_key FROM encryption_keys
+			WHERE server_public_key = %s
+			AND created > %s
+			LIMIT 1`,
+		d.Placeholder(1),
+		d.Ago(config.AppConstants.EncryptionKeyValidityDays, "DAY"),
+	)
+}
+
+// Like privForPub, but scanned into the array nacl/box wants. Returns
+// ErrKeyNotFound if there is no valid keypair for pub.
+func serverPrivateKeyForPub(ctx context.Context, db *sql.DB, pub []byte) (*[32]byte, error) {
+	var priv []byte
+	if err := privForPub(ctx, db, pub).Scan(&priv); err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
-	if n != 1 {
-		if err := tx.Rollback(); err != nil {
-			return nil, err
+	if len(priv) != pb.KeyLength {
+		return nil, ErrInvalidKeyFormat
+	}
+
+	var key [32]byte
+	copy(key[:], priv)
+	return &key, nil
+}
+
+// Look up which region and originator issued the keypair an app public key
+// was claimed against. Returns ErrKeyNotFound if it hasn't been claimed.
+func regionAndOriginatorForPub(ctx context.Context, db queryRower, appPublicKey []byte) (region, originator string, err error) {
+	var nullableOriginator sql.NullString
+	err = db.QueryRowContext(ctx,
+		"SELECT region, originator FROM encryption_keys WHERE app_public_key = ?",
+		appPublicKey,
+	).Scan(&region, &nullableOriginator)
+	if err == sql.ErrNoRows {
+		return "", "", ErrKeyNotFound
+	} else if err != nil {
+		return "", "", err
+	}
+	return region, nullableOriginator.String, nil
+}
+
+// An empty EnabledRegions serves every region.
+func checkRegionEnabled(region string) error {
+	if len(config.AppConstants.EnabledRegions) == 0 {
+		return nil
+	}
+	for _, enabled := range config.AppConstants.EnabledRegions {
+		if region == enabled {
+			return nil
 		}
-		return nil, ErrInvalidOneTimeCode
 	}
+	return ErrRegionNotEnabled
+}
 
-	s, err = tx.Prepare(
-		`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`,
-	)
+// A MaxRetrievalRangeHours of 0 allows any range.
+func checkHourRange(startHour, endHour uint32) error {
+	maxHours := config.AppConstants.MaxRetrievalRangeHours
+	if maxHours > 0 && endHour > startHour && endHour-startHour > maxHours {
+		return ErrRangeTooWide
+	}
+	return nil
+}
 
+// Return keys that were SUBMITTED to the Diagnosis Server during the specified
+// UTC date.
+//
+// Only return keys that correspond to a Key valid for a date less than 14 days ago.
+func diagnosisKeysForHours(ctx context.Context, db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) (*sql.Rows, error) {
+	region, err := normalizeRegion(region)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegionEnabled(region); err != nil {
+		return nil, err
+	}
+	if err := checkHourRange(startHour, endHour); err != nil {
+		return nil, err
+	}
+	query, args := diagnosisKeysForHoursQuery(region, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel)
+	return db.QueryContext(ctx, query, args...)
+}
+
+// Read the keys diagnosisKeysForHours would return, pageSize at a time in
+// key_data order. Each page follows on from the last key_data seen rather than
+// an offset, and every page is read from one read-only REPEATABLE READ
+// transaction, so keys submitted or deleted while paging are neither skipped
+// nor served twice. The first page is read before returning so that a failing
+// query is reported before the caller writes anything.
+func diagnosisKeyPagesForHours(ctx context.Context, db txBeginner, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32, pageSize int) (*keyPages, error) {
+	region, err := normalizeRegion(region)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegionEnabled(region); err != nil {
+		return nil, err
+	}
+	if err := checkHourRange(startHour, endHour); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	pages := &keyPages{
+		ctx:                               ctx,
+		tx:                                tx,
+		region:                            region,
+		startHour:                         startHour,
+		endHour:                           endHour,
+		currentRollingStartIntervalNumber: currentRollingStartIntervalNumber,
+		minTransmissionRiskLevel:          minTransmissionRiskLevel,
+		pageSize:                          pageSize,
+	}
+
+	pages.first, err = pages.read()
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
 			return nil, err
 		}
 		return nil, err
 	}
+	return pages, nil
+}
 
-	row = s.QueryRow(appPublicKey)
+// keyPages is the KeyPages returned by diagnosisKeyPagesForHours.
+type keyPages struct {
+	ctx                               context.Context
+	tx                                *sql.Tx
+	region                            string
+	startHour                         uint32
+	endHour                           uint32
+	currentRollingStartIntervalNumber int32
+	minTransmissionRiskLevel          int32
+	pageSize                          int
+
+	first []*pb.TemporaryExposureKey
+	after []byte
+	done  bool
+}
 
-	event := Event{Originator: originator, DeviceType: Server, Identifier: OTKClaimed, Count: 1, Date: time.Now()}
-	if err := saveEvent(db, event); err != nil {
-		LogEvent(ctx, err, event)
+func (p *keyPages) Next() ([]*pb.TemporaryExposureKey, error) {
+	if p.first != nil {
+		keys := p.first
+		p.first = nil
+		return keys, nil
+	}
+	if p.done {
+		return nil, nil
 	}
+	return p.read()
+}
 
-	var serverPub []byte
-	if err := row.Scan(&serverPub); err != nil {
-		if err := tx.Rollback(); err != nil {
+// Nothing is written while paging, so the transaction is just rolled back.
+func (p *keyPages) Close() error {
+	if err := p.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
+
+func (p *keyPages) read() ([]*pb.TemporaryExposureKey, error) {
+	regionClause := "region = ?"
+	regionArgs := []interface{}{p.region}
+	if p.after != nil {
+		regionClause += " AND key_data > ?"
+		regionArgs = append(regionArgs, p.after)
+	}
+
+	query, args := diagnosisKeysQueryOrderedBy(regionClause, regionArgs, p.startHour, p.endHour, p.currentRollingStartIntervalNumber, p.minTransmissionRiskLevel, "key_data")
+	rows, err := p.tx.QueryContext(p.ctx, query+"LIMIT ?", append(args, p.pageSize)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys, err := handleKeysRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) < p.pageSize {
+		p.done = true
+	}
+	if len(keys) > 0 {
+		p.after = keys[len(keys)-1].GetKeyData()
+	}
+	return keys, nil
+}
+
+func diagnosisKeysForHoursQuery(region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) (string, []interface{}) {
+	return diagnosisKeysQuery("region = ?", []interface{}{region}, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel)
+}
+
+// Like diagnosisKeysForHours, but for several regions in one query. Every row
+// carries its region so callers can split the result back up.
+func diagnosisKeysForHoursMultiRegion(ctx context.Context, db *sql.DB, regions []string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) (*sql.Rows, error) {
+	if len(regions) == 0 {
+		return nil, ErrInvalidRegion
+	}
+	for _, region := range regions {
+		if err := checkRegionEnabled(region); err != nil {
 			return nil, err
 		}
+	}
+	if err := checkHourRange(startHour, endHour); err != nil {
 		return nil, err
 	}
+	query, args := diagnosisKeysForHoursMultiRegionQuery(regions, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel)
+	return db.QueryContext(ctx, query, args...)
+}
 
-	if err = tx.Commit(); err != nil {
+func diagnosisKeysForHoursMultiRegionQuery(regions []string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) (string, []interface{}) {
+	regionArgs := make([]interface{}, 0, len(regions))
+	for _, region := range regions {
+		regionArgs = append(regionArgs, region)
+	}
+
+	regionClause := fmt.Sprintf(
+		"region IN (%s)",
+		strings.TrimSuffix(strings.Repeat("?, ", len(regions)), ", "),
+	)
+	return diagnosisKeysQuery(regionClause, regionArgs, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel)
+}
+
+// Like diagnosisKeysForHours, but ordered by a caller chosen column so test
+// fixtures can be fetched in a predictable order. orderBy must be one of
+// orderByColumns; empty means key_data.
+func diagnosisKeysForHoursOrdered(ctx context.Context, db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, orderBy string) (*sql.Rows, error) {
+	region, err := normalizeRegion(region)
+	if err != nil {
 		return nil, err
 	}
-	return serverPub, nil
+
+	if err := checkRegionEnabled(region); err != nil {
+		return nil, err
+	}
+	if err := checkHourRange(startHour, endHour); err != nil {
+		return nil, err
+	}
+
+	if orderBy == "" {
+		orderBy = "key_data"
+	}
+	orderByClause, ok := orderByColumns[orderBy]
+	if !ok {
+		return nil, ErrInvalidOrderBy
+	}
+
+	query, args := diagnosisKeysQueryOrderedBy("region = ?", []interface{}{region}, startHour, endHour, currentRollingStartIntervalNumber, 0, orderByClause)
+	return db.QueryContext(ctx, query, args...)
+}
+
+// Columns diagnosis keys may be ordered by, and the ORDER BY each one uses.
+// Ties are broken by key_data so the order is always the same.
+var orderByColumns = map[string]string{
+	"key_data":                      "key_data",
+	"rolling_start_interval_number": "rolling_start_interval_number, key_data",
+}
+
+func diagnosisKeysQuery(regionClause string, regionArgs []interface{}, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) (string, []interface{}) {
+	// don't implicitly order by insertion date: for privacy. Random ordering is
+	// applied when the export is built.
+	orderBy := "key_data"
+	if config.AppConstants.ExportKeyOrder == config.ExportKeyOrderSubmission {
+		orderBy = "hour_of_submission, key_data"
+	}
+
+	return diagnosisKeysQueryOrderedBy(regionClause, regionArgs, startHour, endHour, currentRollingStartIntervalNumber, minTransmissionRiskLevel, orderBy)
+}
+
+// Return the keys submitted in or after sinceHour, along with the latest
+// hour_of_submission among them so incremental syncs can advance their cursor.
+// The cursor stays at sinceHour when there are no keys. Keys can still arrive
+// for the latest hour, so clients should resume from the cursor itself and
+// expect to see that hour's keys again. Hours diagnosisKeysForHours wouldn't
+// serve yet (see clampEndHour) are held back here too.
+func diagnosisKeysSince(ctx context.Context, db *sql.DB, region string, sinceHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32) ([]*pb.TemporaryExposureKey, uint32, error) {
+	region, err := normalizeRegion(region)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := checkRegionEnabled(region); err != nil {
+		return nil, 0, err
+	}
+
+	endHour := clampEndHour(timemath.HourNumber(clock.Now()) + 1)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+	args := []interface{}{sinceHour, endHour, minRollingStartIntervalNumber, region}
+
+	var extraClauses string
+	if minTransmissionRiskLevel > 0 {
+		extraClauses += " AND transmission_risk_level >= ?"
+		args = append(args, minTransmissionRiskLevel)
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		%s
+		ORDER BY key_data`, extraClauses), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var keys []*pb.TemporaryExposureKey
+	cursor := sinceHour
+	for rows.Next() {
+		var key []byte
+		var rollingStartIntervalNumber int32
+		var rollingPeriod int32
+		var transmissionRiskLevel int32
+		var reportType pb.TemporaryExposureKey_ReportType
+		var daysSinceOnsetOfSymptoms sql.NullInt32
+		var hourOfSubmission uint32
+		if err := rows.Scan(&key, &rollingStartIntervalNumber, &rollingPeriod, &transmissionRiskLevel, &reportType, &daysSinceOnsetOfSymptoms, &hourOfSubmission); err != nil {
+			return nil, 0, err
+		}
+		tek := &pb.TemporaryExposureKey{
+			KeyData:                    key,
+			RollingStartIntervalNumber: &rollingStartIntervalNumber,
+			RollingPeriod:              &rollingPeriod,
+			TransmissionRiskLevel:      &transmissionRiskLevel,
+			ReportType:                 &reportType,
+		}
+		if daysSinceOnsetOfSymptoms.Valid {
+			tek.DaysSinceOnsetOfSymptoms = &daysSinceOnsetOfSymptoms.Int32
+		}
+		keys = append(keys, tek)
+
+		if hourOfSubmission > cursor {
+			cursor = hourOfSubmission
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return keys, cursor, nil
+}
+
+// Pull endHour back to retrievalHourLag hours before the current one, so only
+// complete hours are served.
+func clampEndHour(endHour uint32) uint32 {
+	lag := config.AppConstants.RetrievalHourLag
+	if lag == 0 {
+		return endHour
+	}
+
+	currentHour := timemath.HourNumber(clock.Now())
+	if currentHour < lag {
+		return 0
+	}
+	if latest := currentHour - lag; endHour > latest {
+		return latest
+	}
+	return endHour
+}
+
+func diagnosisKeysQueryOrderedBy(regionClause string, regionArgs []interface{}, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32, minTransmissionRiskLevel int32, orderBy string) (string, []interface{}) {
+	endHour = clampEndHour(endHour)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+	args := append([]interface{}{startHour, endHour, minRollingStartIntervalNumber}, regionArgs...)
+
+	var extraClauses string
+	if minTransmissionRiskLevel > 0 {
+		extraClauses += " AND transmission_risk_level >= ?"
+		args = append(args, minTransmissionRiskLevel)
+	}
+
+	// Steer the optimizer if it picks the wrong index for this query under load
+	var indexHint string
+	if index := config.AppConstants.DiagnosisKeysForceIndex; index != "" && config.DiagnosisKeysIndexes[index] {
+		indexHint = fmt.Sprintf(" FORCE INDEX (%s)", index)
+	}
+
+	return fmt.Sprintf(`SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys%s
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND %s
+		AND deleted_at IS NULL
+		%s
+		ORDER BY %s
+		`, indexHint, regionClause, extraClauses, orderBy), args
+}
+
+// Keys we can't serve are skipped rather than stored.
+func validateKey(key *pb.TemporaryExposureKey) error {
+	if len(key.GetKeyData()) != pb.KeyDataLength {
+		return ErrInvalidKeyData
+	}
+	if err := validateRollingPeriod(key); err != nil {
+		return err
+	}
+	if key.GetRollingStartIntervalNumber() <= 0 {
+		return ErrInvalidRollingStartIntervalNumber
+	}
+	if key.GetRollingStartIntervalNumber() > timemath.CurrentIntervalNumber()+futureRollingStartTolerance {
+		return ErrFutureRollingStartIntervalNumber
+	}
+	if key.DaysSinceOnsetOfSymptoms != nil && (key.GetDaysSinceOnsetOfSymptoms() < -maxDaysSinceOnsetOfSymptoms || key.GetDaysSinceOnsetOfSymptoms() > maxDaysSinceOnsetOfSymptoms) {
+		return ErrInvalidDaysSinceOnsetOfSymptoms
+	}
+	return nil
+}
+
+// Exposure Notification only scores days_since_onset_of_symptoms of -14..14.
+const maxDaysSinceOnsetOfSymptoms = 14
+
+// How many 10 minute intervals past the current one a key may start. Allows
+// for devices whose clocks are a little fast without accepting tomorrow's key.
+const futureRollingStartTolerance = 12
+
+// Exposure Notification clients only accept a rolling_period of 1..144.
+func validateRollingPeriod(key *pb.TemporaryExposureKey) error {
+	if key.GetRollingPeriod() < 1 || key.GetRollingPeriod() > pb.MaxTEKRollingPeriod {
+		return ErrInvalidRollingPeriod
+	}
+	return nil
+}
+
+// MySQL's error numbers for a unique key violation, and for a transaction
+// that lost a deadlock or gave up waiting for a lock.
+const (
+	mysqlDuplicateEntry  = 1062
+	mysqlLockWaitTimeout = 1205
+	mysqlDeadlock        = 1213
+)
+
+// How many times retryOnDeadlock runs a function, and how long it waits
+// before the first retry. The wait doubles after each attempt.
+const deadlockAttempts = 3
+
+var deadlockRetryDelay = 50 * time.Millisecond
+
+// Run fn, running it again if it fails because of a deadlock or lock wait
+// timeout. MySQL has already rolled the transaction back in either case, so
+// it's safe to retry from the start. Any other error is returned straight away.
+func retryOnDeadlock(ctx context.Context, fn func() error) error {
+	delay := deadlockRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isLockError(err) || attempt == deadlockAttempts {
+			return err
+		}
+
+		log(ctx, err).WithField("attempt", attempt).Warn("retrying after lock error")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
 }
 
-func persistEncryptionKey(db *sql.DB, region, originator string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
-	_, err := db.Exec(
-		`INSERT INTO encryption_keys
-			(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-		region, originator, priv[:], pub[:], oneTimeCode, config.AppConstants.InitialRemainingKeys,
-	)
-	return err
+// Whether err is a unique key violation on one_time_code, i.e. another request
+// generated the same code first.
+func isDuplicateOneTimeCode(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry && strings.Contains(mysqlErr.Message, "one_time_code")
 }
 
-func persistEncryptionKeyWithHashID(db *sql.DB, region, originator, hashID string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
-	_, err := db.Exec(
-		`INSERT INTO encryption_keys
-			(region, originator, hash_id, server_private_key, server_public_key, one_time_code, remaining_keys)
-			VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		region, originator, hashID, priv[:], pub[:], oneTimeCode, config.AppConstants.InitialRemainingKeys,
-	)
-	if err == nil {
-		return err
-	} else if strings.Contains(err.Error(), "for key 'one_time_code") { // OTC duplicate, re-run
-		return err
-	} else if strings.Contains(err.Error(), "for key 'hash_id") { // HashID duplicate
-		var oneTimeCode sql.NullString
-		row := db.QueryRow("SELECT one_time_code FROM encryption_keys WHERE hash_id = ?", hashID)
-		row.Scan(&oneTimeCode)
+func isLockError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlDeadlock || mysqlErr.Number == mysqlLockWaitTimeout)
+}
 
-		if oneTimeCode.Valid { // unused hashID found
-			_, err = db.Exec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`, hashID)
-			if err != nil {
-				return err
-			}
-			return errors.New("regenerate OTC for hashID")
-		}
-		return errors.New("used hashID found")
+// Record the nonce an upload was encrypted with. The pair is unique, so an
+// upload that has been captured and sent again fails with ErrReplay.
+func checkAndRecordUploadNonce(ctx context.Context, tx *sql.Tx, appPublicKey, nonce []byte) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)", appPublicKey, nonce)
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrReplay
 	}
 	return err
 }
 
-func privForPub(db *sql.DB, pub []byte) *sql.Row {
-	return db.QueryRow(fmt.Sprintf(`
-		SELECT server_private_key FROM encryption_keys
-			WHERE server_public_key = ?
-			AND created > (NOW() - INTERVAL %d DAY)
-			LIMIT 1`,
-		config.AppConstants.EncryptionKeyValidityDays,
-	),
-		pub,
-	)
+// SkippedKey is a diagnosis key that was left out of a batch, and why.
+type SkippedKey struct {
+	KeyData []byte
+	Reason  error
 }
 
-// Return keys that were SUBMITTED to the Diagnosis Server during the specified
-// UTC date.
-//
-// Only return keys that correspond to a Key valid for a date less than 14 days ago.
-func diagnosisKeysForHours(db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32) (*sql.Rows, error) {
-	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
-
-	return db.Query(
-		`SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level FROM diagnosis_keys
-		WHERE hour_of_submission >= ?
-		AND hour_of_submission < ?
-		AND rolling_start_interval_number > ?
-		AND region = ?
-		ORDER BY key_data
-		`, // don't implicitly order by insertion date: for privacy
-		startHour, endHour, minRollingStartIntervalNumber, region,
-	)
+// StoreKeysResult is the outcome of storing a batch of diagnosis keys: how
+// many were inserted, how many had already been submitted, and which were
+// skipped as invalid.
+type StoreKeysResult struct {
+	Inserted   int64
+	Duplicates int64
+	Skipped    []SkippedKey
 }
 
-func registerDiagnosisKeys(db *sql.DB, appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) error {
-	tx, err := db.Begin()
+// Store a batch of diagnosis keys for a keypair in one transaction: record the
+// upload nonce, check the keypair still has an upload allowance and was
+// claimed recently enough, insert the valid keys, and take them off the
+// allowance. Nothing is stored if any step fails or the batch is too big.
+func storeKeys(ctx context.Context, db txBeginner, appPublicKey, nonce []byte, keys []*pb.TemporaryExposureKey, hourOfSubmission uint32) (StoreKeysResult, error) {
+	if len(appPublicKey) != pb.KeyLength {
+		return StoreKeysResult{}, ErrInvalidKeyFormat
+	}
+
+	if len(keys) > config.AppConstants.MaxKeysPerUpload {
+		return StoreKeysResult{}, ErrTooManyKeys
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return StoreKeysResult{}, err
 	}
 
 	var region string
 	var originator string
 	var remainingKeys int64
-	if err := tx.QueryRow("SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE", appPubKey[:]).Scan(&region, &originator, &remainingKeys); err != nil {
+	if err := tx.QueryRowContext(ctx, "SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE", appPublicKey).Scan(&region, &originator, &remainingKeys); err != nil {
 		if err := tx.Rollback(); err != nil {
-			return err
+			return StoreKeysResult{}, err
 		}
-		return err
+		return StoreKeysResult{}, err
+	}
+
+	if err := checkAndRecordUploadNonce(ctx, tx, appPublicKey, nonce); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return StoreKeysResult{}, err
+		}
+		return StoreKeysResult{}, err
 	}
 
 	if remainingKeys == 0 {
 		if err := tx.Rollback(); err != nil {
-			return err
+			return StoreKeysResult{}, err
 		}
-		return ErrKeyConsumed
+		return StoreKeysResult{}, ErrKeyConsumed
 	}
 
-	s, err := tx.Prepare(`
-		INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	)
+	// A keypair claimed before claimed_at was recorded is rejected
+	if limit := config.AppConstants.MaxClaimToUploadMinutes; limit > 0 {
+		claimedAfter := clock.Now().Add(-time.Duration(limit) * time.Minute)
+		var expired bool
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COALESCE(claimed_at < ?, TRUE) FROM encryption_keys WHERE app_public_key = ?",
+			claimedAfter, appPublicKey,
+		).Scan(&expired); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return StoreKeysResult{}, err
+			}
+			return StoreKeysResult{}, err
+		}
+
+		if expired {
+			if err := tx.Rollback(); err != nil {
+				return StoreKeysResult{}, err
+			}
+			return StoreKeysResult{}, ErrClaimExpiredForUpload
+		}
+	}
+
+	result, err := insertDiagnosisKeys(ctx, tx, region, originator, remainingKeys, appPublicKey, keys, hourOfSubmission)
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
-			return err
+			return StoreKeysResult{}, err
 		}
-		return err
+		return StoreKeysResult{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return StoreKeysResult{}, err
 	}
 
-	hourOfSubmission := timemath.HourNumber(time.Now())
+	return result, nil
+}
+
+// Insert the valid keys of a batch and decrement remaining_keys by the number
+// inserted. The caller holds the keypair's row lock and rolls back on error.
+func insertDiagnosisKeys(ctx context.Context, tx *sql.Tx, region, originator string, remainingKeys int64, appPublicKey []byte, keys []*pb.TemporaryExposureKey, hourOfSubmission uint32) (StoreKeysResult, error) {
+	var result StoreKeysResult
 
-	var keysInserted int64
+	region, err := normalizeRegion(region)
+	if err != nil {
+		return result, err
+	}
+
+	s, err := tx.PrepareContext(ctx, `
+		INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	)
+	if err != nil {
+		return result, err
+	}
 
 	for _, key := range keys {
-		result, err := s.Exec(region, originator, key.GetKeyData(), key.GetRollingStartIntervalNumber(), key.GetRollingPeriod(), key.GetTransmissionRiskLevel(), hourOfSubmission)
+		if err := validateKey(key); err != nil {
+			result.Skipped = append(result.Skipped, SkippedKey{KeyData: key.GetKeyData(), Reason: err})
+			continue
+		}
+
+		res, err := s.ExecContext(ctx, region, originator, key.GetKeyData(), key.GetRollingStartIntervalNumber(), key.GetRollingPeriod(), key.GetTransmissionRiskLevel(), key.GetReportType(), key.DaysSinceOnsetOfSymptoms, hourOfSubmission)
 		if err != nil {
-			if err := tx.Rollback(); err != nil {
-				return err
-			}
-			return err
+			return result, err
 		}
-		n, err := result.RowsAffected()
+		n, err := res.RowsAffected()
 		if err != nil {
-			if err := tx.Rollback(); err != nil {
-				return err
-			}
-			return err
+			return result, err
 		}
 
-		keysInserted += n
+		// INSERT IGNORE reports a key we already have as no rows affected, so
+		// a re-upload isn't an error
+		if n == 0 {
+			result.Duplicates++
+		}
+		result.Inserted += n
 	}
 
-	if remainingKeys < keysInserted {
-		if err := tx.Rollback(); err != nil {
-			return err
-		}
-		return ErrTooManyKeys
+	if remainingKeys < result.Inserted {
+		return result, ErrTooManyKeys
 	}
 
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		UPDATE encryption_keys
 		SET remaining_keys = remaining_keys - ?
 		WHERE remaining_keys >= ?
 		AND app_public_key = ?`,
-		keysInserted,
-		keysInserted,
-		appPubKey[:],
+		result.Inserted,
+		result.Inserted,
+		appPublicKey,
 	)
-
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return err
-		}
-		return ErrTooManyKeys
+		return result, ErrTooManyKeys
 	}
 
-	if err = tx.Commit(); err != nil {
-		return err
+	// Counted in the same transaction so the statistic matches what was stored
+	if result.Inserted > 0 {
+		if err := incrementOriginatorUploadCount(ctx, tx, originator, result.Inserted); err != nil {
+			return result, err
+		}
 	}
 
-	return nil
+	return result, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Add n keys to today's upload count for an originator. Only the name the
+// token maps to is stored, so bearer tokens never end up in the table.
+func incrementOriginatorUploadCount(ctx context.Context, db execer, originator string, n int64) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`,
+		originatorName(originator), clock.Now().UTC().Format("2006-01-02"), n, n,
+	)
+	return err
 }
 
 type queryRower interface {
-	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// txBeginner is all a query that does its work in a transaction needs from
+// *sql.DB, so tests can substitute a beginner that records or fails calls.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
 }
 
-func checkClaimKeyBan(db queryRower, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
+func checkClaimKeyBan(ctx context.Context, db queryRower, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
 	var failures uint16
 	var lastFailure time.Time
 	var maxConsecutiveClaimKeyFailures = config.AppConstants.MaxConsecutiveClaimKeyFailures
-	q := db.QueryRow(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
+	q := db.QueryRowContext(ctx, `SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
 	if err := q.Scan(&failures, &lastFailure); err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return maxConsecutiveClaimKeyFailures, 0, nil
@@ -384,18 +1377,18 @@ func checkClaimKeyBan(db queryRower, identifier string) (triesRemaining int, ban
 	return triesRemaining, banDuration, nil
 }
 
-func registerClaimKeySuccess(db *sql.DB, identifier string) error {
-	_, err := db.Exec(`DELETE FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
+func registerClaimKeySuccess(ctx context.Context, db *sql.DB, identifier string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
 	return err
 }
 
-func registerClaimKeyFailure(db *sql.DB, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
-	tx, err := db.Begin()
+func registerClaimKeyFailure(ctx context.Context, db *sql.DB, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	if _, err := tx.Exec(`
+	if _, err := tx.ExecContext(ctx, `
 		INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
 		ON DUPLICATE KEY UPDATE
       failures = failures + 1,
@@ -407,7 +1400,7 @@ func registerClaimKeyFailure(db *sql.DB, identifier string) (triesRemaining int,
 		return 0, 0, err
 	}
 
-	triesRemaining, banDuration, err = checkClaimKeyBan(tx, identifier)
+	triesRemaining, banDuration, err = checkClaimKeyBan(ctx, tx, identifier)
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
 			return 0, 0, err
@@ -421,20 +1414,59 @@ func registerClaimKeyFailure(db *sql.DB, identifier string) (triesRemaining int,
 	return triesRemaining, banDuration, nil
 }
 
-func deleteOldFailedClaimKeyAttempts(db *sql.DB) (int64, error) {
-	threshold := time.Now().Add(-(time.Duration(config.AppConstants.ClaimKeyBanDuration) * time.Hour))
+func deleteOldFailedClaimKeyAttempts(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	threshold := clock.Now().Add(-(time.Duration(config.AppConstants.ClaimKeyBanDuration) * time.Hour))
 
-	res, err := db.Exec(`DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`, threshold)
-	if err != nil {
-		return 0, err
+	return purge(ctx, db, "failed_key_claim_attempts", "last_failure < ?", opts, threshold)
+}
+
+// countRecentClaimFailures sums the failed claim attempts of every identifier
+// that has failed since since. failures is kept per identifier, so an
+// identifier that is still failing contributes its earlier attempts too.
+func countRecentClaimFailures(ctx context.Context, db *sql.DB, since time.Time) (int, error) {
+	var count int
+
+	row := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(failures), 0) FROM failed_key_claim_attempts WHERE last_failure >= ?`, since)
+	if err := row.Scan(&count); err != nil {
+		return -1, err
 	}
-	return res.RowsAffected()
+
+	return count, nil
+}
+
+// Uploads are rejected once their timestamp is an hour old, so a nonce only
+// needs to be remembered a little longer than that to stop replays.
+const uploadNonceRetention = 24 * time.Hour
+
+func deleteOldUploadNonces(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	threshold := clock.Now().Add(-uploadNonceRetention)
+
+	return purge(ctx, db, "used_upload_nonces", "created < ?", opts, threshold)
+}
+
+// How long a readiness check waits for the database before giving up.
+const pingTimeout = 2 * time.Second
+
+// Check that the database is reachable and can answer a trivial query.
+func ping(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database ping failed: %w", err)
+	}
+
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("database SELECT 1 failed: %w", err)
+	}
+	return nil
 }
 
-func countClaimedOneTimeCodes(db *sql.DB) (int64, error) {
+func countClaimedOneTimeCodes(ctx context.Context, db *sql.DB) (int64, error) {
 	var count int64
 
-	row := db.QueryRow("SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NULL")
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NULL")
 	err := row.Scan(&count)
 
 	if err != nil {
@@ -444,10 +1476,10 @@ func countClaimedOneTimeCodes(db *sql.DB) (int64, error) {
 	return count, err
 }
 
-func countDiagnosisKeys(db *sql.DB) (int64, error) {
+func countDiagnosisKeys(ctx context.Context, db *sql.DB) (int64, error) {
 	var count int64
 
-	row := db.QueryRow("SELECT COUNT(*) FROM diagnosis_keys")
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM diagnosis_keys WHERE deleted_at IS NULL")
 	err := row.Scan(&count)
 
 	if err != nil {
@@ -457,10 +1489,10 @@ func countDiagnosisKeys(db *sql.DB) (int64, error) {
 	return count, err
 }
 
-func countUnclaimedOneTimeCodes(db *sql.DB) (int64, error) {
+func countUnclaimedOneTimeCodes(ctx context.Context, db *sql.DB) (int64, error) {
 	var count int64
 
-	row := db.QueryRow("SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NOT NULL")
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NOT NULL")
 	err := row.Scan(&count)
 
 	if err != nil {
@@ -469,3 +1501,323 @@ func countUnclaimedOneTimeCodes(db *sql.DB) (int64, error) {
 
 	return count, err
 }
+
+// Revoke a one time code that hasn't been claimed yet by deleting its keypair.
+func expireOneTimeCode(ctx context.Context, db *sql.DB, oneTimeCode string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM encryption_keys WHERE one_time_code = ? AND app_public_key IS NULL", oneTimeCode)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCodeNotFound
+	}
+	return nil
+}
+
+// ClaimStatus is what OneTimeCodeStatus knows about a one time code.
+type ClaimStatus string
+
+const (
+	Unclaimed ClaimStatus = "unclaimed"
+	Claimed   ClaimStatus = "claimed"
+	Expired   ClaimStatus = "expired"
+	NotFound  ClaimStatus = "not_found"
+)
+
+// Claiming a code clears one_time_code so it can be issued again, and leaves
+// only its hash behind. A code that has been reissued since it was claimed
+// reports on the new, unclaimed copy.
+func oneTimeCodeStatus(ctx context.Context, db *sql.DB, originator, oneTimeCode string) (ClaimStatus, error) {
+	var created time.Time
+
+	row := db.QueryRowContext(ctx, "SELECT created FROM encryption_keys WHERE one_time_code = ? AND originator = ?", oneTimeCode, originator)
+	if err := row.Scan(&created); err == nil {
+		// Match the window claimKey accepts, grace included
+		window := time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes+config.AppConstants.OneTimeCodeGraceMinutes) * time.Minute
+		if !created.After(clock.Now().Add(-window)) {
+			return Expired, nil
+		}
+		return Unclaimed, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var claimed int
+	row = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryption_keys WHERE claimed_code_hash = ? AND originator = ?", hashOneTimeCode(oneTimeCode), originator)
+	if err := row.Scan(&claimed); err != nil {
+		return "", err
+	}
+	if claimed > 0 {
+		return Claimed, nil
+	}
+	return NotFound, nil
+}
+
+// A claimed code can't be used again, so a plain hash is enough to recognise
+// it without keeping the code itself.
+func hashOneTimeCode(oneTimeCode string) string {
+	sum := sha256.Sum256([]byte(oneTimeCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// Look up the server public key for a code that hasn't been claimed yet, so
+// support can hand it back to a user out of band.
+func serverPublicKeyForCode(ctx context.Context, db *sql.DB, oneTimeCode string) ([]byte, error) {
+	var serverPub []byte
+
+	row := db.QueryRowContext(ctx, "SELECT server_public_key FROM encryption_keys WHERE one_time_code = ? AND app_public_key IS NULL", oneTimeCode)
+	if err := row.Scan(&serverPub); err == sql.ErrNoRows {
+		return nil, ErrCodeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return serverPub, nil
+}
+
+// Look up the region a one time code was issued for, so a claim can be held
+// to that region's rules before the code is used up.
+func oneTimeCodeRegion(ctx context.Context, db *sql.DB, oneTimeCode string) (string, error) {
+	var region string
+
+	row := db.QueryRowContext(ctx, "SELECT region FROM encryption_keys WHERE one_time_code = ?", oneTimeCode)
+	if err := row.Scan(&region); err == sql.ErrNoRows {
+		return "", ErrCodeNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return region, nil
+}
+
+// countUnclaimedCodes counts the codes an originator has issued that are
+// still waiting to be claimed and have not yet expired.
+func countUnclaimedCodes(ctx context.Context, db *sql.DB, originator string) (int, error) {
+	var count int
+
+	row := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM encryption_keys WHERE originator = ? AND one_time_code IS NOT NULL AND created > (NOW() - INTERVAL ? MINUTE)",
+		originator, config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
+	if err := row.Scan(&count); err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+// Refuse to issue another one time code once a region has as many unclaimed
+// codes outstanding as it's configured to allow. The count locks the region's
+// unclaimed codes, so it has to run in the transaction that inserts the new
+// code: a concurrent request then waits for that insert and counts it.
+func enforceRegionCodeCap(ctx context.Context, tx queryRower, region string) error {
+	limit, ok := config.AppConstants.MaxActiveCodesPerRegion[region]
+	if !ok || limit <= 0 {
+		return nil
+	}
+
+	var count int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM encryption_keys WHERE region = ? AND one_time_code IS NOT NULL FOR UPDATE",
+		region,
+	).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrRegionCodeCapReached
+	}
+	return nil
+}
+
+// Record a code being generated for hashID, refusing with ErrHashIDRateLimited
+// once HashIDRateLimit codes have been generated for it within the window. The
+// count and insert share a transaction with the hashID's rows locked, so
+// concurrent requests can't both slip under the limit.
+func enforceHashIDRateLimit(ctx context.Context, db *sql.DB, hashID string) error {
+	limit := config.AppConstants.HashIDRateLimit
+	if limit <= 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM hash_id_key_claims WHERE hash_id = ? AND created > (NOW() - INTERVAL ? MINUTE) FOR UPDATE",
+		hashID, config.AppConstants.HashIDRateLimitWindowMinutes,
+	).Scan(&count); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+
+	if count >= limit {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return ErrHashIDRateLimited
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO hash_id_key_claims (hash_id) VALUES (?)", hashID); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteOldHashIDKeyClaims(ctx context.Context, db *sql.DB, opts CleanupOptions) (int64, error) {
+	return purge(ctx, db, "hash_id_key_claims", "created < (NOW() - INTERVAL ? MINUTE)", opts, config.AppConstants.HashIDRateLimitWindowMinutes)
+}
+
+// Count the one time codes in each region that are still waiting to be
+// claimed and haven't yet timed out.
+func activeEncryptionKeysByRegion(ctx context.Context, db *sql.DB) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT region, COUNT(*) FROM encryption_keys
+		WHERE one_time_code IS NOT NULL
+		AND   created >= (NOW() - INTERVAL %d MINUTE)
+		GROUP BY region`, config.AppConstants.OneTimeCodeExpiryInMinutes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var region string
+		var count int
+		if err := rows.Scan(&region, &count); err != nil {
+			return nil, err
+		}
+		counts[region] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// Server public keys of every keypair still within its validity period,
+// claimed or not, so rotation can be audited. A keypair exactly
+// EncryptionKeyValidityDays old is no longer valid.
+func activeServerPublicKeys(ctx context.Context, db *sql.DB) ([][]byte, error) {
+	validFrom := clock.Now().Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT server_public_key FROM encryption_keys
+		WHERE server_public_key IS NOT NULL
+		AND created > ?
+		ORDER BY created`,
+		validFrom,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// app_public_key is UNIQUE, so any result here means the constraint was
+// dropped or bypassed and a claim has gone wrong.
+func findDuplicateAppKeys(ctx context.Context, db *sql.DB) ([][]byte, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT app_public_key FROM encryption_keys
+		WHERE app_public_key IS NOT NULL
+		GROUP BY app_public_key
+		HAVING COUNT(*) > 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Claimed rows have had their one time code cleared, so malformed ones are
+// identified by their hex encoded server public key instead (empty if that is
+// what's missing).
+func findMalformedClaimedRows(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(HEX(server_public_key), '') FROM encryption_keys
+		WHERE one_time_code IS NULL
+		AND (app_public_key IS NULL OR server_public_key IS NULL OR server_private_key IS NULL)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// CorruptRow is an encryption_keys row whose server_public_key isn't the
+// public half of its server_private_key. Rows are identified by their hex
+// encoded server public key, as claimed rows no longer have a one time code.
+type CorruptRow struct {
+	ServerPublicKey string `json:"server_public_key"`
+	Region          string `json:"region"`
+	Claimed         bool   `json:"claimed"`
+}
+
+// Re-derive every server public key from its private key and report the rows
+// where the two don't match. Apps encrypt uploads to server_public_key, so a
+// corrupt row can never decrypt them.
+func verifyServerKeypairIntegrity(ctx context.Context, db *sql.DB) ([]CorruptRow, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT server_public_key, server_private_key, region, one_time_code IS NULL FROM encryption_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var corrupt []CorruptRow
+	for rows.Next() {
+		var pub, priv []byte
+		var row CorruptRow
+		if err := rows.Scan(&pub, &priv, &row.Region, &row.Claimed); err != nil {
+			return nil, err
+		}
+		if validKeypair(pub, priv) {
+			continue
+		}
+		row.ServerPublicKey = fmt.Sprintf("%X", pub)
+		corrupt = append(corrupt, row)
+	}
+
+	return corrupt, rows.Err()
+}
@@ -1,8 +1,11 @@
 package persistence
 
 import (
+	"context"
 	"crypto/rand"
+	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -11,6 +14,7 @@ import (
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/nacl/box"
 )
@@ -22,13 +26,219 @@ func TestDeleteOldDiagnosisKeys(t *testing.T) {
 	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
 	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
 
-	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`).WithArgs(oldestHour).WillReturnResult(sqlmock.NewResult(1, 1))
-	deleteOldDiagnosisKeys(db)
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? LIMIT ?`).WithArgs(oldestHour, config.AppConstants.DiagnosisKeyDeleteChunkSize).WillReturnResult(sqlmock.NewResult(1, 37))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? LIMIT ?`).WithArgs(oldestHour, config.AppConstants.DiagnosisKeyDeleteChunkSize).WillReturnResult(sqlmock.NewResult(0, 0))
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
+	assert.Equal(t, int64(37), receivedResult, "Expected the number of rows deleted")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
+}
+
+func TestDeleteOldDiagnosisKeysInChunks(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldChunkSize := config.AppConstants.DiagnosisKeyDeleteChunkSize
+	defer func() { config.AppConstants.DiagnosisKeyDeleteChunkSize = oldChunkSize }()
+	config.AppConstants.DiagnosisKeyDeleteChunkSize = 10
+
+	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
+	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
+	query := `DELETE FROM diagnosis_keys WHERE hour_of_submission < ? LIMIT ?`
+
+	// Deletes bounded chunks until nothing is left
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(23), receivedResult, "Expected the rows deleted by every chunk")
+	assert.Nil(t, receivedErr, "Expected nil if deletes ran")
+
+	// Returns the rows already deleted if a chunk fails
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(query).WithArgs(oldestHour, 10).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(10), receivedResult, "Expected the rows deleted before the failure")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if a chunk fails")
+}
+
+func TestDeleteOldDiagnosisKeysByRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldRetention := config.AppConstants.RegionRetentionDays
+	defer func() { config.AppConstants.RegionRetentionDays = oldRetention }()
+	config.AppConstants.RegionRetentionDays = map[string]uint32{"302": 15, "303": 10}
+
+	today := timemath.DateNumber(time.Now())
+	oldestHour302 := timemath.HourNumberAtStartOfDate(today - 15)
+	oldestHour303 := timemath.HourNumberAtStartOfDate(today - 10)
+	oldestHour := timemath.HourNumberAtStartOfDate(today - config.AppConstants.MaxDiagnosisKeyRetentionDays)
+
+	oldChunkSize := config.AppConstants.DiagnosisKeyDeleteChunkSize
+	defer func() { config.AppConstants.DiagnosisKeyDeleteChunkSize = oldChunkSize }()
+	config.AppConstants.DiagnosisKeyDeleteChunkSize = 0
+
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE region = ? AND hour_of_submission < ?`).WithArgs("302", oldestHour302).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE region = ? AND hour_of_submission < ?`).WithArgs("303", oldestHour303).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE region NOT IN (?, ?) AND hour_of_submission < ?`).WithArgs("302", "303", oldestHour).WillReturnResult(sqlmock.NewResult(0, 4))
+
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.NotEqual(t, oldestHour302, oldestHour303, "Expected each region to have its own bound")
+	assert.Equal(t, int64(9), receivedResult, "Expected the deletes from every region to be counted")
+	assert.Nil(t, receivedErr, "Expected nil if deletes ran")
+
+	// Stops at the first failed delete
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE region = ? AND hour_of_submission < ?`).WithArgs("302", oldestHour302).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(0), receivedResult, "Expected no rows to be deleted")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if delete fails")
+}
+
+func TestSoftDeleteOldDiagnosisKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldSoftDelete := config.AppConstants.SoftDeleteDiagnosisKeys
+	defer func() { config.AppConstants.SoftDeleteDiagnosisKeys = oldSoftDelete }()
+	config.AppConstants.SoftDeleteDiagnosisKeys = true
+
+	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
+	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
+
+	// Marks keys as deleted instead of deleting them
+	mock.ExpectExec(`UPDATE diagnosis_keys SET deleted_at = NOW() WHERE hour_of_submission < ? AND deleted_at IS NULL`).WithArgs(oldestHour).WillReturnResult(sqlmock.NewResult(0, 6))
+
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(6), receivedResult, "Expected the number of rows soft deleted")
+	assert.Nil(t, receivedErr, "Expected nil if update ran")
+
+	// Returns error if update fails
+	mock.ExpectExec(`UPDATE diagnosis_keys SET deleted_at = NOW() WHERE hour_of_submission < ? AND deleted_at IS NULL`).WithArgs(oldestHour).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(0), receivedResult, "Expected no rows to be soft deleted")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if update fails")
+}
+
+func TestPurgeSoftDeletedDiagnosisKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE deleted_at IS NOT NULL AND deleted_at < (NOW() - INTERVAL ? SECOND)`).WithArgs(int64(7 * 24 * 60 * 60)).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	receivedResult, receivedErr := purgeSoftDeletedDiagnosisKeys(context.Background(), db, 7*24*time.Hour, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(3), receivedResult, "Expected the number of rows purged")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
+
+	// A dry run only counts the rows it would purge
+	mock.ExpectQuery(`SELECT COUNT(*) FROM diagnosis_keys WHERE deleted_at IS NOT NULL AND deleted_at < (NOW() - INTERVAL ? SECOND)`).WithArgs(int64(7 * 24 * 60 * 60)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	receivedResult, receivedErr = purgeSoftDeletedDiagnosisKeys(context.Background(), db, 7*24*time.Hour, CleanupOptions{DryRun: true})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(3), receivedResult, "Expected the number of rows that would be purged")
+	assert.Nil(t, receivedErr, "Expected nil if count ran")
+}
+
+func TestDeleteDiagnosisKeysForRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `DELETE FROM diagnosis_keys WHERE region = ?`
+
+	// Returns error if query fails
+	mock.ExpectExec(query).WithArgs("302").WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := deleteDiagnosisKeysForRegion(context.Background(), db, "302")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the number of keys deleted
+	mock.ExpectExec(query).WithArgs("302").WillReturnResult(sqlmock.NewResult(0, 25))
+
+	deleted, receivedErr := deleteDiagnosisKeysForRegion(context.Background(), db, "302")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(25), deleted, "Expected the number of keys deleted")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestDeleteOldDiagnosisKeysFrozenClock(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC))
+
+	// 2020-07-20 is day 18463; 15 days earlier starts at hour 442752
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? LIMIT ?`).WithArgs(uint32(442752), config.AppConstants.DiagnosisKeyDeleteChunkSize).WillReturnResult(sqlmock.NewResult(1, 4))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? LIMIT ?`).WithArgs(uint32(442752), config.AppConstants.DiagnosisKeyDeleteChunkSize).WillReturnResult(sqlmock.NewResult(0, 0))
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(4), receivedResult, "Expected the number of rows deleted")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
 }
 
 func TestDeleteOldEncryptionKeys(t *testing.T) {
@@ -36,20 +246,130 @@ func TestDeleteOldEncryptionKeys(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	query := fmt.Sprintf(`
-		DELETE FROM encryption_keys
-		WHERE  (created < (NOW() - INTERVAL %d DAY))
-		OR    ((created < (NOW() - INTERVAL %d MINUTE)) AND app_public_key IS NULL)
-		OR    remaining_keys = 0
-	`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes)
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC))
+
+	codesQuery := `DELETE FROM encryption_keys WHERE app_public_key IS NULL AND created < ?`
+	validityQuery := `DELETE FROM encryption_keys WHERE created < ? AND (app_public_key IS NOT NULL OR created >= ?)`
+	usedUpQuery := `DELETE FROM encryption_keys WHERE remaining_keys = 0 AND created >= ? AND (app_public_key IS NOT NULL OR created >= ?)`
+
+	// Runs each part and adds up what they deleted
+	validFrom := time.Date(2020, 7, 5, 15, 30, 0, 0, time.UTC)
+	codesValidFrom := time.Date(2020, 7, 19, 15, 30, 0, 0, time.UTC)
+	mock.ExpectExec(codesQuery).WithArgs(codesValidFrom).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(validityQuery).WithArgs(validFrom, codesValidFrom).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(usedUpQuery).WithArgs(validFrom, codesValidFrom).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	receivedResult, receivedErr := deleteOldEncryptionKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(7), receivedResult, "Expected the total deleted by every part")
+	assert.Nil(t, receivedErr, "Expected nil if the deletes ran")
+
+	// Stops at the first part that fails, reporting what was already deleted
+	mock.ExpectExec(codesQuery).WithArgs(AnyType{}).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(validityQuery).WithArgs(AnyType{}, AnyType{}).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteOldEncryptionKeys(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(4), receivedResult, "Expected the rows deleted before the failure")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if a delete fails")
+}
+
+func TestDeleteExpiredUnclaimedCodes(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC))
+
+	codesValidFrom := time.Date(2020, 7, 19, 15, 30, 0, 0, time.UTC)
+
+	// Only unclaimed codes past OneTimeCodeExpiryInMinutes are deleted
+	mock.ExpectExec(`DELETE FROM encryption_keys WHERE app_public_key IS NULL AND created < ?`).WithArgs(codesValidFrom).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	receivedResult, receivedErr := deleteExpiredUnclaimedCodes(context.Background(), db, CleanupOptions{})
+
+	assert.Equal(t, int64(3), receivedResult, "Expected the number of codes deleted")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
+
+	// Counted instead in a dry run
+	row := sqlmock.NewRows([]string{"count"}).AddRow(5)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key IS NULL AND created < ?`).WithArgs(codesValidFrom).WillReturnRows(row)
+
+	receivedResult, receivedErr = deleteExpiredUnclaimedCodes(context.Background(), db, CleanupOptions{DryRun: true})
+
+	assert.Equal(t, int64(5), receivedResult, "Expected the number of codes that would be deleted")
+	assert.Nil(t, receivedErr, "Expected nil if count ran")
+
+	// Returns error if delete fails
+	mock.ExpectExec(`DELETE FROM encryption_keys WHERE app_public_key IS NULL AND created < ?`).WithArgs(codesValidFrom).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteExpiredUnclaimedCodes(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(0), receivedResult, "Expected 0 if delete fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if delete fails")
+}
+
+func TestDeleteOldKeysDryRun(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	dryRun := CleanupOptions{DryRun: true}
+
+	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
+	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
+
+	// Diagnosis keys are counted, not deleted
+	row := sqlmock.NewRows([]string{"count"}).AddRow(12)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM diagnosis_keys WHERE hour_of_submission < ?`).WithArgs(oldestHour).WillReturnRows(row)
 
-	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
-	deleteOldEncryptionKeys(db)
+	receivedResult, receivedErr := deleteOldDiagnosisKeys(context.Background(), db, dryRun)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
+	assert.Equal(t, int64(12), receivedResult, "Expected the number of rows that would be deleted")
+	assert.Nil(t, receivedErr, "Expected nil if count ran")
+
+	// Encryption keys are counted, not deleted, with the statements that
+	// would delete them
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key IS NULL AND created < ?`).WithArgs(AnyType{}).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE created < ? AND (app_public_key IS NOT NULL OR created >= ?)`).WithArgs(AnyType{}, AnyType{}).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE remaining_keys = 0 AND created >= ? AND (app_public_key IS NOT NULL OR created >= ?)`).WithArgs(AnyType{}, AnyType{}).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	receivedResult, receivedErr = deleteOldEncryptionKeys(context.Background(), db, dryRun)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(5), receivedResult, "Expected the number of rows that would be deleted")
+	assert.Nil(t, receivedErr, "Expected nil if count ran")
+
+	// Returns error if the count fails
+	mock.ExpectQuery(`SELECT COUNT(*) FROM diagnosis_keys WHERE hour_of_submission < ?`).WithArgs(oldestHour).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = deleteOldDiagnosisKeys(context.Background(), db, dryRun)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(0), receivedResult, "Expected no count if the query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if count fails")
 }
 
 func TestClaimKey(t *testing.T) {
@@ -64,7 +384,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
-	_, receivedErr := claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -78,7 +398,7 @@ func TestClaimKey(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"count"}).AddRow(1)
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -92,10 +412,10 @@ func TestClaimKey(t *testing.T) {
 	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	setupSelectOneTimeCode(mock, oneTimeCode,"1950-01-01 00:00:00" )
+	setupSelectOneTimeCode(mock, oneTimeCode, time.Unix(3600, 0), pub[:])
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -104,35 +424,34 @@ func TestClaimKey(t *testing.T) {
 	expectedErr = ErrInvalidOneTimeCode
 	assert.Equal(t, expectedErr, receivedErr, "Expected ErrInvalidOneTimeCode if time code is not valid")
 
-	// Prepare update fails
+	// Looking up the one time code fails
 	mock.ExpectBegin()
 	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnError(fmt.Errorf("error"))
+
+	mock.ExpectRollback()
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
-	setupSelectOneTimeCode(mock, oneTimeCode, time.Now())
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedErr = fmt.Errorf("error")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not look up the one time code")
 
 	query := fmt.Sprintf(
 		`UPDATE encryption_keys
 		SET one_time_code = NULL,
 			app_public_key = ?,
-			created = ?
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
 		WHERE one_time_code = ?
 		AND created > (NOW() - INTERVAL %d MINUTE)`,
 		config.AppConstants.OneTimeCodeExpiryInMinutes,
 	)
 
-	mock.ExpectPrepare(query).WillReturnError(fmt.Errorf("error"))
-
-	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
-	}
-
-	expectedErr = fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not prepare update")
-
 	// Execute fails after update
 	mock.ExpectBegin()
 	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
@@ -140,14 +459,14 @@ func TestClaimKey(t *testing.T) {
 
 	created := time.Now()
 
-	setupSelectOneTimeCode(mock, oneTimeCode, created)
+	setupSelectOneTimeCode(mock, oneTimeCode, created, pub[:])
 
 	created = timemath.MostRecentUTCMidnight(created)
 
-	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectExec(query).WithArgs(pub[:], created, sqlmock.AnyArg(), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -163,14 +482,14 @@ func TestClaimKey(t *testing.T) {
 
 	created = time.Now()
 
-	setupSelectOneTimeCode(mock, oneTimeCode, created)
+	setupSelectOneTimeCode(mock, oneTimeCode, created, pub[:])
 
 	created = timemath.MostRecentUTCMidnight(created)
 
-	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectExec(query).WithArgs(pub[:], created, sqlmock.AnyArg(), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 2))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -179,30 +498,21 @@ func TestClaimKey(t *testing.T) {
 	expectedErr = ErrInvalidOneTimeCode
 	assert.Equal(t, expectedErr, receivedErr, "Expected ErrInvalidOneTimeCode if rowsAffected was not 1")
 
-	// Getting public key throws an error
+	// Stored server key is malformed, so the code is refused before it's claimed
 	mock.ExpectBegin()
 	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	created = time.Now()
-
-	setupSelectOneTimeCode(mock, oneTimeCode, created)
-
-	created = timemath.MostRecentUTCMidnight(created)
-
-	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
-
-	mock.ExpectPrepare(`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`).ExpectQuery().WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
+	setupSelectOneTimeCode(mock, oneTimeCode, time.Now(), pub[:31])
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if server_public_key was not queried")
+	assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat if server_public_key is the wrong length")
 
 	// Commits and returns a server key
 	mock.ExpectBegin()
@@ -211,18 +521,15 @@ func TestClaimKey(t *testing.T) {
 
 	created = time.Now()
 
-	setupSelectOneTimeCode(mock, oneTimeCode, created)
+	setupSelectOneTimeCode(mock, oneTimeCode, created, pub[:])
 
 	created = timemath.MostRecentUTCMidnight(created)
 
-	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
-
-	rows = sqlmock.NewRows([]string{"server_public_key"}).AddRow(pub[:])
-	mock.ExpectPrepare(`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`).ExpectQuery().WithArgs(pub[:]).WillReturnRows(rows)
+	mock.ExpectExec(query).WithArgs(pub[:], created, sqlmock.AnyArg(), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectCommit()
 
-	serverKey, _ := claimKey(db, oneTimeCode, pub[:], nil)
+	serverKey, _ := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -232,738 +539,3402 @@ func TestClaimKey(t *testing.T) {
 
 }
 
-func setupSelectOneTimeCode(mock sqlmock.Sqlmock, oneTimeCode string, time driver.Value) {
-	rows := sqlmock.NewRows([]string{"created", "originator"}).AddRow(time, "originator")
-	mock.ExpectQuery(`SELECT created, originator FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnRows(rows)
-}
-
-func TestPersistEncryptionKey(t *testing.T) {
+func TestClaimKeyPublicKeyLength(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	region := "302"
-	originator := "randomOrigin"
-	pub, priv, _ := box.GenerateKey(rand.Reader)
-	oneTimeCode := "80311300"
-
-	// Return error
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("error"))
+	// Wrong length keys are rejected without touching the database
+	for _, length := range []int{31, 33} {
+		_, receivedErr := claimKey(context.Background(), db, "80311300", make([]byte, length))
 
-	receivedErr := persistEncryptionKey(db, region, originator, pub, priv, oneTimeCode)
+		assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat for a %d byte key", length)
+	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr := fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute insert")
-
-	// Success
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	// A 32 byte key goes on to the database
+	key := make([]byte, 32)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(key).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
 
-	receivedResult := persistEncryptionKey(db, region, originator, pub, priv, oneTimeCode)
+	_, receivedErr := claimKey(context.Background(), db, "80311300", key)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Nil(t, receivedResult, "Expected nil if it could execute insert")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected the query to run for a 32 byte key")
+}
+
+// sameInstant matches a time argument regardless of its location.
+type sameInstant time.Time
 
+func (a sameInstant) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Equal(time.Time(a))
 }
 
-func testPersistEncryptionKeyWithHashID(t *testing.T) {
+func TestClaimKeyDateTimezone(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	region := "302"
-	originator := "randomOrigin"
-	pub, priv, _ := box.GenerateKey(rand.Reader)
-	oneTimeCode := "80311300"
-	hashID := "abcd"
+	oldLocation := config.AppConstants.KeyDateLocation
+	defer func() { config.AppConstants.KeyDateLocation = oldLocation }()
+	config.AppConstants.KeyDateLocation, _ = time.LoadLocation("Asia/Tokyo")
 
-	// Return error if unknown error
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("error"))
+	// Keep the claim inside the rotation window
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC))
 
-	receivedErr := persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	query := fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
-	}
+	// 20:00 UTC is already the next day in Tokyo, so created snaps to Tokyo
+	// midnight rather than back to UTC midnight
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	expectedErr := fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
+	setupSelectOneTimeCode(mock, oneTimeCode, time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC), pub[:])
 
-	// Return error if duplicate one_time_code
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("for key 'one_time_code"))
+	created := time.Date(2021, 1, 1, 15, 0, 0, 0, time.UTC)
+	mock.ExpectExec(query).WithArgs(pub[:], sameInstant(created), time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC), hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	serverKey, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("for key 'one_time_code")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute insert")
+	assert.Nil(t, receivedErr, "Expected nil if claim ran")
+	assert.Equal(t, pub[:], serverKey, "should return server key")
+}
 
-	// Return error if duplicate used hashID found
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("for key 'hash_id"))
+// capturedBytes matches any []byte argument and remembers it.
+type capturedBytes struct{ value *[]byte }
 
-	rows := sqlmock.NewRows([]string{"one_time_code"}).AddRow(nil)
-	mock.ExpectQuery(
-		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
+func (c capturedBytes) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	*c.value = b
+	return ok
+}
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+func TestClaimKeyRotatesStaleServerKey(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
-	}
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
 
-	expectedErr = fmt.Errorf("used hashID found")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute insert")
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
 
-	// Return error if duplicate un-used hashID found but delete fails
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("for key 'for key 'hash_id"))
+	query := fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)
 
-	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow(oneTimeCode)
-	mock.ExpectQuery(
-		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
-	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnError(fmt.Errorf("error"))
+	// A row created inside the rotation window keeps its server key
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	setupSelectOneTimeCode(mock, oneTimeCode, now.Add(-2*time.Hour), serverPub[:])
+
+	mock.ExpectExec(query).WithArgs(pub[:], timemath.MostRecentUTCMidnight(now), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	serverKey, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute delete")
+	assert.Nil(t, receivedErr, "Expected nil if claim ran")
+	assert.Equal(t, serverPub[:], serverKey, "Expected the stored server key for a fresh row")
 
-	// Return error if duplicate un-used hashID found and delete passes (regenerates OTC)
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnError(fmt.Errorf("for key 'for key 'hash_id"))
+	// With validity enforcement off, a row created before the rotation window
+	// gets a new keypair and a new created date
+	defer func(enforce bool) { config.AppConstants.EnforceKeyValidityOnClaim = enforce }(config.AppConstants.EnforceKeyValidityOnClaim)
+	config.AppConstants.EnforceKeyValidityOnClaim = false
 
-	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow(oneTimeCode)
-	mock.ExpectQuery(
-		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
-	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
+	stale := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays+1) * 24 * time.Hour)
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	mock.ExpectBegin()
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	setupSelectOneTimeCode(mock, oneTimeCode, stale, serverPub[:])
+
+	mock.ExpectExec(query).WithArgs(pub[:], timemath.MostRecentUTCMidnight(now), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var rotatedPriv, rotatedPub []byte
+	mock.ExpectExec(`UPDATE encryption_keys
+		SET server_private_key = ?,
+			server_public_key = ?
+		WHERE app_public_key = ?`).WithArgs(capturedBytes{&rotatedPriv}, capturedBytes{&rotatedPub}, pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	serverKey, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("regenerate OTC for hashID")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could execute delete")
+	assert.Nil(t, receivedErr, "Expected nil if claim ran")
+	assert.Len(t, rotatedPriv, pb.KeyLength, "Expected a new server private key to be stored")
+	assert.Len(t, rotatedPub, pb.KeyLength, "Expected a new server public key to be stored")
+	assert.NotEqual(t, serverPub[:], rotatedPub, "Expected the stale server key to be replaced")
+	assert.Equal(t, rotatedPub, serverKey, "Expected the new server key to be returned")
 
-	// Success
-	mock.ExpectExec(
-		`INSERT INTO encryption_keys
-		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
-		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
-		region,
-		originator,
-		hashID,
-		priv[:],
-		pub[:],
-		oneTimeCode,
-		config.AppConstants.InitialRemainingKeys,
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	// Rotation failing rolls the claim back
+	mock.ExpectBegin()
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	setupSelectOneTimeCode(mock, oneTimeCode, stale, serverPub[:])
+
+	mock.ExpectExec(query).WithArgs(pub[:], timemath.MostRecentUTCMidnight(now), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`UPDATE encryption_keys
+		SET server_private_key = ?,
+			server_public_key = ?
+		WHERE app_public_key = ?`).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), pub[:]).WillReturnError(fmt.Errorf("error"))
+
+	mock.ExpectRollback()
 
-	receivedResult := persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	_, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Nil(t, receivedResult, "Expected nothing if could execute insert")
-
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the server key could not be rotated")
 }
 
-func TestPrivForPub(t *testing.T) {
+func TestClaimKeyExpiredKey(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	pub, priv, _ := box.GenerateKey(rand.Reader)
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
 
-	query := fmt.Sprintf(`
-	SELECT server_private_key FROM encryption_keys
-		WHERE server_public_key = ?
-		AND created > (NOW() - INTERVAL %d DAY)
-		LIMIT 1`,
-		config.AppConstants.EncryptionKeyValidityDays,
+	query := fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
 	)
 
-	rows := sqlmock.NewRows([]string{"server_private_key"}).AddRow(priv[:])
-	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(rows)
+	// A freshly created row can be claimed
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	expectedResult := priv[:]
-	var receivedResult []byte
-	privForPub(db, pub[:]).Scan(&receivedResult)
+	setupSelectOneTimeCode(mock, oneTimeCode, now.Add(-time.Minute), serverPub[:])
 
-	assert.Equal(t, expectedResult, receivedResult, "Expected private key for public key")
+	mock.ExpectExec(query).WithArgs(pub[:], timemath.MostRecentUTCMidnight(now), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	serverKey, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
-}
 
-func TestDiagnosisKeysForHours(t *testing.T) {
-	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
-	defer db.Close()
+	assert.Nil(t, receivedErr, "Expected nil if claim ran")
+	assert.Equal(t, serverPub[:], serverKey, "Expected the stored server key for a fresh row")
 
-	region := "302"
-	startHour := uint32(100)
-	endHour := uint32(200)
-	currentRollingStartIntervalNumber := int32(2651450)
-	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+	// A row older than the key validity period is refused without being updated
+	overAged := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays)*24*time.Hour - time.Minute)
 
-	query := `
-	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level FROM diagnosis_keys
-		WHERE hour_of_submission >= ?
-		AND hour_of_submission < ?
-		AND rolling_start_interval_number > ?
-		AND region = ?
-		ORDER BY key_data`
+	mock.ExpectBegin()
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}).AddRow("302", []byte{}, 2651450, 144, 4)
-	mock.ExpectQuery(query).WithArgs(
-		startHour,
-		endHour,
-		minRollingStartIntervalNumber,
-		region).WillReturnRows(row)
+	setupSelectOneTimeCode(mock, oneTimeCode, overAged, pub[:])
 
-	expectedResult := []byte("302")
-	rows, _ := diagnosisKeysForHours(db, region, startHour, endHour, currentRollingStartIntervalNumber)
-	var receivedResult []byte
-	for rows.Next() {
-		rows.Scan(&receivedResult, nil, nil, nil, nil)
-	}
+	mock.ExpectRollback()
 
-	assert.Equal(t, expectedResult, receivedResult, "Expected rows for the query")
+	serverKey, receivedErr = claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
+
+	assert.Nil(t, serverKey, "Expected no server key for an over-aged row")
+	assert.Equal(t, ErrExpiredKey, receivedErr, "Expected ErrExpiredKey for an over-aged row")
+	assert.True(t, errors.Is(receivedErr, ErrInvalidOneTimeCode), "Expected ErrExpiredKey to be treated as an invalid one time code")
 }
 
-func TestRegisterDiagnosisKeys(t *testing.T) {
+func TestRotateExpiringServerKeys(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	pub, _, _ := box.GenerateKey(rand.Reader)
-	keys := []*pb.TemporaryExposureKey{}
-	region := "302"
-	originator := "randomOrigin"
-
-	// Roll back if table is locked
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	validFrom := now.Add(-time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour)
+	expiringFrom := validFrom.Add(2 * 24 * time.Hour)
+
+	selectQuery := `
+		SELECT one_time_code FROM encryption_keys
+		WHERE app_public_key IS NULL
+		AND one_time_code IS NOT NULL
+		AND created > ?
+		AND created <= ?
+		FOR UPDATE`
+	updateQuery := `UPDATE encryption_keys
+			SET server_private_key = ?,
+				server_public_key = ?,
+				created = ?
+			WHERE one_time_code = ?`
+
+	// Only rows created inside the window are selected, and each gets a new
+	// keypair and today's date
 	mock.ExpectBegin()
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
-	mock.ExpectRollback()
-	receivedErr := registerDiagnosisKeys(db, pub, keys, nil)
+	rows := sqlmock.NewRows([]string{"one_time_code"}).AddRow("AAAAAAAAAA").AddRow("BBBBBBBBBB")
+	mock.ExpectQuery(selectQuery).WithArgs(validFrom, expiringFrom).WillReturnRows(rows)
+
+	var privA, pubA, privB, pubB []byte
+	mock.ExpectExec(updateQuery).WithArgs(capturedBytes{&privA}, capturedBytes{&pubA}, timemath.MostRecentUTCMidnight(now), "AAAAAAAAAA").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(capturedBytes{&privB}, capturedBytes{&pubB}, timemath.MostRecentUTCMidnight(now), "BBBBBBBBBB").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rotated, receivedErr := rotateExpiringServerKeys(context.Background(), db, 2)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr := fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if table is locked")
+	assert.Nil(t, receivedErr, "Expected nil if rotation ran")
+	assert.Equal(t, 2, rotated, "Expected both rows in the window to be rotated")
+	assert.Len(t, pubA, pb.KeyLength, "Expected a new server public key to be stored")
+	assert.Len(t, privA, pb.KeyLength, "Expected a new server private key to be stored")
+	assert.NotEqual(t, pubA, pubB, "Expected each row to get its own keypair")
 
-	// Roll back if 0 keys are left and return error
+	// Nothing in the window leaves everything alone
 	mock.ExpectBegin()
-	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 0)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
-	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	rows = sqlmock.NewRows([]string{"one_time_code"})
+	mock.ExpectQuery(selectQuery).WithArgs(validFrom, expiringFrom).WillReturnRows(rows)
+	mock.ExpectCommit()
+
+	rotated, receivedErr = rotateExpiringServerKeys(context.Background(), db, 2)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = ErrKeyConsumed
-	assert.Equal(t, expectedErr, receivedErr, "Expected ErrKeyConsumed if 0 keys are left")
+	assert.Nil(t, receivedErr, "Expected nil if rotation ran")
+	assert.Equal(t, 0, rotated, "Expected no rows outside the window to be rotated")
 
-	// Roll back if prepare fails
+	// A failed update rolls back every rotation
 	mock.ExpectBegin()
-	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
-	mock.ExpectPrepare(
-		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	).WillReturnError(fmt.Errorf("error"))
-
+	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow("AAAAAAAAAA").AddRow("BBBBBBBBBB")
+	mock.ExpectQuery(selectQuery).WithArgs(validFrom, expiringFrom).WillReturnRows(rows)
+	mock.ExpectExec(updateQuery).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), timemath.MostRecentUTCMidnight(now), "AAAAAAAAAA").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), timemath.MostRecentUTCMidnight(now), "BBBBBBBBBB").WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+
+	rotated, receivedErr = rotateExpiringServerKeys(context.Background(), db, 2)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if prepare to insert fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if a row could not be updated")
+	assert.Equal(t, 0, rotated, "Expected no rotations to be reported after a rollback")
+}
 
-	// Rolls back if it fails to execute insertion of keys
-	key := randomTestKey()
-	keys = []*pb.TemporaryExposureKey{key}
+func TestClaimedInGrace(t *testing.T) {
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
 
-	hourOfSubmission := timemath.HourNumber(time.Now())
+	defer func(grace uint32) { config.AppConstants.OneTimeCodeGraceMinutes = grace }(config.AppConstants.OneTimeCodeGraceMinutes)
+	expiry := time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute
+
+	// Without grace nothing is flagged, even past expiry
+	config.AppConstants.OneTimeCodeGraceMinutes = 0
+	assert.False(t, claimedInGrace(now.Add(-expiry)), "Expected no grace when it is disabled")
+
+	// With grace, codes at or past expiry are flagged and unexpired ones aren't
+	config.AppConstants.OneTimeCodeGraceMinutes = 10
+	assert.False(t, claimedInGrace(now.Add(-expiry+time.Second)), "Expected an unexpired code not to be flagged")
+	assert.True(t, claimedInGrace(now.Add(-expiry)), "Expected a code expiring now to be flagged")
+	assert.True(t, claimedInGrace(now.Add(-expiry-5*time.Minute)), "Expected a recently expired code to be flagged")
+}
+
+func TestClaimKeyGraceWindow(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldMetrics := metrics
+	defer func() { metrics = oldMetrics }()
+	sink := &fakeSink{}
+	metrics = sink
+
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	defer func(grace uint32) { config.AppConstants.OneTimeCodeGraceMinutes = grace }(config.AppConstants.OneTimeCodeGraceMinutes)
+
+	updateQuery := func(minutes uint32) string {
+		return fmt.Sprintf(
+			`UPDATE encryption_keys
+			SET one_time_code = NULL,
+				app_public_key = ?,
+				created = ?,
+				claimed_at = ?,
+				claimed_code_hash = ?
+			WHERE one_time_code = ?
+			AND created > (NOW() - INTERVAL %d MINUTE)`,
+			minutes,
+		)
+	}
+	justExpired := now.Add(-time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes+5) * time.Minute)
+
+	// Without grace the window is the expiry and a code just past it isn't claimed
+	config.AppConstants.OneTimeCodeGraceMinutes = 0
 
 	mock.ExpectBegin()
-	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
-	mock.ExpectPrepare(
-		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	).ExpectExec().WithArgs(
-		region,
-		originator,
-		key.GetKeyData(),
-		key.GetRollingStartIntervalNumber(),
-		key.GetRollingPeriod(),
-		key.GetTransmissionRiskLevel(),
-		hourOfSubmission,
-	).WillReturnError(fmt.Errorf("error"))
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	setupSelectOneTimeCode(mock, oneTimeCode, justExpired, pub[:])
+
+	mock.ExpectExec(updateQuery(config.AppConstants.OneTimeCodeExpiryInMinutes)).WithArgs(pub[:], timemath.MostRecentUTCMidnight(justExpired), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(0, 0))
 
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+
+	_, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = fmt.Errorf("error")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if execute insert fails")
-
-	// Rolls back if more keys are inserted that are allowed
-	keyOne := randomTestKey()
-	keyTwo := randomTestKey()
-	keys = []*pb.TemporaryExposureKey{keyOne, keyTwo}
+	assert.Equal(t, ErrInvalidOneTimeCode, receivedErr, "Expected an expired code to be refused without grace")
+	assert.NotContains(t, sink.names, claimKeyGrace, "Expected no grace claim to be counted")
 
-	hourOfSubmission = timemath.HourNumber(time.Now())
+	// With grace the window widens and the claim succeeds, flagged as in grace
+	config.AppConstants.OneTimeCodeGraceMinutes = 10
 
 	mock.ExpectBegin()
-	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	rows = sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 
-	mock.ExpectPrepare(
-		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	)
+	setupSelectOneTimeCode(mock, oneTimeCode, justExpired, serverPub[:])
 
-	for _, key := range keys {
-		mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`).WithArgs(
-			region,
-			originator,
-			key.GetKeyData(),
-			key.GetRollingStartIntervalNumber(),
-			key.GetRollingPeriod(),
-			key.GetTransmissionRiskLevel(),
-			hourOfSubmission,
-		).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery(config.AppConstants.OneTimeCodeExpiryInMinutes+10)).WithArgs(pub[:], timemath.MostRecentUTCMidnight(justExpired), now, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	serverKey, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
+	assert.Nil(t, receivedErr, "Expected a recently expired code to be claimed with grace")
+	assert.Equal(t, serverPub[:], serverKey, "Expected the stored server key")
+	assert.Contains(t, sink.names, claimKeyGrace, "Expected the grace claim to be counted")
+}
+
+func setupSelectOneTimeCode(mock sqlmock.Sqlmock, oneTimeCode string, time driver.Value, serverPub []byte) {
+	rows := sqlmock.NewRows([]string{"created", "originator", "region", "server_public_key"}).AddRow(time, "originator", "302", serverPub)
+	mock.ExpectQuery(`SELECT created, originator, region, server_public_key FROM encryption_keys WHERE one_time_code = ?`).WithArgs(oneTimeCode).WillReturnRows(rows)
+}
+
+func TestPersistEncryptionKey(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	originator := "randomOrigin"
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
+	// Return error
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+
+	_, receivedErr := persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = ErrTooManyKeys
-	assert.Equal(t, expectedErr, receivedErr, "Expected error more keys than allowed are inserted")
+	expectedErr := fmt.Errorf("error")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute insert")
 
-	// Rolls back if final update fails
-	keyOne = randomTestKey()
-	keyTwo = randomTestKey()
-	keys = []*pb.TemporaryExposureKey{keyOne, keyTwo}
+	// Return ErrInvalidRegion without touching the database for a malformed region
+	_, receivedErr = persistEncryptionKey(context.Background(), db, "CA-ON", originator, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 
-	hourOfSubmission = timemath.HourNumber(time.Now())
+	assert.Equal(t, ErrInvalidRegion, receivedErr, "Expected ErrInvalidRegion for a malformed region")
 
+	// Return ErrDuplicateOneTimeCode if another request took the code first
 	mock.ExpectBegin()
-	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 3)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '80311300' for key 'one_time_code'"})
+	mock.ExpectRollback()
 
-	mock.ExpectPrepare(
-		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	)
+	_, receivedErr = persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
 
-	for _, key := range keys {
-		mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`).WithArgs(
-			region,
-			originator,
-			key.GetKeyData(),
-			key.GetRollingStartIntervalNumber(),
-			key.GetRollingPeriod(),
-			key.GetTransmissionRiskLevel(),
-			hourOfSubmission,
-		).WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
+	assert.Equal(t, ErrDuplicateOneTimeCode, receivedErr, "Expected ErrDuplicateOneTimeCode if the one_time_code is taken")
+
+	// Other unique key violations are returned as they are
+	duplicateKeyErr := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'x' for key 'server_public_key'"}
+	mock.ExpectBegin()
 	mock.ExpectExec(
-		`UPDATE encryption_keys
-	SET remaining_keys = remaining_keys - ?
-	WHERE remaining_keys >= ?
-	AND app_public_key = ?`,
-	).WithArgs(
-		len(keys),
-		len(keys),
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(duplicateKeyErr)
+	mock.ExpectRollback()
+
+	_, receivedErr = persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, duplicateKeyErr, receivedErr, "Expected other duplicate errors to be returned unchanged")
+
+	// Success
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedErr := persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, PersistResult{OneTimeCode: oneTimeCode}, receivedResult, "Expected the code and no replacement on a clean insert")
+	assert.Nil(t, receivedErr, "Expected nil if it could execute insert")
+
+}
+
+func TestPersistEncryptionKeyOriginatorRemainingKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.OriginatorRemainingKeys = map[string]uint32{"onapi": 60, token2: 5}
+	defer func() { config.AppConstants.OriginatorRemainingKeys = map[string]uint32{} }()
+
+	region := "302"
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+
+	// Uses the override for a configured originator
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		token1,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		uint32(60),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, receivedErr := persistEncryptionKey(context.Background(), db, region, token1, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if it could execute insert")
+
+	// Falls back to InitialRemainingKeys for everyone else, even if the raw token is configured
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		token2,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, receivedErr = persistEncryptionKey(context.Background(), db, region, token2, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if it could execute insert")
+}
+
+func testPersistEncryptionKeyWithHashID(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	originator := "randomOrigin"
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+	hashID := "abcd"
+
+	// Return error if unknown error
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
 		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("error"))
 
-	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, receivedErr := persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedErr := fmt.Errorf("error")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
+
+	// Return error if duplicate one_time_code
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'AAABBBCCCC' for key 'one_time_code'"})
+
+	_, receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrDuplicateOneTimeCode, receivedErr, "Expected ErrDuplicateOneTimeCode if the one_time_code is taken")
+
+	// Return error if duplicate used hashID found
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(fmt.Errorf("for key 'hash_id"))
+
+	rows := sqlmock.NewRows([]string{"one_time_code"}).AddRow(nil)
+	mock.ExpectQuery(
+		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
+
+	_, receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedErr = fmt.Errorf("used hashID found")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute insert")
+
+	// Return error if duplicate un-used hashID found but delete fails
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(fmt.Errorf("for key 'for key 'hash_id"))
+
+	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow(oneTimeCode)
+	mock.ExpectQuery(
+		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
+	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedErr = fmt.Errorf("error")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute delete")
+
+	// Return error if duplicate un-used hashID found and delete passes (regenerates OTC)
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnError(fmt.Errorf("for key 'for key 'hash_id"))
+
+	rows = sqlmock.NewRows([]string{"one_time_code"}).AddRow(oneTimeCode)
+	mock.ExpectQuery(
+		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
+	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	receivedResult, receivedErr := persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedErr = fmt.Errorf("regenerate OTC for hashID")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could execute delete")
+	assert.True(t, receivedResult.ReplacedExisting, "Expected ReplacedExisting if the unused code was deleted")
+
+	// Success
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		hashID,
+		priv[:],
+		pub[:],
+		oneTimeCode,
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	receivedResult, receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, PersistResult{OneTimeCode: oneTimeCode}, receivedResult, "Expected the code and no replacement on a clean insert")
+	assert.Nil(t, receivedErr, "Expected nothing if could execute insert")
+
+}
+
+func TestPrivForPub(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+
+	query := fmt.Sprintf(`
+	SELECT server_private_key FROM encryption_keys
+		WHERE server_public_key = ?
+		AND created > (NOW() - INTERVAL %d DAY)
+		LIMIT 1`,
+		config.AppConstants.EncryptionKeyValidityDays,
+	)
+
+	rows := sqlmock.NewRows([]string{"server_private_key"}).AddRow(priv[:])
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(rows)
+
+	expectedResult := priv[:]
+	var receivedResult []byte
+	privForPub(context.Background(), db, pub[:]).Scan(&receivedResult)
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected private key for public key")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestServerPrivateKeyForPub(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+
+	query := fmt.Sprintf(`
+	SELECT server_private_key FROM encryption_keys
+		WHERE server_public_key = ?
+		AND created > (NOW() - INTERVAL %d DAY)
+		LIMIT 1`,
+		config.AppConstants.EncryptionKeyValidityDays,
+	)
+
+	// Returns ErrKeyNotFound if there is no keypair
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"server_private_key"}))
+
+	receivedResult, receivedErr := serverPrivateKeyForPub(context.Background(), db, pub[:])
+
+	assert.Nil(t, receivedResult, "Expected nil if there is no keypair")
+	assert.Equal(t, ErrKeyNotFound, receivedErr, "Expected ErrKeyNotFound if there is no keypair")
+
+	// Returns error if the stored key is the wrong length
+	rows := sqlmock.NewRows([]string{"server_private_key"}).AddRow(priv[:16])
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(rows)
+
+	receivedResult, receivedErr = serverPrivateKeyForPub(context.Background(), db, pub[:])
+
+	assert.Nil(t, receivedResult, "Expected nil if the key is the wrong length")
+	assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat if the key is the wrong length")
+
+	// Success
+	rows = sqlmock.NewRows([]string{"server_private_key"}).AddRow(priv[:])
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(rows)
+
+	receivedResult, receivedErr = serverPrivateKeyForPub(context.Background(), db, pub[:])
+
+	assert.Equal(t, priv, receivedResult, "Expected private key for public key")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegionAndOriginatorForPub(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	query := `SELECT region, originator FROM encryption_keys WHERE app_public_key = ?`
+
+	// Returns ErrKeyNotFound if the key hasn't been claimed
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator"}))
+
+	region, originator, receivedErr := regionAndOriginatorForPub(context.Background(), db, pub[:])
+
+	assert.Equal(t, "", region, "Expected no region if the key is not found")
+	assert.Equal(t, "", originator, "Expected no originator if the key is not found")
+	assert.Equal(t, ErrKeyNotFound, receivedErr, "Expected ErrKeyNotFound if the key is not found")
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
+
+	_, _, receivedErr = regionAndOriginatorForPub(context.Background(), db, pub[:])
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the region and originator
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator"}).AddRow("302", "ONApi"))
+
+	region, originator, receivedErr = regionAndOriginatorForPub(context.Background(), db, pub[:])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, "302", region, "Expected the keypair's region")
+	assert.Equal(t, "ONApi", originator, "Expected the keypair's originator")
+	assert.Nil(t, receivedErr, "Expected nil if the key is found")
+}
+
+func TestDiagnosisKeysForHours(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	query := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`
+
+	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).AddRow("302", []byte{}, 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(query).WithArgs(
+		startHour,
+		endHour,
+		minRollingStartIntervalNumber,
+		region).WillReturnRows(row)
+
+	expectedResult := []byte("302")
+	rows, _ := diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	var receivedResult []byte
+	for rows.Next() {
+		rows.Scan(&receivedResult, nil, nil, nil, nil, nil, nil)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected rows for the query")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysForHoursNormalizesRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	query := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`
+
+	// A padded region is queried trimmed
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery(query).WithArgs(uint32(100), uint32(200), minRollingStartIntervalNumber, "302").WillReturnRows(rows)
+
+	_, receivedErr := diagnosisKeysForHours(context.Background(), db, " 302\n", 100, 200, currentRollingStartIntervalNumber, 0)
+
+	assert.Nil(t, receivedErr, "Expected nil for a padded region")
+
+	// A malformed region is refused without a query
+	_, receivedErr = diagnosisKeysForHours(context.Background(), db, "30-2", 100, 200, currentRollingStartIntervalNumber, 0)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrInvalidRegion, receivedErr, "Expected ErrInvalidRegion for a malformed region")
+}
+
+func TestDiagnosisKeysForHoursHourLag(t *testing.T) {
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+	currentHour := timemath.HourNumber(now)
+
+	oldLag := config.AppConstants.RetrievalHourLag
+	defer func() { config.AppConstants.RetrievalHourLag = oldLag }()
+
+	region := "302"
+	startHour := currentHour - 24
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	// No lag serves up to the requested end hour, even the current one
+	config.AppConstants.RetrievalHourLag = 0
+
+	_, args := diagnosisKeysForHoursQuery(region, startHour, currentHour+1, currentRollingStartIntervalNumber, 0)
+	assert.Equal(t, []interface{}{startHour, currentHour + 1, minRollingStartIntervalNumber, region}, args, "Expected the end hour to be unchanged")
+
+	// With a lag the end hour is pulled back behind the current hour
+	config.AppConstants.RetrievalHourLag = 2
+
+	_, args = diagnosisKeysForHoursQuery(region, startHour, currentHour+1, currentRollingStartIntervalNumber, 0)
+	assert.Equal(t, []interface{}{startHour, currentHour - 2, minRollingStartIntervalNumber, region}, args, "Expected the end hour to be clamped")
+
+	// End hours already far enough back are left alone
+	_, args = diagnosisKeysForHoursQuery(region, startHour, currentHour-5, currentRollingStartIntervalNumber, 0)
+	assert.Equal(t, []interface{}{startHour, currentHour - 5, minRollingStartIntervalNumber, region}, args, "Expected an older end hour to be unchanged")
+
+	// The clamped window is what gets queried
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`
+
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery(query).WithArgs(
+		startHour,
+		currentHour-2,
+		minRollingStartIntervalNumber,
+		region).WillReturnRows(rows)
+
+	_, receivedErr := diagnosisKeysForHours(context.Background(), db, region, startHour, currentHour+1, currentRollingStartIntervalNumber, 0)
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysForHoursMultiRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	regions := []string{"302", "303", "304"}
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	// The IN clause has one placeholder per region
+	query, args := diagnosisKeysForHoursMultiRegionQuery(regions, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	assert.Contains(t, query, "AND region IN (?, ?, ?)\n", "Expected a placeholder for each region")
+	assert.Equal(t, []interface{}{startHour, endHour, minRollingStartIntervalNumber, "302", "303", "304"}, args, "Expected the regions after the hour and RSIN bounds")
+
+	query, _ = diagnosisKeysForHoursMultiRegionQuery([]string{"302"}, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	assert.Contains(t, query, "AND region IN (?)\n", "Expected a single placeholder for one region")
+
+	// Rows keep their region and the key_data ordering across regions
+	query = `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region IN (?, ?, ?)
+		AND deleted_at IS NULL
+		ORDER BY key_data`
+
+	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).
+		AddRow("303", []byte{1}, 2651450, 144, 4, 1, nil).
+		AddRow("302", []byte{2}, 2651450, 144, 4, 1, nil).
+		AddRow("304", []byte{3}, 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(query).WithArgs(
+		startHour,
+		endHour,
+		minRollingStartIntervalNumber,
+		"302", "303", "304").WillReturnRows(row)
+
+	rows, receivedErr := diagnosisKeysForHoursMultiRegion(context.Background(), db, regions, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	var receivedRegions []string
+	var receivedKeys [][]byte
+	for rows.Next() {
+		var region string
+		var key []byte
+		rows.Scan(&region, &key, nil, nil, nil, nil, nil)
+		receivedRegions = append(receivedRegions, region)
+		receivedKeys = append(receivedKeys, key)
+	}
+
+	assert.Equal(t, []string{"303", "302", "304"}, receivedRegions, "Expected the region of each row")
+	assert.Equal(t, [][]byte{{1}, {2}, {3}}, receivedKeys, "Expected rows in key_data order")
+
+	// No regions is refused before querying
+	_, receivedErr = diagnosisKeysForHoursMultiRegion(context.Background(), db, []string{}, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	assert.Equal(t, ErrInvalidRegion, receivedErr, "Expected ErrInvalidRegion if no regions are given")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysForHoursOrdered(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	columns := []string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}
+
+	// Default ordering is key_data
+	query := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`
+
+	row := sqlmock.NewRows(columns).
+		AddRow("302", []byte{1}, 2651460, 144, 4, 1, nil).
+		AddRow("302", []byte{2}, 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(query).WithArgs(
+		startHour,
+		endHour,
+		minRollingStartIntervalNumber,
+		region).WillReturnRows(row)
+
+	rows, receivedErr := diagnosisKeysForHoursOrdered(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, "")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+	assert.Equal(t, [][]byte{{1}, {2}}, scanKeyData(rows), "Expected keys ordered by key_data")
+
+	// Ordering by rolling_start_interval_number
+	query = `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY rolling_start_interval_number, key_data`
+
+	row = sqlmock.NewRows(columns).
+		AddRow("302", []byte{2}, 2651450, 144, 4, 1, nil).
+		AddRow("302", []byte{1}, 2651460, 144, 4, 1, nil)
+	mock.ExpectQuery(query).WithArgs(
+		startHour,
+		endHour,
+		minRollingStartIntervalNumber,
+		region).WillReturnRows(row)
+
+	rows, receivedErr = diagnosisKeysForHoursOrdered(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, "rolling_start_interval_number")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+	assert.Equal(t, [][]byte{{2}, {1}}, scanKeyData(rows), "Expected keys ordered by rolling_start_interval_number")
+
+	// Anything not on the allow-list is rejected before a query is run
+	_, receivedErr = diagnosisKeysForHoursOrdered(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, "key_data; DROP TABLE diagnosis_keys")
+	assert.Equal(t, ErrInvalidOrderBy, receivedErr, "Expected ErrInvalidOrderBy for a column not on the allow-list")
+
+	_, receivedErr = diagnosisKeysForHoursOrdered(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, "hour_of_submission")
+	assert.Equal(t, ErrInvalidOrderBy, receivedErr, "Expected ErrInvalidOrderBy for a column not on the allow-list")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func scanKeyData(rows *sql.Rows) [][]byte {
+	var keys [][]byte
+	for rows.Next() {
+		var region string
+		var key []byte
+		var rsin, rollingPeriod, trl, reportType int32
+		var onset sql.NullInt32
+		rows.Scan(&region, &key, &rsin, &rollingPeriod, &trl, &reportType, &onset)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestDiagnosisKeysForHoursForceIndex(t *testing.T) {
+	oldIndex := config.AppConstants.DiagnosisKeysForceIndex
+	defer func() { config.AppConstants.DiagnosisKeysForceIndex = oldIndex }()
+
+	config.AppConstants.DiagnosisKeysForceIndex = ""
+	query, _ := diagnosisKeysForHoursQuery("302", 100, 200, 2651450, 0)
+	assert.NotContains(t, query, "FORCE INDEX", "Expected no index hint by default")
+
+	config.AppConstants.DiagnosisKeysForceIndex = "hour_of_submission"
+	query, _ = diagnosisKeysForHoursQuery("302", 100, 200, 2651450, 0)
+	assert.Contains(t, query, "FROM diagnosis_keys FORCE INDEX (hour_of_submission)\n", "Expected the configured index hint")
+
+	// Only indexes on the allow-list are written into the query
+	config.AppConstants.DiagnosisKeysForceIndex = "region) WHERE 1=1 --"
+	query, _ = diagnosisKeysForHoursQuery("302", 100, 200, 2651450, 0)
+	assert.NotContains(t, query, "FORCE INDEX", "Expected no index hint for an index not on the allow-list")
+}
+
+func TestCheckRegionEnabled(t *testing.T) {
+	oldRegions := config.AppConstants.EnabledRegions
+	defer func() { config.AppConstants.EnabledRegions = oldRegions }()
+
+	config.AppConstants.EnabledRegions = []string{}
+	assert.Nil(t, checkRegionEnabled("999"), "Expected every region to be enabled by default")
+
+	config.AppConstants.EnabledRegions = []string{"302"}
+	assert.Nil(t, checkRegionEnabled("302"), "Expected nil for an enabled region")
+	assert.Equal(t, ErrRegionNotEnabled, checkRegionEnabled("999"), "Expected ErrRegionNotEnabled for a disabled region")
+
+	// Disabled regions are refused before querying
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	_, receivedErr := diagnosisKeysForHours(context.Background(), db, "999", 100, 200, 2651450, 0)
+	assert.Equal(t, ErrRegionNotEnabled, receivedErr, "Expected ErrRegionNotEnabled for a disabled region")
+
+	_, receivedErr = diagnosisKeyPagesForHours(context.Background(), db, "999", 100, 200, 2651450, 0, 2)
+	assert.Equal(t, ErrRegionNotEnabled, receivedErr, "Expected ErrRegionNotEnabled for a disabled region")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysSince(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+	endHour := timemath.HourNumber(now) + 1
+
+	query := `
+		SELECT key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+
+		ORDER BY key_data`
+	columns := []string{"key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms", "hour_of_submission"}
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(uint32(100), endHour, minRollingStartIntervalNumber, "302").WillReturnError(fmt.Errorf("error"))
+
+	receivedKeys, receivedCursor, receivedErr := diagnosisKeysSince(context.Background(), db, "302", 100, currentRollingStartIntervalNumber, 0)
+
+	assert.Nil(t, receivedKeys, "Expected nil keys if query fails")
+	assert.Equal(t, uint32(0), receivedCursor, "Expected no cursor if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the keys with the latest hour seen as the cursor
+	rows := sqlmock.NewRows(columns).
+		AddRow([]byte{1}, 2651450, 144, 4, 1, nil, 104).
+		AddRow([]byte{2}, 2651450, 144, 4, 1, 3, 101)
+	mock.ExpectQuery(query).WithArgs(uint32(100), endHour, minRollingStartIntervalNumber, "302").WillReturnRows(rows)
+
+	receivedKeys, receivedCursor, receivedErr = diagnosisKeysSince(context.Background(), db, "302", 100, currentRollingStartIntervalNumber, 0)
+
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
+	assert.Len(t, receivedKeys, 2, "Expected both keys")
+	assert.Equal(t, []byte{1}, receivedKeys[0].GetKeyData(), "Expected keys in key_data order")
+	assert.Nil(t, receivedKeys[0].DaysSinceOnsetOfSymptoms, "Expected no days since onset for a NULL column")
+	assert.Equal(t, int32(3), receivedKeys[1].GetDaysSinceOnsetOfSymptoms(), "Expected days since onset")
+	assert.Equal(t, uint32(104), receivedCursor, "Expected the latest hour of submission as the cursor")
+
+	// Leaves the cursor where it was when there are no new keys
+	mock.ExpectQuery(query).WithArgs(uint32(105), endHour, minRollingStartIntervalNumber, "302").WillReturnRows(sqlmock.NewRows(columns))
+
+	receivedKeys, receivedCursor, receivedErr = diagnosisKeysSince(context.Background(), db, "302", 105, currentRollingStartIntervalNumber, 0)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
+	assert.Empty(t, receivedKeys, "Expected no keys")
+	assert.Equal(t, uint32(105), receivedCursor, "Expected the cursor to stay at sinceHour")
+
+	// Holds back hours diagnosisKeysForHours wouldn't serve yet
+	oldLag := config.AppConstants.RetrievalHourLag
+	defer func() { config.AppConstants.RetrievalHourLag = oldLag }()
+	config.AppConstants.RetrievalHourLag = 2
+
+	mock.ExpectQuery(query).WithArgs(uint32(100), timemath.HourNumber(now)-2, minRollingStartIntervalNumber, "302").WillReturnRows(sqlmock.NewRows(columns))
+
+	_, _, receivedErr = diagnosisKeysSince(context.Background(), db, "302", 100, currentRollingStartIntervalNumber, 0)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
+
+	// Refuses a malformed region without a query
+	_, _, receivedErr = diagnosisKeysSince(context.Background(), db, "CA-ON", 105, currentRollingStartIntervalNumber, 0)
+	assert.Equal(t, ErrInvalidRegion, receivedErr, "Expected ErrInvalidRegion for a malformed region")
+}
+
+func TestCheckHourRange(t *testing.T) {
+	oldMax := config.AppConstants.MaxRetrievalRangeHours
+	defer func() { config.AppConstants.MaxRetrievalRangeHours = oldMax }()
+
+	config.AppConstants.MaxRetrievalRangeHours = 0
+	assert.Nil(t, checkHourRange(0, 100000), "Expected any range to be allowed by default")
+
+	config.AppConstants.MaxRetrievalRangeHours = 360
+	assert.Nil(t, checkHourRange(100, 124), "Expected nil for a single day")
+	assert.Nil(t, checkHourRange(100, 460), "Expected nil for a range at the limit")
+	assert.Equal(t, ErrRangeTooWide, checkHourRange(100, 461), "Expected ErrRangeTooWide for a range beyond the limit")
+
+	// Wide ranges are refused before querying
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	_, receivedErr := diagnosisKeysForHours(context.Background(), db, "302", 100, 461, 2651450, 0)
+	assert.Equal(t, ErrRangeTooWide, receivedErr, "Expected ErrRangeTooWide for a range beyond the limit")
+
+	_, receivedErr = diagnosisKeyPagesForHours(context.Background(), db, "302", 100, 461, 2651450, 0, 2)
+	assert.Equal(t, ErrRangeTooWide, receivedErr, "Expected ErrRangeTooWide for a range beyond the limit")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestQueriesCancelledContext(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, receivedErr := diagnosisKeysForHours(ctx, db, "302", 100, 200, 2651450, 0)
+	assert.Equal(t, context.Canceled, receivedErr, "Expected context.Canceled if the context was cancelled")
+
+	_, receivedErr = diagnosisKeyPagesForHours(ctx, db, "302", 100, 200, 2651450, 0, 2)
+	assert.Equal(t, context.Canceled, receivedErr, "Expected context.Canceled if the context was cancelled")
+
+	_, receivedErr = claimKey(ctx, db, "AAABBBCCCC", pub[:])
+	assert.Equal(t, context.Canceled, receivedErr, "Expected context.Canceled if the context was cancelled")
+
+	_, receivedErr = storeKeys(ctx, db, pub[:], nonce[:], []*pb.TemporaryExposureKey{}, 1)
+	assert.Equal(t, context.Canceled, receivedErr, "Expected context.Canceled if the context was cancelled")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeyPagesForHours(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	firstPageQuery := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data
+		LIMIT ?`
+	nextPageQuery := `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ? AND key_data > ?
+		AND deleted_at IS NULL
+		ORDER BY key_data
+		LIMIT ?`
+	columns := []string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}
+
+	// Rolls back and returns error if the first page fails
+	mock.ExpectBegin()
+	mock.ExpectQuery(firstPageQuery).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, 2).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+
+	receivedPages, receivedErr := diagnosisKeyPagesForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, 2)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedPages, "Expected no pages if the first page fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the first page fails")
+
+	// Each page carries on from the last key_data of the one before, in one
+	// transaction, until a short page
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows(columns).
+		AddRow("302", []byte("a"), 2651450, 144, 4, 1, nil).
+		AddRow("302", []byte("b"), 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(firstPageQuery).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, 2).WillReturnRows(rows)
+	rows = sqlmock.NewRows(columns).
+		AddRow("302", []byte("c"), 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(nextPageQuery).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, []byte("b"), 2).WillReturnRows(rows)
+	mock.ExpectRollback()
+
+	receivedPages, receivedErr = diagnosisKeyPagesForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, 2)
+	assert.Nil(t, receivedErr, "Expected nil if the first page was read")
+
+	page, err := receivedPages.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(page), "Expected a page of keys")
+	assert.Equal(t, []byte("a"), page[0].KeyData, "Expected keys in key_data order")
+	assert.Equal(t, []byte("b"), page[1].KeyData, "Expected keys in key_data order")
+
+	page, err = receivedPages.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page), "Expected the rest of the keys")
+	assert.Equal(t, []byte("c"), page[0].KeyData, "Expected the keys after the last page")
+
+	page, err = receivedPages.Next()
+	assert.Nil(t, err)
+	assert.Empty(t, page, "Expected no more keys after a short page")
+
+	assert.Nil(t, receivedPages.Close(), "Expected nil if the transaction was closed")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// Returns error if a later page fails
+	mock.ExpectBegin()
+	rows = sqlmock.NewRows(columns).
+		AddRow("302", []byte("a"), 2651450, 144, 4, 1, nil).
+		AddRow("302", []byte("b"), 2651450, 144, 4, 1, nil)
+	mock.ExpectQuery(firstPageQuery).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, 2).WillReturnRows(rows)
+	mock.ExpectQuery(nextPageQuery).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, []byte("b"), 2).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+
+	receivedPages, receivedErr = diagnosisKeyPagesForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0, 2)
+	assert.Nil(t, receivedErr, "Expected nil if the first page was read")
+
+	receivedPages.Next()
+	_, err = receivedPages.Next()
+	assert.Equal(t, fmt.Errorf("error"), err, "Expected error if a later page fails")
+
+	assert.Nil(t, receivedPages.Close(), "Expected nil if the transaction was closed")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysForHoursMinTransmissionRiskLevel(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	// No threshold leaves the query unchanged
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region).WillReturnRows(rows)
+
+	diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// A threshold adds the predicate and its arg
+	rows = sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		AND transmission_risk_level >= ?
+		ORDER BY key_data`).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region, int32(3)).WillReturnRows(rows)
+
+	diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 3)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiagnosisKeysForHoursSubmissionOrder(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldOrder := config.AppConstants.ExportKeyOrder
+	defer func() { config.AppConstants.ExportKeyOrder = oldOrder }()
+	config.AppConstants.ExportKeyOrder = config.ExportKeyOrderSubmission
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
+
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"})
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY hour_of_submission, key_data`).WithArgs(startHour, endHour, minRollingStartIntervalNumber, region).WillReturnRows(rows)
+
+	diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIncrementOriginatorUploadCount(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2020, 7, 20, 23, 30, 0, 0, time.UTC))
+
+	query := `INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`
+
+	// Adds to the count for the translated originator and today's UTC date
+	mock.ExpectExec(query).WithArgs(onApi, "2020-07-20", int64(3), int64(3)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	receivedErr := incrementOriginatorUploadCount(context.Background(), db, token1, 3)
+
+	assert.Nil(t, receivedErr, "Expected nil if upsert ran")
+
+	// Returns error if the upsert fails
+	mock.ExpectExec(query).WithArgs(onApi, "2020-07-20", int64(3), int64(3)).WillReturnError(fmt.Errorf("error"))
+
+	receivedErr = incrementOriginatorUploadCount(context.Background(), db, token1, 3)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if upsert fails")
+
+	// Tokens that don't map to a name are never stored
+	mock.ExpectExec(query).WithArgs(unknownOriginator, "2020-07-20", int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(query).WithArgs(unknownOriginator, "2020-07-20", int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.Nil(t, incrementOriginatorUploadCount(context.Background(), db, token2, 1), "Expected nil if upsert ran")
+	assert.Nil(t, incrementOriginatorUploadCount(context.Background(), db, "randomOrigin", 1), "Expected nil if upsert ran")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRetryOnDeadlock(t *testing.T) {
+	oldDelay := deadlockRetryDelay
+	defer func() { deadlockRetryDelay = oldDelay }()
+	deadlockRetryDelay = 0
+
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+	lockWaitTimeout := &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+
+	// Retries a deadlock and returns the later success
+	calls := 0
+	receivedErr := retryOnDeadlock(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return deadlock
+		}
+		return nil
+	})
+
+	assert.Nil(t, receivedErr, "Expected nil if a retry succeeds")
+	assert.Equal(t, 2, calls, "Expected one retry after the deadlock")
+
+	// Retries a lock wait timeout too
+	calls = 0
+	receivedErr = retryOnDeadlock(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return lockWaitTimeout
+		}
+		return nil
+	})
+
+	assert.Nil(t, receivedErr, "Expected nil if a retry succeeds")
+	assert.Equal(t, 2, calls, "Expected one retry after the lock wait timeout")
+
+	// Gives up on a persistent deadlock
+	calls = 0
+	receivedErr = retryOnDeadlock(context.Background(), func() error {
+		calls++
+		return deadlock
+	})
+
+	assert.Equal(t, deadlock, receivedErr, "Expected the deadlock if every attempt fails")
+	assert.Equal(t, deadlockAttempts, calls, "Expected every attempt to be used")
+
+	// Returns other errors straight away
+	calls = 0
+	receivedErr = retryOnDeadlock(context.Background(), func() error {
+		calls++
+		return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	})
+
+	assert.Equal(t, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, receivedErr, "Expected other errors to be returned")
+	assert.Equal(t, 1, calls, "Expected no retry for other errors")
+}
+
+func TestCheckAndRecordUploadNonce(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	query := `INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`
+
+	// Records a nonce on first use
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	tx, _ := db.Begin()
+
+	receivedErr := checkAndRecordUploadNonce(context.Background(), tx, pub[:], nonce[:])
+
+	assert.Nil(t, receivedErr, "Expected nil on first use of a nonce")
+
+	// Rejects a nonce that has been used before
+	mock.ExpectExec(query).WithArgs(pub[:], nonce[:]).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+
+	receivedErr = checkAndRecordUploadNonce(context.Background(), tx, pub[:], nonce[:])
+
+	assert.Equal(t, ErrReplay, receivedErr, "Expected ErrReplay if the nonce was already used")
+
+	// Passes other errors through
+	mock.ExpectExec(query).WithArgs(pub[:], nonce[:]).WillReturnError(fmt.Errorf("error"))
+
+	receivedErr = checkAndRecordUploadNonce(context.Background(), tx, pub[:], nonce[:])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the insert fails")
+}
+
+func TestStoreKeysReplay(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+
+	// Roll back without touching remaining_keys if the upload is a replay
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mock.ExpectRollback()
+
+	_, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, 1)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrReplay, receivedErr, "Expected ErrReplay if the nonce was already used")
+}
+
+func TestValidateRollingPeriod(t *testing.T) {
+	key := randomTestKey()
+	assert.Nil(t, validateRollingPeriod(key), "Expected nil for a rolling period of 144")
+
+	rollingPeriod := int32(0)
+	key.RollingPeriod = &rollingPeriod
+	assert.Equal(t, ErrInvalidRollingPeriod, validateRollingPeriod(key), "Expected ErrInvalidRollingPeriod for a rolling period of 0")
+
+	rollingPeriod = int32(200)
+	key.RollingPeriod = &rollingPeriod
+	assert.Equal(t, ErrInvalidRollingPeriod, validateRollingPeriod(key), "Expected ErrInvalidRollingPeriod for a rolling period of 200")
+}
+
+func TestValidateKey(t *testing.T) {
+	key := randomTestKey()
+	assert.Nil(t, validateKey(key), "Expected nil for a valid key")
+
+	key.KeyData = make([]byte, 15)
+	assert.Equal(t, ErrInvalidKeyData, validateKey(key), "Expected ErrInvalidKeyData for 15 bytes of key data")
+	key.KeyData = make([]byte, 16)
+	assert.Nil(t, validateKey(key), "Expected nil for 16 bytes of key data")
+	key.KeyData = make([]byte, 17)
+	assert.Equal(t, ErrInvalidKeyData, validateKey(key), "Expected ErrInvalidKeyData for 17 bytes of key data")
+
+	key = randomTestKey()
+	rollingPeriod := int32(0)
+	key.RollingPeriod = &rollingPeriod
+	assert.Equal(t, ErrInvalidRollingPeriod, validateKey(key), "Expected ErrInvalidRollingPeriod for a rolling period of 0")
+
+	key = randomTestKey()
+	rollingStartIntervalNumber := int32(0)
+	key.RollingStartIntervalNumber = &rollingStartIntervalNumber
+	assert.Equal(t, ErrInvalidRollingStartIntervalNumber, validateKey(key), "Expected ErrInvalidRollingStartIntervalNumber for a rolling start interval number of 0")
+
+	current := timemath.CurrentIntervalNumber()
+
+	rollingStartIntervalNumber = timemath.RollingStartIntervalNumberPlusDays(current, -1)
+	assert.Nil(t, validateKey(key), "Expected nil for yesterday's key")
+
+	rollingStartIntervalNumber = (current / pb.MaxTEKRollingPeriod) * pb.MaxTEKRollingPeriod
+	assert.Nil(t, validateKey(key), "Expected nil for today's key")
+
+	rollingStartIntervalNumber = current
+	assert.Nil(t, validateKey(key), "Expected nil for a key starting in the current interval")
+
+	rollingStartIntervalNumber = current + futureRollingStartTolerance
+	assert.Nil(t, validateKey(key), "Expected nil for a key just inside the tolerance")
+
+	rollingStartIntervalNumber = current + futureRollingStartTolerance + 1
+	assert.Equal(t, ErrFutureRollingStartIntervalNumber, validateKey(key), "Expected ErrFutureRollingStartIntervalNumber for a key past the tolerance")
+
+	rollingStartIntervalNumber = timemath.RollingStartIntervalNumberPlusDays(current, 30)
+	assert.Equal(t, ErrFutureRollingStartIntervalNumber, validateKey(key), "Expected ErrFutureRollingStartIntervalNumber for a key 30 days out")
+
+	key = randomTestKey()
+	daysSinceOnsetOfSymptoms := int32(3)
+	key.DaysSinceOnsetOfSymptoms = &daysSinceOnsetOfSymptoms
+	assert.Nil(t, validateKey(key), "Expected nil for an onset 3 days before the key")
+
+	daysSinceOnsetOfSymptoms = -14
+	assert.Nil(t, validateKey(key), "Expected nil at the lower bound")
+
+	daysSinceOnsetOfSymptoms = 14
+	assert.Nil(t, validateKey(key), "Expected nil at the upper bound")
+
+	daysSinceOnsetOfSymptoms = -15
+	assert.Equal(t, ErrInvalidDaysSinceOnsetOfSymptoms, validateKey(key), "Expected ErrInvalidDaysSinceOnsetOfSymptoms below -14")
+
+	daysSinceOnsetOfSymptoms = 15
+	assert.Equal(t, ErrInvalidDaysSinceOnsetOfSymptoms, validateKey(key), "Expected ErrInvalidDaysSinceOnsetOfSymptoms above 14")
+}
+
+// recordingBeginner is a txBeginner that records every BeginTx and either
+// fails it with err or hands it on to db.
+type recordingBeginner struct {
+	db    *sql.DB
+	err   error
+	calls int
+}
+
+func (b *recordingBeginner) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.db.BeginTx(ctx, opts)
+}
+
+func TestTransactionalQueriesUseTxBeginner(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	appPubKey, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+
+	// Nothing is begun for requests refused up front
+	beginner := &recordingBeginner{db: db, err: fmt.Errorf("begin failed")}
+
+	_, receivedErr := claimKey(context.Background(), beginner, "AAAAAAAAAA", []byte{})
+	assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat for a short app key")
+	_, receivedErr = persistEncryptionKey(context.Background(), beginner, "CA-ON", "randomOrigin", pub, priv, "AAAAAAAAAA")
+	assert.Equal(t, ErrInvalidRegion, receivedErr, "Expected ErrInvalidRegion for a malformed region")
+	_, receivedErr = storeKeys(context.Background(), beginner, []byte{}, nonce[:], nil, 1)
+	assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat for a short app key")
+
+	assert.Equal(t, 0, beginner.calls, "Expected no transaction to be begun")
+
+	// A failed begin is returned from each query
+	_, receivedErr = claimKey(context.Background(), beginner, "AAAAAAAAAA", appPubKey[:])
+	assert.Equal(t, beginner.err, receivedErr, "Expected the begin error from claimKey")
+	_, receivedErr = persistEncryptionKey(context.Background(), beginner, "302", "randomOrigin", pub, priv, "AAAAAAAAAA")
+	assert.Equal(t, beginner.err, receivedErr, "Expected the begin error from persistEncryptionKey")
+	_, receivedErr = storeKeys(context.Background(), beginner, appPubKey[:], nonce[:], nil, 1)
+	assert.Equal(t, beginner.err, receivedErr, "Expected the begin error from storeKeys")
+
+	assert.Equal(t, 3, beginner.calls, "Expected one begin per query")
+
+	// A working beginner commits the transaction it began
+	beginner = &recordingBeginner{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs(
+		"302",
+		"randomOrigin",
+		priv[:],
+		pub[:],
+		"AAAAAAAAAA",
+		config.AppConstants.InitialRemainingKeys,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedErr := persistEncryptionKey(context.Background(), beginner, "302", "randomOrigin", pub, priv, "AAAAAAAAAA")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if the insert committed")
+	assert.Equal(t, PersistResult{OneTimeCode: "AAAAAAAAAA"}, receivedResult, "Expected the persisted one time code")
+	assert.Equal(t, 1, beginner.calls, "Expected a single transaction")
+}
+
+func TestStoreKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	region := "302"
+	originator := "randomOrigin"
+	hourOfSubmission := uint32(442752)
+
+	selectQuery := `SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`
+	insertQuery := `INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	updateQuery := `UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`
+	statsQuery := `INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`
+
+	expectInsert := func(key *pb.TemporaryExposureKey) *sqlmock.ExpectedExec {
+		return mock.ExpectExec(insertQuery).WithArgs(
+			region,
+			originator,
+			key.GetKeyData(),
+			key.GetRollingStartIntervalNumber(),
+			key.GetRollingPeriod(),
+			key.GetTransmissionRiskLevel(),
+			key.GetReportType(),
+			key.DaysSinceOnsetOfSymptoms,
+			hourOfSubmission,
+		)
+	}
+
+	// Rejects a malformed public key without touching the database
+	_, receivedErr := storeKeys(context.Background(), db, pub[:31], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrInvalidKeyFormat, receivedErr, "Expected ErrInvalidKeyFormat for a 31 byte key")
+
+	// Rejects a batch over MaxKeysPerUpload without touching the database
+	oldMaxKeys := config.AppConstants.MaxKeysPerUpload
+	defer func() { config.AppConstants.MaxKeysPerUpload = oldMaxKeys }()
+	config.AppConstants.MaxKeysPerUpload = 2
+
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey(), randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrTooManyKeys, receivedErr, "Expected ErrTooManyKeys for a batch one over the limit")
+
+	// A batch at the limit goes on to the database
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("error"))
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected a batch at the limit to reach the database")
+
+	config.AppConstants.MaxKeysPerUpload = oldMaxKeys
+
+	// Returns error if the transaction can't be started
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("error"))
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if begin fails")
+
+	// Rolls back if the keypair can't be locked
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the select fails")
+
+	// Rolls back if the allowance is used up
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 0))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrKeyConsumed, receivedErr, "Expected ErrKeyConsumed if no keys are left")
+
+	// Rolls back if the insert can't be prepared
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{randomTestKey()}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if prepare fails")
+
+	// Rolls back if an insert fails
+	key := randomTestKey()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(key).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{key}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if insert fails")
+
+	// Rolls back if more keys are inserted than are allowed
+	keyOne, keyTwo := randomTestKey(), randomTestKey()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 1))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(keyOne).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectInsert(keyTwo).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{keyOne, keyTwo}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrTooManyKeys, receivedErr, "Expected ErrTooManyKeys if the allowance is exceeded")
+
+	// Rolls back if the allowance can't be decremented
+	key = randomTestKey()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(key).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(int64(1), int64(1), pub[:]).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{key}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrTooManyKeys, receivedErr, "Expected ErrTooManyKeys if the update fails")
+
+	// Rolls back if the upload count can't be recorded
+	key = randomTestKey()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(key).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(statsQuery).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{key}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the upload count can't be recorded")
+
+	// Returns error if the commit fails
+	key = randomTestKey()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(key).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(statsQuery).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit().WillReturnError(fmt.Errorf("error"))
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{key}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if commit fails")
+
+	// Stores the valid keys and reports the skipped ones
+	valid, duplicate := randomTestKey(), randomTestKey()
+	badPeriod := randomTestKey()
+	rollingPeriod := int32(0)
+	badPeriod.RollingPeriod = &rollingPeriod
+	badStart := randomTestKey()
+	rollingStartIntervalNumber := int32(0)
+	badStart.RollingStartIntervalNumber = &rollingStartIntervalNumber
+	future := randomTestKey()
+	futureRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(timemath.CurrentIntervalNumber(), 1)
+	future.RollingStartIntervalNumber = &futureRollingStartIntervalNumber
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(valid).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectInsert(duplicate).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(updateQuery).WithArgs(int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(statsQuery).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	receivedResult, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{valid, badPeriod, duplicate, badStart, future}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := StoreKeysResult{
+		Inserted:   1,
+		Duplicates: 1,
+		Skipped: []SkippedKey{
+			{KeyData: badPeriod.GetKeyData(), Reason: ErrInvalidRollingPeriod},
+			{KeyData: badStart.GetKeyData(), Reason: ErrInvalidRollingStartIntervalNumber},
+			{KeyData: future.GetKeyData(), Reason: ErrFutureRollingStartIntervalNumber},
+		},
+	}
+	assert.Equal(t, expectedResult, receivedResult, "Expected the inserted count and skipped keys")
+	assert.Nil(t, receivedErr, "Expected nil if the keys were stored")
+
+	// Keys whose key data isn't 16 bytes are skipped
+	short, exact, long := randomTestKey(), randomTestKey(), randomTestKey()
+	short.KeyData = short.KeyData[:15]
+	long.KeyData = append(long.KeyData, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	expectInsert(exact).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(statsQuery).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	receivedResult, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{short, exact, long}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult = StoreKeysResult{
+		Inserted: 1,
+		Skipped: []SkippedKey{
+			{KeyData: short.GetKeyData(), Reason: ErrInvalidKeyData},
+			{KeyData: long.GetKeyData(), Reason: ErrInvalidKeyData},
+		},
+	}
+	assert.Equal(t, expectedResult, receivedResult, "Expected only the 16 byte key to be inserted")
+	assert.Nil(t, receivedErr, "Expected nil if the valid key was stored")
+}
+
+func TestReportTypeRoundTrip(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	region := "302"
+	originator := "randomOrigin"
+	hourOfSubmission := uint32(100)
+
+	// Keys without a report type are stored as confirmed by a test
+	legacy := randomTestKey()
+	selfReport := randomTestKey()
+	selfReport.ReportType = pb.TemporaryExposureKey_SELF_REPORT.Enum()
+
+	insertQuery := `INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	mock.ExpectExec(insertQuery).WithArgs(region, originator, legacy.GetKeyData(), int32(2651450), int32(144), int32(2), 1, nil, hourOfSubmission).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertQuery).WithArgs(region, originator, selfReport.GetKeyData(), int32(2651450), int32(144), int32(2), 3, nil, hourOfSubmission).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`).WithArgs(int64(2), int64(2), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(2), int64(2)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{legacy, selfReport}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if keys were stored")
+
+	// Retrieved keys carry the stored report type
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).
+		AddRow(region, legacy.GetKeyData(), 2651450, 144, 2, 1, nil).
+		AddRow(region, selfReport.GetKeyData(), 2651450, 144, 2, 3, nil)
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`).WithArgs(startHour, endHour, AnyType{}, region).WillReturnRows(rows)
+
+	result, _ := diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	keys, receivedErr := handleKeysRows(result)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if rows were read")
+	assert.Equal(t, pb.TemporaryExposureKey_CONFIRMED_TEST, keys[0].GetReportType(), "Expected a confirmed test for the legacy key")
+	assert.Equal(t, pb.TemporaryExposureKey_SELF_REPORT, keys[1].GetReportType(), "Expected the self report to round trip")
+}
+
+func TestDaysSinceOnsetOfSymptomsRoundTrip(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	region := "302"
+	originator := "randomOrigin"
+	hourOfSubmission := uint32(100)
+
+	// Unknown onsets are stored as NULL, in-range ones as sent, and keys out of
+	// range are skipped
+	unknown := randomTestKey()
+	known := randomTestKey()
+	knownOnset := int32(-14)
+	known.DaysSinceOnsetOfSymptoms = &knownOnset
+	outOfRange := randomTestKey()
+	outOfRangeOnset := int32(21)
+	outOfRange.DaysSinceOnsetOfSymptoms = &outOfRangeOnset
+
+	insertQuery := `INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 5))
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(insertQuery)
+	mock.ExpectExec(insertQuery).WithArgs(region, originator, unknown.GetKeyData(), int32(2651450), int32(144), int32(2), 1, nil, hourOfSubmission).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertQuery).WithArgs(region, originator, known.GetKeyData(), int32(2651450), int32(144), int32(2), 1, -14, hourOfSubmission).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`).WithArgs(int64(2), int64(2), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(2), int64(2)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	receivedResult, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], []*pb.TemporaryExposureKey{unknown, known, outOfRange}, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if keys were stored")
+	assert.Equal(t, []SkippedKey{{KeyData: outOfRange.GetKeyData(), Reason: ErrInvalidDaysSinceOnsetOfSymptoms}}, receivedResult.Skipped, "Expected the out of range key to be skipped")
+
+	// Retrieved keys only carry an onset if one was stored
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "report_type", "days_since_onset_of_symptoms"}).
+		AddRow(region, unknown.GetKeyData(), 2651450, 144, 2, 1, nil).
+		AddRow(region, known.GetKeyData(), 2651450, 144, 2, 1, -14)
+	mock.ExpectQuery(`
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND deleted_at IS NULL
+		ORDER BY key_data`).WithArgs(startHour, endHour, AnyType{}, region).WillReturnRows(rows)
+
+	result, _ := diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber, 0)
+	keys, receivedErr := handleKeysRows(result)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if rows were read")
+	assert.Nil(t, keys[0].DaysSinceOnsetOfSymptoms, "Expected no onset for the unknown key")
+	assert.Equal(t, int32(-14), keys[1].GetDaysSinceOnsetOfSymptoms(), "Expected the stored onset")
+}
+
+func TestStoreKeysSkipsInvalidRollingPeriod(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	region := "302"
+	originator := "randomOrigin"
+	hourOfSubmission := timemath.HourNumber(time.Now())
+
+	valid := randomTestKey()
+	zero := randomTestKey()
+	zeroRollingPeriod := int32(0)
+	zero.RollingPeriod = &zeroRollingPeriod
+	tooLong := randomTestKey()
+	tooLongRollingPeriod := int32(200)
+	tooLong.RollingPeriod = &tooLongRollingPeriod
+
+	keys := []*pb.TemporaryExposureKey{zero, valid, tooLong}
+
+	// Only the valid key is inserted and counted against remaining_keys
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 3)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	)
+
+	mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`).WithArgs(
+		region,
+		originator,
+		valid.GetKeyData(),
+		valid.GetRollingStartIntervalNumber(),
+		valid.GetRollingPeriod(),
+		valid.GetTransmissionRiskLevel(),
+		valid.GetReportType(),
+		valid.DaysSinceOnsetOfSymptoms,
+		hourOfSubmission,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+	SET remaining_keys = remaining_keys - ?
+	WHERE remaining_keys >= ?
+	AND app_public_key = ?`,
+	).WithArgs(1, 1, pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	_, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], keys, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil when the valid keys are commited")
+}
+
+func TestStoreKeysClaimWindow(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldLimit := config.AppConstants.MaxClaimToUploadMinutes
+	defer func() { config.AppConstants.MaxClaimToUploadMinutes = oldLimit }()
+	config.AppConstants.MaxClaimToUploadMinutes = 60
+
+	now := time.Date(2021, 3, 2, 23, 30, 0, 0, time.UTC)
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(now)
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	region := "302"
+	originator := "randomOrigin"
+	keys := []*pb.TemporaryExposureKey{randomTestKey()}
+	hourOfSubmission := timemath.HourNumber(now)
+
+	// Roll back if the keypair was claimed too long ago
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	row = sqlmock.NewRows([]string{"expired"}).AddRow(true)
+	mock.ExpectQuery(`SELECT COALESCE(claimed_at < ?, TRUE) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(now.Add(-60*time.Minute), pub[:]).WillReturnRows(row)
+	mock.ExpectRollback()
+
+	_, receivedErr := storeKeys(context.Background(), db, pub[:], nonce[:], keys, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, ErrClaimExpiredForUpload, receivedErr, "Expected ErrClaimExpiredForUpload if claimed outside the window")
+
+	// Accepts uploads within the window
+	mock.ExpectBegin()
+	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	row = sqlmock.NewRows([]string{"expired"}).AddRow(false)
+	mock.ExpectQuery(`SELECT COALESCE(claimed_at < ?, TRUE) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(now.Add(-60*time.Minute), pub[:]).WillReturnRows(row)
+
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	)
+
+	for _, key := range keys {
+		mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`).WithArgs(
+			region,
+			originator,
+			key.GetKeyData(),
+			key.GetRollingStartIntervalNumber(),
+			key.GetRollingPeriod(),
+			key.GetTransmissionRiskLevel(),
+			key.GetReportType(),
+			key.DaysSinceOnsetOfSymptoms,
+			hourOfSubmission,
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+	SET remaining_keys = remaining_keys - ?
+	WHERE remaining_keys >= ?
+	AND app_public_key = ?`,
+	).WithArgs(
+		len(keys),
+		len(keys),
+		pub[:],
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], keys, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if claimed within the window")
+}
+
+// capturedTime matches any time.Time argument and remembers it.
+type capturedTime struct{ value *time.Time }
+
+func (c capturedTime) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	*c.value = t
+	return ok
+}
+
+func TestClaimLateThenUploadWithinWindow(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldLimit := config.AppConstants.MaxClaimToUploadMinutes
+	defer func() { config.AppConstants.MaxClaimToUploadMinutes = oldLimit }()
+	config.AppConstants.MaxClaimToUploadMinutes = 60
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	oneTimeCode := "80311300"
+	issued := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	claimedAt := time.Date(2021, 3, 2, 23, 0, 0, 0, time.UTC)
+	uploadedAt := claimedAt.Add(30 * time.Minute)
+	defer func() { clock = timemath.RealClock{} }()
+
+	// Claimed late on the day after the code was issued
+	clock = fixedClock(claimedAt)
+
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+	setupSelectOneTimeCode(mock, oneTimeCode, issued, pub[:])
+
+	var stored time.Time
+	mock.ExpectExec(fmt.Sprintf(
+		`UPDATE encryption_keys
+		SET one_time_code = NULL,
+			app_public_key = ?,
+			created = ?,
+			claimed_at = ?,
+			claimed_code_hash = ?
+		WHERE one_time_code = ?
+		AND created > (NOW() - INTERVAL %d MINUTE)`,
+		config.AppConstants.OneTimeCodeExpiryInMinutes,
+	)).WithArgs(pub[:], timemath.MostRecentUTCMidnight(issued), capturedTime{&stored}, hashOneTimeCode(oneTimeCode), oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, receivedErr := claimKey(context.Background(), db, oneTimeCode, pub[:])
+
+	assert.Nil(t, receivedErr, "Expected nil if claim ran")
+	assert.Equal(t, claimedAt, stored, "Expected claimed_at to record the time of the claim")
+
+	// Uploaded half an hour later
+	clock = fixedClock(uploadedAt)
+
+	var nonce [24]byte
+	keys := []*pb.TemporaryExposureKey{randomTestKey()}
+	hourOfSubmission := timemath.HourNumber(uploadedAt)
+	claimedAfter := uploadedAt.Add(-60 * time.Minute)
+
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "originator", 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnRows(row)
+	mock.ExpectExec(`INSERT INTO used_upload_nonces (app_public_key, nonce) VALUES (?, ?)`).WithArgs(pub[:], nonce[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	row = sqlmock.NewRows([]string{"expired"}).AddRow(stored.Before(claimedAfter))
+	mock.ExpectQuery(`SELECT COALESCE(claimed_at < ?, TRUE) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(claimedAfter, pub[:]).WillReturnRows(row)
+
+	insert := `INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, report_type, days_since_onset_of_symptoms, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	mock.ExpectPrepare(insert)
+	for _, key := range keys {
+		mock.ExpectExec(insert).WithArgs(
+			"302",
+			"originator",
+			key.GetKeyData(),
+			key.GetRollingStartIntervalNumber(),
+			key.GetRollingPeriod(),
+			key.GetTransmissionRiskLevel(),
+			key.GetReportType(),
+			key.DaysSinceOnsetOfSymptoms,
+			hourOfSubmission,
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+	SET remaining_keys = remaining_keys - ?
+	WHERE remaining_keys >= ?
+	AND app_public_key = ?`,
+	).WithArgs(len(keys), len(keys), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`INSERT INTO originator_upload_stats
+		(originator, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(unknownOriginator, AnyType{}, int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit()
+
+	_, receivedErr = storeKeys(context.Background(), db, pub[:], nonce[:], keys, hourOfSubmission)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if uploaded within the window of a late claim")
+}
+
+func TestCheckClaimKeyBan(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	var maxConsecutiveClaimKeyFailures = config.AppConstants.MaxConsecutiveClaimKeyFailures
+
+	identifier := "127.0.0.1"
+
+	// Queries and succeeds if no result is found
+	row := sqlmock.NewRows([]string{"failures", "last_failure"})
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+
+	expectedTriesRemaining := maxConsecutiveClaimKeyFailures
+	expectedBanDuration := time.Duration(0)
+
+	receivedTriesRemaining, receivedBanDuration, _ := checkClaimKeyBan(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+
+	// Queries and fails if an unkown error is returned
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnError(fmt.Errorf("error"))
+
+	expectedTriesRemaining = 0
+	expectedBanDuration = time.Duration(0)
+	expectedErr := fmt.Errorf("error")
+
+	receivedTriesRemaining, receivedBanDuration, receivedErr := checkClaimKeyBan(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if unkown error occures")
+
+	// Returns correct tries remaining if not banned
+	attempts := 1
+	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now())
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+
+	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - attempts
+	expectedBanDuration = time.Duration(0)
+
+	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures - attempts as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+
+	// Returns correct banDuration if banned
+	attempts = maxConsecutiveClaimKeyFailures
+	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now())
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+
+	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - attempts
+	expectedBanDuration, _ = time.ParseDuration("59m59s")
+
+	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected 0 as tries remaining")
+	assert.GreaterOrEqual(t, receivedBanDuration.Seconds(), expectedBanDuration.Seconds(), "Expected something greater than 59m59s as ban duration")
+
+	// Resets if banDuration has expired
+	attempts = maxConsecutiveClaimKeyFailures
+	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now().Add(-time.Hour*1))
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+
+	expectedTriesRemaining = maxConsecutiveClaimKeyFailures
+	expectedBanDuration = time.Duration(0)
+
+	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+}
+
+func TestRegisterClaimKeySuccess(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	identifier := "127.0.0.1"
+
+	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnResult(sqlmock.NewResult(1, 1))
+	receivedResult := registerClaimKeySuccess(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult, "Expected nil if executed delete")
+}
+
+func TestRegisterClaimKeyFailure(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	identifier := "127.0.0.1"
+	var maxConsecutiveClaimKeyFailures = config.AppConstants.MaxConsecutiveClaimKeyFailures
+
+	// Roll back if insert fails
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
+		ON DUPLICATE KEY UPDATE
+      failures = failures + 1,
+			last_failure = NOW()`).WithArgs(
+		identifier,
+	).WillReturnError(fmt.Errorf("error"))
+	mock.ExpectRollback()
+
+	expectedTriesRemaining := 0
+	expectedBanDuration := time.Duration(0)
+	expectedErr := fmt.Errorf("error")
+
+	receivedTriesRemaining, receivedBanDuration, receivedErr := registerClaimKeyFailure(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
+
+	// Rolls back if checkClaimKeyBan returns an error
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
+		ON DUPLICATE KEY UPDATE
+      failures = failures + 1,
+			last_failure = NOW()`).WithArgs(
+		identifier,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	//--> Called in checkClaimKeyBan
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnError(fmt.Errorf("error"))
+
+	mock.ExpectRollback()
+
+	expectedTriesRemaining = 0
+	expectedBanDuration = time.Duration(0)
+	expectedErr = fmt.Errorf("error")
+
+	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
+
+	// Commits and returns the correct data from checkClaimKeyBan
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
+		ON DUPLICATE KEY UPDATE
+      failures = failures + 1,
+			last_failure = NOW()`).WithArgs(
+		identifier,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	//--> Called in checkClaimKeyBan
+	row := sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(1, time.Now())
+	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+
+	mock.ExpectCommit()
+
+	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - 1
+	expectedBanDuration = time.Duration(0)
+
+	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(context.Background(), db, identifier)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures - 1 as tries remaining")
+	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
+	assert.Nil(t, receivedErr, "Expected no error if inserted")
+}
+
+func TestDeleteOldFailedClaimKeyAttempts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectedResult := int64(1)
+	receivedResult, receivedError := deleteOldFailedClaimKeyAttempts(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to only affect one row")
+	assert.Nil(t, receivedError, "Expected nil if executed delete")
+
+	// A dry run only counts the rows it would delete
+	mock.ExpectQuery(`SELECT COUNT(*) FROM failed_key_claim_attempts WHERE last_failure < ?`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	receivedResult, receivedError = deleteOldFailedClaimKeyAttempts(context.Background(), db, CleanupOptions{DryRun: true})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, int64(2), receivedResult, "Expected the number of rows that would be deleted")
+	assert.Nil(t, receivedError, "Expected nil if count ran")
+}
+
+func TestCountRecentClaimFailures(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `SELECT COALESCE(SUM(failures), 0) FROM failed_key_claim_attempts WHERE last_failure >= ?`
+	now := time.Now()
+
+	// Attempts inside the window are summed
+	since := now.Add(-15 * time.Minute)
+	mock.ExpectQuery(query).WithArgs(since).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+
+	receivedResult, receivedError := countRecentClaimFailures(context.Background(), db, since)
+
+	assert.Equal(t, 7, receivedResult, "Expected the failures inside the window")
+	assert.Nil(t, receivedError, "Expected nil if the count succeeded")
+
+	// No attempts inside the window counts zero
+	since = now.Add(-time.Minute)
+	mock.ExpectQuery(query).WithArgs(since).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	receivedResult, receivedError = countRecentClaimFailures(context.Background(), db, since)
+
+	assert.Equal(t, 0, receivedResult, "Expected no failures outside the window to be counted")
+	assert.Nil(t, receivedError, "Expected nil if the count succeeded")
+
+	// Return error
+	mock.ExpectQuery(query).WithArgs(since).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedError = countRecentClaimFailures(context.Background(), db, since)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, -1, receivedResult, "Expected -1 if the query failed")
+	assert.Equal(t, fmt.Errorf("error"), receivedError, "Expected error if the query failed")
+}
+
+func TestDeleteOldUploadNonces(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	mock.ExpectExec(`DELETE FROM used_upload_nonces WHERE created < ?`).WithArgs(now.Add(-uploadNonceRetention)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectedResult := int64(1)
+	receivedResult, receivedError := deleteOldUploadNonces(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to only affect one row")
+	assert.Nil(t, receivedError, "Expected nil if executed delete")
+}
+
+func TestCountClaimedOneTimeCodes(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NULL`).WillReturnRows(row)
+
+	expectedResult := int64(100)
+
+	receivedResult, receivedErr := countClaimedOneTimeCodes(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestCountDiagnosisKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM diagnosis_keys WHERE deleted_at IS NULL`).WillReturnRows(row)
+
+	expectedResult := int64(100)
+
+	receivedResult, receivedErr := countDiagnosisKeys(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestCountUnclaimedOneTimeCodes(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
+	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NOT NULL`).WillReturnRows(row)
+
+	expectedResult := int64(100)
+
+	receivedResult, receivedErr := countUnclaimedOneTimeCodes(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestExpireOneTimeCode(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := "DELETE FROM encryption_keys WHERE one_time_code = ? AND app_public_key IS NULL"
+
+	// Returns error if delete fails
+	mock.ExpectExec(query).WithArgs("ABC123DEF4").WillReturnError(fmt.Errorf("error"))
+
+	receivedErr := expireOneTimeCode(context.Background(), db, "ABC123DEF4")
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if delete fails")
+
+	// Returns ErrCodeNotFound if the code was already claimed or doesn't exist
+	mock.ExpectExec(query).WithArgs("ABC123DEF4").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	receivedErr = expireOneTimeCode(context.Background(), db, "ABC123DEF4")
+
+	assert.Equal(t, ErrCodeNotFound, receivedErr, "Expected ErrCodeNotFound if nothing was deleted")
+
+	// Revokes an unclaimed code
+	mock.ExpectExec(query).WithArgs("ABC123DEF4").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	receivedErr = expireOneTimeCode(context.Background(), db, "ABC123DEF4")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if the code was revoked")
+}
+
+func TestServerPublicKeyForCode(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `SELECT server_public_key FROM encryption_keys WHERE one_time_code = ? AND app_public_key IS NULL`
+	pub, _, _ := box.GenerateKey(rand.Reader)
+
+	// Returns the server public key of an unclaimed code
+	mock.ExpectQuery(query).WithArgs("AAAAAAAAAA").WillReturnRows(sqlmock.NewRows([]string{"server_public_key"}).AddRow(pub[:]))
+
+	receivedResult, receivedErr := serverPublicKeyForCode(context.Background(), db, "AAAAAAAAAA")
+
+	assert.Equal(t, pub[:], receivedResult, "Expected the server public key")
+	assert.Nil(t, receivedErr, "Expected nil for an unclaimed code")
+
+	// Returns ErrCodeNotFound if the code was already claimed or doesn't exist
+	mock.ExpectQuery(query).WithArgs("BBBBBBBBBB").WillReturnRows(sqlmock.NewRows([]string{"server_public_key"}))
+
+	receivedResult, receivedErr = serverPublicKeyForCode(context.Background(), db, "BBBBBBBBBB")
+
+	assert.Nil(t, receivedResult, "Expected no key for a missing code")
+	assert.Equal(t, ErrCodeNotFound, receivedErr, "Expected ErrCodeNotFound for a missing code")
+
+	// Returns error if the query fails
+	mock.ExpectQuery(query).WithArgs("AAAAAAAAAA").WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr = serverPublicKeyForCode(context.Background(), db, "AAAAAAAAAA")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult, "Expected no key if the query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the query fails")
+}
+
+func TestOneTimeCodeRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `SELECT region FROM encryption_keys WHERE one_time_code = ?`
+
+	// Returns the region stored with the code
+	mock.ExpectQuery(query).WithArgs("AAAAAAAAAA").WillReturnRows(sqlmock.NewRows([]string{"region"}).AddRow("303"))
+
+	receivedResult, receivedErr := oneTimeCodeRegion(context.Background(), db, "AAAAAAAAAA")
+
+	assert.Equal(t, "303", receivedResult, "Expected the code's region")
+	assert.Nil(t, receivedErr, "Expected nil for a known code")
+
+	// Returns ErrCodeNotFound if the code doesn't exist
+	mock.ExpectQuery(query).WithArgs("BBBBBBBBBB").WillReturnRows(sqlmock.NewRows([]string{"region"}))
+
+	receivedResult, receivedErr = oneTimeCodeRegion(context.Background(), db, "BBBBBBBBBB")
+
+	assert.Equal(t, "", receivedResult, "Expected no region for a missing code")
+	assert.Equal(t, ErrCodeNotFound, receivedErr, "Expected ErrCodeNotFound for a missing code")
+
+	// Returns error if the query fails
+	mock.ExpectQuery(query).WithArgs("AAAAAAAAAA").WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr = oneTimeCodeRegion(context.Background(), db, "AAAAAAAAAA")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the query fails")
+}
+
+func TestOneTimeCodeStatus(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	defer func() { clock = timemath.RealClock{} }()
+	now := time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC)
+	clock = fixedClock(now)
+
+	query := "SELECT created FROM encryption_keys WHERE one_time_code = ? AND originator = ?"
+	claimedQuery := "SELECT COUNT(*) FROM encryption_keys WHERE claimed_code_hash = ? AND originator = ?"
+	expiry := time.Duration(config.AppConstants.OneTimeCodeExpiryInMinutes) * time.Minute
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs("ABC123DEF4", token1).WillReturnError(fmt.Errorf("error"))
+
+	status, receivedErr := oneTimeCodeStatus(context.Background(), db, token1, "ABC123DEF4")
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+	assert.Equal(t, ClaimStatus(""), status, "Expected no status if query fails")
+
+	for _, tc := range []struct {
+		name     string
+		created  time.Time
+		expected ClaimStatus
+	}{
+		{"an unclaimed code", now.Add(-time.Hour), Unclaimed},
+		{"a code past its expiry", now.Add(-expiry), Expired},
+	} {
+		rows := sqlmock.NewRows([]string{"created"}).AddRow(tc.created)
+		mock.ExpectQuery(query).WithArgs("ABC123DEF4", token1).WillReturnRows(rows)
+
+		status, receivedErr = oneTimeCodeStatus(context.Background(), db, token1, "ABC123DEF4")
+
+		assert.Nil(t, receivedErr, "Expected nil if query ran")
+		assert.Equal(t, tc.expected, status, "Expected %s for %s", tc.expected, tc.name)
+	}
+
+	// Returns error if the claimed code lookup fails
+	mock.ExpectQuery(query).WithArgs("ABC123DEF4", token1).WillReturnRows(sqlmock.NewRows([]string{"created"}))
+	mock.ExpectQuery(claimedQuery).WithArgs(hashOneTimeCode("ABC123DEF4"), token1).WillReturnError(fmt.Errorf("error"))
+
+	status, receivedErr = oneTimeCodeStatus(context.Background(), db, token1, "ABC123DEF4")
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+	assert.Equal(t, ClaimStatus(""), status, "Expected no status if query fails")
+
+	// Claiming cleared the code but left its hash, as claimKey writes it
+	mock.ExpectQuery(query).WithArgs("ABC123DEF4", token1).WillReturnRows(sqlmock.NewRows([]string{"created"}))
+	mock.ExpectQuery(claimedQuery).WithArgs(hashOneTimeCode("ABC123DEF4"), token1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	status, receivedErr = oneTimeCodeStatus(context.Background(), db, token1, "ABC123DEF4")
+
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+	assert.Equal(t, Claimed, status, "Expected Claimed for a claimed code")
+
+	// A code that doesn't exist, or belongs to another originator
+	mock.ExpectQuery(query).WithArgs("ABC123DEF4", token1).WillReturnRows(sqlmock.NewRows([]string{"created"}))
+	mock.ExpectQuery(claimedQuery).WithArgs(hashOneTimeCode("ABC123DEF4"), token1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	status, receivedErr = oneTimeCodeStatus(context.Background(), db, token1, "ABC123DEF4")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+	assert.Equal(t, NotFound, status, "Expected NotFound for an unknown code")
+}
+
+func TestCountUnclaimedCodes(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := "SELECT COUNT(*) FROM encryption_keys WHERE originator = ? AND one_time_code IS NOT NULL AND created > (NOW() - INTERVAL ? MINUTE)"
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs("originator", config.AppConstants.OneTimeCodeExpiryInMinutes).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := countUnclaimedCodes(context.Background(), db, "originator")
+
+	assert.Equal(t, -1, receivedResult, "Expected -1 if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns zero if the originator has no outstanding codes
+	row := sqlmock.NewRows([]string{"count"}).AddRow(0)
+	mock.ExpectQuery(query).WithArgs("originator", config.AppConstants.OneTimeCodeExpiryInMinutes).WillReturnRows(row)
+
+	receivedResult, receivedErr = countUnclaimedCodes(context.Background(), db, "originator")
+
+	assert.Equal(t, 0, receivedResult, "Expected to receive count of 0")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	// Returns the count
+	row = sqlmock.NewRows([]string{"count"}).AddRow(7)
+	mock.ExpectQuery(query).WithArgs("originator", config.AppConstants.OneTimeCodeExpiryInMinutes).WillReturnRows(row)
+
+	receivedResult, receivedErr = countUnclaimedCodes(context.Background(), db, "originator")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 7, receivedResult, "Expected to receive count of 7")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestActiveEncryptionKeysByRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := fmt.Sprintf(`
+		SELECT region, COUNT(*) FROM encryption_keys
+		WHERE one_time_code IS NOT NULL
+		AND   created >= (NOW() - INTERVAL %d MINUTE)
+		GROUP BY region`, config.AppConstants.OneTimeCodeExpiryInMinutes)
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := activeEncryptionKeysByRegion(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult, "Expected nil if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Counts are grouped by region
+	rows := sqlmock.NewRows([]string{"region", "count"}).AddRow("302", 12).AddRow("303", 4)
+	mock.ExpectQuery(query).WillReturnRows(rows)
+
+	receivedResult, receivedErr = activeEncryptionKeysByRegion(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, map[string]int{"302": 12, "303": 4}, receivedResult, "Expected active codes for both regions")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func randomTestKey() *pb.TemporaryExposureKey {
+	token := make([]byte, 16)
+	rand.Read(token)
+	transmissionRiskLevel := int32(2)
+	rollingStartIntervalNumber := int32(2651450)
+	rollingPeriod := int32(144)
+	key := &pb.TemporaryExposureKey{
+		KeyData:                    token,
+		TransmissionRiskLevel:      &transmissionRiskLevel,
+		RollingStartIntervalNumber: &rollingStartIntervalNumber,
+		RollingPeriod:              &rollingPeriod,
+	}
+	return key
+}
+
+func TestClampRemainingKeysToOriginatorLimit(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.OriginatorRemainingKeys = map[string]uint32{"onapi": 60}
+	defer func() { config.AppConstants.OriginatorRemainingKeys = map[string]uint32{} }()
+
+	limit := config.AppConstants.InitialRemainingKeys
+	selectQuery := `SELECT DISTINCT originator FROM encryption_keys WHERE remaining_keys > 0`
+	updateQuery := `UPDATE encryption_keys SET remaining_keys = ? WHERE originator = ? AND remaining_keys > ?`
+
+	// Returns error if originators can't be listed
+	mock.ExpectQuery(selectQuery).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := clampRemainingKeysToOriginatorLimit(context.Background(), db, CleanupOptions{})
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	expectedErr = ErrTooManyKeys
-	assert.Equal(t, expectedErr, receivedErr, "Expected error more keys than allowed are inserted")
+	assert.Equal(t, int64(0), receivedResult, "Expected no rows to be clamped")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if select fails")
 
-	// Commits and logs how many keys were inserted
-	keyOne = randomTestKey()
-	keyTwo = randomTestKey()
-	keys = []*pb.TemporaryExposureKey{keyOne, keyTwo}
+	// Returns error if update fails
+	mock.ExpectQuery(selectQuery).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token2))
+	mock.ExpectExec(updateQuery).WithArgs(limit, token2, limit).WillReturnError(fmt.Errorf("error"))
 
-	hourOfSubmission = timemath.HourNumber(time.Now())
+	receivedResult, receivedErr = clampRemainingKeysToOriginatorLimit(context.Background(), db, CleanupOptions{})
 
-	mock.ExpectBegin()
-	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 3)
-	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 
-	mock.ExpectPrepare(
-		`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	)
+	assert.Equal(t, int64(0), receivedResult, "Expected no rows to be clamped")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if update fails")
 
-	for _, key := range keys {
-		mock.ExpectExec(`INSERT IGNORE INTO diagnosis_keys
-		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`).WithArgs(
-			region,
-			originator,
-			key.GetKeyData(),
-			key.GetRollingStartIntervalNumber(),
-			key.GetRollingPeriod(),
-			key.GetTransmissionRiskLevel(),
-			hourOfSubmission,
-		).WillReturnResult(sqlmock.NewResult(1, 1))
+	// Each originator is clamped to its own allowance
+	mock.ExpectQuery(selectQuery).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token1).AddRow(token2))
+	mock.ExpectExec(updateQuery).WithArgs(uint32(60), token1, uint32(60)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(updateQuery).WithArgs(limit, token2, limit).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	receivedResult, receivedErr = clampRemainingKeysToOriginatorLimit(context.Background(), db, CleanupOptions{})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	mock.ExpectExec(
-		`UPDATE encryption_keys
-	SET remaining_keys = remaining_keys - ?
-	WHERE remaining_keys >= ?
-	AND app_public_key = ?`,
-	).WithArgs(
-		len(keys),
-		len(keys),
-		pub[:],
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.Equal(t, int64(3), receivedResult, "Expected the rows over each originator's allowance to be clamped")
+	assert.Nil(t, receivedErr, "Expected nil if update ran")
 
-	mock.ExpectCommit()
-	receivedResult := registerDiagnosisKeys(db, pub, keys, nil)
+	// A dry run only counts the rows it would clamp
+	countQuery := `SELECT COUNT(*) FROM encryption_keys WHERE originator = ? AND remaining_keys > ?`
+	mock.ExpectQuery(selectQuery).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token1).AddRow(token2))
+	mock.ExpectQuery(countQuery).WithArgs(token1, uint32(60)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(countQuery).WithArgs(token2, limit).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	receivedResult, receivedErr = clampRemainingKeysToOriginatorLimit(context.Background(), db, CleanupOptions{DryRun: true})
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Nil(t, receivedResult, "Expected nil when keys are commited")
+	assert.Equal(t, int64(3), receivedResult, "Expected the rows over each originator's allowance to be counted")
+	assert.Nil(t, receivedErr, "Expected nil if count ran")
 }
 
-func TestCheckClaimKeyBan(t *testing.T) {
-	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+func TestPing(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual), sqlmock.MonitorPingsOption(true))
 	defer db.Close()
 
-	var maxConsecutiveClaimKeyFailures = config.AppConstants.MaxConsecutiveClaimKeyFailures
+	// Returns error if the ping fails
+	mock.ExpectPing().WillReturnError(fmt.Errorf("error"))
 
-	identifier := "127.0.0.1"
+	receivedErr := ping(context.Background(), db)
 
-	// Queries and succeeds if no result is found
-	row := sqlmock.NewRows([]string{"failures", "last_failure"})
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 
-	expectedTriesRemaining := maxConsecutiveClaimKeyFailures
-	expectedBanDuration := time.Duration(0)
+	assert.EqualError(t, receivedErr, "database ping failed: error", "Expected error if ping failed")
+
+	// Returns error if the query fails
+	mock.ExpectPing()
+	mock.ExpectQuery(`SELECT 1`).WillReturnError(fmt.Errorf("error"))
 
-	receivedTriesRemaining, receivedBanDuration, _ := checkClaimKeyBan(db, identifier)
+	receivedErr = ping(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-
-	// Queries and fails if an unkown error is returned
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnError(fmt.Errorf("error"))
+	assert.EqualError(t, receivedErr, "database SELECT 1 failed: error", "Expected error if query failed")
 
-	expectedTriesRemaining = 0
-	expectedBanDuration = time.Duration(0)
-	expectedErr := fmt.Errorf("error")
+	// Success
+	mock.ExpectPing()
+	mock.ExpectQuery(`SELECT 1`).WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr := checkClaimKeyBan(db, identifier)
+	receivedErr = ping(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if unkown error occures")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
 
-	// Returns correct tries remaining if not banned
-	attempts := 1
-	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now())
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+func TestEnforceRegionCodeCap(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
 
-	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - attempts
-	expectedBanDuration = time.Duration(0)
+	oldLimits := config.AppConstants.MaxActiveCodesPerRegion
+	defer func() { config.AppConstants.MaxActiveCodesPerRegion = oldLimits }()
+	config.AppConstants.MaxActiveCodesPerRegion = map[string]int{"302": 10, "999": 100}
+
+	query := `SELECT COUNT(*) FROM encryption_keys WHERE region = ? AND one_time_code IS NOT NULL FOR UPDATE`
+
+	// Under the cap
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(9))
 
-	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(db, identifier)
+	receivedErr := enforceRegionCodeCap(context.Background(), db, "302")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures - attempts as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-
-	// Returns correct banDuration if banned
-	attempts = maxConsecutiveClaimKeyFailures
-	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now())
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+	assert.Nil(t, receivedErr, "Expected nil if region is under its cap")
 
-	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - attempts
-	expectedBanDuration, _ = time.ParseDuration("59m59s")
+	// At the cap
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
 
-	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(db, identifier)
+	receivedErr = enforceRegionCodeCap(context.Background(), db, "302")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected 0 as tries remaining")
-	assert.GreaterOrEqual(t, receivedBanDuration.Seconds(), expectedBanDuration.Seconds(), "Expected something greater than 59m59s as ban duration")
+	assert.Equal(t, ErrRegionCodeCapReached, receivedErr, "Expected ErrRegionCodeCapReached if region is at its cap")
 
-	// Resets if banDuration has expired
-	attempts = maxConsecutiveClaimKeyFailures
-	row = sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(attempts, time.Now().Add(-time.Hour*1))
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+	// Another region is counted against its own cap
+	mock.ExpectQuery(query).WithArgs("999").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
 
-	expectedTriesRemaining = maxConsecutiveClaimKeyFailures
-	expectedBanDuration = time.Duration(0)
+	receivedErr = enforceRegionCodeCap(context.Background(), db, "999")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if another region is at the first region's cap")
 
-	receivedTriesRemaining, receivedBanDuration, _ = checkClaimKeyBan(db, identifier)
+	// Regions without a cap aren't counted
+	receivedErr = enforceRegionCodeCap(context.Background(), db, "123")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-}
+	assert.Nil(t, receivedErr, "Expected nil if region has no cap")
 
-func TestRegisterClaimKeySuccess(t *testing.T) {
-	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
-	defer db.Close()
+	// The count shares the insert's transaction, which is rolled back at the cap
+	pub, priv, _ := box.GenerateKey(rand.Reader)
 
-	identifier := "127.0.0.1"
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+	mock.ExpectRollback()
 
-	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnResult(sqlmock.NewResult(1, 1))
-	receivedResult := registerClaimKeySuccess(db, identifier)
+	_, receivedErr = persistEncryptionKey(context.Background(), db, "302", "randomOrigin", pub, priv, "AAAAAAAAAA")
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Nil(t, receivedResult, "Expected nil if executed delete")
+	assert.Equal(t, ErrRegionCodeCapReached, receivedErr, "Expected ErrRegionCodeCapReached without inserting a code")
+
+	// Under the cap the code is inserted before the transaction commits
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(9))
+	mock.ExpectExec(`INSERT INTO encryption_keys
+		(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
+		VALUES (?, ?, ?, ?, ?, ?)`).WithArgs("302", "randomOrigin", priv[:], pub[:], "AAAAAAAAAA", config.AppConstants.InitialRemainingKeys).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, receivedErr = persistEncryptionKey(context.Background(), db, "302", "randomOrigin", pub, priv, "AAAAAAAAAA")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedErr, "Expected nil if the region is under its cap")
 }
 
-func TestRegisterClaimKeyFailure(t *testing.T) {
+func TestEnforceHashIDRateLimit(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	identifier := "127.0.0.1"
-	var maxConsecutiveClaimKeyFailures = config.AppConstants.MaxConsecutiveClaimKeyFailures
+	oldLimit := config.AppConstants.HashIDRateLimit
+	oldWindow := config.AppConstants.HashIDRateLimitWindowMinutes
+	defer func() {
+		config.AppConstants.HashIDRateLimit = oldLimit
+		config.AppConstants.HashIDRateLimitWindowMinutes = oldWindow
+	}()
+	config.AppConstants.HashIDRateLimitWindowMinutes = 60
 
-	// Roll back if insert fails
-	mock.ExpectBegin()
-	mock.ExpectExec(
-		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
-		ON DUPLICATE KEY UPDATE
-      failures = failures + 1,
-			last_failure = NOW()`).WithArgs(
-		identifier,
-	).WillReturnError(fmt.Errorf("error"))
-	mock.ExpectRollback()
+	hashID := "abcd"
+	query := `SELECT COUNT(*) FROM hash_id_key_claims WHERE hash_id = ? AND created > (NOW() - INTERVAL ? MINUTE) FOR UPDATE`
+	insert := `INSERT INTO hash_id_key_claims (hash_id) VALUES (?)`
 
-	expectedTriesRemaining := 0
-	expectedBanDuration := time.Duration(0)
-	expectedErr := fmt.Errorf("error")
+	// Nothing is counted if the limit is disabled
+	config.AppConstants.HashIDRateLimit = 0
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr := registerClaimKeyFailure(db, identifier)
+	receivedErr := enforceHashIDRateLimit(context.Background(), db, hashID)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
-
-	// Rolls back if checkClaimKeyBan returns an error
-	mock.ExpectBegin()
-	mock.ExpectExec(
-		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
-		ON DUPLICATE KEY UPDATE
-      failures = failures + 1,
-			last_failure = NOW()`).WithArgs(
-		identifier,
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.Nil(t, receivedErr, "Expected nil if the limit is disabled")
 
-	//--> Called in checkClaimKeyBan
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnError(fmt.Errorf("error"))
+	config.AppConstants.HashIDRateLimit = 3
 
+	// Rolls back if the count fails
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs(hashID, uint32(60)).WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
 
-	expectedTriesRemaining = 0
-	expectedBanDuration = time.Duration(0)
-	expectedErr = fmt.Errorf("error")
-
-	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(db, identifier)
+	receivedErr = enforceHashIDRateLimit(context.Background(), db, hashID)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-	assert.Equal(t, expectedErr, receivedErr, "Expected error if could not execute update")
-
-	// Commits and returns the correct data from checkClaimKeyBan
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if the count fails")
 
+	// Under the limit the code is recorded
 	mock.ExpectBegin()
-	mock.ExpectExec(
-		`INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
-		ON DUPLICATE KEY UPDATE
-      failures = failures + 1,
-			last_failure = NOW()`).WithArgs(
-		identifier,
-	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(query).WithArgs(hashID, uint32(60)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(insert).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	//--> Called in checkClaimKeyBan
-	row := sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(1, time.Now())
-	mock.ExpectQuery(`SELECT failures, last_failure FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnRows(row)
+	receivedErr = enforceHashIDRateLimit(context.Background(), db, hashID)
 
-	mock.ExpectCommit()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 
-	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - 1
-	expectedBanDuration = time.Duration(0)
+	assert.Nil(t, receivedErr, "Expected nil if the hashID is under the limit")
+
+	// At the limit the request is refused and nothing is recorded
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs(hashID, uint32(60)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectRollback()
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(db, identifier)
+	receivedErr = enforceHashIDRateLimit(context.Background(), db, hashID)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedTriesRemaining, receivedTriesRemaining, "Expected maxConsecutiveClaimKeyFailures - 1 as tries remaining")
-	assert.Equal(t, expectedBanDuration, receivedBanDuration, "Expected 0 as ban duration")
-	assert.Nil(t, receivedErr, "Expected no error if inserted")
+	assert.Equal(t, ErrHashIDRateLimited, receivedErr, "Expected ErrHashIDRateLimited if the hashID is at the limit")
 }
 
-func TestDeleteOldFailedClaimKeyAttempts(t *testing.T) {
+func TestDeleteOldHashIDKeyClaims(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM hash_id_key_claims WHERE created < (NOW() - INTERVAL ? MINUTE)`).WithArgs(config.AppConstants.HashIDRateLimitWindowMinutes).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	expectedResult := int64(1)
-	receivedResult, receivedError := deleteOldFailedClaimKeyAttempts(db)
+	receivedResult, receivedError := deleteOldHashIDKeyClaims(context.Background(), db, CleanupOptions{})
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -973,74 +3944,163 @@ func TestDeleteOldFailedClaimKeyAttempts(t *testing.T) {
 	assert.Nil(t, receivedError, "Expected nil if executed delete")
 }
 
-func TestCountClaimedOneTimeCodes(t *testing.T) {
+func TestActiveServerPublicKeys(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
-	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NULL`).WillReturnRows(row)
+	defer func() { clock = timemath.RealClock{} }()
+	clock = fixedClock(time.Date(2020, 7, 20, 15, 30, 0, 0, time.UTC))
 
-	expectedResult := int64(100)
+	query := `
+		SELECT server_public_key FROM encryption_keys
+		WHERE server_public_key IS NOT NULL
+		AND created > ?
+		ORDER BY created`
 
-	receivedResult, receivedErr := countClaimedOneTimeCodes(db)
+	// A keypair created exactly EncryptionKeyValidityDays ago is excluded
+	validFrom := time.Date(2020, 7, 5, 15, 30, 0, 0, time.UTC)
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(validFrom).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := activeServerPublicKeys(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns every active key
+	first := make([]byte, 32)
+	rand.Read(first)
+	second := make([]byte, 32)
+	rand.Read(second)
+
+	rows := sqlmock.NewRows([]string{"server_public_key"}).AddRow(first).AddRow(second)
+	mock.ExpectQuery(query).WithArgs(validFrom).WillReturnRows(rows)
+
+	receivedResult, receivedErr = activeServerPublicKeys(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, [][]byte{first, second}, receivedResult, "Expected both active keys")
 	assert.Nil(t, receivedErr, "Expected nil if query ran")
 }
 
-func TestCountDiagnosisKeys(t *testing.T) {
+func TestFindDuplicateAppKeys(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
-	mock.ExpectQuery(`SELECT COUNT(*) FROM diagnosis_keys`).WillReturnRows(row)
+	query := `
+		SELECT app_public_key FROM encryption_keys
+		WHERE app_public_key IS NOT NULL
+		GROUP BY app_public_key
+		HAVING COUNT(*) > 1`
 
-	expectedResult := int64(100)
+	// Returns error if query fails
+	mock.ExpectQuery(query).WillReturnError(fmt.Errorf("error"))
 
-	receivedResult, receivedErr := countDiagnosisKeys(db)
+	receivedResult, receivedErr := findDuplicateAppKeys(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the duplicated app key
+	duplicate := make([]byte, 32)
+	rand.Read(duplicate)
+
+	rows := sqlmock.NewRows([]string{"app_public_key"}).AddRow(duplicate)
+	mock.ExpectQuery(query).WillReturnRows(rows)
+
+	receivedResult, receivedErr = findDuplicateAppKeys(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, [][]byte{duplicate}, receivedResult, "Expected the duplicated app key")
 	assert.Nil(t, receivedErr, "Expected nil if query ran")
 }
 
-func TestCountUnclaimedOneTimeCodes(t *testing.T) {
+func TestFindMalformedClaimedRows(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
 
-	row := sqlmock.NewRows([]string{"count"}).AddRow(100)
-	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE one_time_code IS NOT NULL`).WillReturnRows(row)
+	query := `
+		SELECT COALESCE(HEX(server_public_key), '') FROM encryption_keys
+		WHERE one_time_code IS NULL
+		AND (app_public_key IS NULL OR server_public_key IS NULL OR server_private_key IS NULL)`
 
-	expectedResult := int64(100)
+	// Returns error if query fails
+	mock.ExpectQuery(query).WillReturnError(fmt.Errorf("error"))
 
-	receivedResult, receivedErr := countUnclaimedOneTimeCodes(db)
+	receivedResult, receivedErr := findMalformedClaimedRows(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.Equal(t, expectedResult, receivedResult, "Expected to receive count of 100")
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the claimed row missing its app key
+	rows := sqlmock.NewRows([]string{"server_public_key"}).AddRow("0A0B0C")
+	mock.ExpectQuery(query).WillReturnRows(rows)
+
+	receivedResult, receivedErr = findMalformedClaimedRows(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, []string{"0A0B0C"}, receivedResult, "Expected the malformed claimed row")
 	assert.Nil(t, receivedErr, "Expected nil if query ran")
 }
 
-func randomTestKey() *pb.TemporaryExposureKey {
-	token := make([]byte, 16)
-	rand.Read(token)
-	transmissionRiskLevel := int32(2)
-	rollingStartIntervalNumber := int32(2651450)
-	rollingPeriod := int32(144)
-	key := &pb.TemporaryExposureKey{
-		KeyData:                    token,
-		TransmissionRiskLevel:      &transmissionRiskLevel,
-		RollingStartIntervalNumber: &rollingStartIntervalNumber,
-		RollingPeriod:              &rollingPeriod,
+func TestVerifyServerKeypairIntegrity(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+		SELECT server_public_key, server_private_key, region, one_time_code IS NULL FROM encryption_keys`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := verifyServerKeypairIntegrity(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
-	return key
+
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Reports only the row whose public key doesn't match its private key
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	_, otherPriv, _ := box.GenerateKey(rand.Reader)
+	wrongPub, _, _ := box.GenerateKey(rand.Reader)
+
+	rows := sqlmock.NewRows([]string{"server_public_key", "server_private_key", "region", "claimed"}).
+		AddRow(pub[:], priv[:], "302", false).
+		AddRow(wrongPub[:], otherPriv[:], "302", true)
+	mock.ExpectQuery(query).WillReturnRows(rows)
+
+	receivedResult, receivedErr = verifyServerKeypairIntegrity(context.Background(), db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := []CorruptRow{{ServerPublicKey: fmt.Sprintf("%X", wrongPub[:]), Region: "302", Claimed: true}}
+	assert.Equal(t, expectedResult, receivedResult, "Expected only the mismatched row")
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
 }
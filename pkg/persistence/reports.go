@@ -0,0 +1,405 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// SubmissionHistogram returns the number of diagnosis keys submitted in each
+// hour of the given UTC date for a region.
+func (c *conn) SubmissionHistogram(ctx context.Context, region string, dateNumber uint32) ([timemath.HoursInDay]int, error) {
+	return submissionHistogram(ctx, c.db, region, dateNumber)
+}
+
+func submissionHistogram(ctx context.Context, db *sql.DB, region string, dateNumber uint32) ([timemath.HoursInDay]int, error) {
+	var histogram [timemath.HoursInDay]int
+
+	startHour := timemath.HourNumberAtStartOfDate(dateNumber)
+	endHour := timemath.HourNumberAtStartOfDate(dateNumber + 1)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission`,
+		region, startHour, endHour,
+	)
+	if err != nil {
+		return histogram, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			hour  uint32
+			count int
+		)
+		if err := rows.Scan(&hour, &count); err != nil {
+			return histogram, err
+		}
+		histogram[hour-startHour] = count
+	}
+
+	return histogram, rows.Err()
+}
+
+// UploadCountsByHour returns how many diagnosis keys a region had uploaded in
+// each hour from startHour up to endHour. Hours without uploads are left out.
+func (c *conn) UploadCountsByHour(ctx context.Context, region string, startHour, endHour uint32) (map[uint32]int, error) {
+	return uploadCountsByHour(ctx, c.db, region, startHour, endHour)
+}
+
+func uploadCountsByHour(ctx context.Context, db *sql.DB, region string, startHour, endHour uint32) (map[uint32]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission`,
+		region, startHour, endHour,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[uint32]int)
+	for rows.Next() {
+		var (
+			hour  uint32
+			count int
+		)
+		if err := rows.Scan(&hour, &count); err != nil {
+			return nil, err
+		}
+		counts[hour] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// CountDiagnosisKeysForDate returns how many diagnosis keys were submitted for
+// a region during the given UTC date and are still being served.
+func (c *conn) CountDiagnosisKeysForDate(ctx context.Context, region string, dateNumber uint32) (int, error) {
+	return countDiagnosisKeysForDate(ctx, c.db, region, dateNumber)
+}
+
+func countDiagnosisKeysForDate(ctx context.Context, db *sql.DB, region string, dateNumber uint32) (int, error) {
+	var count int
+
+	startHour := timemath.HourNumberAtStartOfDate(dateNumber)
+	endHour := timemath.HourNumberAtStartOfDate(dateNumber + 1)
+
+	row := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL`,
+		region, startHour, endHour,
+	)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// KeySubmissionBounds returns the hour numbers of the oldest and newest
+// diagnosis keys held for a region. Both are 0 if the region has no keys.
+func (c *conn) KeySubmissionBounds(ctx context.Context, region string) (uint32, uint32, error) {
+	return keySubmissionBounds(ctx, c.db, region)
+}
+
+func keySubmissionBounds(ctx context.Context, db *sql.DB, region string) (uint32, uint32, error) {
+	var oldestHour, newestHour sql.NullInt64
+
+	row := db.QueryRowContext(ctx, `
+		SELECT MIN(hour_of_submission), MAX(hour_of_submission) FROM diagnosis_keys
+		WHERE region = ?
+		AND deleted_at IS NULL`,
+		region,
+	)
+	if err := row.Scan(&oldestHour, &newestHour); err != nil {
+		return 0, 0, err
+	}
+
+	return uint32(oldestHour.Int64), uint32(newestHour.Int64), nil
+}
+
+// PeakUploadHour returns the hour of the given UTC date (0-23) in which the
+// most diagnosis keys were submitted for a region, and how many were.
+func (c *conn) PeakUploadHour(ctx context.Context, region string, dateNumber int) (uint32, int, error) {
+	return peakUploadHour(ctx, c.db, region, dateNumber)
+}
+
+func peakUploadHour(ctx context.Context, db *sql.DB, region string, dateNumber int) (uint32, int, error) {
+	startHour := timemath.HourNumberAtStartOfDate(uint32(dateNumber))
+	endHour := timemath.HourNumberAtStartOfDate(uint32(dateNumber + 1))
+
+	var (
+		hour  uint32
+		count int
+	)
+	row := db.QueryRowContext(ctx, `
+		SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission
+		ORDER BY COUNT(*) DESC, hour_of_submission
+		LIMIT 1`,
+		region, startHour, endHour,
+	)
+	switch err := row.Scan(&hour, &count); err {
+	case sql.ErrNoRows:
+		return 0, 0, nil
+	case nil:
+		return hour - startHour, count, nil
+	default:
+		return 0, 0, err
+	}
+}
+
+// DayRatio is the number of one time codes generated and claimed on a UTC date.
+type DayRatio struct {
+	Date      time.Time
+	Generated int
+	Claimed   int
+	Ratio     float64
+}
+
+// GenerationClaimRatio returns, for each day between start and end inclusive,
+// how many one time codes were generated and how many of those were claimed.
+func (c *conn) GenerationClaimRatio(ctx context.Context, start, end time.Time) ([]DayRatio, error) {
+	return generationClaimRatio(ctx, c.db, start, end)
+}
+
+// Read from events rather than encryption_keys, since claimed keys have their
+// created timestamp rewritten and are deleted once they expire.
+func generationClaimRatio(ctx context.Context, db *sql.DB, start, end time.Time) ([]DayRatio, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT date,
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END),
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END)
+		FROM events
+		WHERE date >= ?
+		AND date <= ?
+		GROUP BY date
+		ORDER BY date`,
+		OTKGenerated, OTKClaimed, start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ratios []DayRatio
+	for rows.Next() {
+		var day DayRatio
+		if err := rows.Scan(&day.Date, &day.Generated, &day.Claimed); err != nil {
+			return nil, err
+		}
+		if day.Generated > 0 {
+			day.Ratio = float64(day.Claimed) / float64(day.Generated)
+		}
+		ratios = append(ratios, day)
+	}
+
+	return ratios, rows.Err()
+}
+
+// OriginatorMonthly is how many one time codes an originator generated and
+// had claimed, and how many diagnosis keys were uploaded with them, in a month.
+type OriginatorMonthly struct {
+	Originator string
+	Generated  int
+	Claimed    int
+	Uploaded   int
+}
+
+// MonthlyOriginatorSummary returns per originator totals for the given UTC
+// calendar month.
+func (c *conn) MonthlyOriginatorSummary(ctx context.Context, year, month int) ([]OriginatorMonthly, error) {
+	return monthlyOriginatorSummary(ctx, c.db, year, month)
+}
+
+// Uploads come from originator_upload_stats, which like events is kept by UTC
+// date and outlives the diagnosis keys themselves, so a month's totals don't
+// shrink as its keys expire. Both are recorded against the originator's name
+// rather than its bearer token.
+func monthlyOriginatorSummary(ctx context.Context, db *sql.DB, year, month int) ([]OriginatorMonthly, error) {
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	summaries := make(map[string]*OriginatorMonthly)
+	summaryFor := func(originator string) *OriginatorMonthly {
+		if _, ok := summaries[originator]; !ok {
+			summaries[originator] = &OriginatorMonthly{Originator: originator}
+		}
+		return summaries[originator]
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT source,
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END),
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END)
+		FROM events
+		WHERE date >= ?
+		AND date < ?
+		GROUP BY source`,
+		OTKGenerated, OTKClaimed, start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			source             string
+			generated, claimed int
+		)
+		if err := rows.Scan(&source, &generated, &claimed); err != nil {
+			return nil, err
+		}
+		summary := summaryFor(source)
+		summary.Generated += generated
+		summary.Claimed += claimed
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT originator, SUM(count) FROM originator_upload_stats
+		WHERE date >= ?
+		AND date < ?
+		GROUP BY originator`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			originator string
+			uploaded   int
+		)
+		if err := rows.Scan(&originator, &uploaded); err != nil {
+			return nil, err
+		}
+		summaryFor(originator).Uploaded += uploaded
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]OriginatorMonthly, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Originator < result[j].Originator })
+
+	return result, nil
+}
+
+// OriginatorUploadDay is how many diagnosis keys an originator's devices
+// uploaded on a UTC date.
+type OriginatorUploadDay struct {
+	Originator string
+	Date       time.Time
+	Count      int
+}
+
+// OriginatorUploadTotals returns the daily upload counts of every originator
+// between start and end inclusive.
+func (c *conn) OriginatorUploadTotals(ctx context.Context, start, end time.Time) ([]OriginatorUploadDay, error) {
+	return originatorUploadTotals(ctx, c.db, start, end)
+}
+
+func originatorUploadTotals(ctx context.Context, db *sql.DB, start, end time.Time) ([]OriginatorUploadDay, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT originator, date, count FROM originator_upload_stats
+		WHERE date >= ?
+		AND date <= ?
+		ORDER BY date, originator`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []OriginatorUploadDay
+	for rows.Next() {
+		var day OriginatorUploadDay
+		if err := rows.Scan(&day.Originator, &day.Date, &day.Count); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+
+	return days, rows.Err()
+}
+
+// KeyMetadata is what analysts get of a diagnosis key: everything about when
+// and how it was submitted except the key itself.
+type KeyMetadata struct {
+	Region                     string `json:"region"`
+	RollingStartIntervalNumber int32  `json:"rolling_start_interval_number"`
+	RollingPeriod              int32  `json:"rolling_period"`
+	TransmissionRiskLevel      int32  `json:"transmission_risk_level"`
+	HourOfSubmission           uint32 `json:"hour_of_submission"`
+}
+
+// StreamDiagnosisKeysJSON writes the KeyMetadata of every diagnosis key for a
+// region submitted in [startHour, endHour) to w as newline-delimited JSON,
+// and returns the number of keys written. Rows are written as they are read,
+// so the export never has to fit in memory.
+func (c *conn) StreamDiagnosisKeysJSON(ctx context.Context, region string, startHour, endHour uint32, w io.Writer) (int, error) {
+	return streamDiagnosisKeysJSON(ctx, c.db, region, startHour, endHour, w)
+}
+
+func streamDiagnosisKeysJSON(ctx context.Context, db *sql.DB, region string, startHour, endHour uint32, w io.Writer) (int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT region, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		ORDER BY hour_of_submission`,
+		region, startHour, endHour,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		var key KeyMetadata
+		if err := rows.Scan(&key.Region, &key.RollingStartIntervalNumber, &key.RollingPeriod, &key.TransmissionRiskLevel, &key.HourOfSubmission); err != nil {
+			return count, err
+		}
+		if err := enc.Encode(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
@@ -0,0 +1,500 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmissionHistogram(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	dateNumber := uint32(18500)
+	startHour := timemath.HourNumberAtStartOfDate(dateNumber)
+	endHour := timemath.HourNumberAtStartOfDate(dateNumber + 1)
+
+	query := `
+	SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := submissionHistogram(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Places counts into the hour of the day they were submitted in
+	rows := sqlmock.NewRows([]string{"hour_of_submission", "count"}).
+		AddRow(startHour, 4).
+		AddRow(startHour+13, 7).
+		AddRow(startHour+23, 1)
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnRows(rows)
+
+	receivedResult, receivedErr := submissionHistogram(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	var expectedResult [timemath.HoursInDay]int
+	expectedResult[0] = 4
+	expectedResult[13] = 7
+	expectedResult[23] = 1
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected counts to land in their hour buckets")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestUploadCountsByHour(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	startHour := uint32(444000)
+	endHour := uint32(444048)
+
+	query := `
+	SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnError(fmt.Errorf("error"))
+
+	receivedResult, receivedErr := uploadCountsByHour(context.Background(), db, region, startHour, endHour)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, receivedResult, "Expected nil result if query fails")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Keys each group's count by its hour of submission
+	rows := sqlmock.NewRows([]string{"hour_of_submission", "count"}).
+		AddRow(startHour, 4).
+		AddRow(startHour+30, 7).
+		AddRow(endHour-1, 1)
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnRows(rows)
+
+	receivedResult, receivedErr = uploadCountsByHour(context.Background(), db, region, startHour, endHour)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := map[uint32]int{startHour: 4, startHour + 30: 7, endHour - 1: 1}
+	assert.Equal(t, expectedResult, receivedResult, "Expected a count for each hour with uploads")
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
+
+	// Hours without uploads give an empty map
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnRows(sqlmock.NewRows([]string{"hour_of_submission", "count"}))
+
+	receivedResult, receivedErr = uploadCountsByHour(context.Background(), db, region, startHour, endHour)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, map[uint32]int{}, receivedResult, "Expected an empty map if there were no uploads")
+	assert.Nil(t, receivedErr, "Expected nil if query succeeds")
+}
+
+func TestCountDiagnosisKeysForDate(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	dateNumber := uint32(18500)
+
+	query := `
+	SELECT COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(region, uint32(444000), uint32(444024)).WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := countDiagnosisKeysForDate(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Counts the keys submitted during the date's 24 hours
+	row := sqlmock.NewRows([]string{"count"}).AddRow(42)
+	mock.ExpectQuery(query).WithArgs(region, uint32(444000), uint32(444024)).WillReturnRows(row)
+
+	receivedResult, receivedErr := countDiagnosisKeysForDate(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 42, receivedResult, "Expected the number of keys for the date")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestKeySubmissionBounds(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+		SELECT MIN(hour_of_submission), MAX(hour_of_submission) FROM diagnosis_keys
+		WHERE region = ?
+		AND deleted_at IS NULL`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs("302").WillReturnError(fmt.Errorf("error"))
+
+	_, _, receivedErr := keySubmissionBounds(context.Background(), db, "302")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the oldest and newest hours for a populated region
+	row := sqlmock.NewRows([]string{"min", "max"}).AddRow(444000, 444350)
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(row)
+
+	oldestHour, newestHour, receivedErr := keySubmissionBounds(context.Background(), db, "302")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, uint32(444000), oldestHour, "Expected the oldest hour")
+	assert.Equal(t, uint32(444350), newestHour, "Expected the newest hour")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	// Returns zeros for a region without keys
+	row = sqlmock.NewRows([]string{"min", "max"}).AddRow(nil, nil)
+	mock.ExpectQuery(query).WithArgs("303").WillReturnRows(row)
+
+	oldestHour, newestHour, receivedErr = keySubmissionBounds(context.Background(), db, "303")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, uint32(0), oldestHour, "Expected no oldest hour for an empty region")
+	assert.Equal(t, uint32(0), newestHour, "Expected no newest hour for an empty region")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestGenerationClaimRatio(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	start := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	query := `
+		SELECT date,
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END),
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END)
+		FROM events
+		WHERE date >= ?
+		AND date <= ?
+		GROUP BY date
+		ORDER BY date`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(OTKGenerated, OTKClaimed, "2020-08-01", "2020-08-02").WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := generationClaimRatio(context.Background(), db, start, end)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Computes the ratio for each day
+	rows := sqlmock.NewRows([]string{"date", "generated", "claimed"}).
+		AddRow(start, 10, 4).
+		AddRow(end, 8, 6)
+	mock.ExpectQuery(query).WithArgs(OTKGenerated, OTKClaimed, "2020-08-01", "2020-08-02").WillReturnRows(rows)
+
+	receivedResult, receivedErr := generationClaimRatio(context.Background(), db, start, end)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := []DayRatio{
+		{Date: start, Generated: 10, Claimed: 4, Ratio: 0.4},
+		{Date: end, Generated: 8, Claimed: 6, Ratio: 0.75},
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected a ratio for each day")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestPeakUploadHour(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	region := "302"
+	dateNumber := 18500
+	startHour := timemath.HourNumberAtStartOfDate(uint32(dateNumber))
+	endHour := timemath.HourNumberAtStartOfDate(uint32(dateNumber + 1))
+
+	query := `
+		SELECT hour_of_submission, COUNT(*) FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		GROUP BY hour_of_submission
+		ORDER BY COUNT(*) DESC, hour_of_submission
+		LIMIT 1`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnError(fmt.Errorf("error"))
+
+	_, _, receivedErr := peakUploadHour(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns the peak hour of the day
+	rows := sqlmock.NewRows([]string{"hour_of_submission", "count"}).AddRow(startHour+17, 42)
+	mock.ExpectQuery(query).WithArgs(region, startHour, endHour).WillReturnRows(rows)
+
+	receivedHour, receivedCount, receivedErr := peakUploadHour(context.Background(), db, region, dateNumber)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, uint32(17), receivedHour, "Expected the peak hour of the day")
+	assert.Equal(t, 42, receivedCount, "Expected the peak hour's count")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestMonthlyOriginatorSummary(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	eventsQuery := `
+		SELECT source,
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END),
+			SUM(CASE WHEN identifier = ? THEN count ELSE 0 END)
+		FROM events
+		WHERE date >= ?
+		AND date < ?
+		GROUP BY source`
+
+	uploadsQuery := `
+		SELECT originator, SUM(count) FROM originator_upload_stats
+		WHERE date >= ?
+		AND date < ?
+		GROUP BY originator`
+
+	// Returns error if query fails
+	mock.ExpectQuery(eventsQuery).WithArgs(OTKGenerated, OTKClaimed, "2020-12-01", "2021-01-01").WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := monthlyOriginatorSummary(context.Background(), db, 2020, 12)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Buckets events and uploads from the month by originator
+	rows := sqlmock.NewRows([]string{"source", "generated", "claimed"}).
+		AddRow(onApi, 10, 7).
+		AddRow(token2, 3, 1)
+	mock.ExpectQuery(eventsQuery).WithArgs(OTKGenerated, OTKClaimed, "2020-12-01", "2021-01-01").WillReturnRows(rows)
+
+	rows = sqlmock.NewRows([]string{"originator", "count"}).
+		AddRow(onApi, 40).
+		AddRow(token2, 5)
+	mock.ExpectQuery(uploadsQuery).WithArgs("2020-12-01", "2021-01-01").WillReturnRows(rows)
+
+	receivedResult, receivedErr := monthlyOriginatorSummary(context.Background(), db, 2020, 12)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := []OriginatorMonthly{
+		{Originator: onApi, Generated: 10, Claimed: 7, Uploaded: 40},
+		{Originator: token2, Generated: 3, Claimed: 1, Uploaded: 5},
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected uploads to be merged with events for the same originator")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestMonthlyOriginatorSummaryMonthBounds(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	defer db.Close()
+
+	// Each month runs from its first day up to, but not including, the first
+	// day of the next, including across a year end and a leap day
+	for _, month := range []struct {
+		year, month int
+		start, end  string
+	}{
+		{2020, 12, "2020-12-01", "2021-01-01"},
+		{2021, 1, "2021-01-01", "2021-02-01"},
+		{2020, 2, "2020-02-01", "2020-03-01"},
+	} {
+		mock.ExpectQuery("FROM events").WithArgs(OTKGenerated, OTKClaimed, month.start, month.end).WillReturnRows(sqlmock.NewRows([]string{"source", "generated", "claimed"}))
+		mock.ExpectQuery("FROM originator_upload_stats").WithArgs(month.start, month.end).WillReturnRows(sqlmock.NewRows([]string{"originator", "count"}))
+
+		_, receivedErr := monthlyOriginatorSummary(context.Background(), db, month.year, month.month)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations for %d-%02d: %s", month.year, month.month, err)
+		}
+
+		assert.Nil(t, receivedErr, "Expected nil if query ran")
+	}
+}
+
+func TestOriginatorUploadTotals(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	start := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	query := `
+		SELECT originator, date, count FROM originator_upload_stats
+		WHERE date >= ?
+		AND date <= ?
+		ORDER BY date, originator`
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs("2020-08-01", "2020-08-02").WillReturnError(fmt.Errorf("error"))
+
+	_, receivedErr := originatorUploadTotals(context.Background(), db, start, end)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+
+	// Returns each originator's daily total
+	rows := sqlmock.NewRows([]string{"originator", "date", "count"}).
+		AddRow("ONApi", start, 12).
+		AddRow("302", end, 4).
+		AddRow("ONApi", end, 7)
+	mock.ExpectQuery(query).WithArgs("2020-08-01", "2020-08-02").WillReturnRows(rows)
+
+	receivedResult, receivedErr := originatorUploadTotals(context.Background(), db, start, end)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expectedResult := []OriginatorUploadDay{
+		{Originator: "ONApi", Date: start, Count: 12},
+		{Originator: "302", Date: end, Count: 4},
+		{Originator: "ONApi", Date: end, Count: 7},
+	}
+	assert.Equal(t, expectedResult, receivedResult, "Expected the daily totals")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+}
+
+func TestStreamDiagnosisKeysJSON(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+		SELECT region, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission FROM diagnosis_keys
+		WHERE region = ?
+		AND hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND deleted_at IS NULL
+		ORDER BY hour_of_submission`
+	columns := []string{"region", "rolling_start_interval_number", "rolling_period", "transmission_risk_level", "hour_of_submission"}
+
+	// Returns error if query fails
+	mock.ExpectQuery(query).WithArgs("302", uint32(444000), uint32(444024)).WillReturnError(fmt.Errorf("error"))
+
+	var buf bytes.Buffer
+	count, receivedErr := streamDiagnosisKeysJSON(context.Background(), db, "302", 444000, 444024, &buf)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if query fails")
+	assert.Equal(t, 0, count, "Expected nothing written if query fails")
+	assert.Empty(t, buf.String(), "Expected nothing written if query fails")
+
+	// Writes one JSON object per row
+	rows := sqlmock.NewRows(columns).
+		AddRow("302", 2650032, 144, 4, 444001).
+		AddRow("302", 2650176, 100, 2, 444010)
+	mock.ExpectQuery(query).WithArgs("302", uint32(444000), uint32(444024)).WillReturnRows(rows)
+
+	buf.Reset()
+	count, receivedErr = streamDiagnosisKeysJSON(context.Background(), db, "302", 444000, 444024, &buf)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expected := `{"region":"302","rolling_start_interval_number":2650032,"rolling_period":144,"transmission_risk_level":4,"hour_of_submission":444001}
+{"region":"302","rolling_start_interval_number":2650176,"rolling_period":100,"transmission_risk_level":2,"hour_of_submission":444010}
+`
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+	assert.Equal(t, 2, count, "Expected a line for each row")
+	assert.Equal(t, expected, buf.String(), "Expected newline-delimited JSON")
+
+	// Rows already written stay written when iteration fails part way
+	rows = sqlmock.NewRows(columns).
+		AddRow("302", 2650032, 144, 4, 444001).
+		AddRow("302", 2650176, 100, 2, 444010).
+		RowError(1, errors.New("connection lost"))
+	mock.ExpectQuery(query).WithArgs("302", uint32(444000), uint32(444024)).WillReturnRows(rows)
+
+	buf.Reset()
+	count, receivedErr = streamDiagnosisKeysJSON(context.Background(), db, "302", 444000, 444024, &buf)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, errors.New("connection lost"), receivedErr, "Expected the row error")
+	assert.Equal(t, 1, count, "Expected the rows before the error to be counted")
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "Expected the rows before the error to be written")
+}
@@ -190,6 +190,74 @@ func (EncryptedUploadResponse_ErrorCode) EnumDescriptor() ([]byte, []int) {
 	return file_proto_covidshield_proto_rawDescGZIP(), []int{3, 0}
 }
 
+type TemporaryExposureKey_ReportType int32
+
+const (
+	TemporaryExposureKey_UNKNOWN                      TemporaryExposureKey_ReportType = 0
+	TemporaryExposureKey_CONFIRMED_TEST               TemporaryExposureKey_ReportType = 1
+	TemporaryExposureKey_CONFIRMED_CLINICAL_DIAGNOSIS TemporaryExposureKey_ReportType = 2
+	TemporaryExposureKey_SELF_REPORT                  TemporaryExposureKey_ReportType = 3
+	TemporaryExposureKey_RECURSIVE                    TemporaryExposureKey_ReportType = 4
+	TemporaryExposureKey_REVOKED                      TemporaryExposureKey_ReportType = 5
+)
+
+// Enum value maps for TemporaryExposureKey_ReportType.
+var (
+	TemporaryExposureKey_ReportType_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "CONFIRMED_TEST",
+		2: "CONFIRMED_CLINICAL_DIAGNOSIS",
+		3: "SELF_REPORT",
+		4: "RECURSIVE",
+		5: "REVOKED",
+	}
+	TemporaryExposureKey_ReportType_value = map[string]int32{
+		"UNKNOWN":                      0,
+		"CONFIRMED_TEST":               1,
+		"CONFIRMED_CLINICAL_DIAGNOSIS": 2,
+		"SELF_REPORT":                  3,
+		"RECURSIVE":                    4,
+		"REVOKED":                      5,
+	}
+)
+
+func (x TemporaryExposureKey_ReportType) Enum() *TemporaryExposureKey_ReportType {
+	p := new(TemporaryExposureKey_ReportType)
+	*p = x
+	return p
+}
+
+func (x TemporaryExposureKey_ReportType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TemporaryExposureKey_ReportType) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_covidshield_proto_enumTypes[2].Descriptor()
+}
+
+func (TemporaryExposureKey_ReportType) Type() protoreflect.EnumType {
+	return &file_proto_covidshield_proto_enumTypes[2]
+}
+
+func (x TemporaryExposureKey_ReportType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Do not use.
+func (x *TemporaryExposureKey_ReportType) UnmarshalJSON(b []byte) error {
+	num, err := protoimpl.X.UnmarshalJSONEnum(x.Descriptor(), b)
+	if err != nil {
+		return err
+	}
+	*x = TemporaryExposureKey_ReportType(num)
+	return nil
+}
+
+// Deprecated: Use TemporaryExposureKey_ReportType.Descriptor instead.
+func (TemporaryExposureKey_ReportType) EnumDescriptor() ([]byte, []int) {
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{7, 0}
+}
+
 // Clients will receive a One Time Code via some external channel (i.e. SMS or
 // verbal). Then, upon issuing THIS request, they will generate a new keypair.
 // If the response comes back successful, the app_public_key (and the
@@ -724,11 +792,18 @@ type TemporaryExposureKey struct {
 	RollingStartIntervalNumber *int32 `protobuf:"varint,3,opt,name=rolling_start_interval_number,json=rollingStartIntervalNumber" json:"rolling_start_interval_number,omitempty"`
 	// Number of intervals in a period.
 	RollingPeriod *int32 `protobuf:"varint,4,opt,name=rolling_period,json=rollingPeriod,def=144" json:"rolling_period,omitempty"`
+	// How the diagnosis behind this key was made. Older clients don't send
+	// it, and their keys are treated as confirmed by a test.
+	ReportType *TemporaryExposureKey_ReportType `protobuf:"varint,5,opt,name=report_type,json=reportType,enum=covidshield.TemporaryExposureKey_ReportType,def=1" json:"report_type,omitempty"`
+	// Days between the start of symptoms and the start of this key's validity,
+	// between -14 and 14. Unset if the onset of symptoms isn't known.
+	DaysSinceOnsetOfSymptoms *int32 `protobuf:"zigzag32,6,opt,name=days_since_onset_of_symptoms,json=daysSinceOnsetOfSymptoms" json:"days_since_onset_of_symptoms,omitempty"`
 }
 
 // Default values for TemporaryExposureKey fields.
 const (
 	Default_TemporaryExposureKey_RollingPeriod = int32(144)
+	Default_TemporaryExposureKey_ReportType    = TemporaryExposureKey_CONFIRMED_TEST
 )
 
 func (x *TemporaryExposureKey) Reset() {
@@ -791,6 +866,20 @@ func (x *TemporaryExposureKey) GetRollingPeriod() int32 {
 	return Default_TemporaryExposureKey_RollingPeriod
 }
 
+func (x *TemporaryExposureKey) GetReportType() TemporaryExposureKey_ReportType {
+	if x != nil && x.ReportType != nil {
+		return *x.ReportType
+	}
+	return Default_TemporaryExposureKey_ReportType
+}
+
+func (x *TemporaryExposureKey) GetDaysSinceOnsetOfSymptoms() int32 {
+	if x != nil && x.DaysSinceOnsetOfSymptoms != nil {
+		return *x.DaysSinceOnsetOfSymptoms
+	}
+	return 0
+}
+
 type TEKSignatureList struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -1031,8 +1120,8 @@ var file_proto_covidshield_proto_rawDesc = []byte{
 	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x41, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74,
 	0x68, 0x6d, 0x4a, 0x04, 0x08, 0x01, 0x10, 0x02, 0x4a, 0x04, 0x08, 0x02, 0x10, 0x03, 0x52, 0x0d,
 	0x61, 0x70, 0x70, 0x5f, 0x62, 0x75, 0x6e, 0x64, 0x6c, 0x65, 0x5f, 0x69, 0x64, 0x52, 0x0f, 0x61,
-	0x6e, 0x64, 0x72, 0x6f, 0x69, 0x64, 0x5f, 0x70, 0x61, 0x63, 0x6b, 0x61, 0x67, 0x65, 0x22, 0xd8,
-	0x01, 0x0a, 0x14, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f,
+	0x6e, 0x64, 0x72, 0x6f, 0x69, 0x64, 0x5f, 0x70, 0x61, 0x63, 0x6b, 0x61, 0x67, 0x65, 0x22, 0xf5,
+	0x03, 0x0a, 0x14, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f,
 	0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x12, 0x19, 0x0a, 0x08, 0x6b, 0x65, 0x79, 0x5f, 0x64,
 	0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x6b, 0x65, 0x79, 0x44, 0x61,
 	0x74, 0x61, 0x12, 0x36, 0x0a, 0x17, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x6d, 0x69, 0x73, 0x73, 0x69,
@@ -1045,24 +1134,42 @@ var file_proto_covidshield_proto_rawDesc = []byte{
 	0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x12, 0x2a, 0x0a,
 	0x0e, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x5f, 0x70, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x18,
 	0x04, 0x20, 0x01, 0x28, 0x05, 0x3a, 0x03, 0x31, 0x34, 0x34, 0x52, 0x0d, 0x72, 0x6f, 0x6c, 0x6c,
-	0x69, 0x6e, 0x67, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x22, 0x4d, 0x0a, 0x10, 0x54, 0x45, 0x4b,
-	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x4c, 0x69, 0x73, 0x74, 0x12, 0x39, 0x0a,
-	0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
-	0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e,
-	0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x52, 0x0a, 0x73, 0x69,
-	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0xab, 0x01, 0x0a, 0x0c, 0x54, 0x45, 0x4b,
-	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x41, 0x0a, 0x0e, 0x73, 0x69, 0x67,
-	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x1a, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e,
-	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0d, 0x73,
-	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1b, 0x0a, 0x09,
-	0x62, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52,
-	0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x74,
-	0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62,
-	0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e,
-	0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67,
-	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x42, 0x17, 0x5a, 0x15, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x2f, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
+	0x69, 0x6e, 0x67, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x12, 0x5d, 0x0a, 0x0b, 0x72, 0x65, 0x70,
+	0x6f, 0x72, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x2c,
+	0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d,
+	0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65,
+	0x79, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x3a, 0x0e, 0x43, 0x4f,
+	0x4e, 0x46, 0x49, 0x52, 0x4d, 0x45, 0x44, 0x5f, 0x54, 0x45, 0x53, 0x54, 0x52, 0x0a, 0x72, 0x65,
+	0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x3e, 0x0a, 0x1c, 0x64, 0x61, 0x79, 0x73,
+	0x5f, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x5f, 0x6f, 0x6e, 0x73, 0x65, 0x74, 0x5f, 0x6f, 0x66, 0x5f,
+	0x73, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x11, 0x52, 0x18,
+	0x64, 0x61, 0x79, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x4f, 0x6e, 0x73, 0x65, 0x74, 0x4f, 0x66,
+	0x53, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x22, 0x7c, 0x0a, 0x0a, 0x52, 0x65, 0x70, 0x6f,
+	0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57,
+	0x4e, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x43, 0x4f, 0x4e, 0x46, 0x49, 0x52, 0x4d, 0x45, 0x44,
+	0x5f, 0x54, 0x45, 0x53, 0x54, 0x10, 0x01, 0x12, 0x20, 0x0a, 0x1c, 0x43, 0x4f, 0x4e, 0x46, 0x49,
+	0x52, 0x4d, 0x45, 0x44, 0x5f, 0x43, 0x4c, 0x49, 0x4e, 0x49, 0x43, 0x41, 0x4c, 0x5f, 0x44, 0x49,
+	0x41, 0x47, 0x4e, 0x4f, 0x53, 0x49, 0x53, 0x10, 0x02, 0x12, 0x0f, 0x0a, 0x0b, 0x53, 0x45, 0x4c,
+	0x46, 0x5f, 0x52, 0x45, 0x50, 0x4f, 0x52, 0x54, 0x10, 0x03, 0x12, 0x0d, 0x0a, 0x09, 0x52, 0x45,
+	0x43, 0x55, 0x52, 0x53, 0x49, 0x56, 0x45, 0x10, 0x04, 0x12, 0x0b, 0x0a, 0x07, 0x52, 0x45, 0x56,
+	0x4f, 0x4b, 0x45, 0x44, 0x10, 0x05, 0x22, 0x4d, 0x0a, 0x10, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67,
+	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x4c, 0x69, 0x73, 0x74, 0x12, 0x39, 0x0a, 0x0a, 0x73, 0x69,
+	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19,
+	0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x45, 0x4b,
+	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x52, 0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61,
+	0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0xab, 0x01, 0x0a, 0x0c, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67,
+	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x41, 0x0a, 0x0e, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a,
+	0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x53, 0x69, 0x67,
+	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0d, 0x73, 0x69, 0x67, 0x6e,
+	0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1b, 0x0a, 0x09, 0x62, 0x61, 0x74,
+	0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x62, 0x61,
+	0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x74, 0x63, 0x68, 0x5f,
+	0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x61, 0x74, 0x63,
+	0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x42, 0x17, 0x5a, 0x15, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x2f, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
 }
 
 var (
@@ -1077,39 +1184,41 @@ func file_proto_covidshield_proto_rawDescGZIP() []byte {
 	return file_proto_covidshield_proto_rawDescData
 }
 
-var file_proto_covidshield_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_proto_covidshield_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
 var file_proto_covidshield_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_proto_covidshield_proto_goTypes = []interface{}{
 	(KeyClaimResponse_ErrorCode)(0),        // 0: covidshield.KeyClaimResponse.ErrorCode
 	(EncryptedUploadResponse_ErrorCode)(0), // 1: covidshield.EncryptedUploadResponse.ErrorCode
-	(*KeyClaimRequest)(nil),                // 2: covidshield.KeyClaimRequest
-	(*KeyClaimResponse)(nil),               // 3: covidshield.KeyClaimResponse
-	(*EncryptedUploadRequest)(nil),         // 4: covidshield.EncryptedUploadRequest
-	(*EncryptedUploadResponse)(nil),        // 5: covidshield.EncryptedUploadResponse
-	(*Upload)(nil),                         // 6: covidshield.Upload
-	(*TemporaryExposureKeyExport)(nil),     // 7: covidshield.TemporaryExposureKeyExport
-	(*SignatureInfo)(nil),                  // 8: covidshield.SignatureInfo
-	(*TemporaryExposureKey)(nil),           // 9: covidshield.TemporaryExposureKey
-	(*TEKSignatureList)(nil),               // 10: covidshield.TEKSignatureList
-	(*TEKSignature)(nil),                   // 11: covidshield.TEKSignature
-	(*duration.Duration)(nil),              // 12: google.protobuf.Duration
-	(*timestamp.Timestamp)(nil),            // 13: google.protobuf.Timestamp
+	(TemporaryExposureKey_ReportType)(0),   // 2: covidshield.TemporaryExposureKey.ReportType
+	(*KeyClaimRequest)(nil),                // 3: covidshield.KeyClaimRequest
+	(*KeyClaimResponse)(nil),               // 4: covidshield.KeyClaimResponse
+	(*EncryptedUploadRequest)(nil),         // 5: covidshield.EncryptedUploadRequest
+	(*EncryptedUploadResponse)(nil),        // 6: covidshield.EncryptedUploadResponse
+	(*Upload)(nil),                         // 7: covidshield.Upload
+	(*TemporaryExposureKeyExport)(nil),     // 8: covidshield.TemporaryExposureKeyExport
+	(*SignatureInfo)(nil),                  // 9: covidshield.SignatureInfo
+	(*TemporaryExposureKey)(nil),           // 10: covidshield.TemporaryExposureKey
+	(*TEKSignatureList)(nil),               // 11: covidshield.TEKSignatureList
+	(*TEKSignature)(nil),                   // 12: covidshield.TEKSignature
+	(*duration.Duration)(nil),              // 13: google.protobuf.Duration
+	(*timestamp.Timestamp)(nil),            // 14: google.protobuf.Timestamp
 }
 var file_proto_covidshield_proto_depIdxs = []int32{
 	0,  // 0: covidshield.KeyClaimResponse.error:type_name -> covidshield.KeyClaimResponse.ErrorCode
-	12, // 1: covidshield.KeyClaimResponse.remaining_ban_duration:type_name -> google.protobuf.Duration
+	13, // 1: covidshield.KeyClaimResponse.remaining_ban_duration:type_name -> google.protobuf.Duration
 	1,  // 2: covidshield.EncryptedUploadResponse.error:type_name -> covidshield.EncryptedUploadResponse.ErrorCode
-	13, // 3: covidshield.Upload.timestamp:type_name -> google.protobuf.Timestamp
-	9,  // 4: covidshield.Upload.keys:type_name -> covidshield.TemporaryExposureKey
-	8,  // 5: covidshield.TemporaryExposureKeyExport.signature_infos:type_name -> covidshield.SignatureInfo
-	9,  // 6: covidshield.TemporaryExposureKeyExport.keys:type_name -> covidshield.TemporaryExposureKey
-	11, // 7: covidshield.TEKSignatureList.signatures:type_name -> covidshield.TEKSignature
-	8,  // 8: covidshield.TEKSignature.signature_info:type_name -> covidshield.SignatureInfo
-	9,  // [9:9] is the sub-list for method output_type
-	9,  // [9:9] is the sub-list for method input_type
-	9,  // [9:9] is the sub-list for extension type_name
-	9,  // [9:9] is the sub-list for extension extendee
-	0,  // [0:9] is the sub-list for field type_name
+	14, // 3: covidshield.Upload.timestamp:type_name -> google.protobuf.Timestamp
+	10, // 4: covidshield.Upload.keys:type_name -> covidshield.TemporaryExposureKey
+	9,  // 5: covidshield.TemporaryExposureKeyExport.signature_infos:type_name -> covidshield.SignatureInfo
+	10, // 6: covidshield.TemporaryExposureKeyExport.keys:type_name -> covidshield.TemporaryExposureKey
+	2,  // 7: covidshield.TemporaryExposureKey.report_type:type_name -> covidshield.TemporaryExposureKey.ReportType
+	12, // 8: covidshield.TEKSignatureList.signatures:type_name -> covidshield.TEKSignature
+	9,  // 9: covidshield.TEKSignature.signature_info:type_name -> covidshield.SignatureInfo
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_proto_covidshield_proto_init() }
@@ -1244,7 +1353,7 @@ func file_proto_covidshield_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_proto_covidshield_proto_rawDesc,
-			NumEnums:      2,
+			NumEnums:      3,
 			NumMessages:   10,
 			NumExtensions: 0,
 			NumServices:   0,
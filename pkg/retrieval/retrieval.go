@@ -2,10 +2,21 @@ package retrieval
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 
 	"github.com/Shopify/goose/logger"
@@ -43,6 +54,95 @@ func transformRegion(reg string) string {
 	return reg
 }
 
+// signatureInfo describes the key exports for region are signed with, using
+// the region's configured verification key id and version if it has them.
+func signatureInfo(region string) *pb.SignatureInfo {
+	keyID := verificationKeyID
+	if id, ok := config.AppConstants.VerificationKeyIDs[region]; ok {
+		keyID = id
+	}
+	keyVersion := verificationKeyVersion
+	if version, ok := config.AppConstants.VerificationKeyVersions[region]; ok {
+		keyVersion = version
+	}
+
+	return &pb.SignatureInfo{
+		VerificationKeyVersion: &keyVersion,
+		VerificationKeyId:      &keyID,
+		SignatureAlgorithm:     &signatureAlgorithm,
+	}
+}
+
+// shuffler is the part of *rand.Rand that orderKeys needs, so tests can pass
+// orderKeys a generator with a fixed seed.
+type shuffler interface {
+	Shuffle(n int, swap func(i, j int))
+}
+
+// keyShuffler randomizes key order for config.AppConstants.ExportKeyOrder
+// "random" when exports are built.
+var (
+	keyShuffler   = rand.New(rand.NewSource(randomSeed()))
+	keyShufflerMu sync.Mutex
+)
+
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// Keys arrive from the database already in keydata or submission order, so
+// only the random order needs any work here. keydata is re-sorted defensively.
+func orderKeys(keys []*pb.TemporaryExposureKey, order string, rng shuffler) {
+	switch order {
+	case config.ExportKeyOrderRandom:
+		rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	case config.ExportKeyOrderSubmission:
+	default:
+		sort.SliceStable(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i].GetKeyData(), keys[j].GetKeyData()) < 0
+		})
+	}
+}
+
+// newZipWriter returns a zip.Writer that deflates at level, one of the
+// compress/flate levels 0-9. Anything else, including the default of -1,
+// keeps archive/zip's own compressor.
+func newZipWriter(w io.Writer, level int) *zip.Writer {
+	zipw := zip.NewWriter(w)
+	if level < flate.NoCompression || level > flate.BestCompression {
+		return zipw
+	}
+	zipw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	return zipw
+}
+
+// KeyPages yields the keys for an export a page at a time. Next returns no
+// keys once every page has been read.
+type KeyPages interface {
+	Next() ([]*pb.TemporaryExposureKey, error)
+}
+
+// SinglePage returns keys already read in full as a KeyPages of one page.
+func SinglePage(keys []*pb.TemporaryExposureKey) KeyPages {
+	return &singlePage{keys: keys}
+}
+
+type singlePage struct {
+	keys []*pb.TemporaryExposureKey
+}
+
+func (p *singlePage) Next() ([]*pb.TemporaryExposureKey, error) {
+	keys := p.keys
+	p.keys = nil
+	return keys, nil
+}
+
 func SerializeTo(
 	ctx context.Context, w io.Writer,
 	keys []*pb.TemporaryExposureKey,
@@ -50,18 +150,34 @@ func SerializeTo(
 	startTimestamp, endTimestamp time.Time,
 	signer Signer,
 ) (int, error) {
-	zipw := zip.NewWriter(w)
+	n, _, err := SerializePagesTo(ctx, w, SinglePage(keys), region, startTimestamp, endTimestamp, signer)
+	return n, err
+}
+
+// SerializePagesTo writes an export like SerializeTo, but writes each page of
+// keys out as it's read so only one page is held in memory at a time. The
+// protobuf encoding of a repeated field is just its elements one after
+// another, so export.bin is the header fields followed by each page's keys,
+// and is signed from a digest taken as it's written. It returns the bytes
+// written before compression and the number of keys.
+//
+// Keys are ordered per page: ExportKeyOrder "random" shuffles within each
+// page rather than across the whole export.
+func SerializePagesTo(
+	ctx context.Context, w io.Writer,
+	pages KeyPages,
+	region string,
+	startTimestamp, endTimestamp time.Time,
+	signer Signer,
+) (int, int, error) {
+	zipw := newZipWriter(w, config.AppConstants.RetrievalZipCompressionLevel)
 
 	one := int32(1)
 
 	start := uint64(startTimestamp.Unix())
 	end := uint64(endTimestamp.Unix())
 
-	sigInfo := &pb.SignatureInfo{
-		VerificationKeyVersion: &verificationKeyVersion,
-		VerificationKeyId:      &verificationKeyID,
-		SignatureAlgorithm:     &signatureAlgorithm,
-	}
+	sigInfo := signatureInfo(region)
 
 	region = transformRegion(region)
 
@@ -72,66 +188,170 @@ func SerializeTo(
 		BatchNum:       &one,
 		BatchSize:      &one,
 		SignatureInfos: []*pb.SignatureInfo{sigInfo},
-		Keys:           keys,
 	}
 
-	exportBinData, err := proto.Marshal(tekExport)
-	if err != nil {
-		return -1, err
-	}
-
-	sig, err := signer.Sign(append(binHeader, exportBinData...))
-	if err != nil {
-		return -1, err
-	}
-
-	sigList := &pb.TEKSignatureList{
-		Signatures: []*pb.TEKSignature{&pb.TEKSignature{
-			SignatureInfo: sigInfo,
-			BatchNum:      &one,
-			BatchSize:     &one,
-			Signature:     sig,
-		}},
-	}
-	exportSigData, err := proto.Marshal(sigList)
+	exportHeaderData, err := proto.Marshal(tekExport)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 
 	totalN := 0
+	count := 0
 
 	f, err := zipw.Create("export.bin")
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
-	n, err := f.Write(binHeader)
+	digest := sha256.New()
+	exportBin := io.MultiWriter(f, digest)
+
+	n, err := exportBin.Write(binHeader)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	totalN += n
 	if n != binHeaderLength {
 		panic("header len")
 	}
-	n, err = f.Write(exportBinData)
+	n, err = exportBin.Write(exportHeaderData)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	totalN += n
-	if n != len(exportBinData) {
-		panic("len")
+
+	for {
+		keys, err := pages.Next()
+		if err != nil {
+			return -1, 0, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		keyShufflerMu.Lock()
+		orderKeys(keys, config.AppConstants.ExportKeyOrder, keyShuffler)
+		keyShufflerMu.Unlock()
+
+		exportKeysData, err := proto.Marshal(&pb.TemporaryExposureKeyExport{Keys: keys})
+		if err != nil {
+			return -1, 0, err
+		}
+		n, err = exportBin.Write(exportKeysData)
+		if err != nil {
+			return -1, 0, err
+		}
+		totalN += n
+		count += len(keys)
 	}
+
+	sig, err := signer.SignDigest(digest.Sum(nil))
+	if err != nil {
+		return -1, 0, err
+	}
+
+	exportSigData, err := marshalSignatureList(sigInfo, one, one, sig)
+	if err != nil {
+		return -1, 0, err
+	}
+
 	f, err = zipw.Create("export.sig")
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	n, err = f.Write(exportSigData)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	totalN += n
 	if n != len(exportSigData) {
 		panic("len")
 	}
 
-	return totalN, zipw.Close()
+	return totalN, count, zipw.Close()
+}
+
+func marshalSignatureList(sigInfo *pb.SignatureInfo, batchNum, batchSize int32, sig []byte) ([]byte, error) {
+	sigList := &pb.TEKSignatureList{
+		Signatures: []*pb.TEKSignature{&pb.TEKSignature{
+			SignatureInfo: sigInfo,
+			BatchNum:      &batchNum,
+			BatchSize:     &batchSize,
+			Signature:     sig,
+		}},
+	}
+	return proto.Marshal(sigList)
+}
+
+// ErrInvalidExport is returned by ResignExport for anything that isn't a ZIP
+// holding an export.bin written by SerializeTo for the given region.
+var ErrInvalidExport = errors.New("not a valid exposure notification export")
+
+// ResignExport replaces the signature of an export written by SerializeTo
+// for region with one made by signer, so exports can be carried over to a new
+// signing key without fetching their keys again. export.bin is copied
+// unchanged; the signature info is the region's current one.
+func ResignExport(export []byte, region string, signer Signer) ([]byte, error) {
+	zipr, err := zip.NewReader(bytes.NewReader(export), int64(len(export)))
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+
+	var exportBin []byte
+	for _, f := range zipr.File {
+		if f.Name != "export.bin" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, ErrInvalidExport
+		}
+		exportBin, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, ErrInvalidExport
+		}
+	}
+	if len(exportBin) < binHeaderLength || !bytes.Equal(exportBin[:binHeaderLength], binHeader) {
+		return nil, ErrInvalidExport
+	}
+
+	tekExport := &pb.TemporaryExposureKeyExport{}
+	if err := proto.Unmarshal(exportBin[binHeaderLength:], tekExport); err != nil {
+		return nil, ErrInvalidExport
+	}
+	if tekExport.GetRegion() != transformRegion(region) {
+		return nil, ErrInvalidExport
+	}
+
+	sig, err := signer.Sign(exportBin)
+	if err != nil {
+		return nil, err
+	}
+
+	exportSigData, err := marshalSignatureList(
+		signatureInfo(region), tekExport.GetBatchNum(), tekExport.GetBatchSize(), sig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zipw := newZipWriter(&buf, config.AppConstants.RetrievalZipCompressionLevel)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{"export.bin", exportBin}, {"export.sig", exportSigData}} {
+		f, err := zipw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zipw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
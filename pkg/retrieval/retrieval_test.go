@@ -1,16 +1,30 @@
 package retrieval
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	mockSigner "github.com/cds-snc/covid-alert-server/mocks/pkg/retrieval"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestMin(t *testing.T) {
@@ -62,7 +76,7 @@ func TestSerializeTo(t *testing.T) {
 	data := make([]byte, 32)
 	rand.Read(data)
 
-	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(data, nil)
+	signer.On("SignDigest", mock.AnythingOfType("[]uint8")).Return(data, nil)
 
 	expectedTotal := 206
 	receivedTotal, receivedZip := SerializeTo(ctx, resp, keys, region, startTimestamp, endTimestamp, signer)
@@ -71,6 +85,233 @@ func TestSerializeTo(t *testing.T) {
 	assert.Nil(t, receivedZip)
 }
 
+type testPages struct {
+	pages [][]*pb.TemporaryExposureKey
+	err   error
+}
+
+func (p *testPages) Next() ([]*pb.TemporaryExposureKey, error) {
+	if len(p.pages) == 0 {
+		return nil, p.err
+	}
+	page := p.pages[0]
+	p.pages = p.pages[1:]
+	return page, nil
+}
+
+func TestSerializePagesTo(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s := &signer{privateKey: privateKey}
+
+	keys := []*pb.TemporaryExposureKey{
+		{KeyData: []byte{1}}, {KeyData: []byte{2}}, {KeyData: []byte{3}},
+	}
+	startTimestamp := time.Unix(1600000000, 0)
+	endTimestamp := startTimestamp.Add(time.Hour)
+
+	var whole bytes.Buffer
+	_, err := SerializeTo(context.Background(), &whole, keys, "302", startTimestamp, endTimestamp, s)
+	assert.Nil(t, err)
+
+	// Pages written one after another make the same export.bin as the keys
+	// written all at once
+	var paged bytes.Buffer
+	pages := &testPages{pages: [][]*pb.TemporaryExposureKey{keys[:2], keys[2:]}}
+	_, count, err := SerializePagesTo(context.Background(), &paged, pages, "302", startTimestamp, endTimestamp, s)
+
+	assert.Nil(t, err, "Expected nil if every page was written")
+	assert.Equal(t, 3, count, "Expected the keys from every page")
+
+	exportBin := readZipFile(t, paged.Bytes(), "export.bin")
+	assert.Equal(t, readZipFile(t, whole.Bytes(), "export.bin"), exportBin, "Expected the same export.bin as writing every key at once")
+
+	tekExport := &pb.TemporaryExposureKeyExport{}
+	assert.Nil(t, proto.Unmarshal(exportBin[binHeaderLength:], tekExport))
+	assert.Len(t, tekExport.GetKeys(), 3, "Expected every key in the export")
+
+	// The signature is over the streamed export.bin
+	sigList := &pb.TEKSignatureList{}
+	assert.Nil(t, proto.Unmarshal(readZipFile(t, paged.Bytes(), "export.sig"), sigList))
+
+	var esig struct {
+		R, S *big.Int
+	}
+	asn1.Unmarshal(sigList.GetSignatures()[0].GetSignature(), &esig)
+	digest := sha256.Sum256(exportBin)
+	assert.True(t, ecdsa.Verify(&privateKey.PublicKey, digest[:], esig.R, esig.S), "Expected the signature to validate")
+
+	// Returns error if a page fails
+	pages = &testPages{pages: [][]*pb.TemporaryExposureKey{keys[:2]}, err: fmt.Errorf("error")}
+	_, _, err = SerializePagesTo(context.Background(), &bytes.Buffer{}, pages, "302", startTimestamp, endTimestamp, s)
+
+	assert.Equal(t, fmt.Errorf("error"), err, "Expected error if a page fails")
+}
+
+func TestNewZipWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("EK Export v1    "), 256)
+
+	// Size of content deflated directly at level
+	deflatedSize := func(level int) int {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, level)
+		fw.Write(content)
+		fw.Close()
+		return buf.Len()
+	}
+
+	// Size of content once written to a ZIP at level
+	zippedSize := func(level int) int {
+		var buf bytes.Buffer
+		zipw := newZipWriter(&buf, level)
+		f, _ := zipw.Create("export.bin")
+		f.Write(content)
+		assert.Nil(t, zipw.Close())
+
+		zipr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		assert.Nil(t, err)
+		assert.Len(t, zipr.File, 1)
+		return int(zipr.File[0].CompressedSize64)
+	}
+
+	assert.Equal(t, deflatedSize(flate.NoCompression), zippedSize(flate.NoCompression), "Expected the configured level to be used")
+	assert.Equal(t, deflatedSize(flate.BestCompression), zippedSize(flate.BestCompression), "Expected the configured level to be used")
+	assert.Greater(t, zippedSize(flate.NoCompression), zippedSize(flate.BestCompression), "Expected level 9 to be smaller than level 0")
+
+	// Out of range levels fall back to the default
+	assert.Equal(t, deflatedSize(flate.DefaultCompression), zippedSize(flate.DefaultCompression), "Expected the default level")
+	assert.Equal(t, deflatedSize(flate.DefaultCompression), zippedSize(12), "Expected the default level for an invalid level")
+}
+
+func TestSignatureInfo(t *testing.T) {
+	oldIDs, oldVersions := config.AppConstants.VerificationKeyIDs, config.AppConstants.VerificationKeyVersions
+	defer func() {
+		config.AppConstants.VerificationKeyIDs = oldIDs
+		config.AppConstants.VerificationKeyVersions = oldVersions
+	}()
+	config.AppConstants.VerificationKeyIDs = map[string]string{"302": "CA-302", "303": "CA-303"}
+	config.AppConstants.VerificationKeyVersions = map[string]string{"302": "v2", "303": "v3"}
+
+	signer := &mockSigner.Signer{}
+	signer.On("SignDigest", mock.AnythingOfType("[]uint8")).Return([]byte("signature"), nil)
+
+	for region, expected := range map[string][2]string{
+		"302": {"CA-302", "v2"},
+		"303": {"CA-303", "v3"},
+		"304": {"302", "v1"},
+	} {
+		var export bytes.Buffer
+		_, err := SerializeTo(context.Background(), &export, []*pb.TemporaryExposureKey{randomTestKey()}, region, time.Now(), time.Now().Add(time.Hour), signer)
+		assert.Nil(t, err)
+
+		tekExport := &pb.TemporaryExposureKeyExport{}
+		assert.Nil(t, proto.Unmarshal(readZipFile(t, export.Bytes(), "export.bin")[binHeaderLength:], tekExport))
+		sigList := &pb.TEKSignatureList{}
+		assert.Nil(t, proto.Unmarshal(readZipFile(t, export.Bytes(), "export.sig"), sigList))
+
+		for _, sigInfo := range []*pb.SignatureInfo{tekExport.GetSignatureInfos()[0], sigList.GetSignatures()[0].GetSignatureInfo()} {
+			assert.Equal(t, expected[0], sigInfo.GetVerificationKeyId(), "Expected the configured key id for %s", region)
+			assert.Equal(t, expected[1], sigInfo.GetVerificationKeyVersion(), "Expected the configured key version for %s", region)
+			assert.Equal(t, signatureAlgorithm, sigInfo.GetSignatureAlgorithm())
+		}
+	}
+}
+
+func TestResignExport(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var export bytes.Buffer
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}
+	_, err := SerializeTo(context.Background(), &export, keys, "302", time.Now(), time.Now().Add(time.Hour), &signer{privateKey: oldKey})
+	assert.Nil(t, err)
+
+	// The rotated key is published under a new key id
+	oldKeyIDs := config.AppConstants.VerificationKeyIDs
+	defer func() { config.AppConstants.VerificationKeyIDs = oldKeyIDs }()
+	config.AppConstants.VerificationKeyIDs = map[string]string{"302": "rotated"}
+
+	resigned, err := ResignExport(export.Bytes(), "302", &signer{privateKey: newKey})
+	assert.Nil(t, err, "Expected nil if export was re-signed")
+
+	// The key payload is copied over unchanged
+	exportBin := readZipFile(t, resigned, "export.bin")
+	assert.Equal(t, readZipFile(t, export.Bytes(), "export.bin"), exportBin, "Expected export.bin to be unchanged")
+
+	// The signature is the new key's
+	sigList := &pb.TEKSignatureList{}
+	assert.Nil(t, proto.Unmarshal(readZipFile(t, resigned, "export.sig"), sigList))
+	assert.Len(t, sigList.GetSignatures(), 1)
+	assert.Equal(t, "rotated", sigList.GetSignatures()[0].GetSignatureInfo().GetVerificationKeyId(), "Expected the region's current key id")
+
+	var esig struct {
+		R, S *big.Int
+	}
+	asn1.Unmarshal(sigList.GetSignatures()[0].GetSignature(), &esig)
+	digest := sha256.Sum256(exportBin)
+
+	assert.True(t, ecdsa.Verify(&newKey.PublicKey, digest[:], esig.R, esig.S), "Expected the signature to validate with the new key")
+	assert.False(t, ecdsa.Verify(&oldKey.PublicKey, digest[:], esig.R, esig.S), "Expected the signature not to validate with the old key")
+
+	// Anything that isn't an export is refused
+	_, err = ResignExport([]byte("not a zip"), "302", &signer{privateKey: newKey})
+	assert.Equal(t, ErrInvalidExport, err, "Expected ErrInvalidExport for a non-ZIP")
+
+	_, err = ResignExport(export.Bytes(), "303", &signer{privateKey: newKey})
+	assert.Equal(t, ErrInvalidExport, err, "Expected ErrInvalidExport for another region's export")
+
+	var empty bytes.Buffer
+	zipw := zip.NewWriter(&empty)
+	f, _ := zipw.Create("export.bin")
+	f.Write([]byte("EK Export v2    "))
+	zipw.Close()
+
+	_, err = ResignExport(empty.Bytes(), "302", &signer{privateKey: newKey})
+	assert.Equal(t, ErrInvalidExport, err, "Expected ErrInvalidExport for the wrong header")
+}
+
+func readZipFile(t *testing.T, data []byte, name string) []byte {
+	zipr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	for _, f := range zipr.File {
+		if f.Name == name {
+			rc, _ := f.Open()
+			defer rc.Close()
+			content, _ := ioutil.ReadAll(rc)
+			return content
+		}
+	}
+	t.Fatalf("no %s in ZIP", name)
+	return nil
+}
+
+func TestOrderKeys(t *testing.T) {
+	keyA := &pb.TemporaryExposureKey{KeyData: []byte{1}}
+	keyB := &pb.TemporaryExposureKey{KeyData: []byte{2}}
+	keyC := &pb.TemporaryExposureKey{KeyData: []byte{3}}
+	keyD := &pb.TemporaryExposureKey{KeyData: []byte{4}}
+
+	// keydata sorts by key
+	keys := []*pb.TemporaryExposureKey{keyC, keyA, keyD, keyB}
+	orderKeys(keys, config.ExportKeyOrderKeyData, mrand.New(mrand.NewSource(1)))
+	assert.Equal(t, []*pb.TemporaryExposureKey{keyA, keyB, keyC, keyD}, keys, "keydata should sort by key")
+
+	// submission keeps the order keys were fetched in
+	keys = []*pb.TemporaryExposureKey{keyC, keyA, keyD, keyB}
+	orderKeys(keys, config.ExportKeyOrderSubmission, mrand.New(mrand.NewSource(1)))
+	assert.Equal(t, []*pb.TemporaryExposureKey{keyC, keyA, keyD, keyB}, keys, "submission should keep fetched order")
+
+	// random is shuffled, and reproducible under a seed
+	keys = []*pb.TemporaryExposureKey{keyA, keyB, keyC, keyD}
+	orderKeys(keys, config.ExportKeyOrderRandom, mrand.New(mrand.NewSource(42)))
+
+	again := []*pb.TemporaryExposureKey{keyA, keyB, keyC, keyD}
+	orderKeys(again, config.ExportKeyOrderRandom, mrand.New(mrand.NewSource(42)))
+
+	assert.ElementsMatch(t, []*pb.TemporaryExposureKey{keyA, keyB, keyC, keyD}, keys, "random should keep every key")
+	assert.NotEqual(t, []*pb.TemporaryExposureKey{keyA, keyB, keyC, keyD}, keys, "random should shuffle keys")
+	assert.Equal(t, keys, again, "random should be deterministic under the same seed")
+}
+
 func randomTestKey() *pb.TemporaryExposureKey {
 	token := make([]byte, 16)
 	rand.Read(token)
@@ -12,6 +12,9 @@ import (
 
 type Signer interface {
 	Sign([]byte) ([]byte, error)
+	// SignDigest signs the SHA-256 digest of data that was hashed as it was
+	// written, rather than held in memory to pass to Sign.
+	SignDigest([]byte) ([]byte, error)
 }
 
 type signer struct {
@@ -38,7 +41,11 @@ func NewSigner() Signer {
 
 func (s *signer) Sign(data []byte) ([]byte, error) {
 	digest := sha256.Sum256(data)
-	sig, err := s.privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	return s.SignDigest(digest[:])
+}
+
+func (s *signer) SignDigest(digest []byte) ([]byte, error) {
+	sig, err := s.privateKey.Sign(rand.Reader, digest, crypto.SHA256)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,85 @@
+package retrieval
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Export files are named for their region and period, e.g. 302-00042.zip.
+// Nothing else in a store is ever deleted.
+var exportFileName = regexp.MustCompile(`^[0-9]{3}-[0-9]{5}\.zip$`)
+
+// ExportFile describes an export that has been written out to an ExportStore.
+type ExportFile struct {
+	Name     string
+	Modified time.Time
+}
+
+// ExportStore is somewhere export files are written to, such as local disk or
+// an object store bucket.
+type ExportStore interface {
+	List(context.Context) ([]ExportFile, error)
+	Delete(context.Context, string) error
+}
+
+type diskExportStore struct {
+	dir string
+}
+
+// NewDiskExportStore returns an ExportStore backed by a local directory.
+func NewDiskExportStore(dir string) ExportStore {
+	return &diskExportStore{dir: dir}
+}
+
+func (s *diskExportStore) List(_ context.Context) ([]ExportFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []ExportFile
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, ExportFile{Name: info.Name(), Modified: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (s *diskExportStore) Delete(_ context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.Base(name)))
+}
+
+// DeleteOldExports removes every export file in the store older than the
+// retention period, in the same way the expiration worker purges old keys.
+// Files not named like an export are left alone, however old.
+// With dryRun set it only counts the files it would have removed.
+func DeleteOldExports(ctx context.Context, store ExportStore, retention time.Duration, dryRun bool) (int64, error) {
+	files, err := store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	threshold := time.Now().Add(-retention)
+
+	var deleted int64
+	for _, file := range files {
+		if !exportFileName.MatchString(file.Name) || !file.Modified.Before(threshold) {
+			continue
+		}
+		if dryRun {
+			deleted++
+			continue
+		}
+		if err := store.Delete(ctx, file.Name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
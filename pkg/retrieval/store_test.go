@@ -0,0 +1,90 @@
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeExportStore struct {
+	files     []ExportFile
+	deleted   []string
+	listErr   error
+	deleteErr error
+}
+
+func (s *fakeExportStore) List(_ context.Context) ([]ExportFile, error) {
+	return s.files, s.listErr
+}
+
+func (s *fakeExportStore) Delete(_ context.Context, name string) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	s.deleted = append(s.deleted, name)
+	return nil
+}
+
+func TestDeleteOldExports(t *testing.T) {
+	retention := 24 * time.Hour
+
+	// Returns error if the store can't be listed
+	store := &fakeExportStore{listErr: fmt.Errorf("error")}
+
+	receivedResult, receivedErr := DeleteOldExports(context.Background(), store, retention, false)
+
+	assert.Equal(t, int64(0), receivedResult, "Expected no files to be deleted")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if list fails")
+
+	// Removes old files and keeps recent ones
+	store = &fakeExportStore{files: []ExportFile{
+		{Name: "302-00001.zip", Modified: time.Now().Add(-48 * time.Hour)},
+		{Name: "302-00002.zip", Modified: time.Now().Add(-1 * time.Hour)},
+	}}
+
+	receivedResult, receivedErr = DeleteOldExports(context.Background(), store, retention, false)
+
+	assert.Equal(t, int64(1), receivedResult, "Expected one file to be deleted")
+	assert.Equal(t, []string{"302-00001.zip"}, store.deleted, "Expected only the old file to be deleted")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
+
+	// A dry run only counts the old files
+	store = &fakeExportStore{files: []ExportFile{
+		{Name: "302-00001.zip", Modified: time.Now().Add(-48 * time.Hour)},
+		{Name: "302-00002.zip", Modified: time.Now().Add(-1 * time.Hour)},
+	}}
+
+	receivedResult, receivedErr = DeleteOldExports(context.Background(), store, retention, true)
+
+	assert.Equal(t, int64(1), receivedResult, "Expected the old file to be counted")
+	assert.Empty(t, store.deleted, "Expected nothing to be deleted in a dry run")
+	assert.Nil(t, receivedErr, "Expected nil if the count ran")
+
+	// Returns error if a file can't be deleted
+	store = &fakeExportStore{
+		files:     []ExportFile{{Name: "302-00001.zip", Modified: time.Now().Add(-48 * time.Hour)}},
+		deleteErr: fmt.Errorf("error"),
+	}
+
+	receivedResult, receivedErr = DeleteOldExports(context.Background(), store, retention, false)
+
+	assert.Equal(t, int64(0), receivedResult, "Expected no files to be deleted")
+	assert.Equal(t, fmt.Errorf("error"), receivedErr, "Expected error if delete fails")
+
+	// Only files named like an export are deleted
+	store = &fakeExportStore{files: []ExportFile{
+		{Name: "302-00001.zip", Modified: time.Now().Add(-48 * time.Hour)},
+		{Name: "old.zip", Modified: time.Now().Add(-48 * time.Hour)},
+		{Name: "302-00001.zip.bak", Modified: time.Now().Add(-48 * time.Hour)},
+		{Name: "../302-00001.zip", Modified: time.Now().Add(-48 * time.Hour)},
+	}}
+
+	receivedResult, receivedErr = DeleteOldExports(context.Background(), store, retention, false)
+
+	assert.Equal(t, int64(1), receivedResult, "Expected one file to be deleted")
+	assert.Equal(t, []string{"302-00001.zip"}, store.deleted, "Expected only the export file to be deleted")
+	assert.Nil(t, receivedErr, "Expected nil if delete ran")
+}
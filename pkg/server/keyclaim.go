@@ -1,9 +1,14 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,21 +23,50 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-func NewKeyClaimServlet(db persistence.Conn, keyClaimAuth keyclaim.Authenticator) srvutil.Servlet {
-	return &keyClaimServlet{db: db, auth: keyClaimAuth}
+func NewKeyClaimServlet(db persistence.Conn, keyClaimAuth keyclaim.Authenticator, delivery keyclaim.DeliveryHook, attestor keyclaim.Attestor) srvutil.Servlet {
+	return &keyClaimServlet{db: db, auth: keyClaimAuth, delivery: delivery, attestor: attestor}
 }
 
 type keyClaimServlet struct {
-	db   persistence.Conn
-	auth keyclaim.Authenticator
+	db       persistence.Conn
+	auth     keyclaim.Authenticator
+	delivery keyclaim.DeliveryHook
+	attestor keyclaim.Attestor
 }
 
 // POST /new-key-claim
+// POST /claim-key
+//
+// Portal endpoints, for holders of a key claim token:
+// GET  /unclaimed-codes
+// GET  /key-bounds/{region}
+// POST /one-time-code-status
+//
+// Admin endpoints, for holders of the ADMIN_TOKEN:
+// POST /expire-code
+// POST /server-key-for-code
+// GET  /active-server-keys
+// GET  /key-count/{region}/{day}
+// POST /purge-region/{region}
+// GET  /key-metadata/{region}/{startHour}/{endHour}
+// GET  /keypair-integrity
+// GET  /upload-counts/{region}/{startHour}/{endHour}
 
 func (s *keyClaimServlet) RegisterRouting(r *mux.Router) {
 	r.HandleFunc("/new-key-claim", s.newKeyClaim)
 	r.HandleFunc("/new-key-claim/{hashID:[0-9,a-z]{128}}", s.newKeyClaim)
 	r.HandleFunc("/claim-key", s.claimKeyWrapper)
+	r.HandleFunc("/unclaimed-codes", s.portalOnly(http.MethodGet, s.unclaimedCodes))
+	r.HandleFunc("/key-bounds/{region}", s.portalOnly(http.MethodGet, s.keyBounds))
+	r.HandleFunc("/expire-code", adminOnly(http.MethodPost, s.expireCode))
+	r.HandleFunc("/one-time-code-status", s.portalOnly(http.MethodPost, s.oneTimeCodeStatus))
+	r.HandleFunc("/server-key-for-code", adminOnly(http.MethodPost, s.serverKeyForCode))
+	r.HandleFunc("/active-server-keys", adminOnly(http.MethodGet, s.activeServerKeys))
+	r.HandleFunc("/key-count/{region}/{day:[0-9]{5}}", adminOnly(http.MethodGet, s.keyCount))
+	r.HandleFunc("/purge-region/{region}", adminOnly(http.MethodPost, s.purgeRegion))
+	r.HandleFunc("/key-metadata/{region}/{startHour:[0-9]+}/{endHour:[0-9]+}", adminOnly(http.MethodGet, s.keyMetadata))
+	r.HandleFunc("/keypair-integrity", adminOnly(http.MethodGet, s.keypairIntegrity))
+	r.HandleFunc("/upload-counts/{region}/{startHour:[0-9]+}/{endHour:[0-9]+}", adminOnly(http.MethodGet, s.uploadCounts))
 }
 
 func (s *keyClaimServlet) newKeyClaim(w http.ResponseWriter, r *http.Request) {
@@ -75,17 +109,31 @@ func (s *keyClaimServlet) newKeyClaim(w http.ResponseWriter, r *http.Request) {
 
 	hashID := vars["hashID"]
 
-	keyClaim, err := s.db.NewKeyClaim(region, originator, hashID)
+	keyClaim, err := s.db.NewKeyClaim(ctx, region, originator, hashID)
 	if err == persistence.ErrHashIDClaimed {
 		log(ctx, err).Info("hashID used")
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
+	} else if err == persistence.ErrInvalidRegion {
+		log(ctx, err).Warn("invalid region")
+		http.Error(w, "invalid region", http.StatusBadRequest)
+		return
+	} else if err == persistence.ErrHashIDRateLimited {
+		log(ctx, err).Warn("hashID rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	} else if err == persistence.ErrRegionCodeCapReached {
+		log(ctx, err).Warn("region active code cap reached")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
 	} else if err != nil {
 		log(ctx, err).Error("error constructing new key claim")
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
+	s.deliverKeyClaim(ctx, keyClaim, hashID)
+
 	event := persistence.Event{
 		Originator: originator,
 		DeviceType: persistence.Server,
@@ -104,6 +152,487 @@ func (s *keyClaimServlet) newKeyClaim(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// adminOnly serves h for requests with the given method that carry the
+// ADMIN_TOKEN, and turns everything else away.
+func adminOnly(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if r.Method != method {
+			log(ctx, nil).WithField("method", r.Method).Info("disallowed method")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isAdmin(r.Header.Get("Authorization")) {
+			log(ctx, nil).Info("bad admin auth header")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// portalHandlerFunc is a handler for portal endpoints, given the region and
+// originator of the caller's key claim token.
+type portalHandlerFunc func(w http.ResponseWriter, r *http.Request, region, originator string)
+
+// portalOnly is adminOnly for portals: it serves h for requests with the
+// given method that carry a key claim token.
+func (s *keyClaimServlet) portalOnly(method string, h portalHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if r.Method != method {
+			log(ctx, nil).WithField("method", r.Method).Info("disallowed method")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hdr := r.Header.Get("Authorization")
+		region, originator, ok := s.regionFromAuthHeader(hdr)
+		if !ok {
+			log(ctx, nil).WithField("header", hdr).Info("bad auth header")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r, region, originator)
+	}
+}
+
+// writeJSON sends v as an uncached JSON response.
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Warn("error writing response")
+	}
+}
+
+// readOneTimeCode reads a one time code sent as a plain text POST body, as
+// returned by /new-key-claim, dropping dashes and surrounding whitespace.
+// Codes are taken in bodies so they stay out of URLs and access logs.
+func readOneTimeCode(w http.ResponseWriter, r *http.Request) (string, error) {
+	reader := http.MaxBytesReader(w, r.Body, 256)
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	oneTimeCode := strings.TrimSpace(string(data))
+	return strings.ReplaceAll(oneTimeCode, "-", ""), nil
+}
+
+// readRegion returns the region route variable. Routes accept any path
+// segment there so that RegionCodePattern alone decides which are valid.
+func readRegion(r *http.Request) (string, error) {
+	region := mux.Vars(r)["region"]
+	return region, persistence.ValidateRegion(region)
+}
+
+// unclaimedCodes reports how many of the caller's codes are still waiting to
+// be claimed. The caller is identified by the same bearer token used to
+// generate codes, so a portal can only see its own count.
+func (s *keyClaimServlet) unclaimedCodes(w http.ResponseWriter, r *http.Request, _, originator string) {
+	ctx := r.Context()
+
+	count, err := s.db.CountUnclaimedCodes(ctx, originator)
+	if err != nil {
+		log(ctx, err).Error("error counting unclaimed codes")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte(strconv.Itoa(count) + "\n")); err != nil {
+		log(ctx, err).Warn("error writing response")
+	}
+}
+
+// expireCode revokes a one time code that was issued by mistake, so it can't
+// be claimed. Codes aren't tied to the portal asking, so this needs the
+// ADMIN_TOKEN.
+func (s *keyClaimServlet) expireCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	oneTimeCode, err := readOneTimeCode(w, r)
+	if err != nil {
+		log(ctx, err).Info("error reading request")
+		http.Error(w, "error reading request", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.ExpireOneTimeCode(ctx, oneTimeCode)
+	if err == persistence.ErrCodeNotFound {
+		log(ctx, err).Info("no unclaimed code to expire")
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log(ctx, err).Error("error expiring one time code")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type oneTimeCodeStatusResponse struct {
+	Status persistence.ClaimStatus `json:"status"`
+}
+
+// oneTimeCodeStatus tells a portal whether one of its own codes has been
+// claimed yet. It changes nothing, but takes the code in a POST body like
+// expireCode.
+func (s *keyClaimServlet) oneTimeCodeStatus(w http.ResponseWriter, r *http.Request, _, originator string) {
+	ctx := r.Context()
+
+	oneTimeCode, err := readOneTimeCode(w, r)
+	if err != nil {
+		log(ctx, err).Info("error reading request")
+		http.Error(w, "error reading request", http.StatusBadRequest)
+		return
+	}
+
+	status, err := s.db.OneTimeCodeStatus(ctx, originator, oneTimeCode)
+	if err != nil {
+		log(ctx, err).Error("error looking up one time code status")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, w, oneTimeCodeStatusResponse{Status: status})
+}
+
+type serverKeyForCodeResponse struct {
+	ServerPublicKey string `json:"server_public_key"`
+}
+
+// serverKeyForCode gives support the hex encoded server public key of an
+// unclaimed code, to re-hand to a user whose claim didn't complete. The code
+// is taken in a POST body like expireCode.
+func (s *keyClaimServlet) serverKeyForCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	oneTimeCode, err := readOneTimeCode(w, r)
+	if err != nil {
+		log(ctx, err).Info("error reading request")
+		http.Error(w, "error reading request", http.StatusBadRequest)
+		return
+	}
+
+	serverPub, err := s.db.ServerPublicKeyForCode(ctx, oneTimeCode)
+	if err == persistence.ErrCodeNotFound {
+		log(ctx, err).Info("no unclaimed code for server key")
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log(ctx, err).Error("error looking up server key for code")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log(ctx, nil).Warn("server key looked up by one time code")
+
+	writeJSON(ctx, w, serverKeyForCodeResponse{ServerPublicKey: hex.EncodeToString(serverPub)})
+}
+
+type keyCountResponse struct {
+	Region string `json:"region"`
+	Date   uint32 `json:"date"`
+	Count  int    `json:"count"`
+}
+
+// keyCount reports how many keys a region is serving for a UTC date. It needs
+// the ADMIN_TOKEN.
+func (s *keyClaimServlet) keyCount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	region, err := readRegion(r)
+	if err != nil {
+		log(ctx, err).Info("invalid region parameter")
+		http.Error(w, "invalid region parameter", http.StatusBadRequest)
+		return
+	}
+
+	dateNumber, err := strconv.ParseUint(mux.Vars(r)["day"], 10, 32)
+	if err != nil {
+		log(ctx, err).Info("invalid day parameter")
+		http.Error(w, "invalid day parameter", http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.db.CountDiagnosisKeysForDate(ctx, region, uint32(dateNumber))
+	if err != nil {
+		log(ctx, err).Error("error counting diagnosis keys")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, w, keyCountResponse{Region: region, Date: uint32(dateNumber), Count: count})
+}
+
+type keyBoundsResponse struct {
+	Region     string `json:"region"`
+	OldestHour uint32 `json:"oldestHour"`
+	NewestHour uint32 `json:"newestHour"`
+}
+
+// keyBounds reports the submission hours of the oldest and newest keys a
+// region holds, so monitoring can spot a region that stopped receiving
+// uploads. Both are 0 if the region has none.
+func (s *keyClaimServlet) keyBounds(w http.ResponseWriter, r *http.Request, region, _ string) {
+	ctx := r.Context()
+
+	requested, err := readRegion(r)
+	if err != nil {
+		log(ctx, err).Info("invalid region parameter")
+		http.Error(w, "invalid region parameter", http.StatusBadRequest)
+		return
+	}
+
+	if requested != region {
+		log(ctx, nil).WithField("region", requested).Info("region not allowed for token")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	oldestHour, newestHour, err := s.db.KeySubmissionBounds(ctx, region)
+	if err != nil {
+		log(ctx, err).Error("error reading key submission bounds")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, w, keyBoundsResponse{Region: region, OldestHour: oldestHour, NewestHour: newestHour})
+}
+
+type activeServerKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// activeServerKeys lists the hex encoded public key of every server keypair
+// still within its validity period, so key rotation can be audited. It spans
+// every region's keypairs, so it needs the ADMIN_TOKEN.
+func (s *keyClaimServlet) activeServerKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	keys, err := s.db.ActiveServerPublicKeys(ctx)
+	if err != nil {
+		log(ctx, err).Error("error listing active server keys")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := activeServerKeysResponse{Keys: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, hex.EncodeToString(key))
+	}
+
+	writeJSON(ctx, w, resp)
+}
+
+type purgeRegionResponse struct {
+	Region  string `json:"region"`
+	Deleted int64  `json:"deleted"`
+}
+
+// purgeRegion deletes every diagnosis key held for a region, for when it
+// leaves the program. This can't be undone, so it needs the ADMIN_TOKEN
+// rather than a key claim token.
+func (s *keyClaimServlet) purgeRegion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	region, err := readRegion(r)
+	if err != nil {
+		log(ctx, err).Info("invalid region parameter")
+		http.Error(w, "invalid region parameter", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.db.DeleteDiagnosisKeysForRegion(ctx, region)
+	if err != nil {
+		log(ctx, err).Error("error purging region")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log(ctx, nil).WithField("region", region).WithField("count", deleted).Warn("purged diagnosis keys for region")
+
+	writeJSON(ctx, w, purgeRegionResponse{Region: region, Deleted: deleted})
+}
+
+// keyMetadata streams the metadata of a region's diagnosis keys as
+// newline-delimited JSON, for analysts who can't use the export ZIPs.
+func (s *keyClaimServlet) keyMetadata(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	startHour, err := strconv.ParseUint(vars["startHour"], 10, 32)
+	if err != nil {
+		log(ctx, err).Info("invalid startHour parameter")
+		http.Error(w, "invalid startHour parameter", http.StatusBadRequest)
+		return
+	}
+	endHour, err := strconv.ParseUint(vars["endHour"], 10, 32)
+	if err != nil || endHour <= startHour {
+		log(ctx, err).Info("invalid endHour parameter")
+		http.Error(w, "invalid endHour parameter", http.StatusBadRequest)
+		return
+	}
+
+	region, err := readRegion(r)
+	if err != nil {
+		log(ctx, err).Info("invalid region parameter")
+		http.Error(w, "invalid region parameter", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/x-ndjson")
+
+	n, err := s.db.StreamDiagnosisKeysJSON(ctx, region, uint32(startHour), uint32(endHour), w)
+	if err != nil {
+		log(ctx, err).WithField("count", n).Error("error streaming key metadata")
+		// Once rows have been written the status can't be changed, so the
+		// client only sees a short response
+		if n == 0 {
+			http.Error(w, "server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	log(ctx, nil).WithField("region", region).WithField("count", n).Info("streamed key metadata")
+}
+
+type keypairIntegrityResponse struct {
+	Corrupt []persistence.CorruptRow `json:"corrupt"`
+}
+
+// keypairIntegrity reports every stored server keypair whose public key
+// doesn't match its private key, for use during incidents.
+func (s *keyClaimServlet) keypairIntegrity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	corrupt, err := s.db.VerifyServerKeypairIntegrity(ctx)
+	if err != nil {
+		log(ctx, err).Error("error verifying server keypairs")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if len(corrupt) > 0 {
+		log(ctx, nil).WithField("count", len(corrupt)).Error("found corrupt server keypairs")
+	} else {
+		corrupt = []persistence.CorruptRow{}
+	}
+
+	writeJSON(ctx, w, keypairIntegrityResponse{Corrupt: corrupt})
+}
+
+type uploadCountsResponse struct {
+	Region string         `json:"region"`
+	Counts map[uint32]int `json:"counts"`
+}
+
+// uploadCounts reports how many keys a region had uploaded in each hour of a
+// window, as an upload rate time series for capacity planning.
+func (s *keyClaimServlet) uploadCounts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+	startHour, err := strconv.ParseUint(vars["startHour"], 10, 32)
+	if err != nil {
+		log(ctx, err).Info("invalid startHour parameter")
+		http.Error(w, "invalid startHour parameter", http.StatusBadRequest)
+		return
+	}
+	endHour, err := strconv.ParseUint(vars["endHour"], 10, 32)
+	if err != nil || endHour <= startHour {
+		log(ctx, err).Info("invalid endHour parameter")
+		http.Error(w, "invalid endHour parameter", http.StatusBadRequest)
+		return
+	}
+
+	region, err := readRegion(r)
+	if err != nil {
+		log(ctx, err).Info("invalid region parameter")
+		http.Error(w, "invalid region parameter", http.StatusBadRequest)
+		return
+	}
+
+	counts, err := s.db.UploadCountsByHour(ctx, region, uint32(startHour), uint32(endHour))
+	if err != nil {
+		log(ctx, err).Error("error counting uploads by hour")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, w, uploadCountsResponse{Region: region, Counts: counts})
+}
+
+// isAdmin reports whether header carries the ADMIN_TOKEN, which is read once
+// at startup. Admin endpoints are disabled while ADMIN_TOKEN is unset.
+func isAdmin(header string) bool {
+	adminToken := config.AppConstants.AdminToken
+	if adminToken == "" {
+		return false
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(parts[1]), []byte(adminToken)) == 1
+}
+
+// How long a single delivery attempt may take, how long to wait before the
+// first retry (the wait doubles after each attempt), and how long delivery may
+// hold up the response overall.
+var (
+	otcDeliveryAttemptTimeout = 2 * time.Second
+	otcDeliveryRetryDelay     = 100 * time.Millisecond
+	otcDeliveryDeadline       = 5 * time.Second
+)
+
+// The code is already persisted by the time we deliver it, so a failed
+// delivery is retried and, if it still fails, the code is returned in the
+// response as usual rather than being lost.
+func (s *keyClaimServlet) deliverKeyClaim(ctx context.Context, keyClaim, hashID string) {
+	ctx, cancel := context.WithTimeout(ctx, otcDeliveryDeadline)
+	defer cancel()
+
+	var err error
+	delay := otcDeliveryRetryDelay
+	for attempt := 1; attempt <= config.AppConstants.OTCDeliveryAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-ctx.Done():
+				log(ctx, err).Error("error delivering one time code")
+				return
+			}
+		}
+
+		if err = s.deliverOnce(ctx, keyClaim, hashID); err == nil {
+			return
+		}
+	}
+	if err != nil {
+		log(ctx, err).Error("error delivering one time code")
+	}
+}
+
+func (s *keyClaimServlet) deliverOnce(ctx context.Context, keyClaim, hashID string) error {
+	ctx, cancel := context.WithTimeout(ctx, otcDeliveryAttemptTimeout)
+	defer cancel()
+	return s.delivery.Deliver(ctx, keyClaim, hashID)
+}
+
 func (s *keyClaimServlet) regionFromAuthHeader(header string) (string, string, bool) {
 	parts := strings.SplitN(header, " ", 2)
 	if len(parts) != 2 || parts[0] != "Bearer" {
@@ -129,14 +658,14 @@ func (s *keyClaimServlet) claimKey(w http.ResponseWriter, r *http.Request) resul
 	// other than transiently in the failed attempts table.
 	ip := getIP(r)
 
-	triesRemaining, banDuration, err := s.db.CheckClaimKeyBan(ip)
+	triesRemaining, banDuration, err := s.db.CheckClaimKeyBan(ctx, ip)
 	if err != nil {
 		kcre := kcrError(pb.KeyClaimResponse_SERVER_ERROR, triesRemaining)
 		return requestError(ctx, w, err, "database error checking claim-key ban", http.StatusInternalServerError, kcre)
 	} else if triesRemaining == 0 {
 		kcre := kcrError(pb.KeyClaimResponse_TEMPORARY_BAN, triesRemaining)
 		kcre.RemainingBanDuration = ptypes.DurationProto(banDuration)
-		return requestError(ctx, w, err, "error reading request", http.StatusTooManyRequests, kcre)
+		return requestError(ctx, w, persistence.ErrBanned, "error reading request", http.StatusTooManyRequests, kcre)
 	}
 
 	w.Header().Add("Content-Type", "application/x-protobuf")
@@ -166,33 +695,54 @@ func (s *keyClaimServlet) claimKey(w http.ResponseWriter, r *http.Request) resul
 
 	appPublicKey := req.GetAppPublicKey()
 
-	serverPub, err := s.db.ClaimKey(oneTimeCode, appPublicKey, ctx)
-	if err == persistence.ErrInvalidKeyFormat {
+	// Attestation follows the region the code was issued for. An unknown code
+	// is left to ClaimKey, which records it as a failed attempt.
+	region, err := s.db.OneTimeCodeRegion(ctx, oneTimeCode)
+	if err != nil && err != persistence.ErrCodeNotFound {
 		return requestError(
-			ctx, w, err, "invalid key format",
-			http.StatusBadRequest, kcrError(pb.KeyClaimResponse_INVALID_KEY, triesRemaining),
-		)
-	} else if err == persistence.ErrDuplicateKey {
-		return requestError(
-			ctx, w, err, "duplicate key",
-			http.StatusUnauthorized, kcrError(pb.KeyClaimResponse_INVALID_KEY, triesRemaining),
-		)
-	} else if err == persistence.ErrInvalidOneTimeCode {
-		triesRemaining, banDuration, err := s.db.ClaimKeyFailure(ip)
-		if err != nil {
-			kcre := kcrError(pb.KeyClaimResponse_SERVER_ERROR, triesRemaining)
-			msg := "database error recording claim-key failure"
-			return requestError(ctx, w, err, msg, http.StatusInternalServerError, kcre)
-		}
-		kcre := kcrError(pb.KeyClaimResponse_INVALID_ONE_TIME_CODE, triesRemaining)
-		kcre.RemainingBanDuration = ptypes.DurationProto(banDuration)
-		return requestError(ctx, w, err, "invalid one time code", http.StatusUnauthorized, kcre)
-	} else if err != nil {
-		return requestError(
-			ctx, w, err, "failure to claim key using OneTimeCode",
+			ctx, w, err, "database error looking up one time code region",
 			http.StatusInternalServerError, kcrError(pb.KeyClaimResponse_SERVER_ERROR, triesRemaining),
 		)
 	}
+	if err == nil && s.attestor.Required(region) {
+		if err := s.attestor.Verify(appPublicKey, r.Header.Get("X-Device-Attestation")); err != nil {
+			return requestError(
+				ctx, w, err, "invalid device attestation",
+				http.StatusUnauthorized, kcrError(pb.KeyClaimResponse_UNKNOWN, triesRemaining),
+			)
+		}
+	}
+
+	serverPub, err := s.db.ClaimKey(ctx, oneTimeCode, appPublicKey)
+	if err != nil {
+		switch persistence.ErrorCodeOf(err) {
+		case persistence.CodeInvalidKeyFormat:
+			return requestError(
+				ctx, w, err, "invalid key format",
+				http.StatusBadRequest, kcrError(pb.KeyClaimResponse_INVALID_KEY, triesRemaining),
+			)
+		case persistence.CodeDuplicateKey:
+			return requestError(
+				ctx, w, err, "duplicate key",
+				http.StatusUnauthorized, kcrError(pb.KeyClaimResponse_INVALID_KEY, triesRemaining),
+			)
+		case persistence.CodeInvalidOneTimeCode:
+			triesRemaining, banDuration, err := s.db.ClaimKeyFailure(ctx, ip)
+			if err != nil {
+				kcre := kcrError(pb.KeyClaimResponse_SERVER_ERROR, triesRemaining)
+				msg := "database error recording claim-key failure"
+				return requestError(ctx, w, err, msg, http.StatusInternalServerError, kcre)
+			}
+			kcre := kcrError(pb.KeyClaimResponse_INVALID_ONE_TIME_CODE, triesRemaining)
+			kcre.RemainingBanDuration = ptypes.DurationProto(banDuration)
+			return requestError(ctx, w, err, "invalid one time code", http.StatusUnauthorized, kcre)
+		default:
+			return requestError(
+				ctx, w, err, "failure to claim key using OneTimeCode",
+				http.StatusInternalServerError, kcrError(pb.KeyClaimResponse_SERVER_ERROR, triesRemaining),
+			)
+		}
+	}
 
 	maxTries := uint32(config.AppConstants.MaxConsecutiveClaimKeyFailures)
 	resp := &pb.KeyClaimResponse{ServerPublicKey: serverPub, TriesRemaining: &maxTries}
@@ -209,10 +759,14 @@ func (s *keyClaimServlet) claimKey(w http.ResponseWriter, r *http.Request) resul
 		log(ctx, err).Info("error writing response")
 	}
 
-	if err := s.db.ClaimKeySuccess(ip); err != nil {
+	if err := s.db.ClaimKeySuccess(ctx, ip); err != nil {
 		log(ctx, err).Warn("error recording claim-key success")
 	}
 
+	if err := s.db.RecordClaimEvent(ctx, ip); err != nil {
+		log(ctx, err).Warn("error recording claim event")
+	}
+
 	return result{}
 }
 
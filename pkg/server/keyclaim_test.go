@@ -2,13 +2,16 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"github.com/stretchr/testify/mock"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -32,16 +35,20 @@ import (
 func TestNewKeyClaimServlet(t *testing.T) {
 	db := &persistence.Conn{}
 	auth := &keyclaim.Authenticator{}
+	delivery := &keyclaim.DeliveryHook{}
+	attestor := &keyclaim.Attestor{}
 
 	expected := &keyClaimServlet{
-		db:   db,
-		auth: auth,
+		db:       db,
+		auth:     auth,
+		delivery: delivery,
+		attestor: attestor,
 	}
-	assert.Equal(t, expected, NewKeyClaimServlet(db, auth), "should return a new keyClaimServlet struct")
+	assert.Equal(t, expected, NewKeyClaimServlet(db, auth, delivery, attestor), "should return a new keyClaimServlet struct")
 }
 
 func TestRegisterRoutingKeyClaim(t *testing.T) {
-	servlet := NewKeyClaimServlet(&persistence.Conn{}, &keyclaim.Authenticator{})
+	servlet := NewKeyClaimServlet(&persistence.Conn{}, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
 	router := Router()
 	servlet.RegisterRouting(router)
 
@@ -49,6 +56,17 @@ func TestRegisterRoutingKeyClaim(t *testing.T) {
 	assert.Contains(t, expectedPaths, "/new-key-claim", "should include a /new-key-claim path")
 	assert.Contains(t, expectedPaths, "/new-key-claim/{hashID:[0-9,a-z]{128}}", "should include a /new-key-claim/{hashID:[0-9,a-z]{128}} path")
 	assert.Contains(t, expectedPaths, "/claim-key", "should include a claim-key path")
+	assert.Contains(t, expectedPaths, "/unclaimed-codes", "should include an unclaimed-codes path")
+	assert.Contains(t, expectedPaths, "/key-count/{region}/{day:[0-9]{5}}", "should include a key-count path")
+	assert.Contains(t, expectedPaths, "/key-bounds/{region}", "should include a key-bounds path")
+	assert.Contains(t, expectedPaths, "/expire-code", "should include an expire-code path")
+	assert.Contains(t, expectedPaths, "/one-time-code-status", "should include a one-time-code-status path")
+	assert.Contains(t, expectedPaths, "/server-key-for-code", "should include a server-key-for-code path")
+	assert.Contains(t, expectedPaths, "/active-server-keys", "should include an active-server-keys path")
+	assert.Contains(t, expectedPaths, "/purge-region/{region}", "should include a purge-region path")
+	assert.Contains(t, expectedPaths, "/key-metadata/{region}/{startHour:[0-9]+}/{endHour:[0-9]+}", "should include a key-metadata path")
+	assert.Contains(t, expectedPaths, "/keypair-integrity", "should include a keypair-integrity path")
+	assert.Contains(t, expectedPaths, "/upload-counts/{region}/{startHour:[0-9]+}/{endHour:[0-9]+}", "should include an upload-counts path")
 }
 
 func TestNewKeyClaim(t *testing.T) {
@@ -59,6 +77,10 @@ func TestNewKeyClaim(t *testing.T) {
 	auth.On("Authenticate", "badtoken").Return("", false)
 	auth.On("Authenticate", "goodtoken").Return("302", true)
 	auth.On("Authenticate", "errortoken").Return("302", true)
+	auth.On("Authenticate", "captoken").Return("302", true)
+	auth.On("Authenticate", "ratelimitedtoken").Return("302", true)
+	auth.On("Authenticate", "undeliverabletoken").Return("302", true)
+	auth.On("Authenticate", "badregiontoken").Return("302", true)
 
 	hashID := hex.EncodeToString(SHA512([]byte("abcd")))
 
@@ -66,13 +88,26 @@ func TestNewKeyClaim(t *testing.T) {
 	db.On( "SaveEvent", mock.AnythingOfType("persistence.Event")).Return(nil)
 
 	// DB Mock
-	db.On("NewKeyClaim", "302", "goodtoken", "").Return("AAABBBCCCC", nil)
-	db.On("NewKeyClaim", "302", "goodtoken", hashID).Return("AAABBBCCCC", nil)
+	db.On("NewKeyClaim", mock.Anything, "302", "goodtoken", "").Return("AAABBBCCCC", nil)
+	db.On("NewKeyClaim", mock.Anything, "302", "goodtoken", hashID).Return("AAABBBCCCC", nil)
 
-	db.On("NewKeyClaim", "302", "errortoken", "").Return("", fmt.Errorf("Random error"))
-	db.On("NewKeyClaim", "302", "errortoken", hashID).Return("", err.ErrHashIDClaimed)
+	db.On("NewKeyClaim", mock.Anything, "302", "errortoken", "").Return("", fmt.Errorf("Random error"))
+	db.On("NewKeyClaim", mock.Anything, "302", "errortoken", hashID).Return("", err.ErrHashIDClaimed)
 
-	servlet := NewKeyClaimServlet(db, auth)
+	db.On("NewKeyClaim", mock.Anything, "302", "captoken", "").Return("", err.ErrRegionCodeCapReached)
+
+	db.On("NewKeyClaim", mock.Anything, "302", "ratelimitedtoken", hashID).Return("", err.ErrHashIDRateLimited)
+
+	db.On("NewKeyClaim", mock.Anything, "302", "undeliverabletoken", "").Return("DDDEEEFFFF", nil)
+
+	db.On("NewKeyClaim", mock.Anything, "302", "badregiontoken", "").Return("", err.ErrInvalidRegion)
+
+	// Delivery Mock
+	delivery := &keyclaim.DeliveryHook{}
+	delivery.On("Deliver", mock.Anything, "AAABBBCCCC", mock.Anything).Return(nil)
+	delivery.On("Deliver", mock.Anything, "DDDEEEFFFF", "").Return(fmt.Errorf("gateway down"))
+
+	servlet := NewKeyClaimServlet(db, auth, delivery, &keyclaim.Attestor{})
 	router := Router()
 	servlet.RegisterRouting(router)
 
@@ -123,72 +158,812 @@ func TestNewKeyClaim(t *testing.T) {
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
-	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Malformed auth header - No space
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearerthisisaverylongtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Bad auth token
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Good auth token - no HashID
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Equal(t, "AAABBBCCCC\n", string(resp.Body.Bytes()), "Correct response is expected")
+	delivery.AssertCalled(t, "Deliver", mock.Anything, "AAABBBCCCC", "")
+
+	// Good auth token -  HashID
+	req, _ = http.NewRequest("POST", "/new-key-claim/"+hashID, nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Equal(t, "AAABBBCCCC\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	// Error saving - no HashID
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer errortoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assert.Equal(t, "server error\n", string(resp.Body.Bytes()), "server error response is expected")
+
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error constructing new key claim")
+
+	// Error saving - duplicate HashID
+	req, _ = http.NewRequest("POST", "/new-key-claim/"+hashID, nil)
+	req.Header.Set("Authorization", "Bearer errortoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 403, resp.Code, "forbidden response is expected")
+	assert.Equal(t, "forbidden\n", string(resp.Body.Bytes()), "forbidden response is expected")
+
+	assertLog(t, hook, 1, logrus.InfoLevel, "hashID used")
+
+	// Region has reached its active code cap
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer captoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 429, resp.Code, "Too many requests response is expected")
+	assert.Equal(t, "too many requests\n", string(resp.Body.Bytes()), "too many requests response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "region active code cap reached")
+
+	// Too many codes recently generated for the hashID
+	req, _ = http.NewRequest("POST", "/new-key-claim/"+hashID, nil)
+	req.Header.Set("Authorization", "Bearer ratelimitedtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 429, resp.Code, "Too many requests response is expected")
+	assert.Equal(t, "too many requests\n", string(resp.Body.Bytes()), "too many requests response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "hashID rate limited")
+
+	// Delivery fails - retried, then the code is still returned
+	oldDelay := otcDeliveryRetryDelay
+	defer func() { otcDeliveryRetryDelay = oldDelay }()
+	otcDeliveryRetryDelay = time.Millisecond
+
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer undeliverabletoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Equal(t, "DDDEEEFFFF\n", string(resp.Body.Bytes()), "Code should be returned if delivery fails")
+	delivery.AssertNumberOfCalls(t, "Deliver", 2+config.AppConstants.OTCDeliveryAttempts)
+
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error delivering one time code")
+
+	// Region doesn't match the configured format
+	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	req.Header.Set("Authorization", "Bearer badregiontoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "Bad request response is expected")
+	assert.Equal(t, "invalid region\n", string(resp.Body.Bytes()), "invalid region response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "invalid region")
+}
+
+func TestDeliverKeyClaim(t *testing.T) {
+	oldTimeout, oldDelay, oldDeadline := otcDeliveryAttemptTimeout, otcDeliveryRetryDelay, otcDeliveryDeadline
+	oldAttempts := config.AppConstants.OTCDeliveryAttempts
+	defer func() {
+		otcDeliveryAttemptTimeout, otcDeliveryRetryDelay, otcDeliveryDeadline = oldTimeout, oldDelay, oldDeadline
+		config.AppConstants.OTCDeliveryAttempts = oldAttempts
+	}()
+	otcDeliveryAttemptTimeout = 10 * time.Millisecond
+	otcDeliveryRetryDelay = 5 * time.Millisecond
+	otcDeliveryDeadline = 50 * time.Millisecond
+	config.AppConstants.OTCDeliveryAttempts = 100
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	// A gateway that never answers is given up on per attempt, with the
+	// attempts backing off until the overall deadline
+	var waits []time.Duration
+	delivery := &keyclaim.DeliveryHook{}
+	delivery.On("Deliver", mock.Anything, "AAABBBCCCC", "").Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		start := time.Now()
+		<-ctx.Done()
+		waits = append(waits, time.Since(start))
+	}).Return(context.DeadlineExceeded)
+
+	servlet := &keyClaimServlet{delivery: delivery}
+
+	start := time.Now()
+	servlet.deliverKeyClaim(context.Background(), "AAABBBCCCC", "")
+	elapsed := time.Since(start)
+
+	assert.Less(t, int64(elapsed), int64(otcDeliveryDeadline+otcDeliveryAttemptTimeout), "Expected delivery to stop at the overall deadline")
+	assert.Less(t, len(waits), 5, "Expected the backoff to limit the attempts within the deadline")
+	assert.Greater(t, len(waits), 1, "Expected a failed attempt to be retried")
+	for _, wait := range waits {
+		assert.Less(t, int64(wait), int64(otcDeliveryAttemptTimeout+20*time.Millisecond), "Expected each attempt to be cut off at its timeout")
+	}
+
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error delivering one time code")
+}
+
+func TestUnclaimedCodes(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// Auth Mock
+	auth.On("Authenticate", "badtoken").Return("", false)
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+	auth.On("Authenticate", "emptytoken").Return("302", true)
+	auth.On("Authenticate", "errortoken").Return("302", true)
+
+	// DB Mock
+	db.On("CountUnclaimedCodes", mock.Anything, "goodtoken").Return(12, nil)
+	db.On("CountUnclaimedCodes", mock.Anything, "emptytoken").Return(0, nil)
+	db.On("CountUnclaimedCodes", mock.Anything, "errortoken").Return(-1, fmt.Errorf("Random error"))
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/unclaimed-codes", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Bad auth token
+	req, _ = http.NewRequest("GET", "/unclaimed-codes", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/unclaimed-codes", nil)
+	req.Header.Set("Authorization", "Bearer errortoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error counting unclaimed codes")
+
+	// No outstanding codes
+	req, _ = http.NewRequest("GET", "/unclaimed-codes", nil)
+	req.Header.Set("Authorization", "Bearer emptytoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "0\n", string(resp.Body.Bytes()), "Expected a count of 0")
+
+	// Outstanding codes
+	req, _ = http.NewRequest("GET", "/unclaimed-codes", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "12\n", string(resp.Body.Bytes()), "Expected a count of 12")
+}
+
+func TestExpireCode(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// A key claim token isn't enough
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+
+	// DB Mock
+	db.On("ExpireOneTimeCode", mock.Anything, "AAABBBCCCC").Return(nil)
+	db.On("ExpireOneTimeCode", mock.Anything, "CLAIMEDXXX").Return(err.ErrCodeNotFound)
+	db.On("ExpireOneTimeCode", mock.Anything, "ERRORXXXXX").Return(fmt.Errorf("Random error"))
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a POST request
+	req, _ := http.NewRequest("GET", "/expire-code", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("POST", "/expire-code", strings.NewReader("AAABBBCCCC"))
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// A portal's key claim token
+	req, _ = http.NewRequest("POST", "/expire-code", strings.NewReader("AAABBBCCCC"))
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+	db.AssertNotCalled(t, "ExpireOneTimeCode", mock.Anything, "AAABBBCCCC")
+
+	// Already claimed
+	req, _ = http.NewRequest("POST", "/expire-code", strings.NewReader("CLAIMEDXXX"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 404, resp.Code, "Not found response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "no unclaimed code to expire")
+
+	// Database error
+	req, _ = http.NewRequest("POST", "/expire-code", strings.NewReader("ERRORXXXXX"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error expiring one time code")
+
+	// Revokes the code, ignoring dashes and the trailing newline
+	req, _ = http.NewRequest("POST", "/expire-code", strings.NewReader("AAA-BBB-CCCC\n"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 204, resp.Code, "No content response is expected")
+	db.AssertCalled(t, "ExpireOneTimeCode", mock.Anything, "AAABBBCCCC")
+}
+
+func TestOneTimeCodeStatus(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// Auth Mock
+	auth.On("Authenticate", "badtoken").Return("", false)
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+
+	// DB Mock
+	db.On("OneTimeCodeStatus", mock.Anything, "goodtoken", "AAABBBCCCC").Return(err.Unclaimed, nil)
+	db.On("OneTimeCodeStatus", mock.Anything, "goodtoken", "ERRORXXXXX").Return(err.ClaimStatus(""), fmt.Errorf("Random error"))
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	// Not a POST request
+	req, _ := http.NewRequest("GET", "/one-time-code-status", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Bad auth token
+	req, _ = http.NewRequest("POST", "/one-time-code-status", strings.NewReader("AAABBBCCCC"))
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Database error
+	req, _ = http.NewRequest("POST", "/one-time-code-status", strings.NewReader("ERRORXXXXX"))
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error looking up one time code status")
+
+	// Reports the status, ignoring dashes and the trailing newline
+	req, _ = http.NewRequest("POST", "/one-time-code-status", strings.NewReader("AAA-BBB-CCCC\n"))
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"status":"unclaimed"}`, string(resp.Body.Bytes()), "Expected the code's status")
+}
+
+func TestKeyCount(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("CountDiagnosisKeysForDate", mock.Anything, "302", uint32(18500)).Return(42, nil)
+	db.On("CountDiagnosisKeysForDate", mock.Anything, "302", uint32(18501)).Return(0, fmt.Errorf("Random error"))
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/key-count/302/18500", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("GET", "/key-count/302/18500", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/key-count/302/18501", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error counting diagnosis keys")
+
+	// Count for the region and date
+	req, _ = http.NewRequest("GET", "/key-count/302/18500", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"region":"302","date":18500,"count":42}`, string(resp.Body.Bytes()), "Expected the key count")
+}
+
+func TestKeyCountRegionPattern(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("CountDiagnosisKeysForDate", mock.Anything, "CA-ON", uint32(18500)).Return(7, nil)
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	oldRegexp := config.AppConstants.RegionCodeRegexp
+	defer func() { config.AppConstants.RegionCodeRegexp = oldRegexp }()
+	config.AppConstants.RegionCodeRegexp = regexp.MustCompile("^CA-[A-Z]{2}$")
+
+	// Region doesn't match the configured pattern
+	req, _ := http.NewRequest("GET", "/key-count/302/18500", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "Bad request response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "invalid region parameter")
+
+	// Region matches the configured pattern
+	req, _ = http.NewRequest("GET", "/key-count/CA-ON/18500", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, `{"region":"CA-ON","date":18500,"count":7}`, string(resp.Body.Bytes()), "Expected the key count")
+}
+
+func TestKeyBounds(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// Auth Mock
+	auth.On("Authenticate", "badtoken").Return("", false)
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+	auth.On("Authenticate", "errortoken").Return("303", true)
+
+	// DB Mock
+	db.On("KeySubmissionBounds", mock.Anything, "302").Return(uint32(444000), uint32(444350), nil)
+	db.On("KeySubmissionBounds", mock.Anything, "303").Return(uint32(0), uint32(0), fmt.Errorf("Random error"))
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/key-bounds/302", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Bad auth token
+	req, _ = http.NewRequest("GET", "/key-bounds/302", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Another region's bounds
+	req, _ = http.NewRequest("GET", "/key-bounds/303", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 403, resp.Code, "Forbidden response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "region not allowed for token")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/key-bounds/303", nil)
+	req.Header.Set("Authorization", "Bearer errortoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error reading key submission bounds")
+
+	// Bounds for the region
+	req, _ = http.NewRequest("GET", "/key-bounds/302", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"region":"302","oldestHour":444000,"newestHour":444350}`, string(resp.Body.Bytes()), "Expected the key bounds")
+}
+
+func TestActiveServerKeys(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// A key claim token isn't enough
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+
+	// DB Mock
+	db.On("ActiveServerPublicKeys", mock.Anything).Return(nil, fmt.Errorf("Random error")).Once()
+	db.On("ActiveServerPublicKeys", mock.Anything).Return([][]byte{{0x01, 0x02}, {0xab, 0xcd}}, nil)
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/active-server-keys", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("GET", "/active-server-keys", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// A portal's key claim token
+	req, _ = http.NewRequest("GET", "/active-server-keys", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/active-server-keys", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error listing active server keys")
+
+	// Lists the hex encoded keys
+	req, _ = http.NewRequest("GET", "/active-server-keys", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"keys":["0102","abcd"]}`, string(resp.Body.Bytes()), "Expected the active keys")
+}
+
+func TestPurgeRegion(t *testing.T) {
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+
+	// Auth Mock
+	auth.On("Authenticate", "goodtoken").Return("302", true)
+
+	// DB Mock
+	db.On("DeleteDiagnosisKeysForRegion", mock.Anything, "302").Return(int64(0), fmt.Errorf("Random error")).Once()
+	db.On("DeleteDiagnosisKeysForRegion", mock.Anything, "302").Return(int64(25), nil)
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = ""
+
+	// Not a POST request
+	req, _ := http.NewRequest("GET", "/purge-region/302", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Disabled without an ADMIN_TOKEN
+	req, _ = http.NewRequest("POST", "/purge-region/302", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	config.AppConstants.AdminToken = "admintoken"
+
+	// A key claim token isn't enough
+	req, _ = http.NewRequest("POST", "/purge-region/302", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// Database error
+	req, _ = http.NewRequest("POST", "/purge-region/302", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error purging region")
+
+	// Reports how many keys were deleted
+	req, _ = http.NewRequest("POST", "/purge-region/302", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"region":"302","deleted":25}`, string(resp.Body.Bytes()), "Expected the number of keys deleted")
+	assertLog(t, hook, 1, logrus.WarnLevel, "purged diagnosis keys for region")
+}
+
+func TestKeyMetadata(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("StreamDiagnosisKeysJSON", mock.Anything, "302", uint32(444000), uint32(444024), mock.Anything).Return(0, fmt.Errorf("Random error")).Once()
+	db.On("StreamDiagnosisKeysJSON", mock.Anything, "302", uint32(444000), uint32(444024), mock.Anything).Return(1, nil).Run(func(args mock.Arguments) {
+		args.Get(4).(io.Writer).Write([]byte("{\"region\":\"302\"}\n"))
+	})
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
 
-	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
 
-	// Malformed auth header - No space
-	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
-	req.Header.Set("Authorization", "Bearerthisisaverylongtoken")
-	resp = httptest.NewRecorder()
-	router.ServeHTTP(resp, req)
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
 
-	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
-	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
 
-	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
 
-	// Bad auth token
-	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
-	req.Header.Set("Authorization", "Bearer badtoken")
-	resp = httptest.NewRecorder()
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/key-metadata/302/444000/444024", nil)
+	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
-	assert.Equal(t, "unauthorized\n", string(resp.Body.Bytes()), "Correct response is expected")
-
-	assertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
 
-	// Good auth token - no HashID
-	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
+	// Needs the admin token
+	req, _ = http.NewRequest("GET", "/key-metadata/302/444000/444024", nil)
 	req.Header.Set("Authorization", "Bearer goodtoken")
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 200, resp.Code, "Success response is expected")
-	assert.Equal(t, "AAABBBCCCC\n", string(resp.Body.Bytes()), "Correct response is expected")
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
 
-	// Good auth token -  HashID
-	req, _ = http.NewRequest("POST", "/new-key-claim/"+hashID, nil)
-	req.Header.Set("Authorization", "Bearer goodtoken")
+	// Empty range
+	req, _ = http.NewRequest("GET", "/key-metadata/302/444024/444000", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 200, resp.Code, "Success response is expected")
-	assert.Equal(t, "AAABBBCCCC\n", string(resp.Body.Bytes()), "Correct response is expected")
+	assert.Equal(t, 400, resp.Code, "Bad request response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "invalid endHour parameter")
 
-	// Error saving - no HashID
-	req, _ = http.NewRequest("POST", "/new-key-claim", nil)
-	req.Header.Set("Authorization", "Bearer errortoken")
+	// Database error before anything was written
+	req, _ = http.NewRequest("GET", "/key-metadata/302/444000/444024", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
 	assert.Equal(t, 500, resp.Code, "Server error response is expected")
-	assert.Equal(t, "server error\n", string(resp.Body.Bytes()), "server error response is expected")
-
-	assertLog(t, hook, 1, logrus.ErrorLevel, "error constructing new key claim")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error streaming key metadata")
 
-	// Error saving - duplicate HashID
-	req, _ = http.NewRequest("POST", "/new-key-claim/"+hashID, nil)
-	req.Header.Set("Authorization", "Bearer errortoken")
+	// Streams what the database writes
+	req, _ = http.NewRequest("GET", "/key-metadata/302/444000/444024", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
 	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 403, resp.Code, "forbidden response is expected")
-	assert.Equal(t, "forbidden\n", string(resp.Body.Bytes()), "forbidden response is expected")
-
-	assertLog(t, hook, 1, logrus.InfoLevel, "hashID used")
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/x-ndjson", resp.Header().Get("Content-Type"), "Expected a newline-delimited JSON response")
+	assert.Equal(t, "{\"region\":\"302\"}\n", string(resp.Body.Bytes()), "Expected the streamed rows")
+	assertLog(t, hook, 1, logrus.InfoLevel, "streamed key metadata")
 }
 
 func TestClaimKey(t *testing.T) {
@@ -199,33 +974,44 @@ func TestClaimKey(t *testing.T) {
 	triesRemaining := config.AppConstants.MaxConsecutiveClaimKeyFailures
 
 	// DB Mock
-	db.On("CheckClaimKeyBan", "1.1.1.1").Return(0, time.Duration(0), fmt.Errorf("Random error"))
-	db.On("CheckClaimKeyBan", "2.2.2.2").Return(0, banDuration, nil)
-	db.On("CheckClaimKeyBan", "3.3.3.3").Return(triesRemaining, time.Duration(0), nil)
-	db.On("CheckClaimKeyBan", "4.4.4.4").Return(triesRemaining, time.Duration(0), nil)
-	db.On("CheckClaimKeyBan", "5.5.5.5").Return(triesRemaining, time.Duration(0), nil)
+	db.On("CheckClaimKeyBan", mock.Anything, "1.1.1.1").Return(0, time.Duration(0), fmt.Errorf("Random error"))
+	db.On("CheckClaimKeyBan", mock.Anything, "2.2.2.2").Return(0, banDuration, nil)
+	db.On("CheckClaimKeyBan", mock.Anything, "3.3.3.3").Return(triesRemaining, time.Duration(0), nil)
+	db.On("CheckClaimKeyBan", mock.Anything, "4.4.4.4").Return(triesRemaining, time.Duration(0), nil)
+	db.On("CheckClaimKeyBan", mock.Anything, "5.5.5.5").Return(triesRemaining, time.Duration(0), nil)
 
 	appPub, _, _ := box.GenerateKey(rand.Reader)
 	serverPub, _, _ := box.GenerateKey(rand.Reader)
 
+	// Code regions
+	db.On("OneTimeCodeRegion", mock.Anything, mock.Anything).Return("302", nil)
+
 	// Valid Code
-	db.On("ClaimKey", "AAAAAAAAAA", appPub[:], mock.Anything).Return(serverPub[:], nil)
+	db.On("ClaimKey", mock.Anything, "AAAAAAAAAA", appPub[:]).Return(serverPub[:], nil)
 
 	// Error Code
-	db.On("ClaimKey", "BBBBBBBBBB", appPub[:], mock.Anything).Return(nil, err.ErrInvalidKeyFormat)
-	db.On("ClaimKey", "CCCCCCCCCC", appPub[:], mock.Anything).Return(nil, err.ErrDuplicateKey)
-	db.On("ClaimKey", "DDDDDDDDDD", appPub[:], mock.Anything).Return(nil, err.ErrInvalidOneTimeCode)
-	db.On("ClaimKey", "EEEEEEEEEE", appPub[:], mock.Anything).Return(nil, fmt.Errorf("Generic Error"))
+	db.On("ClaimKey", mock.Anything, "BBBBBBBBBB", appPub[:]).Return(nil, err.ErrInvalidKeyFormat)
+	db.On("ClaimKey", mock.Anything, "CCCCCCCCCC", appPub[:]).Return(nil, err.ErrDuplicateKey)
+	db.On("ClaimKey", mock.Anything, "DDDDDDDDDD", appPub[:]).Return(nil, err.ErrInvalidOneTimeCode)
+	db.On("ClaimKey", mock.Anything, "EEEEEEEEEE", appPub[:]).Return(nil, fmt.Errorf("Generic Error"))
 
 	// Mock failure log
-	db.On("ClaimKeyFailure", "3.3.3.3").Return(triesRemaining-1, banDuration, nil)
-	db.On("ClaimKeyFailure", "4.4.4.4").Return(triesRemaining, time.Duration(0), fmt.Errorf("Random error"))
+	db.On("ClaimKeyFailure", mock.Anything, "3.3.3.3").Return(triesRemaining-1, banDuration, nil)
+	db.On("ClaimKeyFailure", mock.Anything, "4.4.4.4").Return(triesRemaining, time.Duration(0), fmt.Errorf("Random error"))
 
 	//Clear IP failure
-	db.On("ClaimKeySuccess", "3.3.3.3").Return(nil)
-	db.On("ClaimKeySuccess", "5.5.5.5").Return(fmt.Errorf("Generic Error"))
+	db.On("ClaimKeySuccess", mock.Anything, "3.3.3.3").Return(nil)
+	db.On("ClaimKeySuccess", mock.Anything, "5.5.5.5").Return(fmt.Errorf("Generic Error"))
+
+	// Claim event log
+	db.On("RecordClaimEvent", mock.Anything, "3.3.3.3").Return(nil)
+	db.On("RecordClaimEvent", mock.Anything, "5.5.5.5").Return(nil)
 
-	servlet := NewKeyClaimServlet(db, auth)
+	// Attestation Mock
+	attestor := &keyclaim.Attestor{}
+	attestor.On("Required", "302").Return(false)
+
+	servlet := NewKeyClaimServlet(db, auth, &keyclaim.DeliveryHook{}, attestor)
 	router := Router()
 	servlet.RegisterRouting(router)
 
@@ -436,6 +1222,114 @@ func TestClaimKey(t *testing.T) {
 	assertLog(t, hook, 1, logrus.WarnLevel, "error recording claim-key success")
 }
 
+func TestClaimKeyAttestation(t *testing.T) {
+	db := &persistence.Conn{}
+	attestor := &keyclaim.Attestor{}
+
+	triesRemaining := config.AppConstants.MaxConsecutiveClaimKeyFailures
+
+	appPub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, _, _ := box.GenerateKey(rand.Reader)
+
+	// DB Mock
+	db.On("CheckClaimKeyBan", mock.Anything, "3.3.3.3").Return(triesRemaining, time.Duration(0), nil)
+	db.On("OneTimeCodeRegion", mock.Anything, "AAAAAAAAAA").Return("302", nil)
+	db.On("OneTimeCodeRegion", mock.Anything, "BBBBBBBBBB").Return("303", nil)
+	db.On("OneTimeCodeRegion", mock.Anything, "CCCCCCCCCC").Return("", err.ErrCodeNotFound)
+	db.On("OneTimeCodeRegion", mock.Anything, "DDDDDDDDDD").Return("", fmt.Errorf("error"))
+	db.On("ClaimKey", mock.Anything, "AAAAAAAAAA", appPub[:]).Return(serverPub[:], nil)
+	db.On("ClaimKey", mock.Anything, "BBBBBBBBBB", appPub[:]).Return(serverPub[:], nil)
+	db.On("ClaimKey", mock.Anything, "CCCCCCCCCC", appPub[:]).Return(nil, err.ErrInvalidOneTimeCode)
+	db.On("ClaimKeyFailure", mock.Anything, "3.3.3.3").Return(triesRemaining-1, time.Duration(0), nil)
+	db.On("ClaimKeySuccess", mock.Anything, "3.3.3.3").Return(nil)
+	db.On("RecordClaimEvent", mock.Anything, "3.3.3.3").Return(nil)
+
+	// Attestation Mock
+	attestor.On("Required", "302").Return(true)
+	attestor.On("Required", "303").Return(false)
+	attestor.On("Verify", appPub[:], "good").Return(nil)
+	attestor.On("Verify", appPub[:], "bad").Return(fmt.Errorf("invalid device attestation"))
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, attestor)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	code := "AAAAAAAAAA"
+	marshalledUpload, _ := proto.Marshal(buildKeyClaimRequest(&code, appPub[:]))
+
+	// Invalid attestation is rejected
+	req, _ := http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	req.Header.Set("X-Device-Attestation", "bad")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.True(t, checkClaimKeyResponseError(resp.Body.Bytes(), pb.KeyClaimResponse_UNKNOWN))
+	db.AssertNotCalled(t, "ClaimKey", mock.Anything, "AAAAAAAAAA", appPub[:])
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "invalid device attestation")
+
+	// Valid attestation is accepted
+	req, _ = http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	req.Header.Set("X-Device-Attestation", "good")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "success response is expected")
+	assert.True(t, checkClaimKeyResponseError(resp.Body.Bytes(), pb.KeyClaimResponse_NONE))
+
+	// The code's own region decides, not the configured one
+	code = "BBBBBBBBBB"
+	marshalledUpload, _ = proto.Marshal(buildKeyClaimRequest(&code, appPub[:]))
+
+	req, _ = http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "success response is expected without attestation in a region that doesn't require it")
+	attestor.AssertNotCalled(t, "Verify", appPub[:], "")
+
+	// An unknown code goes on to ClaimKey and counts as a failed attempt
+	code = "CCCCCCCCCC"
+	marshalledUpload, _ = proto.Marshal(buildKeyClaimRequest(&code, appPub[:]))
+
+	req, _ = http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.True(t, checkClaimKeyResponseError(resp.Body.Bytes(), pb.KeyClaimResponse_INVALID_ONE_TIME_CODE))
+	db.AssertCalled(t, "ClaimKeyFailure", mock.Anything, "3.3.3.3")
+
+	// A failed region lookup is a server error
+	code = "DDDDDDDDDD"
+	marshalledUpload, _ = proto.Marshal(buildKeyClaimRequest(&code, appPub[:]))
+
+	req, _ = http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assert.True(t, checkClaimKeyResponseError(resp.Body.Bytes(), pb.KeyClaimResponse_SERVER_ERROR))
+	db.AssertNotCalled(t, "ClaimKey", mock.Anything, "DDDDDDDDDD", appPub[:])
+}
+
 func checkClaimKeyResponseDuration(data []byte, duration *durationpb.Duration) bool {
 	var response pb.KeyClaimResponse
 	proto.Unmarshal(data, &response)
@@ -473,3 +1367,222 @@ func SHA512(message []byte) []byte {
 	c.Write(message)
 	return c.Sum(nil)
 }
+
+func TestKeypairIntegrity(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("VerifyServerKeypairIntegrity", mock.Anything).Return(nil, fmt.Errorf("Random error")).Once()
+	db.On("VerifyServerKeypairIntegrity", mock.Anything).Return(nil, nil).Once()
+	db.On("VerifyServerKeypairIntegrity", mock.Anything).Return([]err.CorruptRow{{ServerPublicKey: "0A0B", Region: "302", Claimed: true}}, nil)
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/keypair-integrity", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("GET", "/keypair-integrity", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/keypair-integrity", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error verifying server keypairs")
+
+	// No corrupt keypairs
+	req, _ = http.NewRequest("GET", "/keypair-integrity", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, `{"corrupt":[]}`, string(resp.Body.Bytes()), "Expected an empty list")
+
+	// Reports the corrupt keypairs
+	req, _ = http.NewRequest("GET", "/keypair-integrity", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"corrupt":[{"server_public_key":"0A0B","region":"302","claimed":true}]}`, string(resp.Body.Bytes()), "Expected the corrupt keypairs")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "found corrupt server keypairs")
+}
+
+func TestServerKeyForCode(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("ServerPublicKeyForCode", mock.Anything, "ERRORXXXXX").Return(nil, fmt.Errorf("Random error"))
+	db.On("ServerPublicKeyForCode", mock.Anything, "CLAIMEDXXX").Return(nil, err.ErrCodeNotFound)
+	db.On("ServerPublicKeyForCode", mock.Anything, "UNCLAIMEDX").Return([]byte{0x0a, 0x0b, 0x0c}, nil)
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a POST request
+	req, _ := http.NewRequest("GET", "/server-key-for-code", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("POST", "/server-key-for-code", strings.NewReader("UNCLAIMEDX"))
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// Database error
+	req, _ = http.NewRequest("POST", "/server-key-for-code", strings.NewReader("ERRORXXXXX"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error looking up server key for code")
+
+	// Claimed or missing code
+	req, _ = http.NewRequest("POST", "/server-key-for-code", strings.NewReader("CLAIMEDXXX"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 404, resp.Code, "Not found response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "no unclaimed code for server key")
+
+	// Unclaimed code, with the dashes users see
+	req, _ = http.NewRequest("POST", "/server-key-for-code", strings.NewReader("UNC-LAI-MEDX"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, `{"server_public_key":"0a0b0c"}`, string(resp.Body.Bytes()), "Expected the hex encoded server key")
+	assertLog(t, hook, 1, logrus.WarnLevel, "server key looked up by one time code")
+}
+
+func TestUploadCounts(t *testing.T) {
+	db := &persistence.Conn{}
+
+	// DB Mock
+	db.On("UploadCountsByHour", mock.Anything, "302", uint32(444000), uint32(444024)).Return(nil, fmt.Errorf("Random error")).Once()
+	db.On("UploadCountsByHour", mock.Anything, "302", uint32(444000), uint32(444024)).Return(map[uint32]int{444000: 4, 444013: 7}, nil)
+
+	servlet := NewKeyClaimServlet(db, &keyclaim.Authenticator{}, &keyclaim.DeliveryHook{}, &keyclaim.Attestor{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldAdminToken := config.AppConstants.AdminToken
+	defer func() { config.AppConstants.AdminToken = oldAdminToken }()
+	config.AppConstants.AdminToken = "admintoken"
+
+	// Not a GET request
+	req, _ := http.NewRequest("POST", "/upload-counts/302/444000/444024", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 405, resp.Code, "Method not allowed response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "disallowed method")
+
+	// Not the admin token
+	req, _ = http.NewRequest("GET", "/upload-counts/302/444000/444024", nil)
+	req.Header.Set("Authorization", "Bearer badtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "bad admin auth header")
+
+	// An empty window
+	req, _ = http.NewRequest("GET", "/upload-counts/302/444024/444000", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "Bad request response is expected")
+	assertLog(t, hook, 1, logrus.InfoLevel, "invalid endHour parameter")
+
+	// Database error
+	req, _ = http.NewRequest("GET", "/upload-counts/302/444000/444024", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "Server error response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "error counting uploads by hour")
+
+	// Reports the count for each hour
+	req, _ = http.NewRequest("GET", "/upload-counts/302/444000/444024", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"), "Expected a JSON response")
+	assert.Equal(t, `{"region":"302","counts":{"444000":4,"444013":7}}`, string(resp.Body.Bytes()), "Expected the counts keyed by hour")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// downloadLimiter caps how many requests a single client IP can make within a
+// fixed window. State is held in memory, so each instance enforces its own
+// limit; this is meant to blunt a misbehaving client, not to be exact.
+type downloadLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	exempt    map[string]bool
+	clients   map[string]*downloadWindow
+	lastPrune time.Time
+}
+
+type downloadWindow struct {
+	start time.Time
+	count int
+}
+
+// newDownloadLimiter returns a limiter allowing limit requests per window for
+// each IP. IPs in exempt (e.g. our CDN or proxies) are never limited. A limit
+// of zero or less disables limiting entirely.
+func newDownloadLimiter(limit int, window time.Duration, exempt []string) *downloadLimiter {
+	exemptIPs := make(map[string]bool)
+	for _, ip := range exempt {
+		exemptIPs[ip] = true
+	}
+	return &downloadLimiter{
+		limit:   limit,
+		window:  window,
+		exempt:  exemptIPs,
+		clients: make(map[string]*downloadWindow),
+	}
+}
+
+// Allow records a request from ip at now and reports whether it is within the
+// limit.
+func (l *downloadLimiter) Allow(ip string, now time.Time) bool {
+	if l.limit <= 0 || l.exempt[ip] {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	client, ok := l.clients[ip]
+	if !ok || now.Sub(client.start) >= l.window {
+		l.clients[ip] = &downloadWindow{start: now, count: 1}
+		return true
+	}
+
+	if client.count >= l.limit {
+		return false
+	}
+	client.count++
+	return true
+}
+
+// prune drops expired windows so the map doesn't grow with every IP we have
+// ever seen. It runs at most once per window.
+func (l *downloadLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	for ip, client := range l.clients {
+		if now.Sub(client.start) >= l.window {
+			delete(l.clients, ip)
+		}
+	}
+	l.lastPrune = now
+}
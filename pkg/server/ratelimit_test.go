@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newDownloadLimiter(2, time.Minute, []string{"10.0.0.1"})
+
+	// Allows up to the limit then rejects
+	assert.True(t, limiter.Allow("127.0.0.1", now), "first request should be allowed")
+	assert.True(t, limiter.Allow("127.0.0.1", now), "second request should be allowed")
+	assert.False(t, limiter.Allow("127.0.0.1", now), "third request should be rejected")
+
+	// Other IPs have their own limit
+	assert.True(t, limiter.Allow("127.0.0.2", now), "another IP should be allowed")
+
+	// Limit resets after the window
+	assert.True(t, limiter.Allow("127.0.0.1", now.Add(time.Minute)), "request after the window should be allowed")
+
+	// Exempt IPs are never limited
+	for i := 0; i < 5; i++ {
+		assert.True(t, limiter.Allow("10.0.0.1", now), "exempt IP should always be allowed")
+	}
+
+	// Expired windows are pruned
+	limiter.Allow("127.0.0.3", now.Add(3*time.Minute))
+	assert.Len(t, limiter.clients, 1, "expired windows should be pruned")
+
+	// Disabled when limit is zero
+	disabled := newDownloadLimiter(0, time.Minute, nil)
+	for i := 0; i < 5; i++ {
+		assert.True(t, disabled.Allow("127.0.0.1", now), "disabled limiter should always allow")
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// NewReadinessServlet serves /readyz, which reports whether this instance can
+// take more traffic. Unlike /services/ping it checks the database, and reports
+// degraded when the connection pool is saturated so the load balancer sheds
+// load elsewhere. /healthz only checks that the database is reachable.
+func NewReadinessServlet(db persistence.Conn) srvutil.Servlet {
+	return &readinessServlet{db: db}
+}
+
+type readinessServlet struct {
+	db persistence.Conn
+
+	mu            sync.Mutex
+	lastWaitCount int64
+}
+
+func (s *readinessServlet) RegisterRouting(r *mux.Router) {
+	r.HandleFunc("/readyz", s.readyz)
+	r.HandleFunc("/healthz", s.healthz)
+}
+
+func (s *readinessServlet) healthz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	if err := s.db.Ping(ctx); err != nil {
+		log(ctx, err).Warn("database unavailable")
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if _, err := w.Write([]byte("OK\n")); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
+
+func (s *readinessServlet) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	if err := s.db.Ping(ctx); err != nil {
+		log(ctx, err).Warn("database unavailable")
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	stats := s.db.Stats()
+
+	s.mu.Lock()
+	saturated := poolSaturated(stats, s.lastWaitCount)
+	s.lastWaitCount = stats.WaitCount
+	s.mu.Unlock()
+
+	if saturated {
+		log(ctx, nil).WithFields(logrus.Fields{
+			"in_use":     stats.InUse,
+			"max_open":   stats.MaxOpenConnections,
+			"wait_count": stats.WaitCount,
+		}).Warn("database pool saturated")
+		http.Error(w, "degraded", http.StatusServiceUnavailable)
+		return
+	}
+
+	if _, err := w.Write([]byte("OK\n")); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
+
+// The pool is saturated when at least ReadinessPoolInUseRatio of the
+// connections are in use and more than ReadinessWaitCountGrowth callers have
+// had to wait for a connection since the last check.
+func poolSaturated(stats sql.DBStats, lastWaitCount int64) bool {
+	if stats.MaxOpenConnections <= 0 {
+		return false
+	}
+
+	inUse := float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	if inUse < config.AppConstants.ReadinessPoolInUseRatio {
+		return false
+	}
+
+	return stats.WaitCount-lastWaitCount > config.AppConstants.ReadinessWaitCountGrowth
+}
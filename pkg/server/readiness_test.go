@@ -0,0 +1,169 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/Shopify/goose/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRegisterRoutingReadiness(t *testing.T) {
+
+	servlet := NewReadinessServlet(&persistence.Conn{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	expectedPaths := GetPaths(router)
+	assert.Contains(t, expectedPaths, "/readyz", "should include a readyz path")
+	assert.Contains(t, expectedPaths, "/healthz", "should include a healthz path")
+}
+
+func TestReadyz(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldRatio := config.AppConstants.ReadinessPoolInUseRatio
+	oldGrowth := config.AppConstants.ReadinessWaitCountGrowth
+	defer func() {
+		config.AppConstants.ReadinessPoolInUseRatio = oldRatio
+		config.AppConstants.ReadinessWaitCountGrowth = oldGrowth
+	}()
+	config.AppConstants.ReadinessPoolInUseRatio = 1.0
+	config.AppConstants.ReadinessWaitCountGrowth = 0
+
+	healthy := sql.DBStats{MaxOpenConnections: 100, InUse: 20, WaitCount: 0}
+	saturated := sql.DBStats{MaxOpenConnections: 100, InUse: 100, WaitCount: 50}
+
+	// Not ready if the database can't be reached
+	db := &persistence.Conn{}
+	db.On("Ping", mock.Anything).Return(fmt.Errorf("error"))
+
+	servlet := NewReadinessServlet(db)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assertLog(t, hook, 1, logrus.WarnLevel, "database unavailable")
+
+	// Ready if the pool is healthy
+	db = &persistence.Conn{}
+	db.On("Ping", mock.Anything).Return(nil)
+	db.On("Stats").Return(healthy)
+
+	servlet = NewReadinessServlet(db)
+	router = Router()
+	servlet.RegisterRouting(router)
+
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "OK\n", string(resp.Body.Bytes()), "OK response is expected")
+	assert.Contains(t, resp.Header()["Cache-Control"], "no-store", "Cache-Control should be set to no-store")
+
+	// Degraded if the pool is fully in use and callers are waiting
+	db = &persistence.Conn{}
+	db.On("Ping", mock.Anything).Return(nil)
+	db.On("Stats").Return(saturated)
+
+	servlet = NewReadinessServlet(db)
+	router = Router()
+	servlet.RegisterRouting(router)
+
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assertLog(t, hook, 1, logrus.WarnLevel, "database pool saturated")
+
+	// Recovers once the wait count stops growing
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+}
+
+func TestHealthz(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	// Unhealthy if the database can't be reached
+	db := &persistence.Conn{}
+	db.On("Ping", mock.Anything).Return(fmt.Errorf("error"))
+
+	servlet := NewReadinessServlet(db)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assertLog(t, hook, 1, logrus.WarnLevel, "database unavailable")
+
+	// Healthy otherwise, without looking at the pool
+	db = &persistence.Conn{}
+	db.On("Ping", mock.Anything).Return(nil)
+
+	servlet = NewReadinessServlet(db)
+	router = Router()
+	servlet.RegisterRouting(router)
+
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "OK\n", string(resp.Body.Bytes()), "OK response is expected")
+	db.AssertNotCalled(t, "Stats")
+}
+
+func TestPoolSaturated(t *testing.T) {
+	oldRatio := config.AppConstants.ReadinessPoolInUseRatio
+	oldGrowth := config.AppConstants.ReadinessWaitCountGrowth
+	defer func() {
+		config.AppConstants.ReadinessPoolInUseRatio = oldRatio
+		config.AppConstants.ReadinessWaitCountGrowth = oldGrowth
+	}()
+	config.AppConstants.ReadinessPoolInUseRatio = 0.9
+	config.AppConstants.ReadinessWaitCountGrowth = 10
+
+	assert.False(t, poolSaturated(sql.DBStats{}, 0), "Expected an unlimited pool to never saturate")
+	assert.False(t, poolSaturated(sql.DBStats{MaxOpenConnections: 100, InUse: 50, WaitCount: 100}, 0), "Expected a half used pool to be ready")
+	assert.False(t, poolSaturated(sql.DBStats{MaxOpenConnections: 100, InUse: 95, WaitCount: 15}, 10), "Expected a small wait growth to be ready")
+	assert.True(t, poolSaturated(sql.DBStats{MaxOpenConnections: 100, InUse: 95, WaitCount: 30}, 10), "Expected a busy pool with waiters to be saturated")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"time"
@@ -23,18 +24,24 @@ const (
 )
 
 func NewRetrieveServlet(db persistence.Conn, auth retrieval.Authenticator, signer retrieval.Signer) srvutil.Servlet {
-	return &retrieveServlet{db: db, auth: auth, signer: signer}
+	limiter := newDownloadLimiter(
+		config.AppConstants.RetrieveRateLimitPerMinute,
+		time.Minute,
+		config.AppConstants.RetrieveRateLimitExemptIPs,
+	)
+	return &retrieveServlet{db: db, auth: auth, signer: signer, limiter: limiter}
 }
 
 type retrieveServlet struct {
-	db     persistence.Conn
-	auth   retrieval.Authenticator
-	signer retrieval.Signer
+	db      persistence.Conn
+	auth    retrieval.Authenticator
+	signer  retrieval.Signer
+	limiter *downloadLimiter
 }
 
 func (s *retrieveServlet) RegisterRouting(r *mux.Router) {
 	// becomes 7 digits in 2084
-	r.HandleFunc("/retrieve/{region:[0-9]{3}}/{day:[0-9]{5}}/{auth:.*}", s.retrieveWrapper)
+	r.HandleFunc("/retrieve/{region}/{day:[0-9]{5}}/{auth:.*}", s.retrieveWrapper)
 }
 
 func (s *retrieveServlet) fail(logger *logrus.Entry, w http.ResponseWriter, logMsg string, responseMsg string, responseCode int) result {
@@ -59,6 +66,15 @@ func (s *retrieveServlet) retrieve(w http.ResponseWriter, r *http.Request) resul
 	ctx := r.Context()
 	vars := mux.Vars(r)
 
+	// be extremely careful not to log this or otherwise cause it to be persisted
+	if !s.limiter.Allow(getIP(r), time.Now()) {
+		return s.fail(log(ctx, nil), w, "too many requests", "", http.StatusTooManyRequests)
+	}
+
+	if err := persistence.ValidateRegion(vars["region"]); err != nil {
+		return s.fail(log(ctx, err), w, "invalid region parameter", "", http.StatusBadRequest)
+	}
+
 	/* Hardcode the region as 302 (Canada MCC)
 	You can see the reason for this in pkg/server/keyclaim.go
 	As stated there I'm going to open an issue to continue this work instead of just
@@ -119,18 +135,44 @@ func (s *retrieveServlet) retrieve(w http.ResponseWriter, r *http.Request) resul
 		return s.fail(log(ctx, nil), w, "request for too-old data", "requested data no longer valid", http.StatusGone)
 	}
 
-	keys, err := s.db.FetchKeysForHours(region, startHour, endHour, currentRSIN)
-	if err != nil {
-		return s.fail(log(ctx, err), w, "database error", "", http.StatusInternalServerError)
+	var pages retrieval.KeyPages
+	if pageSize := config.AppConstants.RetrievalPageSize; pageSize > 0 {
+		keyPages, err := s.db.FetchKeyPagesForHours(ctx, region, startHour, endHour, currentRSIN, pageSize)
+		if err != nil {
+			return s.failFetch(ctx, w, err)
+		}
+		defer func() {
+			if err := keyPages.Close(); err != nil {
+				log(ctx, err).Warn("error closing key pages")
+			}
+		}()
+		pages = keyPages
+	} else {
+		keys, err := s.db.FetchKeysForHours(ctx, region, startHour, endHour, currentRSIN)
+		if err != nil {
+			return s.failFetch(ctx, w, err)
+		}
+		pages = retrieval.SinglePage(keys)
 	}
 
 	w.Header().Add("Content-Type", "application/zip")
 	w.Header().Add("Cache-Control", "public, max-age=3600, max-stale=600")
 
-	size, err := retrieval.SerializeTo(ctx, w, keys, region, startTimestamp, endTimestamp, s.signer)
+	// With RetrievalPageSize set, later pages are read while the export is
+	// being written, so a database error then cuts the response short.
+	size, count, err := retrieval.SerializePagesTo(ctx, w, pages, region, startTimestamp, endTimestamp, s.signer)
 	if err != nil {
 		log(ctx, err).Info("error writing response")
 	}
-	log(ctx, nil).WithField("unzipped-size", size).WithField("keys", len(keys)).Info("Wrote retrieval")
+	log(ctx, nil).WithField("unzipped-size", size).WithField("keys", count).Info("Wrote retrieval")
 	return result(struct{}{})
 }
+
+func (s *retrieveServlet) failFetch(ctx context.Context, w http.ResponseWriter, err error) result {
+	if err == persistence.ErrRegionNotEnabled {
+		return s.fail(log(ctx, err), w, "region not enabled", "region not enabled", http.StatusNotFound)
+	} else if err == persistence.ErrRangeTooWide {
+		return s.fail(log(ctx, err), w, "requested range too wide", "", http.StatusBadRequest)
+	}
+	return s.fail(log(ctx, err), w, "database error", "", http.StatusInternalServerError)
+}
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
+	"time"
 
 	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	err "github.com/cds-snc/covid-alert-server/pkg/persistence"
 	retrieval "github.com/cds-snc/covid-alert-server/mocks/pkg/retrieval"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 	"github.com/Shopify/goose/logger"
@@ -29,6 +33,11 @@ func TestNewRetrieveServlet(t *testing.T) {
 		db:     db,
 		auth:   auth,
 		signer: signer,
+		limiter: newDownloadLimiter(
+			config.AppConstants.RetrieveRateLimitPerMinute,
+			time.Minute,
+			config.AppConstants.RetrieveRateLimitExemptIPs,
+		),
 	}
 	assert.Equal(t, expected, NewRetrieveServlet(db, auth, signer), "should return a new retrieveServlet struct")
 
@@ -41,7 +50,7 @@ func TestRegisterRoutingRetrieve(t *testing.T) {
 	servlet.RegisterRouting(router)
 
 	expectedPaths := GetPaths(router)
-	assert.Contains(t, expectedPaths, "/retrieve/{region:[0-9]{3}}/{day:[0-9]{5}}/{auth:.*}", "should include a retrieve path")
+	assert.Contains(t, expectedPaths, "/retrieve/{region}/{day:[0-9]{5}}/{auth:.*}", "should include a retrieve path")
 
 }
 
@@ -82,9 +91,9 @@ func TestRetrieve(t *testing.T) {
 	startHour := (timemath.CurrentDateNumber() - 15) * 24
 	endHour := timemath.CurrentDateNumber() * 24
 
-	db.On("FetchKeysForHours", region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, nil)
+	db.On("FetchKeysForHours", mock.Anything, region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, nil)
 
-	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+	signer.On("SignDigest", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
 
 	// Future date mock
 	auth.On("Authenticate", region, futureDate, goodAuth).Return(true)
@@ -97,7 +106,7 @@ func TestRetrieve(t *testing.T) {
 	startHour = (timemath.CurrentDateNumber() - 1) * 24
 	endHour = timemath.CurrentDateNumber() * 24
 
-	db.On("FetchKeysForHours", region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{}, fmt.Errorf("error"))
+	db.On("FetchKeysForHours", mock.Anything, region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{}, fmt.Errorf("error"))
 
 	servlet := NewRetrieveServlet(db, auth, signer)
 	router := Router()
@@ -131,6 +140,7 @@ func TestRetrieve(t *testing.T) {
 	assert.Equal(t, 200, resp.Code, "Success response is expected")
 	assert.Contains(t, resp.Header()["Content-Type"], "application/zip", "Cache-Control should be set to application/zip")
 	assert.Contains(t, resp.Header()["Cache-Control"], "public, max-age=3600, max-stale=600", "Cache-Control should be set to public, max-age=3600, max-stale=600")
+	db.AssertNotCalled(t, "MarkKeysExported", mock.Anything, mock.Anything)
 
 	assertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
 
@@ -163,6 +173,181 @@ func TestRetrieve(t *testing.T) {
 
 }
 
+func TestRetrieveRegionNotEnabled(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	db := &persistence.Conn{}
+	auth := &retrieval.Authenticator{}
+	signer := &retrieval.Signer{}
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+	db.On("FetchKeysForHours", mock.Anything, region, startHour, endHour, currentRSIN).Return(nil, err.ErrRegionNotEnabled)
+
+	servlet := NewRetrieveServlet(db, auth, signer)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 404, resp.Code, "404 response is expected")
+	assert.Equal(t, "region not enabled\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "region not enabled")
+}
+
+func TestRetrieveRangeTooWide(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	db := &persistence.Conn{}
+	auth := &retrieval.Authenticator{}
+	signer := &retrieval.Signer{}
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+	db.On("FetchKeysForHours", mock.Anything, region, startHour, endHour, currentRSIN).Return(nil, err.ErrRangeTooWide)
+
+	servlet := NewRetrieveServlet(db, auth, signer)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.Equal(t, "requested range too wide\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "requested range too wide")
+}
+
+func TestRetrieveRateLimit(t *testing.T) {
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	db := &persistence.Conn{}
+	auth := &retrieval.Authenticator{}
+	signer := &retrieval.Signer{}
+
+	region := "302"
+	badAuth := "dcba"
+	currentDateNumber := fmt.Sprint(timemath.CurrentDateNumber())
+
+	auth.On("Authenticate", region, currentDateNumber, badAuth).Return(false)
+
+	servlet := &retrieveServlet{
+		db:      db,
+		auth:    auth,
+		signer:  signer,
+		limiter: newDownloadLimiter(1, time.Minute, []string{"10.0.0.1"}),
+	}
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// First request is let through to authentication
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, currentDateNumber, badAuth), nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "invalid auth parameter")
+
+	// Over the limit is rejected
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, currentDateNumber, badAuth), nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 429, resp.Code, "Too many requests response is expected")
+	assert.Equal(t, "too many requests\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "too many requests")
+
+	// Exempt IPs bypass the limit
+	for i := 0; i < 3; i++ {
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, currentDateNumber, badAuth), nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	}
+}
+
+func TestRetrieveInvalidRegion(t *testing.T) {
+
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldRegexp := config.AppConstants.RegionCodeRegexp
+	defer func() { config.AppConstants.RegionCodeRegexp = oldRegexp }()
+	config.AppConstants.RegionCodeRegexp = regexp.MustCompile("^302$")
+
+	servlet := NewRetrieveServlet(&persistence.Conn{}, &retrieval.Authenticator{}, &retrieval.Signer{})
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "999", "00000", "abcd"), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "Bad request response is expected")
+	assert.Equal(t, "invalid region parameter\n", string(resp.Body.Bytes()), "Correct response is expected")
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "invalid region parameter")
+}
+
 func randomTestKey() *pb.TemporaryExposureKey {
 	token := make([]byte, 16)
 	rand.Read(token)
@@ -177,3 +362,66 @@ func randomTestKey() *pb.TemporaryExposureKey {
 	}
 	return key
 }
+
+func TestRetrievePaged(t *testing.T) {
+	// Capture logs
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	nullLog.ExitFunc = func(code int) {}
+
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logrus.NewEntry(nullLog)
+	}
+
+	oldPageSize := config.AppConstants.RetrievalPageSize
+	defer func() { config.AppConstants.RetrievalPageSize = oldPageSize }()
+	config.AppConstants.RetrievalPageSize = 2
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	auth := &retrieval.Authenticator{}
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+
+	signer := &retrieval.Signer{}
+	signer.On("SignDigest", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	// Streams every page into the export and closes the pages
+	pages := &persistence.KeyPages{}
+	pages.On("Next").Return([]*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, nil).Once()
+	pages.On("Next").Return([]*pb.TemporaryExposureKey{randomTestKey()}, nil).Once()
+	pages.On("Next").Return(nil, nil).Once()
+	pages.On("Close").Return(nil).Once()
+
+	db := &persistence.Conn{}
+	db.On("FetchKeyPagesForHours", mock.Anything, region, startHour, endHour, currentRSIN, 2).Return(pages, nil).Once()
+
+	servlet := NewRetrieveServlet(db, auth, signer)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Equal(t, 3, hook.LastEntry().Data["keys"], "Expected the keys from every page")
+	assertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+	pages.AssertExpectations(t)
+	db.AssertNotCalled(t, "FetchKeysForHours", mock.Anything, region, startHour, endHour, currentRSIN)
+
+	// Fails before writing anything if the first page can't be read
+	db.On("FetchKeyPagesForHours", mock.Anything, region, startHour, endHour, currentRSIN, 2).Return(nil, fmt.Errorf("error")).Once()
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "500 response is expected")
+	assertLog(t, hook, 1, logrus.ErrorLevel, "database error")
+}
@@ -8,6 +8,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 
@@ -66,7 +67,7 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serverPriv, err := s.db.PrivForPub(serverPub)
+	serverPriv, err := s.db.PrivForPub(ctx, serverPub)
 	if err != nil {
 		requestError(
 			ctx, w, err, "failure to resolve client keypair",
@@ -102,7 +103,9 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// decrypt payload
+	// decrypt payload. box is authenticated encryption: Open only succeeds if
+	// the payload was sealed with the private half of appPubKey and hasn't
+	// been altered since, so a successful Open already verifies the sender.
 	plaintext, ok := box.Open(nil, seu.Payload, nonce, appPubKey, privKey)
 	if !ok {
 		requestError(
@@ -130,7 +133,7 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(upload.GetKeys()) > pb.MaxKeysInUpload {
+	if len(upload.GetKeys()) > config.AppConstants.MaxKeysPerUpload {
 		requestError(
 			ctx, w, err, "too many keys provided",
 			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_TOO_MANY_KEYS),
@@ -151,13 +154,25 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 		return // requestError done by validateKeys
 	}
 
-	err = s.db.StoreKeys(appPubKey, upload.GetKeys(), ctx)
+	err = s.db.StoreKeys(ctx, appPubKey, nonce[:], upload.GetKeys())
 	if err == persistence.ErrKeyConsumed {
 		requestError(
 			ctx, w, err, "key is used up",
 			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_KEYPAIR),
 		)
 		return
+	} else if err == persistence.ErrReplay {
+		requestError(
+			ctx, w, err, "upload nonce reused",
+			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS),
+		)
+		return
+	} else if err == persistence.ErrClaimExpiredForUpload {
+		requestError(
+			ctx, w, err, "claim expired for upload",
+			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_KEYPAIR),
+		)
+		return
 	} else if err == persistence.ErrTooManyKeys {
 		requestError(
 			ctx, w, err, "not enough keys remaining",
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	persistenceErrors "github.com/cds-snc/covid-alert-server/pkg/persistence"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/Shopify/goose/logger"
@@ -73,15 +74,19 @@ func TestUpload(t *testing.T) {
 	goodServerPubNoKeysRemaining, goodServerPrivNoKeysRemaining, _ := box.GenerateKey(rand.Reader)
 	goodAppPubDBError, goodAppPrivDBError, _ := box.GenerateKey(rand.Reader)
 
-	db.On("PrivForPub", badServerPub[:]).Return(nil, fmt.Errorf("No priv cert"))
-	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("PrivForPub", goodServerPubNoKeysRemaining[:]).Return(goodServerPrivNoKeysRemaining[:], nil)
-	db.On("PrivForPub", goodServerPubBadPriv[:]).Return(make([]byte, 16), nil)
+	db.On("PrivForPub", mock.Anything, badServerPub[:]).Return(nil, fmt.Errorf("No priv cert"))
+	db.On("PrivForPub", mock.Anything, goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("PrivForPub", mock.Anything, goodServerPubNoKeysRemaining[:]).Return(goodServerPrivNoKeysRemaining[:], nil)
+	db.On("PrivForPub", mock.Anything, goodServerPubBadPriv[:]).Return(make([]byte, 16), nil)
 
-	db.On("StoreKeys", goodAppPubKeyUsed, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(persistenceErrors.ErrKeyConsumed)
-	db.On("StoreKeys", goodAppPubNoKeysRemaining, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything ).Return(persistenceErrors.ErrTooManyKeys)
-	db.On("StoreKeys", goodAppPubDBError, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(fmt.Errorf("generic DB error"))
-	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(nil)
+	var replayedNonce [24]byte
+	io.ReadFull(rand.Reader, replayedNonce[:])
+
+	db.On("StoreKeys", mock.Anything, goodAppPubKeyUsed, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]*covidshield.TemporaryExposureKey")).Return(persistenceErrors.ErrKeyConsumed)
+	db.On("StoreKeys", mock.Anything, goodAppPubNoKeysRemaining, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]*covidshield.TemporaryExposureKey")).Return(persistenceErrors.ErrTooManyKeys)
+	db.On("StoreKeys", mock.Anything, goodAppPubDBError, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]*covidshield.TemporaryExposureKey")).Return(fmt.Errorf("generic DB error"))
+	db.On("StoreKeys", mock.Anything, goodAppPub, replayedNonce[:], mock.AnythingOfType("[]*covidshield.TemporaryExposureKey")).Return(persistenceErrors.ErrReplay)
+	db.On("StoreKeys", mock.Anything, goodAppPub, mock.AnythingOfType("[]uint8"), mock.AnythingOfType("[]*covidshield.TemporaryExposureKey")).Return(nil)
 
 	servlet := NewUploadServlet(db)
 	router := Router()
@@ -168,6 +173,21 @@ func TestUpload(t *testing.T) {
 
 	assertLog(t, hook, 1, logrus.WarnLevel, "failure to decrypt payload")
 
+	// Fails to decrypt a correctly sealed payload that was altered in transit
+	io.ReadFull(rand.Reader, nonce[:])
+	encrypted = box.Seal(msg[:], []byte("hello world"), &nonce, goodServerPub, goodAppPriv)
+	encrypted[len(encrypted)-1] ^= 0xff
+
+	payload, _ = proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ = http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_DECRYPTION_FAILED))
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "failure to decrypt payload")
+
 	// Fails unmarshall into Upload
 	io.ReadFull(rand.Reader, nonce[:])
 	encrypted = box.Seal(msg[:], []byte("hello world"), &nonce, goodAppPub, goodServerPriv)
@@ -208,7 +228,7 @@ func TestUpload(t *testing.T) {
 	pbts = timestamppb.Timestamp{
 		Seconds: ts.Unix(),
 	}
-	upload = buildUpload(pb.MaxKeysInUpload+1, pbts)
+	upload = buildUpload(config.AppConstants.MaxKeysPerUpload+1, pbts)
 	marshalledUpload, _ = proto.Marshal(upload)
 	encrypted = box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
@@ -228,7 +248,7 @@ func TestUpload(t *testing.T) {
 	pbts = timestamppb.Timestamp{
 		Seconds: ts.Unix() - 4000,
 	}
-	upload = buildUpload(pb.MaxKeysInUpload, pbts)
+	upload = buildUpload(config.AppConstants.MaxKeysPerUpload, pbts)
 	marshalledUpload, _ = proto.Marshal(upload)
 	encrypted = box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
@@ -262,6 +282,25 @@ func TestUpload(t *testing.T) {
 
 	assertLog(t, hook, 1, logrus.WarnLevel, "key is used up")
 
+	// Replayed upload
+	ts = time.Now()
+	pbts = timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload = buildUpload(1, pbts)
+	marshalledUpload, _ = proto.Marshal(upload)
+	encrypted = box.Seal(msg[:], marshalledUpload, &replayedNonce, goodServerPub, goodAppPriv)
+
+	payload, _ = proto.Marshal(buildUploadRequest(goodServerPub[:], replayedNonce[:], goodAppPub[:], encrypted))
+	req, _ = http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS))
+
+	assertLog(t, hook, 1, logrus.WarnLevel, "upload nonce reused")
+
 	// Not enough keys remaining
 	io.ReadFull(rand.Reader, nonce[:])
 	ts = time.Now()
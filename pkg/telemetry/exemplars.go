@@ -0,0 +1,39 @@
+package telemetry
+
+import (
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// registry backs the prometheus metric provider. The OpenTelemetry exporter
+// registers its collector here, alongside the native histograms below which
+// can carry exemplars.
+var registry = promclient.NewRegistry()
+
+var requestDuration = promclient.NewHistogram(promclient.HistogramOpts{
+	Name: "covidshield_http_request_duration_seconds",
+	Help: "Time taken to serve HTTP requests",
+})
+
+func init() {
+	registry.MustRegister(requestDuration)
+}
+
+// observeRequestDuration records the request latency and, if enabled, links
+// the observation to its trace so a slow bucket can be followed to the trace.
+func observeRequestDuration(spanCtx trace.SpanContext, d time.Duration) {
+	seconds := d.Seconds()
+
+	if config.AppConstants.EnablePrometheusExemplars && spanCtx.IsValid() {
+		requestDuration.(promclient.ExemplarObserver).ObserveWithExemplar(
+			seconds, promclient.Labels{"trace_id": spanCtx.TraceID.String()},
+		)
+		return
+	}
+
+	requestDuration.Observe(seconds)
+}
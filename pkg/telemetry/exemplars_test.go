@@ -0,0 +1,44 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+func TestObserveRequestDurationAttachesExemplar(t *testing.T) {
+	oldFlag := config.AppConstants.EnablePrometheusExemplars
+	defer func() { config.AppConstants.EnablePrometheusExemplars = oldFlag }()
+	config.AppConstants.EnablePrometheusExemplars = true
+
+	traceID, _ := trace.IDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanCtx := trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled}
+
+	observeRequestDuration(spanCtx, 20*time.Millisecond)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	var exemplarTraceID string
+	for _, family := range families {
+		if family.GetName() != "covidshield_http_request_duration_seconds" {
+			continue
+		}
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			if exemplar := bucket.GetExemplar(); exemplar != nil {
+				for _, label := range exemplar.GetLabel() {
+					if label.GetName() == "trace_id" {
+						exemplarTraceID = label.GetValue()
+					}
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, traceID.String(), exemplarTraceID, "Expected an exemplar carrying the trace ID")
+}
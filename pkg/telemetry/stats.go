@@ -2,8 +2,11 @@ package telemetry
 
 import (
 	"context"
+	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/workers"
 
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
@@ -26,12 +29,16 @@ func initSystemStatsObserver(db persistence.Conn) {
 	var claimedOneTimeCodesTotalMetric metric.Int64ValueObserver
 	var diagnosisKeysTotalMetric metric.Int64ValueObserver
 	var unclaimedOneTimeCodesTotalMetric metric.Int64ValueObserver
+	var diagnosisKeysPurgedMetric metric.Int64ValueObserver
+	var recentClaimFailuresMetric metric.Int64ValueObserver
 
-	cb := metric.Must(meter).NewBatchObserver(func(_ context.Context, result metric.BatchObserverResult) {
+	cb := metric.Must(meter).NewBatchObserver(func(ctx context.Context, result metric.BatchObserverResult) {
 		v, _ := mem.VirtualMemory()
-		claimedOneTimeCodesTotalMetricCount, _ := db.CountClaimedOneTimeCodes()
-		diagnosisKeysTotalMetricCount, _ := db.CountDiagnosisKeys()
-		unclaimedOneTimeCodesTotalMetricCount, _ := db.CountUnclaimedOneTimeCodes()
+		claimedOneTimeCodesTotalMetricCount, _ := db.CountClaimedOneTimeCodes(ctx)
+		diagnosisKeysTotalMetricCount, _ := db.CountDiagnosisKeys(ctx)
+		unclaimedOneTimeCodesTotalMetricCount, _ := db.CountUnclaimedOneTimeCodes(ctx)
+		claimFailureWindow := time.Duration(config.AppConstants.ClaimFailureWindowMinutes) * time.Minute
+		recentClaimFailuresMetricCount, _ := db.CountRecentClaimFailures(ctx, time.Now().Add(-claimFailureWindow))
 		result.Observe(nil,
 			memTotal.Observation(int64(v.Total)),
 			memUsedPercent.Observation(v.UsedPercent),
@@ -41,6 +48,8 @@ func initSystemStatsObserver(db persistence.Conn) {
 			diagnosisKeysTotalMetric.Observation(diagnosisKeysTotalMetricCount),
 			claimedOneTimeCodesTotalMetric.Observation(claimedOneTimeCodesTotalMetricCount),
 			unclaimedOneTimeCodesTotalMetric.Observation(unclaimedOneTimeCodesTotalMetricCount),
+			diagnosisKeysPurgedMetric.Observation(workers.DiagnosisKeysPurged()),
+			recentClaimFailuresMetric.Observation(int64(recentClaimFailuresMetricCount)),
 		)
 	})
 
@@ -71,6 +80,12 @@ func initSystemStatsObserver(db persistence.Conn) {
 	unclaimedOneTimeCodesTotalMetric = cb.NewInt64ValueObserver("covidshield.app.unclaimed_one_time_codes.total",
 		metric.WithDescription("Total number of unclaimed one time codes"),
 	)
+	diagnosisKeysPurgedMetric = cb.NewInt64ValueObserver("covidshield.app.diagnosis_keys.purged",
+		metric.WithDescription("Number of diagnosis keys deleted by the last expiration run"),
+	)
+	recentClaimFailuresMetric = cb.NewInt64ValueObserver("covidshield.app.claim_failures.recent",
+		metric.WithDescription("Number of failed claim attempts in the last claimFailureWindowMinutes"),
+	)
 }
 
 func getCPUPercentage() float64 {
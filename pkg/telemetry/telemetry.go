@@ -3,7 +3,9 @@ package telemetry
 import (
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
 
 	"github.com/Shopify/goose/logger"
@@ -17,6 +19,8 @@ import (
 	"go.opentelemetry.io/otel/sdk/metric/controller/pull"
 	"go.opentelemetry.io/otel/sdk/metric/controller/push"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Providers
@@ -105,12 +109,15 @@ func InitMeter(db persistence.Conn) func() {
 		}
 		cleanupFunc = pusher.Stop
 	case PROMETHEUS:
-		var exporter *prometheus.Exporter
-		exporter, err = prometheus.InstallNewPipeline(prometheus.Config{}, pull.WithStateful(false))
+		_, err = prometheus.InstallNewPipeline(prometheus.Config{Registry: registry}, pull.WithStateful(false))
 		if err != nil {
 			break
 		}
-		http.HandleFunc("/metrics", exporter.ServeHTTP)
+		// Exemplars are only transmitted in the OpenMetrics format, which the
+		// exporter's own handler doesn't negotiate.
+		http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			EnableOpenMetrics: config.AppConstants.EnablePrometheusExemplars,
+		}))
 		go func() {
 			_ = http.ListenAndServe(":2222", nil)
 		}()
@@ -144,6 +151,9 @@ func OpenTelemetryMiddleware(next http.Handler) http.Handler {
 			trace.WithAttributes(attrs...),
 		)
 		defer span.End()
+
+		start := time.Now()
 		next.ServeHTTP(w, r)
+		observeRequestDuration(span.SpanContext(), time.Since(start))
 	})
 }
@@ -10,8 +10,23 @@ const (
 	SecondsInHour = 3600
 	SecondsInDay  = 86400
 	HoursInDay    = 24
+
+	SecondsInInterval = 600
 )
 
+// Clock tells the time. Code that works out time bounds can take a Clock so
+// tests can pin "now" to a fixed instant.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the system clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
 func HourNumber(t time.Time) uint32 {
 	return uint32(t.Unix() / SecondsInHour)
 }
@@ -24,10 +39,33 @@ func MostRecentUTCMidnight(t time.Time) time.Time {
 	return time.Unix((t.UTC().Unix()/SecondsInDay)*SecondsInDay, 0).UTC()
 }
 
+// MostRecentMidnightIn is MostRecentUTCMidnight for the calendar days of loc.
+func MostRecentMidnightIn(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
 func HourNumberAtStartOfDate(dateNumber uint32) uint32 {
 	return dateNumber * HoursInDay
 }
 
+// HourNumbersBetween returns every hour number from the start of startDate up
+// to, but not including, the start of endDate.
+func HourNumbersBetween(startDate, endDate uint32) []uint32 {
+	if endDate <= startDate {
+		return []uint32{}
+	}
+
+	start := HourNumberAtStartOfDate(startDate)
+	end := HourNumberAtStartOfDate(endDate)
+
+	hours := make([]uint32, 0, end-start)
+	for hour := start; hour < end; hour++ {
+		hours = append(hours, hour)
+	}
+	return hours
+}
+
 func HourNumberPlusDays(hourNumber uint32, days int) uint32 {
 	return uint32(int(hourNumber) + HoursInDay*days)
 }
@@ -39,3 +77,14 @@ func RollingStartIntervalNumberPlusDays(rsin int32, days int) int32 {
 func CurrentDateNumber() uint32 {
 	return DateNumber(time.Now())
 }
+
+// IntervalNumber is the Exposure Notification interval number of t: the
+// number of 10 minute intervals since the Unix epoch.
+func IntervalNumber(t time.Time) int32 {
+	return int32(t.Unix() / SecondsInInterval)
+}
+
+// CurrentIntervalNumber is the interval number of the current time.
+func CurrentIntervalNumber() int32 {
+	return IntervalNumber(time.Now())
+}
@@ -29,6 +29,20 @@ func TestMostRecentUTCMidnight(t *testing.T) {
 
 }
 
+func TestMostRecentMidnightIn(t *testing.T) {
+
+	now := time.Now()
+	assert.True(t, MostRecentUTCMidnight(now).Equal(MostRecentMidnightIn(now, time.UTC)))
+
+	// 20:00 UTC is already the next day at UTC+9
+	loc := time.FixedZone("UTC+9", 9*SecondsInHour)
+	expected := time.Date(2021, 1, 1, 15, 0, 0, 0, time.UTC)
+	received := MostRecentMidnightIn(time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC), loc)
+	assert.True(t, expected.Equal(received))
+	assert.Equal(t, 2, received.Day())
+
+}
+
 func TestHourNumberAtStartOfDate(t *testing.T) {
 
 	expected := uint32(1000 * 24)
@@ -36,6 +50,23 @@ func TestHourNumberAtStartOfDate(t *testing.T) {
 
 }
 
+func TestHourNumbersBetween(t *testing.T) {
+
+	hours := HourNumbersBetween(1000, 1001)
+	assert.Equal(t, HoursInDay, len(hours))
+	assert.Equal(t, uint32(1000*24), hours[0])
+	assert.Equal(t, uint32(1001*24-1), hours[HoursInDay-1])
+
+	hours = HourNumbersBetween(1000, 1003)
+	assert.Equal(t, 3*HoursInDay, len(hours))
+	assert.Equal(t, uint32(1000*24), hours[0])
+	assert.Equal(t, uint32(1003*24-1), hours[3*HoursInDay-1])
+
+	assert.Empty(t, HourNumbersBetween(1003, 1000))
+	assert.Empty(t, HourNumbersBetween(1000, 1000))
+
+}
+
 func TestHourNumberPlusDays(t *testing.T) {
 
 	expected := uint32(int(20000) + 24*10)
@@ -56,3 +87,19 @@ func TestCurrentDateNumber(t *testing.T) {
 	assert.Equal(t, expected, CurrentDateNumber())
 
 }
+
+func TestIntervalNumber(t *testing.T) {
+
+	assert.Equal(t, int32(0), IntervalNumber(time.Unix(599, 0)))
+	assert.Equal(t, int32(1), IntervalNumber(time.Unix(600, 0)))
+	// 2020-07-20 15:30 UTC
+	assert.Equal(t, int32(2658765), IntervalNumber(time.Unix(1595259000, 0)))
+
+}
+
+func TestCurrentIntervalNumber(t *testing.T) {
+
+	expected := int32(time.Now().Unix() / 600)
+	assert.Equal(t, expected, CurrentIntervalNumber())
+
+}
@@ -2,37 +2,62 @@ package workers
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/retrieval"
 
 	"github.com/Shopify/goose/logger"
 	"gopkg.in/tomb.v2"
 )
 
-var expirationRunner = func(w *worker, ctx context.Context) error {
+// Number of diagnosis keys removed by the most recent expiration run.
+var diagnosisKeysPurged int64
+
+// DiagnosisKeysPurged returns how many diagnosis keys the last expiration run
+// deleted, so it can be reported as a gauge.
+func DiagnosisKeysPurged() int64 {
+	return atomic.LoadInt64(&diagnosisKeysPurged)
+}
+
+// Log the outcome of a cleanup step, flagging counts from a dry run.
+func logCleanup(ctx context.Context, opts persistence.CleanupOptions, count int64, msg string) {
+	if opts.DryRun {
+		msg = "dry run: would have " + msg
+	}
+	log(ctx, nil).WithField("count", count).Info(msg)
+}
+
+// Clean out old data. With opts.DryRun set every destructive step only counts
+// what it would have removed.
+func runExpiration(w *worker, ctx context.Context, opts persistence.CleanupOptions) error {
 	log(ctx, nil).Info("running")
 
 	var lastErr error
 
-	if nDeleted, err := w.db.DeleteOldDiagnosisKeys(); err != nil {
+	if nDeleted, err := w.db.DeleteOldDiagnosisKeys(ctx, opts); err != nil {
 		log(ctx, err).Info("failed to delete old diagnosis keys")
 		lastErr = err
 	} else {
-		log(ctx, nil).WithField("count", nDeleted).Info("deleted old diagnosis keys")
+		if !opts.DryRun {
+			atomic.StoreInt64(&diagnosisKeysPurged, nDeleted)
+		}
+		logCleanup(ctx, opts, nDeleted, "deleted old diagnosis keys")
 	}
 
-	// Count the keys we are going to delete
-	var (
-		counts []persistence.CountByOriginator
-		countErr error
-	)
-	if counts, countErr = w.db.CountOldEncryptionKeysByOriginator(); countErr != nil {
-		log(ctx, countErr).Info("Unable to count old encryption keys")
+	// Count the keys we are going to delete. A dry run records no events, so
+	// it doesn't need them.
+	var counts []persistence.CountByOriginator
+	if !opts.DryRun {
+		var countErr error
+		if counts, countErr = w.db.CountOldEncryptionKeysByOriginator(ctx); countErr != nil {
+			log(ctx, countErr).Info("Unable to count old encryption keys")
+		}
 	}
 
-	if nDeleted, err := w.db.DeleteOldEncryptionKeys(); err != nil {
+	if nDeleted, err := w.db.DeleteOldEncryptionKeys(ctx, opts); err != nil {
 		log(ctx, err).Info("failed to delete old encryption keys")
 		lastErr = err
 	} else {
@@ -49,30 +74,100 @@ var expirationRunner = func(w *worker, ctx context.Context) error {
 			}
 
 		}
-		log(ctx, nil).WithField("count", nDeleted).Info("deleted old encryption keys")
+		logCleanup(ctx, opts, nDeleted, "deleted old encryption keys")
+	}
+
+	// Purge regardless of SoftDeleteDiagnosisKeys, so keys soft deleted before
+	// it was turned off still get removed
+	retention := time.Duration(config.AppConstants.SoftDeletedKeyRetentionDays) * 24 * time.Hour
+	if nDeleted, err := w.db.PurgeSoftDeletedDiagnosisKeys(ctx, retention, opts); err != nil {
+		log(ctx, err).Info("failed to purge soft deleted diagnosis keys")
+		lastErr = err
+	} else {
+		logCleanup(ctx, opts, nDeleted, "purged soft deleted diagnosis keys")
+	}
+
+	if config.AppConstants.ClampRemainingKeysToLimit {
+		if nClamped, err := w.db.ClampRemainingKeysToOriginatorLimit(ctx, opts); err != nil {
+			log(ctx, err).Info("failed to clamp remaining keys")
+			lastErr = err
+		} else {
+			logCleanup(ctx, opts, nClamped, "clamped remaining keys")
+		}
+	}
+
+	if withinDays := config.AppConstants.RotateServerKeysWithinDays; withinDays > 0 && !opts.DryRun {
+		if nRotated, err := w.db.RotateExpiringServerKeys(ctx, withinDays); err != nil {
+			log(ctx, err).Info("failed to rotate expiring server keys")
+			lastErr = err
+		} else {
+			log(ctx, nil).WithField("count", nRotated).Info("rotated expiring server keys")
+		}
 	}
 
-	if nDeleted, err := w.db.DeleteOldFailedClaimKeyAttempts(); err != nil {
+	if nDeleted, err := w.db.DeleteOldFailedClaimKeyAttempts(ctx, opts); err != nil {
 		log(ctx, err).Info("failed to delete old failed claim-key attempts")
 		lastErr = err
 	} else {
-		log(ctx, nil).WithField("count", nDeleted).Info("deleted old claim-key attempts")
+		logCleanup(ctx, opts, nDeleted, "deleted old claim-key attempts")
+	}
+
+	if nDeleted, err := w.db.DeleteOldUploadNonces(ctx, opts); err != nil {
+		log(ctx, err).Info("failed to delete old upload nonces")
+		lastErr = err
+	} else {
+		logCleanup(ctx, opts, nDeleted, "deleted old upload nonces")
+	}
+
+	if nDeleted, err := w.db.DeleteOldHashIDKeyClaims(ctx, opts); err != nil {
+		log(ctx, err).Info("failed to delete old hashID key claims")
+		lastErr = err
+	} else {
+		logCleanup(ctx, opts, nDeleted, "deleted old hashID key claims")
+	}
+
+	if nDeleted, err := w.db.DeleteOldClaimEvents(ctx, opts); err != nil {
+		log(ctx, err).Info("failed to delete old claim events")
+		lastErr = err
+	} else {
+		logCleanup(ctx, opts, nDeleted, "deleted old claim events")
+	}
+
+	if !opts.DryRun {
+		if nMarked, err := w.db.MarkKeysExported(ctx, config.AppConstants.RegionCode); err != nil {
+			log(ctx, err).Info("failed to mark keys exported")
+			lastErr = err
+		} else {
+			log(ctx, nil).WithField("count", nMarked).Info("marked keys exported")
+		}
+	}
+
+	if dir := config.AppConstants.ExportDirectory; dir != "" {
+		retention := time.Duration(config.AppConstants.ExportFileRetentionHours) * time.Hour
+		if nDeleted, err := retrieval.DeleteOldExports(ctx, retrieval.NewDiskExportStore(dir), retention, opts.DryRun); err != nil {
+			log(ctx, err).Info("failed to delete old export files")
+			lastErr = err
+		} else {
+			logCleanup(ctx, opts, nDeleted, "deleted old export files")
+		}
 	}
 
 	return lastErr
 }
 
-func StartExpirationWorker(db persistence.Conn) (Worker, error) {
-	return createExpirationWorker(db, time.Duration(config.AppConstants.WorkerExpirationInterval)*time.Second)
+func StartExpirationWorker(db persistence.Conn, opts persistence.CleanupOptions) (Worker, error) {
+	return createExpirationWorker(db, time.Duration(config.AppConstants.WorkerExpirationInterval)*time.Second, opts)
 }
 
-func createExpirationWorker(db persistence.Conn, interval time.Duration) (Worker, error) {
+func createExpirationWorker(db persistence.Conn, interval time.Duration, opts persistence.CleanupOptions) (Worker, error) {
 	worker := &worker{
 		name:     "expiration",
 		db:       db,
 		interval: interval,
 		tomb:     &tomb.Tomb{},
-		runner:   expirationRunner,
+		runner: func(w *worker, ctx context.Context) error {
+			return runExpiration(w, ctx, opts)
+		},
 	}
 
 	// Run the worker once, before returning, to clean out old data on boot.